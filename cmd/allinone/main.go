@@ -0,0 +1,103 @@
+// allinone/main.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/internal/connector"
+	"nitro-dev-qemu/internal/enclave"
+	vsockproxy "nitro-dev-qemu/internal/vsock-proxy"
+	"nitro-dev-qemu/pkg/kmstest"
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// The default addresses of the enclave and the vsock-proxy, which the
+// connector and the enclave dial without being told.
+const (
+	enclaveCID  = 3
+	enclavePort = 9000
+	proxyPort   = 8000
+)
+
+// allinone runs the vsock-proxy, the enclave and the connector in one
+// process, wired together by an in-memory vsock transport, against a fake
+// KMS unless --kms-target names a real one. There is no VM, socket or
+// container to set up, so it is the quickest way to try a change:
+//
+//	go run ./cmd/allinone encrypt "hello"
+//	go run ./cmd/allinone --enclave-flags "--max-conns 8" -- --envelope encrypt "hello"
+//
+// Connector flags and commands follow the allinone flags, after "--" if
+// they start with a flag. The enclave and vsock-proxy keep their default
+// vsock addresses, so the connector reaches them without extra flags.
+func main() {
+	kmsTarget := flag.String("kms-target", "fake", "KMS endpoint for the vsock-proxy, or \"fake\" for an in-process fake KMS (pkg/kmstest)")
+	fakeKeys := flag.String("fake-kms-keys", "alias/dev-key", "Comma-separated key aliases the fake KMS creates")
+	enclaveFlags := flag.String("enclave-flags", "", "Extra enclave flags, space-separated, e.g. '--pipeline gzip,siv --max-conns 8'")
+	proxyFlags := flag.String("proxy-flags", "", "Extra vsock-proxy flags, space-separated, e.g. '--allowed-keys alias/dev-key'")
+	startTimeout := flag.Duration("start-timeout", 10*time.Second, "How long to wait for the enclave and the vsock-proxy to listen")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  allinone [flags] [--] [connector flags] [command]\n\n")
+		fmt.Fprintf(os.Stderr, "Runs the vsock-proxy, the enclave and the connector in one process.\n")
+		fmt.Fprintf(os.Stderr, "See connector --help for the connector flags and commands.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	logging.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	if err := logging.Setup("allinone"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	target := *kmsTarget
+	if target == "fake" {
+		kms := kmstest.NewServer(strings.Split(*fakeKeys, ",")...)
+		defer kms.Close()
+		target = kms.URL
+		slog.Info("Started fake KMS", "url", target, "keys", *fakeKeys)
+	}
+
+	// The probes and metrics would need TCP ports, and the line mode port
+	// can't be reached from outside the process; the extra flags can turn
+	// them back on.
+	mem := &vsock.Memory{}
+	go func() {
+		args := append([]string{"--kms-target", target, "--metrics-port", "0", "--health-port", "0"}, strings.Fields(*proxyFlags)...)
+		vsockproxy.Main(flag.NewFlagSet("vsock-proxy", flag.ExitOnError), args, mem)
+	}()
+	go func() {
+		args := append([]string{"--line-port", "0", "--health-port", "0"}, strings.Fields(*enclaveFlags)...)
+		enclave.Main(flag.NewFlagSet("enclave", flag.ExitOnError), args, mem)
+		// On SIGINT/SIGTERM the enclave drains its connections; the
+		// process is done once it has
+		os.Exit(0)
+	}()
+
+	for _, addr := range []vsock.Addr{{CID: vsock.HostCID, Port: proxyPort}, {CID: enclaveCID, Port: enclavePort}} {
+		if err := waitForListener(mem, addr, *startTimeout); err != nil {
+			logging.Fatal("Component didn't start", "addr", addr.String(), "err", err)
+		}
+	}
+
+	connector.Main(flag.NewFlagSet("connector", flag.ExitOnError), flag.Args(), mem)
+}
+
+// waitForListener waits until something listens on addr, or timeout
+// passes. The components log their own startup failures.
+func waitForListener(m *vsock.Memory, addr vsock.Addr, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !m.Listening(addr.CID, addr.Port) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nothing listening after %v", timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,460 @@
+// Package integration runs the connector, enclave and vsock-proxy binaries
+// together against a fake KMS (pkg/kmstest), over the TCP vsock transport,
+// so the whole request path can be checked without a VM or LocalStack.
+// The tests build the binaries first, so they are skipped with -short.
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/callout"
+	"nitro-dev-qemu/pkg/kmstest"
+)
+
+// stack is a running vsock-proxy and enclave, and the connector binary to
+// send them requests with.
+type stack struct {
+	bin         string
+	kms         *kmstest.Server
+	enclavePort int
+	// healthPorts are the vsock-proxy's and the enclave's probe ports
+	healthPorts [2]int
+
+	// The processes and their flags, so scenarios can kill and restart
+	// them
+	proxyPort              int
+	proxy, enclave         *exec.Cmd
+	proxyArgs, enclaveArgs []string
+}
+
+// lockedBuffer collects a process's output, which the test reads while
+// the process may still be writing.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+var (
+	buildOnce sync.Once
+	buildDir  string
+	buildErr  error
+)
+
+// build compiles the binaries once per test run.
+func build(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds and runs the binaries; skipped with -short")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	buildOnce.Do(func() {
+		if buildDir, buildErr = os.MkdirTemp("", "nitro-integration"); buildErr != nil {
+			return
+		}
+		cmd := exec.Command(goTool, "build", "-o", buildDir+string(filepath.Separator), "./cmd/allinone", "./cmd/connector", "./cmd/enclave", "./cmd/vsock-proxy")
+		cmd.Dir = ".."
+		if out, err := cmd.CombinedOutput(); err != nil {
+			buildErr = fmt.Errorf("go build: %v\n%s", err, out)
+		}
+	})
+	if buildErr != nil {
+		t.Fatal(buildErr)
+	}
+	return buildDir
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if buildDir != "" {
+		os.RemoveAll(buildDir)
+	}
+	os.Exit(code)
+}
+
+// usedPorts are the ports freePort has handed out. The listener it finds
+// a port with is closed before the binaries start, so the kernel may offer
+// the same port again.
+var (
+	usedPortsMu sync.Mutex
+	usedPorts   = map[int]bool{}
+)
+
+// freePort returns a TCP port nothing is listening on and that no earlier
+// call returned.
+func freePort(t *testing.T) int {
+	t.Helper()
+	usedPortsMu.Lock()
+	defer usedPortsMu.Unlock()
+	for {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if !usedPorts[port] {
+			usedPorts[port] = true
+			return port
+		}
+	}
+}
+
+// start runs a binary until the test ends, logging its output if the test
+// fails, and waits until it listens on port.
+func start(t *testing.T, bin string, port int, args ...string) *exec.Cmd {
+	t.Helper()
+	var out lockedBuffer
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	// Fake credentials, so the vsock-proxy signs its requests as it would
+	// for AWS KMS instead of looking further down the credential chain
+	cmd.Env = append(os.Environ(), "AWS_ACCESS_KEY_ID=test", "AWS_SECRET_ACCESS_KEY=test", "AWS_SESSION_TOKEN=", "AWS_EC2_METADATA_DISABLED=true")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		done := make(chan struct{})
+		go func() { cmd.Wait(); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-done
+		}
+		if t.Failed() {
+			t.Logf("%s output:\n%s", filepath.Base(bin), out.String())
+		}
+	})
+
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		if err == nil {
+			conn.Close()
+			return cmd
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s didn't listen on port %d: %v\n%s", filepath.Base(bin), port, err, out.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// startStack runs a vsock-proxy against a fresh fake KMS and an enclave
+// in front of it, with alias/dev-token-key as a deterministic key and
+// crypto-shredding under alias/dev-key. enclaveFlags are added to the
+// enclave's.
+func startStack(t *testing.T, enclaveFlags ...string) *stack {
+	bin := build(t)
+	kms := kmstest.NewServer("alias/dev-key", "alias/dev-token-key")
+	t.Cleanup(kms.Close)
+
+	proxyPort, enclavePort := freePort(t), freePort(t)
+	healthPorts := [2]int{freePort(t), freePort(t)}
+	proxyArgs := []string{
+		"--vsock-transport", "tcp",
+		"--listen-port", fmt.Sprint(proxyPort),
+		"--kms-target", kms.URL,
+		"--metrics-port", "0",
+		"--health-port", fmt.Sprint(healthPorts[0]),
+		"--dns-cache-ttl", "0",
+	}
+	proxy := start(t, filepath.Join(bin, "vsock-proxy"), proxyPort, proxyArgs...)
+
+	// A workload's callout service, redacting digits
+	sock := filepath.Join(t.TempDir(), "workload.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go callout.Serve(l, func(ctx context.Context, req *callout.Request) (*callout.Response, error) {
+		redacted := strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return '*'
+			}
+			return r
+		}, string(req.Payload))
+		return &callout.Response{Result: []byte(redacted)}, nil
+	})
+
+	tokenKey := make([]byte, 64)
+	rand.Read(tokenKey)
+	enclaveArgs := append([]string{
+		"--vsock-transport", "tcp",
+		"--listen-port", fmt.Sprint(enclavePort),
+		"--upstream-port", fmt.Sprint(proxyPort),
+		"--line-port", "0",
+		"--health-port", fmt.Sprint(healthPorts[1]),
+		"--deterministic-key", "alias/dev-token-key=" + kms.Encrypt("alias/dev-token-key", tokenKey),
+		"--shred-key", "alias/dev-key=" + kms.Encrypt("alias/dev-key", tokenKey[:32]),
+		"--callout", "unix://" + sock,
+		"--callout-ops", "Redact",
+	}, enclaveFlags...)
+	enclave := start(t, filepath.Join(bin, "enclave"), enclavePort, enclaveArgs...)
+
+	return &stack{
+		bin: bin, kms: kms, enclavePort: enclavePort, healthPorts: healthPorts,
+		proxyPort: proxyPort, proxy: proxy, enclave: enclave, proxyArgs: proxyArgs, enclaveArgs: enclaveArgs,
+	}
+}
+
+// connector runs one connector command and returns its stdout, trimmed,
+// and exit code.
+func (s *stack) connector(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	out, code := s.run(t, nil, args...)
+	return strings.TrimSpace(string(out)), code
+}
+
+// run runs one connector command with stdin and returns its stdout and
+// exit code.
+func (s *stack) run(t *testing.T, stdin io.Reader, args ...string) ([]byte, int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := s.connectorCommand(ctx, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return stdout.Bytes(), 0
+	case errors.As(err, &exitErr):
+		t.Logf("connector %s: exit %d\n%s", strings.Join(args, " "), exitErr.ExitCode(), stderr.String())
+		return stdout.Bytes(), exitErr.ExitCode()
+	}
+	t.Fatalf("connector %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	return nil, 0
+}
+
+// connectorCommand returns the command to run the connector against the
+// stack, with a 20s --timeout.
+func (s *stack) connectorCommand(ctx context.Context, args ...string) *exec.Cmd {
+	args = append([]string{"--vsock-transport", "tcp", "--upstream-port", fmt.Sprint(s.enclavePort), "--timeout", "20s", "--log-level", "warn"}, args...)
+	return exec.CommandContext(ctx, filepath.Join(s.bin, "connector"), args...)
+}
+
+// roundTrip encrypts plaintext with the given connector flags, checks the
+// result differs, decrypts it and checks it comes back.
+func (s *stack) roundTrip(t *testing.T, plaintext string, flags ...string) string {
+	t.Helper()
+	ciphertext, code := s.connector(t, append(flags, "encrypt", plaintext)...)
+	if code != 0 {
+		t.Fatalf("encrypt %v: exit %d", flags, code)
+	}
+	if ciphertext == "" || ciphertext == plaintext {
+		t.Fatalf("encrypt %v: got %q", flags, ciphertext)
+	}
+	decrypted, code := s.connector(t, append(flags, "decrypt", ciphertext)...)
+	if code != 0 {
+		t.Fatalf("decrypt %v: exit %d", flags, code)
+	}
+	if decrypted != plaintext {
+		t.Fatalf("decrypt %v: got %q, want %q", flags, decrypted, plaintext)
+	}
+	return ciphertext
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := startStack(t)
+
+	t.Run("kms", func(t *testing.T) {
+		s.roundTrip(t, "hello from the connector")
+	})
+	t.Run("envelope", func(t *testing.T) {
+		s.roundTrip(t, strings.Repeat("a larger payload, ", 1000)+"the end", "--envelope")
+	})
+	t.Run("pipeline", func(t *testing.T) {
+		s.roundTrip(t, strings.Repeat("compressible ", 500)+"text", "--pipeline", "gzip,envelope,base64")
+	})
+	t.Run("fields", func(t *testing.T) {
+		doc := `{"name":"alice","ssn":"078-05-1120"}`
+		ciphertext := s.roundTrip(t, doc, "--fields", "$.ssn", "--pipeline", "envelope,base64")
+		if !strings.Contains(ciphertext, `"name":"alice"`) || strings.Contains(ciphertext, "078-05-1120") {
+			t.Fatalf("EncryptFields = %s", ciphertext)
+		}
+	})
+	t.Run("deterministic", func(t *testing.T) {
+		a := s.roundTrip(t, "alice@example.com", "--key-id", "alias/dev-token-key", "--pipeline", "siv,base64")
+		b := s.roundTrip(t, "alice@example.com", "--key-id", "alias/dev-token-key", "--pipeline", "siv,base64")
+		if a != b {
+			t.Fatalf("deterministic tokens differ: %s, %s", a, b)
+		}
+	})
+	t.Run("fpe", func(t *testing.T) {
+		token := s.roundTrip(t, "4111-1111-1111-1111", "--fpe", "--key-id", "alias/dev-token-key")
+		if len(token) != len("4111-1111-1111-1111") || strings.Count(token, "-") != 3 {
+			t.Fatalf("FPE token %q doesn't keep the format", token)
+		}
+	})
+	t.Run("shred", func(t *testing.T) {
+		alice := s.roundTrip(t, "alice@example.com", "--record-id", "user-1")
+		bob := s.roundTrip(t, "bob@example.com", "--record-id", "user-2")
+		if out, code := s.connector(t, "shred", "user-1"); code != 0 || !strings.HasPrefix(out, "shredded user-1") {
+			t.Fatalf("shred: exit %d, %q", code, out)
+		}
+		if _, code := s.connector(t, "--record-id", "user-1", "decrypt", alice); code != 8 {
+			t.Fatalf("decrypt after shred: exit %d, want 8 (policy)", code)
+		}
+		if out, _ := s.connector(t, "--record-id", "user-2", "decrypt", bob); out != "bob@example.com" {
+			t.Fatalf("other record after shred: %q", out)
+		}
+	})
+	t.Run("stream", func(t *testing.T) {
+		// Several megabytes, well past what one KMS Encrypt takes
+		data := make([]byte, 5<<20+123)
+		rand.Read(data)
+		sealed, code := s.run(t, bytes.NewReader(data), "--stream", "--chunk-size", "262144", "encrypt")
+		if code != 0 {
+			t.Fatalf("stream encrypt: exit %d", code)
+		}
+		plain, code := s.run(t, bytes.NewReader(sealed), "--stream", "decrypt")
+		if code != 0 {
+			t.Fatalf("stream decrypt: exit %d", code)
+		}
+		if !bytes.Equal(plain, data) {
+			t.Fatalf("stream round trip returned %d bytes, want %d", len(plain), len(data))
+		}
+	})
+	t.Run("file", func(t *testing.T) {
+		dir := t.TempDir()
+		data := make([]byte, 3<<20)
+		rand.Read(data)
+		plain, sealed, restored := filepath.Join(dir, "data.bin"), filepath.Join(dir, "data.bin.enc"), filepath.Join(dir, "restored.bin")
+		os.WriteFile(plain, data, 0o644)
+		if _, code := s.connector(t, "encrypt-file", plain, sealed); code != 0 {
+			t.Fatalf("encrypt-file: exit %d", code)
+		}
+		if _, code := s.connector(t, "decrypt-file", sealed, restored); code != 0 {
+			t.Fatalf("decrypt-file: exit %d", code)
+		}
+		if got, _ := os.ReadFile(restored); !bytes.Equal(got, data) {
+			t.Fatalf("file round trip returned %d bytes, want %d", len(got), len(data))
+		}
+	})
+	t.Run("health", func(t *testing.T) {
+		for _, port := range s.healthPorts {
+			for _, path := range []string{"/healthz", "/readyz"} {
+				resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("port %d %s: %s %s", port, path, resp.Status, body)
+				}
+			}
+		}
+	})
+	t.Run("callout", func(t *testing.T) {
+		out, code := s.connector(t, "call", "Redact", "card 4111-1111")
+		if code != 0 || out != "card ****-****" {
+			t.Fatalf("call Redact = %q, exit %d", out, code)
+		}
+		if _, code := s.connector(t, "call", "Frobnicate", "x"); code != 4 {
+			t.Fatalf("call Frobnicate: exit %d, want 4", code)
+		}
+	})
+
+	// Every KMS operation went through the fake, and data keys were
+	// unwrapped with attested Decrypt
+	for _, action := range []string{"Encrypt", "Decrypt", "GenerateDataKey"} {
+		if s.kms.Calls(action) == 0 {
+			t.Errorf("the fake KMS got no %s calls", action)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := startStack(t)
+
+	// Exit codes are part of the connector's interface (see exitcodes.go)
+	out, code := s.connector(t, "--json", "--key-id", "alias/missing", "encrypt", "x")
+	if code != 5 {
+		t.Fatalf("unknown key: exit %d, want 5 (KMS error)", code)
+	}
+	var report struct {
+		Error struct {
+			Kind    string            `json:"kind"`
+			Code    string            `json:"code"`
+			Details map[string]string `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("--json output %q: %v", out, err)
+	}
+	if report.Error.Code != "kms_error" || report.Error.Details["kms_error_type"] != "NotFoundException" {
+		t.Fatalf("unknown key: %+v", report.Error)
+	}
+
+	if _, code := s.connector(t, "decrypt", "bm90IGEgYmxvYg=="); code != 5 {
+		t.Fatalf("bad CiphertextBlob: exit %d, want 5", code)
+	}
+	if _, code := s.connector(t, "--key-id", "alias/dev-token-key", "encrypt", "x"); code != 8 {
+		t.Fatalf("deterministic key for Encrypt: exit %d, want 8 (policy)", code)
+	}
+	if _, code := s.connector(t, "--upstream-port", fmt.Sprint(freePort(t)), "encrypt", "x"); code != 3 {
+		t.Fatalf("nothing listening: exit %d, want 3 (connect failure)", code)
+	}
+}
+
+// TestAllInOne runs each component in one allinone process, with its
+// in-process fake KMS. Fake KMS keys are the same in every process, so a
+// second run decrypts what the first encrypted.
+func TestAllInOne(t *testing.T) {
+	bin := build(t)
+	allinone := func(args ...string) string {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, filepath.Join(bin, "allinone"), append([]string{"--log-level", "warn"}, args...)...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("allinone %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	for _, flags := range [][]string{nil, {"--", "--envelope"}} {
+		ciphertext := allinone(append(flags, "encrypt", "hello from one process")...)
+		if got := allinone(append(flags, "decrypt", ciphertext)...); got != "hello from one process" {
+			t.Fatalf("%v decrypt = %q", flags, got)
+		}
+	}
+}
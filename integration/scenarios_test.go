@@ -0,0 +1,199 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The failure scenarios break one part of a running stack the way
+// production breaks it, check what the connector reports meanwhile, and
+// check that the stack recovers by itself once the failure ends. Run them
+// alone, at full length, with make scenarios.
+
+var brownout = flag.Duration("brownout", 5*time.Second, "How long KMS fails in the kms-brownout scenario (make scenarios uses 30s)")
+
+// errorReport is the connector's --json failure report.
+type errorReport struct {
+	Kind      string            `json:"kind"`
+	ExitCode  int               `json:"exit_code"`
+	Code      string            `json:"code"`
+	Retryable bool              `json:"retryable"`
+	Details   map[string]string `json:"details"`
+}
+
+// tryEncrypt runs connector --json encrypt and returns its exit code and,
+// when it failed, its error report.
+func (s *stack) tryEncrypt(t *testing.T, plaintext string) (int, *errorReport) {
+	t.Helper()
+	out, code := s.connector(t, "--json", "encrypt", plaintext)
+	return code, parseReport(t, code, out)
+}
+
+func parseReport(t *testing.T, code int, out string) *errorReport {
+	t.Helper()
+	if code == 0 {
+		return nil
+	}
+	var report struct {
+		Error errorReport `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("--json output %q: %v", out, err)
+	}
+	return &report.Error
+}
+
+// crash kills a component with SIGKILL, as a crash or an OOM kill would.
+func crash(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+// waitFor polls cond until it holds, failing the test after timeout.
+func waitFor(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up after %v waiting for %s", timeout, what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// readyz returns the HTTP status of a /readyz probe.
+func readyz(t *testing.T, port int) int {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/readyz", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestScenarios(t *testing.T) {
+	t.Run("enclave-crash", func(t *testing.T) {
+		s := startStack(t)
+		s.kms.Stall(3 * time.Second)
+		calls := s.kms.Calls("Encrypt")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		cmd := s.connectorCommand(ctx, "--json", "encrypt", "in flight")
+		var stdout strings.Builder
+		cmd.Stdout = &stdout
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the request to reach KMS", 10*time.Second, func() bool { return s.kms.Calls("Encrypt") > calls })
+		crashed := time.Now()
+		crash(s.enclave)
+
+		// The connector fails at once rather than at its --timeout, and
+		// says the request may be retried
+		err := cmd.Wait()
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("connector with the enclave crashed mid-request: %v", err)
+		}
+		report := parseReport(t, exitErr.ExitCode(), stdout.String())
+		if report.ExitCode != 4 || !report.Retryable {
+			t.Fatalf("enclave crashed mid-request: %+v", report)
+		}
+		if waited := time.Since(crashed); waited > 5*time.Second {
+			t.Fatalf("connector took %v to notice the crash", waited)
+		}
+
+		// A restarted enclave serves at once, with the same vsock-proxy
+		s.kms.Stall(0)
+		s.enclave = start(t, filepath.Join(s.bin, "enclave"), s.enclavePort, s.enclaveArgs...)
+		s.roundTrip(t, "after the enclave restarted")
+	})
+
+	t.Run("proxy-restart", func(t *testing.T) {
+		s := startStack(t)
+		// The enclave now holds pooled connections to the vsock-proxy
+		s.roundTrip(t, "before the restart")
+		crash(s.proxy)
+
+		// While the proxy is down, requests fail quickly and are retryable
+		code, report := s.tryEncrypt(t, "proxy down")
+		if code != 4 || report.Code != "upstream_error" || !report.Retryable {
+			t.Fatalf("vsock-proxy down: exit %d, %+v", code, report)
+		}
+
+		// The first request after the restart succeeds: the enclave
+		// redials the dead pooled connections without the connector
+		// retrying
+		s.proxy = start(t, filepath.Join(s.bin, "vsock-proxy"), s.proxyPort, s.proxyArgs...)
+		s.roundTrip(t, "after the proxy restarted")
+	})
+
+	t.Run("kms-brownout", func(t *testing.T) {
+		s := startStack(t)
+		s.kms.Brownout(*brownout)
+		end := time.Now().Add(*brownout)
+
+		// Requests fail with a retryable KMS error, and the vsock-proxy
+		// reports itself not ready
+		code, report := s.tryEncrypt(t, "during the brownout")
+		if code != 5 || !report.Retryable || report.Details["kms_error_type"] != "KMSInternalException" {
+			t.Fatalf("during the brownout: exit %d, %+v", code, report)
+		}
+		waitFor(t, "the vsock-proxy to report not ready", 5*time.Second, func() bool {
+			return readyz(t, s.healthPorts[0]) == http.StatusServiceUnavailable
+		})
+
+		// Once KMS recovers, so does the stack, without restarting anything
+		waitFor(t, "Encrypt to succeed again", *brownout+10*time.Second, func() bool {
+			code, _ := s.tryEncrypt(t, "after the brownout")
+			return code == 0
+		})
+		if time.Now().Before(end) {
+			t.Fatal("Encrypt succeeded during the brownout")
+		}
+		waitFor(t, "the vsock-proxy to report ready", 10*time.Second, func() bool {
+			return readyz(t, s.healthPorts[0]) == http.StatusOK
+		})
+		s.roundTrip(t, "after the brownout")
+	})
+
+	t.Run("vsock-exhaustion", func(t *testing.T) {
+		s := startStack(t, "--max-conns", "2", "--conn-queue-timeout", "100ms", "--read-timeout", "3s")
+
+		// Peers that connect and never send, like stuck clients, hold
+		// every connection slot
+		for range 2 {
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.enclavePort))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		// Further requests are turned away with a retryable busy error
+		// instead of queueing behind them
+		code, report := s.tryEncrypt(t, "no slot")
+		if code != 4 || report.Code != "busy" || !report.Retryable {
+			t.Fatalf("slots exhausted: exit %d, %+v", code, report)
+		}
+
+		// --read-timeout frees the slots, and the enclave serves again
+		waitFor(t, "Encrypt to succeed again", 10*time.Second, func() bool {
+			code, _ := s.tryEncrypt(t, "slots freed")
+			return code == 0
+		})
+	})
+}
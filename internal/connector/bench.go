@@ -0,0 +1,162 @@
+// connector/bench.go
+package connector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"nitro-dev-qemu/pkg/payload"
+)
+
+// benchResult is the outcome of one benchmark request.
+type benchResult struct {
+	latency time.Duration
+	err     error
+}
+
+// runBench sends requests operations through the enclave from concurrency
+// workers, each on its own vsock connection as in the other modes, and
+// prints throughput, latency percentiles and error counts. Encrypt is
+// benchmarked by default; with --decrypt, one payload is encrypted up front
+// and its CiphertextBlob is decrypted repeatedly. It returns the process
+// exit code: non-zero only if every request failed.
+func runBench(requests, concurrency, size int, decrypt, jsonOutput bool) int {
+	if requests <= 0 || concurrency <= 0 || size < 0 {
+		return reportFailure(usageFailure(fmt.Errorf("--bench-requests and --bench-concurrency must be positive and --bench-payload-size non-negative")), jsonOutput)
+	}
+	concurrency = min(concurrency, requests)
+	plaintext := payload.New(bytes.Repeat([]byte("x"), size))
+
+	op := encryptOp()
+	do := func() error {
+		_, err := encryptViaEnclave(newRequest(encryptOp(), plaintext))
+		return err
+	}
+	if decrypt {
+		op = decryptOp()
+		blob, err := encryptViaEnclave(newRequest(encryptOp(), plaintext))
+		if err != nil {
+			return reportFailure(fmt.Errorf("failed to encrypt the benchmark payload: %w", err), jsonOutput)
+		}
+		do = func() error {
+			_, err := decryptViaEnclave(newRequest(decryptOp(), payload.FromString(blob)))
+			return err
+		}
+	}
+
+	slog.Info("Starting benchmark", "operation", op, "requests", requests, "concurrency", concurrency, "payload_bytes", size)
+
+	results := make([]benchResult, requests)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	startTime := time.Now()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				t := time.Now()
+				err := do()
+				results[i] = benchResult{latency: time.Since(t), err: err}
+			}
+		}()
+	}
+	for i := range requests {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(startTime)
+
+	report := summarizeBench(results, elapsed)
+	report.Operation = op
+	report.Concurrency = concurrency
+	report.PayloadBytes = size
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		report.print()
+	}
+
+	if report.Succeeded == 0 {
+		return reportFailure(fmt.Errorf("all %d requests failed: %w", requests, results[0].err), jsonOutput)
+	}
+	return exitOK
+}
+
+// benchReport is what --bench prints, as text or with --json.
+type benchReport struct {
+	Operation    string         `json:"operation"`
+	Requests     int            `json:"requests"`
+	Concurrency  int            `json:"concurrency"`
+	PayloadBytes int            `json:"payload_bytes"`
+	Succeeded    int            `json:"succeeded"`
+	Failed       int            `json:"failed"`
+	Errors       map[string]int `json:"errors,omitempty"`
+	DurationMs   float64        `json:"duration_ms"`
+	Throughput   float64        `json:"requests_per_second"`
+	P50Ms        float64        `json:"p50_ms"`
+	P95Ms        float64        `json:"p95_ms"`
+	P99Ms        float64        `json:"p99_ms"`
+	MaxMs        float64        `json:"max_ms"`
+}
+
+// summarizeBench computes throughput over the whole run and latency
+// percentiles over successful requests only, so fast failures (e.g.
+// connection refused) don't flatter the numbers. Errors are counted by the
+// same kinds the one-shot commands report.
+func summarizeBench(results []benchResult, elapsed time.Duration) benchReport {
+	r := benchReport{Requests: len(results), Errors: map[string]int{}, DurationMs: ms(elapsed)}
+	var latencies []time.Duration
+	for _, res := range results {
+		if res.err != nil {
+			kind, _ := classify(res.err)
+			r.Errors[kind]++
+			r.Failed++
+			continue
+		}
+		r.Succeeded++
+		latencies = append(latencies, res.latency)
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(r.Succeeded) / elapsed.Seconds()
+	}
+	if n := len(latencies); n > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		r.P50Ms = ms(latencies[n*50/100])
+		r.P95Ms = ms(latencies[n*95/100])
+		r.P99Ms = ms(latencies[n*99/100])
+		r.MaxMs = ms(latencies[n-1])
+	}
+	return r
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (r benchReport) print() {
+	fmt.Println("=== BENCHMARK SUMMARY ===")
+	fmt.Printf("Operation: %s (%d-byte payload)\n", r.Operation, r.PayloadBytes)
+	fmt.Printf("Requests: %d (%d concurrent)\n", r.Requests, r.Concurrency)
+	fmt.Printf("Succeeded: %d\n", r.Succeeded)
+	fmt.Printf("Failed: %d\n", r.Failed)
+	kinds := make([]string, 0, len(r.Errors))
+	for kind := range r.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("  %s: %d\n", kind, r.Errors[kind])
+	}
+	fmt.Printf("Duration: %.1f ms\n", r.DurationMs)
+	fmt.Printf("Throughput: %.1f req/s\n", r.Throughput)
+	fmt.Printf("Latency p50/p95/p99/max: %.2f / %.2f / %.2f / %.2f ms\n", r.P50Ms, r.P95Ms, r.P99Ms, r.MaxMs)
+	fmt.Println("=========================")
+}
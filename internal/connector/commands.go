@@ -0,0 +1,190 @@
+// connector/commands.go
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// runCommand executes a one-shot subcommand and returns the process exit
+// code:
+//
+//	connector [flags] encrypt [text]      (reads stdin when text is omitted)
+//	connector [flags] decrypt [blob]
+//	connector [flags] sign [message]
+//	connector [flags] verify signature [message]
+//	connector [flags] shred record-id
+//	connector [flags] call operation [input]   (a workload operation, see the enclave's --callout)
+//	connector [flags] encrypt-file in out      (see runFileCommand)
+//	connector [flags] decrypt-file in out
+//
+// With --columns, encrypt and decrypt stream CSV instead (see streamCSV),
+// and with --stream, data of any size (see streamEncrypt).
+//
+// The result goes to stdout (as JSON with --json); logs stay on stderr.
+func runCommand(args []string, jsonOutput bool, tr *transcript) int {
+	cmd, rest := args[0], args[1:]
+	var signature, operation string
+	switch cmd {
+	case "encrypt", "decrypt", "sign":
+	case "verify":
+		if len(rest) == 0 {
+			return reportFailure(usageFailure(fmt.Errorf("verify needs a signature")), jsonOutput)
+		}
+		signature, rest = rest[0], rest[1:]
+	case "shred":
+		if len(rest) != 1 || rest[0] == "" {
+			return reportFailure(usageFailure(fmt.Errorf("shred needs a record ID")), jsonOutput)
+		}
+	case "call":
+		if len(rest) == 0 || rest[0] == "" {
+			return reportFailure(usageFailure(fmt.Errorf("call needs an operation")), jsonOutput)
+		}
+		operation, rest = rest[0], rest[1:]
+	case "encrypt-file", "decrypt-file":
+		return runFileCommand(cmd, rest, jsonOutput, tr)
+	default:
+		return reportFailure(usageFailure(fmt.Errorf("unknown command %q (expected encrypt, decrypt, encrypt-file, decrypt-file, sign, verify, shred or call)", cmd)), jsonOutput)
+	}
+
+	if len(rest) > 1 {
+		return reportFailure(usageFailure(fmt.Errorf("%s takes at most one argument", cmd)), jsonOutput)
+	}
+	if (len(columns) > 0 || streamMode) && (cmd == "encrypt" || cmd == "decrypt") {
+		var in io.Reader = os.Stdin
+		if len(rest) == 1 {
+			in = strings.NewReader(rest[0])
+		}
+		if streamMode {
+			return runStreamCommand(cmd, in, jsonOutput, tr)
+		}
+		return runCSVCommand(cmd, in, jsonOutput, tr)
+	}
+
+	var input string
+	switch {
+	case len(rest) == 1:
+		input = rest[0]
+	default:
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return reportFailure(fmt.Errorf("failed to read stdin: %v", err), jsonOutput)
+		}
+		input = strings.TrimSuffix(string(data), "\n")
+	}
+
+	startTime := time.Now()
+	var (
+		result string
+		req    *protocol.Request
+		rec    transcriptRecord
+		err    error
+	)
+	switch cmd {
+	case "encrypt":
+		plaintext := payload.FromString(input)
+		req = newRequest(encryptOp(), plaintext)
+		result, err = encryptViaEnclave(req)
+		rec = transcriptRecord{
+			Operation:       encryptOp(),
+			PlaintextBytes:  plaintext.Len(),
+			CiphertextBytes: len(result),
+			Ciphertext:      transcriptCiphertext(encryptOp(), result),
+		}
+	case "decrypt":
+		ciphertextBlob := strings.TrimSpace(input)
+		var plaintext payload.Payload
+		req = newRequest(decryptOp(), payload.FromString(ciphertextBlob))
+		plaintext, err = decryptViaEnclave(req)
+		result = plaintext.Reveal()
+		rec = transcriptRecord{
+			Operation:       decryptOp(),
+			PlaintextBytes:  plaintext.Len(),
+			CiphertextBytes: len(ciphertextBlob),
+			Ciphertext:      transcriptCiphertext(decryptOp(), ciphertextBlob),
+		}
+	case "sign":
+		message := payload.FromString(input)
+		req = newRequest(protocol.OpSign, message)
+		result, err = signViaEnclave(req)
+		rec = transcriptRecord{
+			Operation:       protocol.OpSign,
+			PlaintextBytes:  message.Len(),
+			CiphertextBytes: len(result),
+			Ciphertext:      result,
+		}
+	case "verify":
+		message := payload.FromString(input)
+		var v *protocol.Verification
+		req = newRequest(protocol.OpVerify, message)
+		v, err = verifyViaEnclave(req, signature)
+		if err == nil {
+			result = fmt.Sprintf("valid (%s, %s)", v.SigningAlgorithm, v.KeyId)
+		}
+		rec = transcriptRecord{
+			Operation:       protocol.OpVerify,
+			PlaintextBytes:  message.Len(),
+			CiphertextBytes: len(signature),
+			Ciphertext:      signature,
+		}
+		if v != nil {
+			// the key KMS used, which --key-id may have left to the proxy
+			rec.KeyID = v.KeyId
+		}
+	case "shred":
+		var r *protocol.ShredResult
+		req = newRequest(protocol.OpShred, payload.Payload{})
+		r, err = shredViaEnclave(req, input)
+		if err == nil {
+			result = fmt.Sprintf("shredded %s at %s", r.RecordId, r.ShreddedAt.Format(time.RFC3339))
+			if !r.HadKey {
+				result += " (it had no key left)"
+			}
+		}
+		rec = transcriptRecord{Operation: protocol.OpShred}
+	case "call":
+		data := payload.FromString(input)
+		var output []byte
+		req = newRequest(operation, data)
+		output, err = callEnclave(req)
+		result = string(output)
+		rec = transcriptRecord{
+			Operation:       operation,
+			PlaintextBytes:  data.Len(),
+			CiphertextBytes: len(output),
+		}
+	}
+	totalTime := time.Since(startTime)
+
+	rec.Timestamp = startTime
+	rec.RequestID = req.RequestId
+	if rec.KeyID == "" {
+		rec.KeyID = req.KeyId
+	}
+	rec.DurationMs = float64(totalTime.Microseconds()) / 1000
+	rec.Status = statusOf(err)
+	rec.Error = errorString(err)
+	tr.Record(rec)
+
+	if err != nil {
+		return reportFailure(err, jsonOutput)
+	}
+
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(struct {
+			Operation  string  `json:"operation"`
+			Result     string  `json:"result"`
+			DurationMs float64 `json:"duration_ms"`
+		}{rec.Operation, result, rec.DurationMs})
+	} else {
+		fmt.Println(result)
+	}
+	return exitOK
+}
@@ -0,0 +1,172 @@
+// connector/csv.go
+package connector
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// columns selects the enclave's EncryptColumns and DecryptColumns
+// operations on these CSV columns (set by --columns); batchRows is how
+// many rows go in each request (set by --batch-rows).
+var (
+	columns   columnList
+	batchRows int
+)
+
+// columnList is a comma-separated list of column names. It implements
+// flag.Value.
+type columnList []string
+
+func (l *columnList) Set(s string) error {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	*l = names
+	return nil
+}
+
+func (l *columnList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+// csvStats summarises a streamed CSV run.
+type csvStats struct {
+	requestIDs        []string // one per batch, in order
+	rows, batches     int
+	inBytes, outBytes int
+}
+
+// streamCSV encrypts (or decrypts) the --columns of the CSV read from in
+// and writes the result to out, --batch-rows rows per enclave request.
+// Only one batch is held in memory at a time, so files of any size can
+// be streamed. Each batch is sent with the header, and the header is
+// written once.
+func streamCSV(in io.Reader, out io.Writer, encrypt bool) (csvStats, error) {
+	var stats csvStats
+	op := protocol.OpDecryptColumns
+	if encrypt {
+		op = protocol.OpEncryptColumns
+	}
+
+	r := csv.NewReader(in)
+	header, err := r.Read()
+	if err == io.EOF {
+		return stats, usageFailure(fmt.Errorf("the CSV input is empty; it needs a header row"))
+	}
+	if err != nil {
+		return stats, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	w := csv.NewWriter(out)
+	w.Write(header)
+
+	batch := [][]string{header}
+	send := func() error {
+		var buf bytes.Buffer
+		bw := csv.NewWriter(&buf)
+		bw.WriteAll(batch)
+		req := newRequest(op, payload.New(buf.Bytes()))
+		stats.requestIDs = append(stats.requestIDs, req.RequestId)
+		result, err := callEnclave(req)
+		if err != nil {
+			return err
+		}
+		records, err := csv.NewReader(bytes.NewReader(result)).ReadAll()
+		if err != nil {
+			return protocolFailure(fmt.Errorf("enclave returned invalid CSV: %v", err))
+		}
+		if len(records) != len(batch) {
+			return protocolFailure(fmt.Errorf("enclave returned %d rows for a batch of %d", len(records)-1, len(batch)-1))
+		}
+		for _, record := range records[1:] {
+			w.Write(record)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("failed to write output: %v", err)
+		}
+		stats.rows += len(batch) - 1
+		stats.batches++
+		stats.inBytes += buf.Len()
+		stats.outBytes += len(result)
+		slog.Debug("Batch done", "batch", stats.batches, "rows", stats.rows)
+		batch = batch[:1]
+		return nil
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read CSV: %v", err)
+		}
+		batch = append(batch, record)
+		if len(batch)-1 >= batchRows {
+			if err := send(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if len(batch) > 1 {
+		if err := send(); err != nil {
+			return stats, err
+		}
+	}
+	w.Flush()
+	return stats, w.Error()
+}
+
+// runCSVCommand performs encrypt or decrypt with --columns, streaming CSV
+// from stdin (or the argument) to stdout.
+func runCSVCommand(cmd string, in io.Reader, jsonOutput bool, tr *transcript) int {
+	encrypt := cmd == "encrypt"
+	startTime := time.Now()
+	stats, err := streamCSV(in, os.Stdout, encrypt)
+	totalTime := time.Since(startTime)
+
+	rec := transcriptRecord{
+		Timestamp:       startTime,
+		KeyID:           keyID,
+		Operation:       decryptOp(),
+		PlaintextBytes:  stats.outBytes,
+		CiphertextBytes: stats.inBytes,
+		DurationMs:      float64(totalTime.Microseconds()) / 1000,
+		Status:          statusOf(err),
+		Error:           errorString(err),
+	}
+	if encrypt {
+		rec.Operation = encryptOp()
+		rec.PlaintextBytes, rec.CiphertextBytes = stats.inBytes, stats.outBytes
+	}
+	if len(stats.requestIDs) > 0 {
+		rec.RequestID = stats.requestIDs[0]
+	}
+	if len(stats.requestIDs) > 1 {
+		rec.RequestIDs = stats.requestIDs
+	}
+	tr.Record(rec)
+
+	if err != nil {
+		slog.Warn("CSV stream stopped", "rows_done", stats.rows, "batches", stats.batches)
+		return reportFailure(err, jsonOutput)
+	}
+	slog.Info("CSV stream done", "rows", stats.rows, "batches", stats.batches, "duration", totalTime)
+	return exitOK
+}
@@ -0,0 +1,152 @@
+// connector/exitcodes.go
+package connector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// Exit codes for one-shot commands. These are part of the connector's
+// interface: scripts branch on them, so existing values must not change.
+const (
+	exitOK           = 0
+	exitInternal     = 1
+	exitUsage        = 2
+	exitConnect      = 3
+	exitProtocol     = 4
+	exitKMS          = 5
+	exitVerification = 6 // invalid signature (attestation verification reserved)
+	exitTimeout      = 7
+	exitPolicy       = 8 // refused by an enclave or vsock-proxy policy
+)
+
+// failure classifies an error so it can be mapped to an exit code and a
+// stable machine-readable kind.
+type failure struct {
+	kind string
+	code int
+	err  error
+	// retry marks a failure that running the command again may not hit
+	retry bool
+}
+
+func (f *failure) Error() string { return f.err.Error() }
+func (f *failure) Unwrap() error { return f.err }
+
+func usageFailure(err error) error {
+	return &failure{kind: "usage_error", code: exitUsage, err: err}
+}
+
+func connectFailure(err error) error {
+	return &failure{kind: "connect_failure", code: exitConnect, err: err}
+}
+
+func protocolFailure(err error) error {
+	return &failure{kind: "protocol_error", code: exitProtocol, err: err}
+}
+
+// connectionFailure is the error for a request whose connection failed
+// after it was sent: a protocol error, unless the enclave dropped the
+// connection (it crashed or restarted mid-request), which is retryable.
+func connectionFailure(err error) error {
+	dropped := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+	return &failure{kind: "protocol_error", code: exitProtocol, err: err, retry: dropped}
+}
+
+func kmsFailure(err error) error {
+	return &failure{kind: "kms_error", code: exitKMS, err: err}
+}
+
+// enclaveFailure classifies an error response from the enclave by its
+// protocol error code.
+func enclaveFailure(perr *protocol.Error) error {
+	err := fmt.Errorf("enclave reported %s: %w", perr.Code, perr)
+	switch perr.Code {
+	case protocol.CodeKMS:
+		return kmsFailure(err)
+	case protocol.CodeTimeout:
+		return timeoutFailure(err)
+	case protocol.CodeInvalidSignature:
+		return verificationFailure(err)
+	case protocol.CodePolicyDenied:
+		return &failure{kind: "policy_denied", code: exitPolicy, err: err}
+	}
+	return protocolFailure(err)
+}
+
+func verificationFailure(err error) error {
+	return &failure{kind: "verification_failure", code: exitVerification, err: err}
+}
+
+func timeoutFailure(err error) error {
+	return &failure{kind: "timeout", code: exitTimeout, err: err}
+}
+
+// classify returns the kind and exit code for err. Unclassified errors are
+// reported as internal errors.
+func classify(err error) (string, int) {
+	var f *failure
+	if errors.As(err, &f) {
+		return f.kind, f.code
+	}
+	return "internal_error", exitInternal
+}
+
+// retryable reports whether running the command again may succeed: the
+// enclave says so, the enclave couldn't be reached in time at all, or it
+// dropped the connection.
+func retryable(err error) bool {
+	var perr *protocol.Error
+	if errors.As(err, &perr) {
+		return perr.Retryable
+	}
+	var f *failure
+	if errors.As(err, &f) && f.retry {
+		return true
+	}
+	kind, _ := classify(err)
+	return kind == "connect_failure" || kind == "timeout"
+}
+
+// reportFailure prints err for a one-shot command and returns the exit
+// code to use. With jsonOutput the error is written to stdout as a single
+// JSON object so automation can parse it; errors reported by the enclave
+// also carry their protocol code, whether they are retryable, and details.
+func reportFailure(err error, jsonOutput bool) int {
+	kind, code := classify(err)
+	var perr *protocol.Error
+	errors.As(err, &perr)
+	if jsonOutput {
+		out := struct {
+			Error struct {
+				Kind      string            `json:"kind"`
+				Message   string            `json:"message"`
+				ExitCode  int               `json:"exit_code"`
+				Code      string            `json:"code,omitempty"`
+				Retryable bool              `json:"retryable"`
+				Details   map[string]string `json:"details,omitempty"`
+			} `json:"error"`
+		}{}
+		out.Error.Kind = kind
+		out.Error.Message = err.Error()
+		out.Error.ExitCode = code
+		out.Error.Retryable = retryable(err)
+		if perr != nil {
+			out.Error.Code = perr.Code
+			out.Error.Details = perr.Details
+		}
+		json.NewEncoder(os.Stdout).Encode(out)
+	} else if retryable(err) {
+		fmt.Fprintf(os.Stderr, "connector: %s (retryable): %v\n", kind, err)
+	} else {
+		fmt.Fprintf(os.Stderr, "connector: %s: %v\n", kind, err)
+	}
+	return code
+}
@@ -0,0 +1,101 @@
+// connector/file.go
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runFileCommand performs encrypt-file or decrypt-file IN OUT. The file
+// goes through the enclave as a stream (see streamEncrypt), so it may be
+// of any size, and an encrypted file is the same format --stream writes:
+// a header with the key ID, algorithm, nonce prefix and encrypted data
+// key, then the chunks. decrypt-file needs nothing but the file and
+// access to the key.
+func runFileCommand(cmd string, args []string, jsonOutput bool, tr *transcript) int {
+	if len(args) != 2 || args[0] == "" || args[1] == "" {
+		return reportFailure(usageFailure(fmt.Errorf("%s needs an input and an output file", cmd)), jsonOutput)
+	}
+	inPath, outPath := args[0], args[1]
+	encrypt := cmd == "encrypt-file"
+
+	startTime := time.Now()
+	stats, err := cryptFile(encrypt, inPath, outPath)
+	recordStream(tr, encrypt, startTime, stats, err)
+	if err != nil {
+		return reportFailure(err, jsonOutput)
+	}
+	totalTime := time.Since(startTime)
+	slog.Info("File done", "input", inPath, "output", outPath, "chunks", stats.chunks, "input_bytes", stats.inBytes, "output_bytes", stats.outBytes, "duration", totalTime)
+
+	verb := "encrypted"
+	if !encrypt {
+		verb = "decrypted"
+	}
+	result := fmt.Sprintf("%s %s (%d bytes) to %s (%d bytes)", verb, inPath, stats.inBytes, outPath, stats.outBytes)
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(struct {
+			Operation   string  `json:"operation"`
+			Result      string  `json:"result"`
+			InputBytes  int     `json:"input_bytes"`
+			OutputBytes int     `json:"output_bytes"`
+			DurationMs  float64 `json:"duration_ms"`
+		}{cmd, result, stats.inBytes, stats.outBytes, float64(totalTime.Microseconds()) / 1000})
+	} else {
+		fmt.Println(result)
+	}
+	return exitOK
+}
+
+// cryptFile streams inPath through the enclave into a temporary file next
+// to outPath, which replaces outPath only once the whole file has gone
+// through. A failed run, such as a damaged or truncated file, leaves no
+// partial output behind. The output is readable by the owner only, since
+// decrypt-file writes plaintext.
+func cryptFile(encrypt bool, inPath, outPath string) (streamStats, error) {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return streamStats{}, usageFailure(err)
+	}
+	defer in.Close()
+	if inInfo, err := in.Stat(); err != nil {
+		return streamStats{}, usageFailure(err)
+	} else if !inInfo.Mode().IsRegular() {
+		return streamStats{}, usageFailure(fmt.Errorf("%s is not a regular file", inPath))
+	} else if outInfo, err := os.Stat(outPath); err == nil && os.SameFile(inInfo, outInfo) {
+		return streamStats{}, usageFailure(fmt.Errorf("the output file is the input file %s", inPath))
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(outPath), "."+filepath.Base(outPath)+".tmp-*")
+	if err != nil {
+		return streamStats{}, fmt.Errorf("failed to create the output file: %v", err)
+	}
+	// Once renamed, there is nothing left to remove
+	defer os.Remove(tmp.Name())
+
+	var stats streamStats
+	if encrypt {
+		stats, err = streamEncrypt(in, tmp)
+	} else {
+		stats, err = streamDecrypt(in, tmp)
+	}
+	if err == nil {
+		if serr := tmp.Sync(); serr != nil {
+			err = fmt.Errorf("failed to write %s: %v", outPath, serr)
+		}
+	}
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to write %s: %v", outPath, cerr)
+	}
+	if err != nil {
+		return stats, err
+	}
+	if err := os.Rename(tmp.Name(), outPath); err != nil {
+		return stats, fmt.Errorf("failed to replace %s: %v", outPath, err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,67 @@
+package connector
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCryptFile(t *testing.T) {
+	fakeStreamEnclave(t)
+	withChunkSize(t, 64)
+	dir := t.TempDir()
+	data := make([]byte, 1000)
+	rand.Read(data)
+	plain, sealed, restored := filepath.Join(dir, "data.bin"), filepath.Join(dir, "data.bin.enc"), filepath.Join(dir, "restored.bin")
+	os.WriteFile(plain, data, 0o644)
+
+	if _, err := cryptFile(true, plain, sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cryptFile(false, sealed, restored); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(restored)
+	if !bytes.Equal(got, data) {
+		t.Fatal("round trip changed the file")
+	}
+	if info, _ := os.Stat(restored); info.Mode().Perm() != 0o600 {
+		t.Fatalf("decrypted file mode %v", info.Mode())
+	}
+
+	// A truncated file fails without touching the existing output or
+	// leaving a temporary file behind
+	enc, _ := os.ReadFile(sealed)
+	os.WriteFile(sealed, enc[:len(enc)-40], 0o644)
+	if _, err := cryptFile(false, sealed, restored); err == nil {
+		t.Fatal("truncated file decrypted")
+	}
+	if got, _ := os.ReadFile(restored); !bytes.Equal(got, data) {
+		t.Fatal("failed decrypt changed the existing output")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Fatalf("%d files left in the directory", len(entries))
+	}
+}
+
+func TestCryptFileUsage(t *testing.T) {
+	fakeStreamEnclave(t)
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "data.bin")
+	os.WriteFile(plain, []byte("hello"), 0o644)
+
+	for _, tt := range []struct{ in, out string }{
+		{filepath.Join(dir, "missing"), filepath.Join(dir, "out")},
+		{plain, plain},
+		{dir, filepath.Join(dir, "out")},
+	} {
+		if _, err := cryptFile(true, tt.in, tt.out); exitCode(err) != exitUsage {
+			t.Errorf("%s to %s: %v", tt.in, tt.out, err)
+		}
+	}
+	if code := runFileCommand("encrypt-file", []string{plain}, false, nil); code != exitUsage {
+		t.Fatalf("one argument: exit %d", code)
+	}
+}
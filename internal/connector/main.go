@@ -0,0 +1,556 @@
+// connector/main.go
+package connector
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/envflag"
+	"nitro-dev-qemu/pkg/jsonpath"
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/profile"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// Main runs the connector with its flags and command parsed from args
+// into fs. cmd/connector passes flag.CommandLine. A program embedding the
+// connector (cmd/allinone) passes a flag set of its own and t, the
+// transport to reach the enclave over in place of --vsock-transport, and
+// sets up logging itself.
+func Main(fs *flag.FlagSet, args []string, t vsock.Transport) {
+	env := envflag.On(fs)
+	transcriptPath := fs.String("transcript", "", "Write a JSON Lines record of every operation (without plaintext) to this file")
+	sqsEndpoint := fs.String("sqs-endpoint", "http://localhost:4566", "SQS endpoint used in queue consumer mode")
+	sqsInputQueue := fs.String("sqs-input-queue", "", "Queue URL to consume plaintext messages from (enables queue consumer mode)")
+	sqsOutputQueue := fs.String("sqs-output-queue", "", "Queue URL to publish encrypted results to")
+	region := env.String("region", "us-east-1", "AWS region SQS requests are signed for in queue consumer mode", "AWS_REGION", "AWS_DEFAULT_REGION")
+	decryptMode := fs.Bool("decrypt", false, "Decrypt pasted CiphertextBlobs instead of encrypting text")
+	jsonOutput := fs.Bool("json", false, "Print one-shot command results and errors as JSON")
+	fs.StringVar(&keyID, "key-id", "", "KMS key ID, ARN or alias to use (default: the vsock-proxy's alias/dev-key, or alias/dev-signing-key for sign and verify)")
+	fs.StringVar(&signingAlgorithm, "signing-algorithm", "RSASSA_PSS_SHA_256", "KMS signing algorithm for sign and verify (e.g. ECDSA_SHA_256 with an ECC key)")
+	fs.BoolVar(&envelopeMode, "envelope", false, "Use enclave-local AES-256-GCM envelope encryption with a KMS data key")
+	fs.BoolVar(&fpeMode, "fpe", false, "Format-preserving encryption (FF3-1) of the numerals in the input, e.g. a card number or SSN, keeping its length and separators; --key-id must be a --deterministic-key key")
+	fs.IntVar(&fpeParams.Radix, "fpe-radix", 0, "Number base of the numerals for --fpe and the fpe stage, 2 to 36 (default 10)")
+	fs.StringVar(&fpeParams.Tweak, "fpe-tweak", "", "7-byte FF3-1 tweak in hex for --fpe and the fpe stage, e.g. one per field so equal values in different fields encrypt differently (default zeros)")
+	fs.StringVar(&recordID, "record-id", "", "Encrypt and decrypt under this record's own key (crypto-shredding), e.g. a customer ID; the shred command destroys it")
+	fs.StringVar(&pipeline, "pipeline", "", "Encrypt and decrypt through this enclave transformation pipeline, e.g. gzip,envelope,base64 (\"default\" for the enclave's --pipeline)")
+	fs.Var(&fields, "fields", "Treat input as a JSON document and encrypt or decrypt only these comma-separated JSONPaths, e.g. '$.ssn,$.customers[*].email'")
+	fs.Var(&columns, "columns", "Treat input as CSV with a header row and encrypt or decrypt only these comma-separated columns, streaming stdin to stdout")
+	fs.IntVar(&batchRows, "batch-rows", 1000, "CSV rows per enclave request with --columns")
+	fs.BoolVar(&streamMode, "stream", false, "Encrypt or decrypt stdin of any size to stdout in chunks over one enclave connection, with one data key per stream")
+	fs.IntVar(&chunkSize, "chunk-size", 1<<20, "Plaintext bytes per chunk with --stream (at most 16 MiB)")
+	enclaveCID = env.Uint32("upstream-cid", 3, "Vsock CID of the enclave", "UPSTREAM_CID")
+	enclavePort = env.Uint32("upstream-port", 9000, "Vsock port of the enclave", "UPSTREAM_PORT")
+	bench := fs.Bool("bench", false, "Load-test the enclave: send --bench-requests operations from --bench-concurrency workers and report throughput and latency")
+	benchRequests := fs.Int("bench-requests", 1000, "Total requests to send in --bench mode")
+	benchConcurrency := fs.Int("bench-concurrency", 16, "Concurrent requests in --bench mode")
+	benchPayloadSize := fs.Int("bench-payload-size", 256, "Plaintext size in bytes for --bench mode")
+	fs.DurationVar(&operationTimeout, "timeout", 0, "Give up on an operation after this long, reporting the stage reached (0 = no timeout)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  connector [flags]                    interactive mode\n")
+		fmt.Fprintf(os.Stderr, "  connector [flags] encrypt [text]     encrypt text (or stdin) and exit\n")
+		fmt.Fprintf(os.Stderr, "  connector [flags] decrypt [blob]     decrypt a CiphertextBlob (or stdin) and exit\n")
+		fmt.Fprintf(os.Stderr, "  connector --stream encrypt|decrypt   stream stdin of any size to stdout\n")
+		fmt.Fprintf(os.Stderr, "  connector encrypt-file|decrypt-file in out   encrypt or decrypt a file of any size\n")
+		fmt.Fprintf(os.Stderr, "  connector [flags] sign [message]     sign a message (or stdin) and print the signature\n")
+		fmt.Fprintf(os.Stderr, "  connector [flags] verify sig [msg]   verify a signature over a message (or stdin)\n")
+		fmt.Fprintf(os.Stderr, "  connector [flags] shred record-id    destroy a record's key (see --record-id)\n")
+		fmt.Fprintf(os.Stderr, "  connector [flags] call op [input]    run a workload operation on the enclave's callout service\n")
+		fmt.Fprintf(os.Stderr, "  connector [flags] --bench            load-test the enclave and report latency\n\n")
+		fmt.Fprintf(os.Stderr, "Exit codes: 0 ok, 1 internal error, 2 usage error, 3 connect failure,\n")
+		fmt.Fprintf(os.Stderr, "            4 protocol error, 5 KMS error, 6 verification failure, 7 timeout\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	prof := profile.Register(fs)
+	var transportName *string
+	if t == nil {
+		transportName = env.String("vsock-transport", "vsock", "How to reach the enclave: vsock, or tcp (tcp:HOST) to run on one machine without a VM, with ports standing in for vsock addresses", "VSOCK_TRANSPORT")
+		logging.RegisterFlags(fs)
+	}
+	fs.Parse(args)
+	if transportName != nil {
+		if err := logging.Setup("connector"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		pt, err := vsock.ParseTransport(*transportName)
+		if err != nil {
+			os.Exit(reportFailure(usageFailure(err), *jsonOutput))
+		}
+		t = pt
+	}
+	transport = t
+
+	if *sqsInputQueue != "" {
+		setupSQSAuth(*region)
+	}
+	rules := append(profile.Common(fs),
+		profile.Rule{Setting: "--sqs-endpoint=" + *sqsEndpoint, Reason: "queue messages carry plaintext, so the SQS endpoint must use https", Violated: func() bool {
+			return *sqsInputQueue != "" && !profile.HTTPS(*sqsEndpoint)
+		}},
+		profile.Rule{Setting: "unsigned SQS requests", Reason: "no AWS credentials were found, and only LocalStack accepts unsigned requests", Violated: func() bool {
+			return *sqsInputQueue != "" && sqsCredentials == nil
+		}})
+	if err := prof.Enforce(rules...); err != nil {
+		os.Exit(reportFailure(usageFailure(err), *jsonOutput))
+	}
+
+	slog.Info("Starting vsock connector client", "cid", *enclaveCID, "port", *enclavePort, "profile", prof.Name())
+
+	if *bench {
+		os.Exit(runBench(*benchRequests, *benchConcurrency, *benchPayloadSize, *decryptMode, *jsonOutput))
+	}
+
+	var tr *transcript
+	if *transcriptPath != "" {
+		var err error
+		tr, err = openTranscript(*transcriptPath)
+		if err != nil {
+			logging.Fatal("Failed to open transcript", "err", err)
+		}
+		defer tr.Close()
+		slog.Info("Writing session transcript", "path", *transcriptPath)
+	}
+
+	if len(columns) > 0 && (fs.NArg() == 0 || batchRows < 1) {
+		os.Exit(reportFailure(usageFailure(fmt.Errorf("--columns needs the encrypt or decrypt command and a positive --batch-rows")), *jsonOutput))
+	}
+
+	if streamMode && fs.NArg() == 0 {
+		os.Exit(reportFailure(usageFailure(fmt.Errorf("--stream needs the encrypt or decrypt command")), *jsonOutput))
+	}
+	if chunkSize < 1 || chunkSize > envelope.MaxChunkSize {
+		os.Exit(reportFailure(usageFailure(fmt.Errorf("--chunk-size must be 1 to %d bytes", envelope.MaxChunkSize)), *jsonOutput))
+	}
+
+	if fs.NArg() > 0 {
+		code := runCommand(fs.Args(), *jsonOutput, tr)
+		tr.Close()
+		os.Exit(code)
+	}
+
+	if *sqsInputQueue != "" {
+		if *sqsOutputQueue == "" {
+			logging.Fatal("--sqs-output-queue is required with --sqs-input-queue")
+		}
+		runSQSMode(*sqsEndpoint, *sqsInputQueue, *sqsOutputQueue, tr)
+		return
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	if *decryptMode {
+		runDecryptLoop(reader, tr)
+		return
+	}
+
+	for {
+		fmt.Print("Enter text to encrypt (or type exit): ")
+		text, _ := reader.ReadString('\n')
+		if text == "exit\n" {
+			slog.Info("Exiting")
+			break
+		}
+
+		// Trim newline and send to enclave
+		if len(text) > 0 {
+			text = text[:len(text)-1] // Remove trailing newline
+		}
+		plaintext := payload.FromString(text)
+
+		slog.Debug("New encryption request", logging.Payload("plaintext", plaintext.Bytes()))
+
+		startTime := time.Now()
+		req := newRequest(encryptOp(), plaintext)
+		encryptedResult, err := encryptViaEnclave(req)
+		totalTime := time.Since(startTime)
+		tr.Record(transcriptRecord{
+			Timestamp:       startTime,
+			RequestID:       req.RequestId,
+			KeyID:           req.KeyId,
+			Operation:       encryptOp(),
+			PlaintextBytes:  plaintext.Len(),
+			CiphertextBytes: len(encryptedResult),
+			Ciphertext:      transcriptCiphertext(encryptOp(), encryptedResult),
+			DurationMs:      float64(totalTime.Microseconds()) / 1000,
+			Status:          statusOf(err),
+			Error:           errorString(err),
+		})
+		if err != nil {
+			slog.Error("Encryption failed", "err", err)
+			continue
+		}
+		slog.Debug("Encryption result", logging.Payload("ciphertext", []byte(encryptedResult)))
+
+		fmt.Println("=== ENCRYPTION SUMMARY ===")
+		fmt.Printf("Plaintext: %q\n", plaintext.Reveal())
+		fmt.Printf("Encrypted: %q\n", encryptedResult)
+		fmt.Printf("Plaintext length: %d chars\n", plaintext.Len())
+		fmt.Printf("Encrypted length: %d chars\n", len(encryptedResult))
+		fmt.Printf("Total round-trip time: %v\n", totalTime)
+		fmt.Println("==========================")
+	}
+}
+
+// runDecryptLoop prompts for CiphertextBlobs (as printed by encrypt mode)
+// and prints the plaintext the enclave returns for each.
+func runDecryptLoop(reader *bufio.Reader, tr *transcript) {
+	for {
+		fmt.Print("Enter CiphertextBlob or envelope to decrypt (or type exit): ")
+		text, _ := reader.ReadString('\n')
+		if text == "exit\n" {
+			slog.Info("Exiting")
+			break
+		}
+
+		ciphertextBlob := strings.TrimSpace(text)
+		if ciphertextBlob == "" {
+			continue
+		}
+
+		slog.Debug("New decryption request", logging.Payload("ciphertext", []byte(ciphertextBlob)))
+
+		startTime := time.Now()
+		req := newRequest(decryptOp(), payload.FromString(ciphertextBlob))
+		plaintext, err := decryptViaEnclave(req)
+		totalTime := time.Since(startTime)
+		tr.Record(transcriptRecord{
+			Timestamp:       startTime,
+			RequestID:       req.RequestId,
+			KeyID:           req.KeyId,
+			Operation:       decryptOp(),
+			PlaintextBytes:  plaintext.Len(),
+			CiphertextBytes: len(ciphertextBlob),
+			Ciphertext:      transcriptCiphertext(decryptOp(), ciphertextBlob),
+			DurationMs:      float64(totalTime.Microseconds()) / 1000,
+			Status:          statusOf(err),
+			Error:           errorString(err),
+		})
+		if err != nil {
+			slog.Error("Decryption failed", "err", err)
+			continue
+		}
+		slog.Debug("Decryption result", logging.Payload("plaintext", plaintext.Bytes()))
+
+		fmt.Println("=== DECRYPTION SUMMARY ===")
+		fmt.Printf("Ciphertext length: %d chars\n", len(ciphertextBlob))
+		fmt.Printf("Plaintext: %q\n", plaintext.Reveal())
+		fmt.Printf("Plaintext length: %d chars\n", plaintext.Len())
+		fmt.Printf("Total round-trip time: %v\n", totalTime)
+		fmt.Println("==========================")
+	}
+}
+
+// envelopeMode selects enclave-local envelope encryption (set by
+// --envelope) instead of a direct KMS Encrypt/Decrypt per request.
+var envelopeMode bool
+
+// fpeMode selects the enclave's FPEEncrypt and FPEDecrypt operations (set
+// by --fpe), with fpeParams (set by --fpe-radix and --fpe-tweak).
+var (
+	fpeMode   bool
+	fpeParams protocol.FPE
+)
+
+// recordID selects the enclave's RecordEncrypt and RecordDecrypt
+// operations under this record's key (set by --record-id).
+var recordID string
+
+// pipeline selects the enclave's Transform and ReverseTransform operations
+// with these stages (set by --pipeline); "default" leaves the choice to
+// the enclave.
+var pipeline string
+
+// fields selects the enclave's EncryptFields and DecryptFields operations
+// on these JSONPaths (set by --fields).
+var fields fieldList
+
+// fieldList is a comma-separated list of JSONPaths. It implements
+// flag.Value, checking each path so mistakes are usage errors.
+type fieldList []string
+
+func (l *fieldList) Set(s string) error {
+	var paths []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		path, _ := protocol.SplitFieldKey(f)
+		if _, err := jsonpath.Parse(path); err != nil {
+			return err
+		}
+		paths = append(paths, f)
+	}
+	*l = paths
+	return nil
+}
+
+func (l *fieldList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func encryptOp() string {
+	switch {
+	case len(columns) > 0:
+		return protocol.OpEncryptColumns
+	case len(fields) > 0:
+		return protocol.OpEncryptFields
+	case pipeline != "":
+		return protocol.OpTransform
+	case recordID != "":
+		return protocol.OpRecordEncrypt
+	case fpeMode:
+		return protocol.OpFPEEncrypt
+	case envelopeMode:
+		return protocol.OpEnvelopeEncrypt
+	}
+	return protocol.OpEncrypt
+}
+
+func decryptOp() string {
+	switch {
+	case len(columns) > 0:
+		return protocol.OpDecryptColumns
+	case len(fields) > 0:
+		return protocol.OpDecryptFields
+	case pipeline != "":
+		return protocol.OpReverseTransform
+	case recordID != "":
+		return protocol.OpRecordDecrypt
+	case fpeMode:
+		return protocol.OpFPEDecrypt
+	case envelopeMode:
+		return protocol.OpEnvelopeDecrypt
+	}
+	return protocol.OpDecrypt
+}
+
+// encryptViaEnclave sends req, whose payload is the plaintext, to the
+// enclave over vsock and returns the encrypted result: a base64
+// CiphertextBlob, or a JSON envelope in envelope mode.
+func encryptViaEnclave(req *protocol.Request) (string, error) {
+	result, err := callEnclave(req)
+	return string(result), err
+}
+
+// decryptViaEnclave sends req, whose payload is a CiphertextBlob (or JSON
+// envelope in envelope mode), to the enclave over vsock and returns the
+// decrypted plaintext.
+func decryptViaEnclave(req *protocol.Request) (payload.Payload, error) {
+	result, err := callEnclave(req)
+	return payload.New(result), err
+}
+
+// signViaEnclave has KMS sign the message in req through the enclave and
+// returns the base64 signature.
+func signViaEnclave(req *protocol.Request) (string, error) {
+	req.Signing = &protocol.Signing{SigningAlgorithm: signingAlgorithm}
+	result, err := callEnclave(req)
+	return string(result), err
+}
+
+// shredViaEnclave has the enclave destroy the key of record, making its
+// ciphertexts unreadable.
+func shredViaEnclave(req *protocol.Request, record string) (*protocol.ShredResult, error) {
+	req.RecordId = record
+	result, err := callEnclave(req)
+	if err != nil {
+		return nil, err
+	}
+	var r protocol.ShredResult
+	if err := json.Unmarshal(result, &r); err != nil {
+		return nil, protocolFailure(fmt.Errorf("failed to parse Shred result: %v", err))
+	}
+	return &r, nil
+}
+
+// verifyViaEnclave has KMS check a base64 signature over the message in
+// req. An invalid signature is an error that classifies as a verification
+// failure.
+func verifyViaEnclave(req *protocol.Request, signature string) (*protocol.Verification, error) {
+	req.Signing = &protocol.Signing{SigningAlgorithm: signingAlgorithm, Signature: signature}
+	result, err := callEnclave(req)
+	if err != nil {
+		return nil, err
+	}
+	var v protocol.Verification
+	if err := json.Unmarshal(result, &v); err != nil {
+		return nil, protocolFailure(fmt.Errorf("failed to parse Verify result: %v", err))
+	}
+	return &v, nil
+}
+
+// keyID and signingAlgorithm are sent with every request (set by --key-id
+// and --signing-algorithm); an empty keyID leaves the choice to the
+// vsock-proxy.
+var keyID, signingAlgorithm string
+
+// newRequest returns a request for op with a fresh ID, the --key-id and
+// the --timeout budget.
+func newRequest(op string, input payload.Payload) *protocol.Request {
+	req := &protocol.Request{
+		Operation: op,
+		KeyId:     keyID,
+		RequestId: protocol.NewRequestID(),
+		TimeoutMs: operationTimeout.Milliseconds(),
+		Payload:   input,
+	}
+	switch op {
+	case protocol.OpEncryptColumns, protocol.OpDecryptColumns:
+		req.Columns = columns
+	case protocol.OpEncryptFields, protocol.OpDecryptFields:
+		req.Fields = fields
+	}
+	switch op {
+	case protocol.OpTransform, protocol.OpReverseTransform,
+		protocol.OpEncryptFields, protocol.OpDecryptFields,
+		protocol.OpEncryptColumns, protocol.OpDecryptColumns:
+		if pipeline != "default" {
+			req.Pipeline = pipeline
+		}
+		if fpeParams != (protocol.FPE{}) {
+			req.FPE = &fpeParams
+		}
+	case protocol.OpFPEEncrypt, protocol.OpFPEDecrypt:
+		req.FPE = &fpeParams
+	case protocol.OpRecordEncrypt, protocol.OpRecordDecrypt:
+		req.RecordId = recordID
+	}
+	return req
+}
+
+// enclaveCID and enclavePort address the enclave (set by --upstream-cid
+// and --upstream-port).
+var enclaveCID, enclavePort *uint32
+
+// transport dials the enclave (set by --vsock-transport); tests swap in
+// a vsock.Memory.
+var transport vsock.Transport = vsock.System{}
+
+// operationTimeout bounds a whole enclave round trip (set by --timeout).
+var operationTimeout time.Duration
+
+// Stages of an enclave round trip, reported when an operation times out.
+const (
+	stageConnecting = "connecting to enclave"
+	stageSending    = "connected, sending request"
+	stageAwaiting   = "request sent, awaiting response"
+)
+
+// stageError reports a timeout together with the stage that was reached:
+// err is a timeout, or ctx's deadline closed the connection under it.
+func stageError(ctx context.Context, stage string, startTime time.Time, err error) error {
+	var ne net.Error
+	if (errors.As(err, &ne) && ne.Timeout()) || ctx.Err() == context.DeadlineExceeded {
+		return timeoutFailure(fmt.Errorf("timed out after %v while %s", time.Since(startTime).Round(time.Millisecond), stage))
+	}
+	return nil
+}
+
+// requestContext returns the context of one enclave request, bounded by
+// --timeout when it is set.
+func requestContext() (context.Context, context.CancelFunc) {
+	if operationTimeout > 0 {
+		return context.WithTimeout(context.Background(), operationTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// callEnclave performs one request against the enclave on a fresh vsock
+// connection and returns the raw result.
+func callEnclave(req *protocol.Request) ([]byte, error) {
+	input := req.Payload
+	logger := slog.With("request_id", req.RequestId, "operation", req.Operation)
+	startTime := time.Now()
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	// Connect to enclave
+	logger.Debug("Connecting to enclave", "cid", *enclaveCID, "port", *enclavePort)
+	conn, err := transport.DialContext(ctx, *enclaveCID, *enclavePort)
+	if err != nil {
+		if terr := stageError(ctx, stageConnecting, startTime, err); terr != nil {
+			return nil, terr
+		}
+		return nil, connectFailure(fmt.Errorf("error connecting to enclave: %v", err))
+	}
+	// The connection lives as long as the request: --timeout closes it
+	ctx, closeConn := vsock.WithConn(ctx, conn)
+	defer func() {
+		closeConn()
+		logger.Debug("Connection closed")
+	}()
+
+	connectTime := time.Since(startTime)
+	logger.Debug("Connected to enclave", "duration", connectTime)
+
+	// Send data
+	logger.Debug("Sending request to enclave", logging.Payload("input", input.Bytes()))
+	sendStart := time.Now()
+	if err := protocol.WriteRequest(conn, req); err != nil {
+		if terr := stageError(ctx, stageSending, startTime, err); terr != nil {
+			return nil, terr
+		}
+		return nil, connectionFailure(fmt.Errorf("write error: %w", err))
+	}
+	logger.Debug("Request sent, waiting for response", "duration", time.Since(sendStart))
+
+	// Read response
+	readStart := time.Now()
+	resp, err := protocol.ReadResponse(conn)
+	if err != nil {
+		if terr := stageError(ctx, stageAwaiting, startTime, err); terr != nil {
+			return nil, terr
+		}
+		return nil, connectionFailure(fmt.Errorf("read error: %w", err))
+	}
+	readTime := time.Since(readStart)
+	if resp.RequestId != req.RequestId {
+		return nil, protocolFailure(fmt.Errorf("response is for request %q, expected %q", resp.RequestId, req.RequestId))
+	}
+	if err := resp.Err(); err != nil {
+		var perr *protocol.Error
+		errors.As(err, &perr)
+		logger.Warn("Request failed in enclave", "code", perr.Code, "err", perr.Message, timingAttr(resp.Timing))
+		return nil, enclaveFailure(perr)
+	}
+	reply := resp.Result.Bytes()
+
+	logger.Info("Received response", "bytes", len(reply), "read_time", readTime, "connect_time", connectTime, "total_time", time.Since(startTime), timingAttr(resp.Timing))
+
+	return reply, nil
+}
+
+// timingAttr logs the enclave's reported budget and stage timings as an
+// "enclave" group, e.g. enclave.budget_ms=15000 enclave.proxy_kms_ms=41.2.
+func timingAttr(t *protocol.Timing) slog.Attr {
+	if t == nil {
+		return slog.Attr{}
+	}
+	args := []any{"budget_ms", t.BudgetMs, "total_ms", t.TotalMs}
+	stages := make([]string, 0, len(t.StagesMs))
+	for name := range t.StagesMs {
+		stages = append(stages, name)
+	}
+	sort.Strings(stages)
+	for _, name := range stages {
+		args = append(args, name+"_ms", t.StagesMs[name])
+	}
+	return slog.Group("enclave", args...)
+}
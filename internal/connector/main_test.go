@@ -0,0 +1,155 @@
+package connector
+
+import (
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// useMemory points callEnclave at an in-memory transport with nothing
+// listening yet.
+func useMemory(t *testing.T) *vsock.Memory {
+	t.Helper()
+	mem := &vsock.Memory{}
+	cid, port := uint32(vsock.LocalCID), uint32(9000)
+	oldTransport, oldCID, oldPort, oldTimeout := transport, enclaveCID, enclavePort, operationTimeout
+	t.Cleanup(func() {
+		transport, enclaveCID, enclavePort, operationTimeout = oldTransport, oldCID, oldPort, oldTimeout
+	})
+	transport, enclaveCID, enclavePort, operationTimeout = mem, &cid, &port, 5*time.Second
+	return mem
+}
+
+// fakeEnclave listens for callEnclave and answers each request with
+// respond. With a nil respond, requests are read but never answered.
+func fakeEnclave(t *testing.T, respond func(*protocol.Request) *protocol.Response) {
+	t.Helper()
+	mem := useMemory(t)
+	l, err := mem.Listen(*enclaveCID, *enclavePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := protocol.ReadRequest(conn)
+				if err != nil || respond == nil {
+					time.Sleep(time.Second)
+					return
+				}
+				protocol.WriteResponse(conn, respond(req))
+			}()
+		}
+	}()
+}
+
+func exitCode(err error) int {
+	_, code := classify(err)
+	return code
+}
+
+func TestCallEnclave(t *testing.T) {
+	var got *protocol.Request
+	fakeEnclave(t, func(req *protocol.Request) *protocol.Response {
+		got = req
+		return protocol.OK(req, []byte("ciphertext"))
+	})
+
+	result, err := callEnclave(&protocol.Request{RequestId: "r1", Operation: protocol.OpEncrypt, KeyId: "alias/dev-key", Payload: payload.FromString("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "ciphertext" {
+		t.Fatalf("result = %q", result)
+	}
+	if got.Version != protocol.Version || got.Operation != protocol.OpEncrypt || got.KeyId != "alias/dev-key" || got.Payload.Reveal() != "hello" {
+		t.Fatalf("enclave got %+v", got)
+	}
+}
+
+func TestCallEnclaveErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(*protocol.Request) *protocol.Response
+		code    int
+	}{
+		{"wrong request", func(req *protocol.Request) *protocol.Response {
+			return protocol.OK(&protocol.Request{RequestId: "other"}, nil)
+		}, exitProtocol},
+		{"kms error", func(req *protocol.Request) *protocol.Response {
+			return protocol.Failed(req, protocol.Errorf(protocol.CodeKMS, "KMS Encrypt failed"))
+		}, exitKMS},
+		{"timeout", func(req *protocol.Request) *protocol.Response {
+			return protocol.Failed(req, protocol.Errorf(protocol.CodeTimeout, "budget exceeded"))
+		}, exitTimeout},
+		{"policy", func(req *protocol.Request) *protocol.Response {
+			return protocol.Failed(req, protocol.Errorf(protocol.CodePolicyDenied, "key not allowed"))
+		}, exitPolicy},
+		{"bad request", func(req *protocol.Request) *protocol.Response {
+			return protocol.Failed(req, protocol.Errorf(protocol.CodeBadRequest, "no"))
+		}, exitProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeEnclave(t, tt.respond)
+			_, err := callEnclave(&protocol.Request{RequestId: "r1", Operation: protocol.OpEncrypt, Payload: payload.FromString("x")})
+			if code := exitCode(err); code != tt.code {
+				t.Fatalf("exit code %d, want %d (err: %v)", code, tt.code, err)
+			}
+		})
+	}
+}
+
+func TestCallEnclaveConnectRefused(t *testing.T) {
+	useMemory(t)
+	_, err := callEnclave(&protocol.Request{RequestId: "r1", Operation: protocol.OpEncrypt})
+	if code := exitCode(err); code != exitConnect {
+		t.Fatalf("exit code %d, want %d (err: %v)", code, exitConnect, err)
+	}
+	if !retryable(err) {
+		t.Fatalf("connect failure not retryable: %v", err)
+	}
+}
+
+func TestCallEnclaveDropped(t *testing.T) {
+	// An enclave that crashes mid-request: the connection closes unanswered
+	mem := useMemory(t)
+	l, err := mem.Listen(*enclaveCID, *enclavePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		protocol.ReadRequest(conn)
+		conn.Close()
+	}()
+	_, err = callEnclave(&protocol.Request{RequestId: "r1", Operation: protocol.OpEncrypt})
+	if code := exitCode(err); code != exitProtocol {
+		t.Fatalf("exit code %d, want %d (err: %v)", code, exitProtocol, err)
+	}
+	if !retryable(err) {
+		t.Fatalf("dropped connection not retryable: %v", err)
+	}
+}
+
+func TestCallEnclaveTimeout(t *testing.T) {
+	fakeEnclave(t, nil)
+	operationTimeout = 50 * time.Millisecond
+	_, err := callEnclave(&protocol.Request{RequestId: "r1", Operation: protocol.OpEncrypt})
+	if code := exitCode(err); code != exitTimeout {
+		t.Fatalf("exit code %d, want %d (err: %v)", code, exitTimeout, err)
+	}
+}
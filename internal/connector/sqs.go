@@ -0,0 +1,195 @@
+// connector/sqs.go
+package connector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"nitro-dev-qemu/pkg/awsauth"
+	"nitro-dev-qemu/pkg/payload"
+)
+
+// sqsRegion is the region SQS requests are signed for.
+var sqsRegion string
+
+// sqsCredentials signs SQS requests once setupSQSAuth has found
+// credentials. It stays nil when none are available, in which case
+// requests go out unsigned, which LocalStack accepts.
+var sqsCredentials awsauth.Provider
+
+// setupSQSAuth resolves AWS credentials from the standard chain
+// (environment, shared config files, instance metadata) for signing SQS
+// requests with SigV4.
+func setupSQSAuth(region string) {
+	sqsRegion = region
+	chain := awsauth.DefaultChain()
+	creds, err := chain.Retrieve()
+	if err != nil {
+		slog.Warn("Sending unsigned SQS requests (fine for LocalStack, rejected by AWS SQS)", "err", err)
+		return
+	}
+	sqsCredentials = chain
+	slog.Info("Signing SQS requests", "region", region, "credentials", creds.Source)
+}
+
+type SQSReceiveMessageRequest struct {
+	QueueUrl            string `json:"QueueUrl"`
+	MaxNumberOfMessages int    `json:"MaxNumberOfMessages"`
+	WaitTimeSeconds     int    `json:"WaitTimeSeconds"`
+}
+
+type SQSMessage struct {
+	MessageId     string `json:"MessageId"`
+	ReceiptHandle string `json:"ReceiptHandle"`
+	Body          string `json:"Body"`
+}
+
+type SQSReceiveMessageResponse struct {
+	Messages []SQSMessage `json:"Messages"`
+}
+
+type SQSMessageAttributeValue struct {
+	DataType    string `json:"DataType"`
+	StringValue string `json:"StringValue"`
+}
+
+type SQSSendMessageRequest struct {
+	QueueUrl          string                              `json:"QueueUrl"`
+	MessageBody       string                              `json:"MessageBody"`
+	MessageAttributes map[string]SQSMessageAttributeValue `json:"MessageAttributes,omitempty"`
+}
+
+type SQSSendMessageResponse struct {
+	MessageId string `json:"MessageId"`
+}
+
+type SQSDeleteMessageRequest struct {
+	QueueUrl      string `json:"QueueUrl"`
+	ReceiptHandle string `json:"ReceiptHandle"`
+}
+
+// runSQSMode polls inputQueue, encrypts every message body through the
+// enclave and publishes the ciphertext to outputQueue. A message is only
+// deleted from the input queue once its result has been published, so
+// failures are retried after the visibility timeout.
+func runSQSMode(endpoint, inputQueue, outputQueue string, tr *transcript) {
+	slog.Info("SQS queue consumer mode", "endpoint", endpoint, "input_queue", inputQueue, "output_queue", outputQueue)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	for {
+		slog.Debug("Polling input queue")
+		var received SQSReceiveMessageResponse
+		err := callSQS(client, endpoint, "ReceiveMessage", SQSReceiveMessageRequest{
+			QueueUrl:            inputQueue,
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     10,
+		}, &received)
+		if err != nil {
+			slog.Warn("ReceiveMessage failed, retrying in 5 seconds", "err", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		slog.Debug("Received messages", "count", len(received.Messages))
+
+		for _, msg := range received.Messages {
+			processSQSMessage(client, endpoint, inputQueue, outputQueue, msg, tr)
+		}
+	}
+}
+
+func processSQSMessage(client *http.Client, endpoint, inputQueue, outputQueue string, msg SQSMessage, tr *transcript) {
+	logger := slog.With("message_id", msg.MessageId)
+	plaintext := payload.FromString(msg.Body)
+	logger.Info("Processing SQS message", "bytes", plaintext.Len())
+
+	startTime := time.Now()
+	req := newRequest(encryptOp(), plaintext)
+	encryptedResult, err := encryptViaEnclave(req)
+	if err == nil {
+		var sent SQSSendMessageResponse
+		err = callSQS(client, endpoint, "SendMessage", SQSSendMessageRequest{
+			QueueUrl:    outputQueue,
+			MessageBody: encryptedResult,
+			MessageAttributes: map[string]SQSMessageAttributeValue{
+				"SourceMessageId": {DataType: "String", StringValue: msg.MessageId},
+			},
+		}, &sent)
+		if err == nil {
+			logger.Debug("Published encrypted result", "output_message_id", sent.MessageId)
+			err = callSQS(client, endpoint, "DeleteMessage", SQSDeleteMessageRequest{
+				QueueUrl:      inputQueue,
+				ReceiptHandle: msg.ReceiptHandle,
+			}, nil)
+		}
+	}
+	totalTime := time.Since(startTime)
+
+	tr.Record(transcriptRecord{
+		Timestamp:       startTime,
+		RequestID:       req.RequestId,
+		SQSMessageID:    msg.MessageId,
+		KeyID:           req.KeyId,
+		Operation:       encryptOp(),
+		PlaintextBytes:  plaintext.Len(),
+		CiphertextBytes: len(encryptedResult),
+		Ciphertext:      transcriptCiphertext(encryptOp(), encryptedResult),
+		DurationMs:      float64(totalTime.Microseconds()) / 1000,
+		Status:          statusOf(err),
+		Error:           errorString(err),
+	})
+	if err != nil {
+		logger.Warn("Message failed, leaving it on the input queue", "err", err)
+		return
+	}
+	logger.Info("Message processed", "duration", totalTime)
+}
+
+// callSQS sends an AWS JSON protocol request for the given SQS action,
+// signed with SigV4 when credentials are available, and decodes the
+// response into out (if non-nil).
+func callSQS(client *http.Client, endpoint, action string, in, out interface{}) error {
+	reqBody, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s request: %v", action, err)
+	}
+
+	httpReq, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %v", action, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	httpReq.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	if sqsCredentials != nil {
+		creds, err := sqsCredentials.Retrieve()
+		if err != nil {
+			return fmt.Errorf("failed to refresh AWS credentials: %v", err)
+		}
+		awsauth.Sign(httpReq, reqBody, "sqs", sqsRegion, creds, time.Now())
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send %s request: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s response: %v", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed with status %d: %s", action, resp.StatusCode, string(respBody))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("failed to parse %s response: %v", action, err)
+		}
+	}
+	return nil
+}
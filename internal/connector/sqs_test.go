@@ -0,0 +1,50 @@
+package connector
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/awsauth"
+)
+
+type staticCredentials awsauth.Credentials
+
+func (c staticCredentials) Retrieve() (awsauth.Credentials, error) {
+	return awsauth.Credentials(c), nil
+}
+
+// fakeSQS answers every call and returns the Authorization header of the
+// last one.
+func fakeSQS(t *testing.T) (string, func() string) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		io.WriteString(w, `{}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() string { return auth }
+}
+
+func TestCallSQSSigned(t *testing.T) {
+	oldCreds, oldRegion := sqsCredentials, sqsRegion
+	t.Cleanup(func() { sqsCredentials, sqsRegion = oldCreds, oldRegion })
+
+	url, auth := fakeSQS(t)
+	if err := callSQS(http.DefaultClient, url, "DeleteMessage", SQSDeleteMessageRequest{QueueUrl: "q"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if auth() != "" {
+		t.Fatalf("signed without credentials: %q", auth())
+	}
+
+	sqsCredentials, sqsRegion = staticCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, "eu-west-1"
+	if err := callSQS(http.DefaultClient, url, "DeleteMessage", SQSDeleteMessageRequest{QueueUrl: "q"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := auth(); !strings.HasPrefix(got, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(got, "/eu-west-1/sqs/aws4_request") {
+		t.Fatalf("Authorization = %q", got)
+	}
+}
@@ -0,0 +1,257 @@
+// connector/stream.go
+package connector
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"nitro-dev-qemu/pkg/framing"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// streamMode selects the enclave's StreamEncrypt and StreamDecrypt
+// operations (set by --stream), with chunkSize bytes of plaintext per
+// chunk (set by --chunk-size).
+var (
+	streamMode bool
+	chunkSize  int
+)
+
+// streamStats summarises a streamed run.
+type streamStats struct {
+	requestID         string // shared by every request of the stream
+	chunks            int
+	inBytes, outBytes int
+}
+
+// enclaveStream is one StreamEncrypt or StreamDecrypt connection. Every
+// request on it shares the stream's request ID; Seq numbers them.
+type enclaveStream struct {
+	ctx       context.Context // closes conn when it ends
+	cancel    context.CancelFunc
+	conn      net.Conn
+	requestID string
+	seq       uint64
+}
+
+// openEnclaveStream connects to the enclave and sends the opening request,
+// returning its result: the stream header for StreamEncrypt.
+func openEnclaveStream(req *protocol.Request) (*enclaveStream, []byte, error) {
+	startTime := time.Now()
+	dialCtx, cancel := requestContext()
+	conn, err := transport.DialContext(dialCtx, *enclaveCID, *enclavePort)
+	cancel()
+	if err != nil {
+		if terr := stageError(dialCtx, stageConnecting, startTime, err); terr != nil {
+			return nil, nil, terr
+		}
+		return nil, nil, connectFailure(fmt.Errorf("error connecting to enclave: %v", err))
+	}
+	// --timeout applies per request, so the stream's own context has none
+	ctx, cancel := vsock.WithConn(context.Background(), conn)
+	s := &enclaveStream{ctx: ctx, cancel: cancel, conn: conn, requestID: req.RequestId}
+	result, err := s.roundTrip(req)
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+	return s, result, nil
+}
+
+// roundTrip sends one request of the stream and returns its result.
+// --timeout applies to each request rather than to the whole stream,
+// whose length depends on the input.
+func (s *enclaveStream) roundTrip(req *protocol.Request) ([]byte, error) {
+	startTime := time.Now()
+	if operationTimeout > 0 {
+		s.conn.SetDeadline(startTime.Add(operationTimeout))
+	}
+	s.seq++
+	req.Seq, req.RequestId = s.seq, s.requestID
+	if err := protocol.WriteRequest(s.conn, req); err != nil {
+		if terr := stageError(s.ctx, stageSending, startTime, err); terr != nil {
+			return nil, terr
+		}
+		return nil, connectionFailure(fmt.Errorf("write error: %w", err))
+	}
+	resp, err := protocol.ReadResponse(s.conn)
+	if err != nil {
+		if terr := stageError(s.ctx, stageAwaiting, startTime, err); terr != nil {
+			return nil, terr
+		}
+		return nil, connectionFailure(fmt.Errorf("read error: %w", err))
+	}
+	if resp.Seq != req.Seq {
+		return nil, protocolFailure(fmt.Errorf("response is for chunk request %d, expected %d", resp.Seq, req.Seq))
+	}
+	if err := resp.Err(); err != nil {
+		var perr *protocol.Error
+		errors.As(err, &perr)
+		return nil, enclaveFailure(perr)
+	}
+	return resp.Result.Bytes(), nil
+}
+
+// chunk sends the next chunk and returns the enclave's result for it.
+func (s *enclaveStream) chunk(op string, data []byte, final bool) ([]byte, error) {
+	return s.roundTrip(&protocol.Request{
+		Operation: op,
+		KeyId:     keyID,
+		Stream:    &protocol.Stream{Final: final},
+		Payload:   payload.New(data),
+	})
+}
+
+func (s *enclaveStream) Close() error {
+	s.cancel()
+	return nil
+}
+
+// streamEncrypt encrypts everything read from in through one StreamEncrypt
+// connection and writes the stream to out: the header, then the encrypted
+// chunks, each as a pkg/framing frame. Only one chunk is held in memory at
+// a time.
+func streamEncrypt(in io.Reader, out io.Writer) (streamStats, error) {
+	var stats streamStats
+	req := newRequest(protocol.OpStreamEncrypt, payload.Payload{})
+	req.Stream = &protocol.Stream{ChunkSize: chunkSize}
+	stats.requestID = req.RequestId
+	s, header, err := openEnclaveStream(req)
+	if err != nil {
+		return stats, err
+	}
+	defer s.Close()
+
+	w := bufio.NewWriter(out)
+	if err := framing.WriteFrame(w, header); err != nil {
+		return stats, fmt.Errorf("failed to write output: %v", err)
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		// A short read is the end of the input, and makes the final chunk;
+		// input that fills its last chunk exactly ends with an empty one
+		n, err := io.ReadFull(in, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return stats, fmt.Errorf("failed to read input: %v", err)
+		}
+		sealed, err := s.chunk(protocol.OpStreamEncrypt, buf[:n], final)
+		if err != nil {
+			return stats, err
+		}
+		if err := framing.WriteFrame(w, sealed); err != nil {
+			return stats, fmt.Errorf("failed to write output: %v", err)
+		}
+		stats.chunks++
+		stats.inBytes += n
+		stats.outBytes += len(sealed)
+		slog.Debug("Chunk encrypted", "chunk", stats.chunks, "bytes", n)
+		if final {
+			return stats, w.Flush()
+		}
+	}
+}
+
+// streamDecrypt reads a stream written by streamEncrypt from in, decrypts
+// it through one StreamDecrypt connection and writes the plaintext to out.
+// It reads one frame ahead, so it can tell the enclave which chunk is the
+// last; a stream cut off at a chunk boundary then fails to decrypt.
+// Plaintext is written as chunks are decrypted, so output from a stream
+// that turns out damaged or cut off further on must be discarded.
+func streamDecrypt(in io.Reader, out io.Writer) (streamStats, error) {
+	var stats streamStats
+	r := bufio.NewReader(in)
+	header, err := framing.ReadFrame(r)
+	if err == io.EOF {
+		return stats, usageFailure(fmt.Errorf("the input is empty; it needs a stream from --stream encrypt"))
+	}
+	if err != nil {
+		return stats, usageFailure(fmt.Errorf("the input isn't a stream from --stream encrypt: %v", err))
+	}
+	req := newRequest(protocol.OpStreamDecrypt, payload.New(header))
+	stats.requestID = req.RequestId
+	s, _, err := openEnclaveStream(req)
+	if err != nil {
+		return stats, err
+	}
+	defer s.Close()
+
+	w := bufio.NewWriter(out)
+	next, err := framing.ReadFrame(r)
+	if err == io.EOF {
+		return stats, usageFailure(fmt.Errorf("the stream has a header but no chunks"))
+	}
+	for err == nil {
+		sealed := next
+		next, err = framing.ReadFrame(r)
+		final := err == io.EOF
+		if err != nil && !final {
+			return stats, fmt.Errorf("failed to read chunk %d: %v", stats.chunks+1, err)
+		}
+		plaintext, cerr := s.chunk(protocol.OpStreamDecrypt, sealed, final)
+		if cerr != nil {
+			return stats, cerr
+		}
+		if _, werr := w.Write(plaintext); werr != nil {
+			return stats, fmt.Errorf("failed to write output: %v", werr)
+		}
+		stats.chunks++
+		stats.inBytes += len(sealed)
+		stats.outBytes += len(plaintext)
+		slog.Debug("Chunk decrypted", "chunk", stats.chunks, "bytes", len(plaintext))
+	}
+	return stats, w.Flush()
+}
+
+// runStreamCommand performs encrypt or decrypt with --stream, from stdin
+// (or the argument) to stdout.
+func runStreamCommand(cmd string, in io.Reader, jsonOutput bool, tr *transcript) int {
+	encrypt := cmd == "encrypt"
+	startTime := time.Now()
+	var (
+		stats streamStats
+		err   error
+	)
+	if encrypt {
+		stats, err = streamEncrypt(in, os.Stdout)
+	} else {
+		stats, err = streamDecrypt(in, os.Stdout)
+	}
+	recordStream(tr, encrypt, startTime, stats, err)
+
+	if err != nil {
+		slog.Warn("Stream stopped", "chunks_done", stats.chunks)
+		return reportFailure(err, jsonOutput)
+	}
+	slog.Info("Stream done", "chunks", stats.chunks, "input_bytes", stats.inBytes, "output_bytes", stats.outBytes, "duration", time.Since(startTime))
+	return exitOK
+}
+
+// recordStream adds a streamed run to the transcript.
+func recordStream(tr *transcript, encrypt bool, startTime time.Time, stats streamStats, err error) {
+	rec := transcriptRecord{
+		Timestamp:       startTime,
+		RequestID:       stats.requestID,
+		KeyID:           keyID,
+		Operation:       protocol.OpStreamDecrypt,
+		PlaintextBytes:  stats.outBytes,
+		CiphertextBytes: stats.inBytes,
+		DurationMs:      float64(time.Since(startTime).Microseconds()) / 1000,
+		Status:          statusOf(err),
+		Error:           errorString(err),
+	}
+	if encrypt {
+		rec.Operation = protocol.OpStreamEncrypt
+		rec.PlaintextBytes, rec.CiphertextBytes = stats.inBytes, stats.outBytes
+	}
+	tr.Record(rec)
+}
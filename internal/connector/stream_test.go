@@ -0,0 +1,139 @@
+package connector
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/framing"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// fakeStreamEnclave serves StreamEncrypt and StreamDecrypt as the enclave
+// does, with a fixed data key.
+func fakeStreamEnclave(t *testing.T) {
+	t.Helper()
+	mem := useMemory(t)
+	l, err := mem.Listen(*enclaveCID, *enclavePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	key := bytes.Repeat([]byte{7}, 32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				first, err := protocol.ReadRequest(conn)
+				if err != nil {
+					return
+				}
+				var s *envelope.Stream
+				var result []byte
+				if first.Operation == protocol.OpStreamEncrypt {
+					s, err = envelope.NewStream(rand.Reader, key, "wrapped", "alias/dev-key", first.Stream.ChunkSize)
+					result, _ = s.Header().Marshal()
+				} else {
+					var h *envelope.StreamHeader
+					if h, err = envelope.ParseStreamHeader(first.Payload.Bytes()); err == nil {
+						s, err = envelope.OpenStream(h, key)
+					}
+				}
+				if err != nil {
+					protocol.WriteResponse(conn, protocol.Failed(first, protocol.Errorf(protocol.CodeBadRequest, "%v", err)))
+					return
+				}
+				protocol.WriteResponse(conn, protocol.OK(first, result))
+				for {
+					req, err := protocol.ReadRequest(conn)
+					if err != nil {
+						return
+					}
+					if first.Operation == protocol.OpStreamEncrypt {
+						result, err = s.Seal(req.Payload.Bytes(), req.Stream.Final)
+					} else {
+						result, err = s.Open(req.Payload.Bytes(), req.Stream.Final)
+					}
+					if err != nil {
+						protocol.WriteResponse(conn, protocol.Failed(req, protocol.Errorf(protocol.CodeBadRequest, "%v", err)))
+						return
+					}
+					protocol.WriteResponse(conn, protocol.OK(req, result))
+				}
+			}()
+		}
+	}()
+}
+
+func withChunkSize(t *testing.T, n int) {
+	old := chunkSize
+	t.Cleanup(func() { chunkSize = old })
+	chunkSize = n
+}
+
+func TestStream(t *testing.T) {
+	fakeStreamEnclave(t)
+	withChunkSize(t, 64)
+
+	for _, size := range []int{0, 63, 64, 1000} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		var sealed bytes.Buffer
+		stats, err := streamEncrypt(bytes.NewReader(data), &sealed)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if want := size/64 + 1; stats.chunks != want || stats.inBytes != size {
+			t.Fatalf("%d bytes: %+v, want %d chunks", size, stats, want)
+		}
+
+		var plain bytes.Buffer
+		if _, err := streamDecrypt(bytes.NewReader(sealed.Bytes()), &plain); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(plain.Bytes(), data) {
+			t.Fatalf("%d bytes: round trip changed the data", size)
+		}
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	fakeStreamEnclave(t)
+	withChunkSize(t, 64)
+
+	var sealed bytes.Buffer
+	if _, err := streamEncrypt(bytes.NewReader(make([]byte, 200)), &sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the last frame: the stream now ends at a chunk boundary
+	var frames [][]byte
+	r := bytes.NewReader(sealed.Bytes())
+	for {
+		f, err := framing.ReadFrame(r)
+		if err != nil {
+			break
+		}
+		frames = append(frames, f)
+	}
+	var cut bytes.Buffer
+	for _, f := range frames[:len(frames)-1] {
+		framing.WriteFrame(&cut, f)
+	}
+	_, err := streamDecrypt(&cut, &bytes.Buffer{})
+	var perr *protocol.Error
+	if !errors.As(err, &perr) || perr.Code != protocol.CodeBadRequest || exitCode(err) != exitProtocol {
+		t.Fatalf("truncated stream: %v", err)
+	}
+
+	if _, err := streamDecrypt(bytes.NewReader([]byte("not a stream")), &bytes.Buffer{}); exitCode(err) != exitUsage {
+		t.Fatalf("garbage input: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+// connector/transcript.go
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// transcriptRecord describes one connector operation. It deliberately has
+// no field for plaintext: only sizes and results are recorded.
+//
+// RequestID is the ID sent to the enclave. An operation made of several
+// requests, such as a CSV stream sent in batches, lists them all in
+// RequestIDs, and RequestID is the first. SQSMessageID is the input message
+// of a queue consumer mode record.
+type transcriptRecord struct {
+	Timestamp       time.Time `json:"timestamp"`
+	RequestID       string    `json:"request_id"`
+	RequestIDs      []string  `json:"request_ids,omitempty"`
+	SQSMessageID    string    `json:"sqs_message_id,omitempty"`
+	Operation       string    `json:"operation"`
+	KeyID           string    `json:"key_id,omitempty"`
+	PlaintextBytes  int       `json:"plaintext_bytes"`
+	CiphertextBytes int       `json:"ciphertext_bytes"`
+	Ciphertext      string    `json:"ciphertext,omitempty"`
+	DurationMs      float64   `json:"duration_ms"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// transcript appends records to a JSON Lines file. A nil *transcript
+// discards records, so callers don't need to check whether one is enabled.
+type transcript struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func openTranscript(path string) (*transcript, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	return &transcript{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record appends rec to the transcript.
+func (t *transcript) Record(rec transcriptRecord) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.enc.Encode(rec); err != nil {
+		slog.Warn("Failed to write transcript record", "err", err)
+	}
+}
+
+func (t *transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.file.Close()
+}
+
+// transcriptCiphertext returns the ciphertext of op for a record, or ""
+// when the result is a whole document: field and column operations encrypt
+// only the selected values, and the rest of the document is plaintext, so
+// their records keep only the sizes.
+func transcriptCiphertext(op, ciphertext string) string {
+	switch op {
+	case protocol.OpEncryptFields, protocol.OpDecryptFields,
+		protocol.OpEncryptColumns, protocol.OpDecryptColumns:
+		return ""
+	}
+	return ciphertext
+}
+
+func statusOf(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func errorString(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,210 @@
+package connector
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// withTranscript opens a transcript in a temporary directory and returns
+// it with a function that closes it and reads back its records.
+func withTranscript(t *testing.T) (*transcript, func() []transcriptRecord) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	tr, err := openTranscript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, func() []transcriptRecord {
+		t.Helper()
+		tr.Close()
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var recs []transcriptRecord
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var rec transcriptRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				t.Fatalf("bad transcript line %q: %v", sc.Text(), err)
+			}
+			recs = append(recs, rec)
+		}
+		return recs
+	}
+}
+
+// recordingEnclave is a fakeEnclave that echoes each payload and returns
+// the IDs of the requests it received.
+func recordingEnclave(t *testing.T) func() []string {
+	var (
+		mu  sync.Mutex
+		ids []string
+	)
+	fakeEnclave(t, func(req *protocol.Request) *protocol.Response {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, req.RequestId)
+		return protocol.OK(req, req.Payload.Bytes())
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(ids)
+	}
+}
+
+func withKeyID(t *testing.T, id string) {
+	old := keyID
+	t.Cleanup(func() { keyID = old })
+	keyID = id
+}
+
+func TestTranscriptRequestAndKeyID(t *testing.T) {
+	received := recordingEnclave(t)
+	tr, records := withTranscript(t)
+	withKeyID(t, "alias/test-key")
+
+	if code := runCommand([]string{"encrypt", "hello"}, false, tr); code != exitOK {
+		t.Fatalf("encrypt exited %d", code)
+	}
+	if code := runCommand([]string{"sign", "hello"}, false, tr); code != exitOK {
+		t.Fatalf("sign exited %d", code)
+	}
+
+	ids, recs := received(), records()
+	if len(ids) != 2 || len(recs) != 2 {
+		t.Fatalf("enclave got %d requests, transcript has %d records", len(ids), len(recs))
+	}
+	for i, rec := range recs {
+		if rec.RequestID == "" || rec.RequestID != ids[i] {
+			t.Errorf("record %d has request_id %q, the enclave got %q", i, rec.RequestID, ids[i])
+		}
+		if rec.KeyID != "alias/test-key" {
+			t.Errorf("record %d has key_id %q", i, rec.KeyID)
+		}
+	}
+}
+
+func TestTranscriptCSVRequestIDs(t *testing.T) {
+	received := recordingEnclave(t)
+	tr, records := withTranscript(t)
+	withKeyID(t, "alias/test-key")
+	oldColumns, oldBatchRows := columns, batchRows
+	t.Cleanup(func() { columns, batchRows = oldColumns, oldBatchRows })
+	columns, batchRows = columnList{"ssn"}, 1
+
+	in := strings.NewReader("name,ssn\nalice,123\nbob,456\n")
+	if code := runCSVCommand("encrypt", in, false, tr); code != exitOK {
+		t.Fatalf("CSV encrypt exited %d", code)
+	}
+
+	ids, recs := received(), records()
+	if len(ids) != 2 || len(recs) != 1 {
+		t.Fatalf("enclave got %d requests, transcript has %d records", len(ids), len(recs))
+	}
+	if recs[0].RequestID != ids[0] || !slices.Equal(recs[0].RequestIDs, ids) {
+		t.Errorf("record has request_id %q and request_ids %q, the enclave got %q", recs[0].RequestID, recs[0].RequestIDs, ids)
+	}
+	if recs[0].KeyID != "alias/test-key" {
+		t.Errorf("record has key_id %q", recs[0].KeyID)
+	}
+}
+
+// A verification records the key KMS used, which the proxy chooses when
+// --key-id is empty.
+func TestTranscriptVerifyKeyID(t *testing.T) {
+	fakeEnclave(t, func(req *protocol.Request) *protocol.Response {
+		result, _ := json.Marshal(protocol.Verification{KeyId: "alias/dev-sign-key", SigningAlgorithm: req.Signing.SigningAlgorithm})
+		return protocol.OK(req, result)
+	})
+	tr, records := withTranscript(t)
+	withKeyID(t, "")
+
+	if code := runCommand([]string{"verify", "c2ln", "hello"}, false, tr); code != exitOK {
+		t.Fatalf("verify exited %d", code)
+	}
+	recs := records()
+	if len(recs) != 1 || recs[0].KeyID != "alias/dev-sign-key" {
+		t.Fatalf("transcript has %+v", recs)
+	}
+}
+
+// EncryptFields returns the whole document with only the selected fields
+// encrypted, so its records must not keep the result.
+func TestTranscriptFieldsOmitDocument(t *testing.T) {
+	recordingEnclave(t)
+	tr, records := withTranscript(t)
+	oldFields := fields
+	t.Cleanup(func() { fields = oldFields })
+	if err := fields.Set("$.card"); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := `{"name":"Ada Lovelace","card":"4111 1111 1111 1111"}`
+	for _, cmd := range []string{"encrypt", "decrypt"} {
+		if code := runCommand([]string{cmd, doc}, false, tr); code != exitOK {
+			t.Fatalf("%s exited %d", cmd, code)
+		}
+	}
+
+	recs := records()
+	if len(recs) != 2 {
+		t.Fatalf("transcript has %d records", len(recs))
+	}
+	for _, rec := range recs {
+		if rec.Ciphertext != "" || rec.CiphertextBytes != len(doc) {
+			t.Errorf("%s record has ciphertext %q (%d bytes)", rec.Operation, rec.Ciphertext, rec.CiphertextBytes)
+		}
+		line, _ := json.Marshal(rec)
+		if strings.Contains(string(line), "Ada Lovelace") {
+			t.Errorf("%s record leaks an unselected field: %s", rec.Operation, line)
+		}
+	}
+}
+
+// A queue consumer mode record carries the enclave request ID, so it can
+// be matched with the enclave's logs, and the SQS message ID separately.
+func TestTranscriptSQS(t *testing.T) {
+	received := recordingEnclave(t)
+	tr, records := withTranscript(t)
+	withKeyID(t, "alias/test-key")
+	var (
+		mu      sync.Mutex
+		actions []string
+	)
+	sqs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		actions = append(actions, r.Header.Get("X-Amz-Target"))
+		mu.Unlock()
+		io.WriteString(w, `{"MessageId":"out-1"}`)
+	}))
+	defer sqs.Close()
+
+	msg := SQSMessage{MessageId: "sqs-msg-1", ReceiptHandle: "rh-1", Body: "hello"}
+	processSQSMessage(sqs.Client(), sqs.URL, "in", "out", msg, tr)
+
+	ids, recs := received(), records()
+	if len(ids) != 1 || len(recs) != 1 {
+		t.Fatalf("enclave got %d requests, transcript has %d records", len(ids), len(recs))
+	}
+	rec := recs[0]
+	if rec.RequestID != ids[0] || rec.SQSMessageID != "sqs-msg-1" || rec.KeyID != "alias/test-key" || rec.Status != "ok" {
+		t.Errorf("record %+v, the enclave got request %q", rec, ids[0])
+	}
+	if want := []string{"AmazonSQS.SendMessage", "AmazonSQS.DeleteMessage"}; !slices.Equal(actions, want) {
+		t.Errorf("SQS got %v, want %v", actions, want)
+	}
+}
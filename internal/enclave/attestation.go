@@ -0,0 +1,96 @@
+// enclave/attestation.go
+package enclave
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"nitro-dev-qemu/pkg/attestation"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// recipientKey is the enclave's ephemeral key for attested Decrypt, created
+// at startup and never persisted. It is nil when --attested-decrypt is off.
+var recipientKey *rsa.PrivateKey
+
+// moduleID identifies this enclave in its attestation evidence.
+var moduleID string
+
+// attestationFormat is the kind of evidence the enclave attests with (set
+// by --attestation-format).
+var attestationFormat attestation.Format
+
+// setupRecipientKey generates the ephemeral key pair whose public half goes
+// into every attestation document, in the format named formatName.
+func setupRecipientKey(formatName string) error {
+	if err := allowAlgorithm(attestation.KeyEncryptionAlgorithm); err != nil {
+		return err
+	}
+	format, err := attestation.Lookup(formatName)
+	if err != nil {
+		return err
+	}
+	attestationFormat = format
+	start := time.Now()
+	key, err := attestation.GenerateRecipientKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate recipient key: %v", err)
+	}
+	recipientKey = key
+	slog.Info("Generated recipient key for attested Decrypt", "bits", attestation.RecipientKeyBits, "format", format.Name(), "duration", time.Since(start))
+	return nil
+}
+
+// decryptThroughProxy forwards a Decrypt request to the vsock-proxy. With
+// attested Decrypt enabled, the request carries an attestation document
+// with the recipient key, the proxy returns CiphertextForRecipient instead
+// of the plaintext, and only this enclave can open it.
+func decryptThroughProxy(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+	if recipientKey == nil {
+		return forwardToVsockProxy(ctx, logger, req)
+	}
+	// The trace records the opened plaintext, not the CiphertextForRecipient,
+	// which a replay without this ephemeral key couldn't open
+	return traceCall(ctx, "vsock-proxy", req, func() ([]byte, error) {
+		return attestedDecrypt(ctx, logger, req)
+	})
+}
+
+// attestedClaims is what the enclave attests to, binding pub: its boot
+// measurement.
+func attestedClaims(pub *rsa.PublicKey) *attestation.Claims {
+	return &attestation.Claims{
+		ModuleID:         moduleID,
+		ExecutableSHA384: measurement.ExecutableSHA384,
+		ConfigSHA384:     measurement.ConfigSHA384,
+		PCRs:             measurement.PCRs,
+		PublicKey:        pub,
+	}
+}
+
+func attestedDecrypt(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+
+	docBytes, err := attestationFormat.Generate(attestedClaims(&recipientKey.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s attestation: %v", attestationFormat.Name(), err)
+	}
+	attested := *req
+	attested.Recipient = &protocol.Recipient{
+		KeyEncryptionAlgorithm: attestation.KeyEncryptionAlgorithm,
+		AttestationDocument:    docBytes,
+	}
+
+	sealed, err := sendToVsockProxy(ctx, logger, &attested)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := attestation.OpenForRecipient(recipientKey, sealed)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeUpstream, "failed to open CiphertextForRecipient: %v", err)
+	}
+	logger.Debug("Opened CiphertextForRecipient", "bytes", len(plaintext))
+	return plaintext, nil
+}
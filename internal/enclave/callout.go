@@ -0,0 +1,107 @@
+// enclave/callout.go
+package enclave
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/callout"
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// callouts hands a workload's own operations to its gRPC service inside
+// the enclave (set by --callout and --callout-ops), so teams can attach
+// business logic, such as scoring or redacting data before it is
+// encrypted, without changing this code. The built-in operations can't be
+// handed over: their checks and key handling stay in the enclave.
+var callouts = &calloutRoutes{ops: operationSet{}}
+
+type calloutRoutes struct {
+	target string
+	ops    operationSet
+	client *callout.Client
+}
+
+// operationSet is a comma-separated list of operation names. It
+// implements flag.Value; repeated flags add to it.
+type operationSet map[string]bool
+
+func (s operationSet) Set(value string) error {
+	for _, op := range strings.Split(value, ",") {
+		if op = strings.TrimSpace(op); op != "" {
+			s[op] = true
+		}
+	}
+	return nil
+}
+
+func (s operationSet) String() string {
+	ops := make([]string, 0, len(s))
+	for op := range s {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return strings.Join(ops, ",")
+}
+
+// setup checks the flags and creates the client. The service needn't be
+// up yet: it is dialed on the first call.
+func (c *calloutRoutes) setup() error {
+	switch {
+	case c.target == "" && len(c.ops) == 0:
+		return nil
+	case c.target == "":
+		return fmt.Errorf("--callout-ops %s needs --callout to name the service", c.ops)
+	case len(c.ops) == 0:
+		return fmt.Errorf("--callout needs --callout-ops to name the operations to forward")
+	}
+	for op := range c.ops {
+		if protocol.IsBuiltin(op) {
+			return fmt.Errorf("%s is a built-in operation and can't be forwarded", op)
+		}
+	}
+	client, err := callout.New(c.target)
+	if err != nil {
+		return err
+	}
+	c.client = client
+	slog.Info("Forwarding workload operations to the callout service", "target", c.target, "operations", c.ops.String())
+	return nil
+}
+
+// handles reports whether op goes to the callout service.
+func (c *calloutRoutes) handles(op string) bool {
+	return c.client != nil && c.ops[op]
+}
+
+// invoke hands req to the callout service and returns its result. A gRPC
+// status from the service reaches the connector as the matching error
+// code (see protocol.FromGRPC); a service that can't be reached is a
+// retryable upstream_error.
+func (c *calloutRoutes) invoke(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+	logger.Debug("Forwarding to the callout service", "operation", req.Operation, logging.Payload("payload", req.Payload.Bytes()))
+	start := time.Now()
+	resp, err := c.client.Invoke(ctx, &callout.Request{
+		Operation: req.Operation,
+		RequestId: req.RequestId,
+		KeyId:     req.KeyId,
+		Payload:   req.Payload.Bytes(),
+	})
+	addStage(ctx, "callout", time.Since(start))
+	var st *callout.Status
+	switch {
+	case errors.As(err, &st):
+		logger.Warn("Callout service failed the request", "operation", req.Operation, "grpc_code", st.Code)
+		return nil, protocol.FromGRPC(st.Code, fmt.Sprintf("callout service: %s", st.Message))
+	case err != nil:
+		return nil, protocol.Errorf(protocol.CodeUpstream, "callout service request failed: %v", err)
+	}
+	logger.Debug("Received result from the callout service", "operation", req.Operation, logging.Payload("result", resp.Result))
+	return resp.Result, nil
+}
@@ -0,0 +1,94 @@
+package enclave
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/callout"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// withCallout runs a callout service answering Score with the payload
+// upper-cased and Deny with PermissionDenied, and forwards ops to it.
+func withCallout(t *testing.T, ops string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "workload.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go callout.Serve(l, func(ctx context.Context, req *callout.Request) (*callout.Response, error) {
+		if req.Operation == "Deny" {
+			return nil, &callout.Status{Code: protocol.GRPCPermissionDenied, Message: "not on the list"}
+		}
+		return &callout.Response{Result: []byte(strings.ToUpper(string(req.Payload)) + " for " + req.RequestId)}, nil
+	})
+
+	old := callouts
+	t.Cleanup(func() { callouts = old })
+	callouts = &calloutRoutes{target: "unix://" + path, ops: operationSet{}}
+	callouts.ops.Set(ops)
+	if err := callouts.setup(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallout(t *testing.T) {
+	seen := fakeProxy(t)
+	withCallout(t, "Score, Deny")
+
+	resp := call(t, &protocol.Request{RequestId: "r1", Operation: "Score", Payload: payload.FromString("hello")})
+	if err := resp.Err(); err != nil || resp.Result.Reveal() != "HELLO for r1" {
+		t.Fatalf("Score = %q, %v", resp.Result.Reveal(), err)
+	}
+	if _, ok := resp.Timing.StagesMs["callout"]; !ok {
+		t.Fatalf("timing has no callout stage: %+v", resp.Timing)
+	}
+
+	resp = call(t, &protocol.Request{RequestId: "r2", Operation: "Deny"})
+	if resp.Error == nil || resp.Error.Code != protocol.CodePolicyDenied || resp.Error.Details["grpc_code"] != "7" {
+		t.Fatalf("Deny: %+v", resp.Error)
+	}
+
+	// Operations that aren't listed are still unsupported
+	resp = call(t, &protocol.Request{RequestId: "r3", Operation: "Frobnicate"})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeUnsupportedOperation {
+		t.Fatalf("Frobnicate: %+v", resp.Error)
+	}
+	if len(seen) != 0 {
+		t.Fatalf("vsock-proxy got %d requests", len(seen))
+	}
+}
+
+func TestCalloutUnreachable(t *testing.T) {
+	fakeProxy(t)
+	old := callouts
+	t.Cleanup(func() { callouts = old })
+	callouts = &calloutRoutes{target: "unix://" + filepath.Join(t.TempDir(), "missing.sock"), ops: operationSet{"Score": true}}
+	if err := callouts.setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := call(t, &protocol.Request{RequestId: "r1", Operation: "Score"})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeUpstream || !resp.Error.Retryable {
+		t.Fatalf("got %+v", resp.Error)
+	}
+}
+
+func TestCalloutSetup(t *testing.T) {
+	for _, c := range []*calloutRoutes{
+		{target: "unix:///run/workload.sock", ops: operationSet{}},
+		{ops: operationSet{"Score": true}},
+		{target: "unix:///run/workload.sock", ops: operationSet{protocol.OpDecrypt: true}},
+		{target: "10.0.0.5:50051", ops: operationSet{"Score": true}},
+	} {
+		if err := c.setup(); err == nil {
+			t.Errorf("--callout %q --callout-ops %q accepted", c.target, c.ops)
+		}
+	}
+}
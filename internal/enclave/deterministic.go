@@ -0,0 +1,233 @@
+// enclave/deterministic.go
+package enclave
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/ff3"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/siv"
+	"nitro-dev-qemu/pkg/transform"
+)
+
+// deterministicKeys are the KMS keys set aside for deterministic
+// encryption, by key ID or alias (set by --deterministic-key). The siv
+// stage encrypts with them so that equal values give equal tokens, which
+// downstream systems can join on. That also reveals which values repeat
+// and how often, so it is opt-in per key, and the keys are kept apart:
+// a deterministic key can't be used for ordinary encryption, and the siv
+// stage can't be used with any other key.
+var deterministicKeys = deterministicKeySet{}
+
+// deterministicPipeline is used with a deterministic key when the request
+// doesn't name a pipeline.
+const deterministicPipeline = "siv,base64"
+
+// deterministicKey is an AES-SIV key, stored wrapped by its KMS key and
+// unwrapped through the vsock-proxy on first use. The FF3-1 key for
+// format-preserving encryption is derived from it (see fpeKey).
+type deterministicKey struct {
+	wrapped string
+
+	mu     sync.Mutex
+	cipher *siv.SIV
+	fpe    *ff3.Cipher
+}
+
+type deterministicKeySet map[string]*deterministicKey
+
+// Set adds a key=CiphertextBlob entry, where the blob is a 64-byte data
+// key wrapped by that KMS key, from
+//
+//	aws kms generate-data-key-without-plaintext --key-id alias/dev-token-key --number-of-bytes 64
+//
+// It implements flag.Value; repeat the flag for more keys.
+func (s *deterministicKeySet) Set(value string) error {
+	key, blob, ok := strings.Cut(value, "=")
+	key, blob = strings.TrimSpace(key), strings.TrimSpace(blob)
+	if !ok || key == "" || blob == "" {
+		return fmt.Errorf("%q is not KEY=CiphertextBlob", value)
+	}
+	if key == "*" {
+		return fmt.Errorf("deterministic keys must be named one by one")
+	}
+	(*s)[key] = &deterministicKey{wrapped: blob}
+	return nil
+}
+
+func (s *deterministicKeySet) String() string {
+	if s == nil {
+		return ""
+	}
+	keys := make([]string, 0, len(*s))
+	for k := range *s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func (s deterministicKeySet) has(keyID string) bool {
+	_, ok := s[keyID]
+	return ok
+}
+
+// warn logs what deterministic encryption gives away, once per key at
+// startup.
+func (s deterministicKeySet) warn() {
+	for _, keyID := range strings.Split(s.String(), ",") {
+		if keyID != "" {
+			slog.Warn("Deterministic encryption enabled: equal values encrypt to equal tokens, revealing which values repeat and how often. Use it only for fields that must be joined on", "key_id", keyID)
+		}
+	}
+}
+
+// checkOperation refuses deterministic keys outside pipeline operations,
+// so they never end up doing ordinary KMS or envelope encryption.
+func (s deterministicKeySet) checkOperation(logger *slog.Logger, req *protocol.Request) error {
+	if !s.has(req.KeyId) {
+		return nil
+	}
+	switch req.Operation {
+	case protocol.OpTransform, protocol.OpReverseTransform,
+		protocol.OpEncryptFields, protocol.OpDecryptFields,
+		protocol.OpEncryptColumns, protocol.OpDecryptColumns,
+		protocol.OpFPEEncrypt, protocol.OpFPEDecrypt:
+		return nil
+	}
+	logger.Warn("Refused deterministic key for a randomized operation", "key_id", req.KeyId, "operation", req.Operation)
+	return deterministicDenied(fmt.Sprintf("%s is a deterministic key; it can only be used through the siv or fpe stage or FPE operations, not %s", req.KeyId, req.Operation), req.KeyId)
+}
+
+// checkPipeline refuses pipelines that mix up deterministic and ordinary
+// keys: a deterministic key must run siv or fpe and no randomized
+// encryption stage, and siv and fpe need a deterministic key.
+func (s deterministicKeySet) checkPipeline(keyID string, p transform.Pipeline) error {
+	var hasDeterministic, hasRandomized bool
+	for _, stage := range p {
+		switch stage.Name() {
+		case "siv", "fpe":
+			hasDeterministic = true
+		case "envelope", "kms":
+			hasRandomized = true
+		}
+	}
+	switch {
+	case s.has(keyID) && (!hasDeterministic || hasRandomized):
+		return deterministicDenied(fmt.Sprintf("%s is a deterministic key; use a pipeline with the siv or fpe stage and no envelope or kms stage, such as %s (got %s)", keyID, deterministicPipeline, p), keyID)
+	case !s.has(keyID) && hasDeterministic:
+		name := keyID
+		if name == "" {
+			name = "the default key"
+		}
+		return deterministicDenied(fmt.Sprintf("the siv and fpe stages need a key set up with --deterministic-key; %s isn't one", name), keyID)
+	}
+	return nil
+}
+
+func deterministicDenied(msg, keyID string) error {
+	return protocol.Errorf(protocol.CodePolicyDenied, "%s", msg).
+		WithDetail("rule", "deterministic-key").
+		WithDetail("key_id", keyID)
+}
+
+// unwrap returns keyID's deterministic key, unwrapping it through KMS
+// Decrypt the first time. A failed unwrap is retried on the next request.
+func (s deterministicKeySet) unwrap(ctx context.Context, logger *slog.Logger, keyID, requestID string) (*deterministicKey, error) {
+	k, ok := s[keyID]
+	if !ok {
+		name := keyID
+		if name == "" {
+			name = "the default key"
+		}
+		return nil, deterministicDenied(fmt.Sprintf("%s isn't set up with --deterministic-key", name), keyID)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cipher != nil {
+		return k, nil
+	}
+
+	logger.Debug("Unwrapping deterministic key through vsock-proxy", "key_id", keyID)
+	key, err := decryptThroughProxy(ctx, logger, &protocol.Request{
+		Operation: protocol.OpDecrypt,
+		KeyId:     keyID,
+		RequestId: requestID,
+		Payload:   payload.FromString(k.wrapped),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping deterministic key for %s failed: %w", keyID, err)
+	}
+	// The AES key schedules keep their own copy
+	defer envelope.Zero(key)
+	c, err := siv.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("deterministic key for %s: %v", keyID, err)
+	}
+	f, err := ff3.New(fpeKey(key))
+	if err != nil {
+		return nil, fmt.Errorf("deterministic key for %s: %v", keyID, err)
+	}
+	k.cipher, k.fpe = c, f
+	logger.Info("Deterministic key ready", "key_id", keyID)
+	return k, nil
+}
+
+// cipherFor returns the AES-SIV cipher for keyID. AES-SIV isn't FIPS
+// approved, so under --fips it fails before the key is unwrapped.
+func (s deterministicKeySet) cipherFor(ctx context.Context, logger *slog.Logger, keyID, requestID string) (*siv.SIV, error) {
+	if err := allowAlgorithm("AES-SIV"); err != nil {
+		return nil, err
+	}
+	k, err := s.unwrap(ctx, logger, keyID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	return k.cipher, nil
+}
+
+// fpeFor returns the FF3-1 cipher for keyID.
+func (s deterministicKeySet) fpeFor(ctx context.Context, logger *slog.Logger, keyID, requestID string) (*ff3.Cipher, error) {
+	k, err := s.unwrap(ctx, logger, keyID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	return k.fpe, nil
+}
+
+// sivStage is the siv transformation stage: AES-SIV under the request's
+// deterministic key. Its output is binary, so follow it with base64 or
+// hex.
+func sivStage() transform.Stage {
+	return transform.Func{
+		StageName: "siv",
+		Fwd: func(ctx context.Context, data []byte) ([]byte, error) {
+			sr := stageRequestFrom(ctx)
+			c, err := deterministicKeys.cipherFor(ctx, sr.logger, sr.req.KeyId, sr.req.RequestId)
+			if err != nil {
+				return nil, err
+			}
+			return c.Seal(data), nil
+		},
+		Rev: func(ctx context.Context, data []byte) ([]byte, error) {
+			sr := stageRequestFrom(ctx)
+			c, err := deterministicKeys.cipherFor(ctx, sr.logger, sr.req.KeyId, sr.req.RequestId)
+			if err != nil {
+				return nil, err
+			}
+			plaintext, err := c.Open(data)
+			if errors.Is(err, siv.ErrOpen) {
+				return nil, protocol.Errorf(protocol.CodeBadRequest, "token failed authentication: it is damaged or was encrypted under a different key than %s", sr.req.KeyId)
+			}
+			return plaintext, err
+		},
+	}
+}
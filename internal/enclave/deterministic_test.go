@@ -0,0 +1,33 @@
+package enclave
+
+import (
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+func TestDeterministicRefusedUnderFIPS(t *testing.T) {
+	seen := fakeProxy(t)
+	withTokenKey(t)
+	registerTestStages()
+	t.Cleanup(func() { fipsMode = false })
+	fipsMode = true
+
+	for _, req := range []*protocol.Request{
+		{Operation: protocol.OpTransform, Pipeline: "siv,base64", Payload: payload.FromString("alice@example.com")},
+		{Operation: protocol.OpReverseTransform, Pipeline: "siv,base64", Payload: payload.FromString("AAAAAAAAAAAAAAAAAAAAAA==")},
+		{Operation: protocol.OpFPEEncrypt, Payload: payload.FromString("4111111111111111")},
+	} {
+		req.RequestId, req.KeyId = "r1", "alias/dev-token-key"
+		resp := call(t, req)
+		if resp.Error == nil || !strings.Contains(resp.Error.Message, "not FIPS approved") {
+			t.Errorf("%s %s under --fips: got %+v", req.Operation, req.Pipeline, resp.Error)
+		}
+	}
+	// Refused before the key was unwrapped through the vsock-proxy
+	if len(seen) != 0 {
+		t.Fatalf("vsock-proxy got %d requests", len(seen))
+	}
+}
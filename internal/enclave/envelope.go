@@ -0,0 +1,161 @@
+// enclave/envelope.go
+package enclave
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// envelopeEncrypt fetches a fresh data key through the vsock-proxy and
+// encrypts plaintext locally with it, so the plaintext never leaves the
+// enclave. The result is a JSON envelope carrying the KMS-encrypted data key.
+// The data key comes from keyID, or the vsock-proxy's default key if empty.
+func envelopeEncrypt(ctx context.Context, logger *slog.Logger, requestID, keyID string, plaintext payload.Payload) ([]byte, error) {
+	if err := allowAlgorithm(envelope.AlgorithmAES256GCM); err != nil {
+		return nil, err
+	}
+
+	cache := dataKeysFrom(ctx)
+	dataKey, ok := cache.generated(keyID)
+	if !ok {
+		logger.Debug("Requesting data key from vsock-proxy")
+		reply, err := forwardToVsockProxy(ctx, logger, &protocol.Request{Operation: protocol.OpGenerateDataKey, KeyId: keyID, RequestId: requestID})
+		if err != nil {
+			return nil, fmt.Errorf("GenerateDataKey failed: %w", err)
+		}
+		if err := json.Unmarshal(reply, &dataKey); err != nil {
+			return nil, fmt.Errorf("failed to parse data key: %v", err)
+		}
+		logger.Debug("Received data key", "key_id", dataKey.KeyId)
+		if cache == nil {
+			defer envelope.Zero(dataKey.Plaintext.Bytes())
+		} else {
+			cache.keepGenerated(keyID, dataKey)
+		}
+	}
+
+	env, err := envelope.Seal(enclaveRand, dataKey.Plaintext.Bytes(), plaintext.Bytes(), dataKey.CiphertextBlob, dataKey.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Encrypted locally", "bytes", plaintext.Len(), "algorithm", env.Algorithm)
+
+	return env.Marshal()
+}
+
+// envelopeDecrypt unwraps the envelope's data key through KMS Decrypt and
+// decrypts the ciphertext locally.
+func envelopeDecrypt(ctx context.Context, logger *slog.Logger, requestID string, data payload.Payload) (payload.Payload, error) {
+	env, err := envelope.Parse(data.Bytes())
+	if err != nil {
+		return payload.Payload{}, protocol.Errorf(protocol.CodeBadRequest, "%v", err)
+	}
+	if err := allowAlgorithm(env.Algorithm); err != nil {
+		return payload.Payload{}, err
+	}
+
+	cache := dataKeysFrom(ctx)
+	dataKey, ok := cache.unwrapped(env.EncryptedDataKey)
+	if !ok {
+		logger.Debug("Unwrapping data key through vsock-proxy", "algorithm", env.Algorithm)
+		dataKey, err = decryptThroughProxy(ctx, logger, &protocol.Request{
+			Operation: protocol.OpDecrypt,
+			RequestId: requestID,
+			Payload:   payload.FromString(env.EncryptedDataKey),
+		})
+		if err != nil {
+			return payload.Payload{}, fmt.Errorf("data key Decrypt failed: %w", err)
+		}
+		if cache == nil {
+			defer envelope.Zero(dataKey)
+		} else {
+			cache.keepUnwrapped(env.EncryptedDataKey, dataKey)
+		}
+	}
+
+	plaintext, err := env.Open(dataKey)
+	if err != nil {
+		return payload.Payload{}, err
+	}
+	logger.Debug("Decrypted locally", "bytes", len(plaintext))
+	return payload.New(plaintext), nil
+}
+
+// dataKeyCache lets the envelopes of one request share data keys. A
+// request that encrypts many values, such as EncryptFields over an array,
+// then makes one GenerateDataKey call per key instead of one per value,
+// and decrypting them makes one Decrypt call per distinct data key. The
+// cache lives only as long as the request; every envelope still carries
+// its own copy of the encrypted data key, so each decrypts on its own.
+type dataKeyCache struct {
+	mu        sync.Mutex
+	keys      map[string]protocol.DataKey // by requested key ID
+	plaintext map[string][]byte           // by encrypted data key
+}
+
+type dataKeyCacheKey struct{}
+
+// withDataKeyCache returns a ctx whose envelope operations share data
+// keys, and a function that zeroes them once the request is done.
+func withDataKeyCache(ctx context.Context) (context.Context, func()) {
+	c := &dataKeyCache{keys: map[string]protocol.DataKey{}, plaintext: map[string][]byte{}}
+	return context.WithValue(ctx, dataKeyCacheKey{}, c), c.zero
+}
+
+// dataKeysFrom returns ctx's cache, or nil; the methods treat a nil cache
+// as always empty.
+func dataKeysFrom(ctx context.Context) *dataKeyCache {
+	c, _ := ctx.Value(dataKeyCacheKey{}).(*dataKeyCache)
+	return c
+}
+
+func (c *dataKeyCache) generated(keyID string) (protocol.DataKey, bool) {
+	if c == nil {
+		return protocol.DataKey{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, ok := c.keys[keyID]
+	return k, ok
+}
+
+func (c *dataKeyCache) keepGenerated(keyID string, k protocol.DataKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[keyID] = k
+	// Envelopes sealed with this key can be opened without KMS, too
+	c.plaintext[k.CiphertextBlob] = k.Plaintext.Bytes()
+}
+
+func (c *dataKeyCache) unwrapped(encryptedKey string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, ok := c.plaintext[encryptedKey]
+	return k, ok
+}
+
+func (c *dataKeyCache) keepUnwrapped(encryptedKey string, key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.plaintext[encryptedKey] = key
+}
+
+func (c *dataKeyCache) zero() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range c.plaintext {
+		envelope.Zero(k)
+	}
+	clear(c.keys)
+	clear(c.plaintext)
+}
@@ -0,0 +1,212 @@
+// enclave/fields.go
+package enclave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"unicode/utf8"
+
+	"nitro-dev-qemu/pkg/jsonpath"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/transform"
+)
+
+// valueCrypter encrypts and decrypts the individual values of a
+// structured payload (JSON fields, CSV cells) through the request's
+// Transform pipeline. All values of a request share one data key (see
+// dataKeyCache), so a payload costs one KMS call however many values it
+// has.
+type valueCrypter struct {
+	ctx     context.Context
+	logger  *slog.Logger
+	req     *protocol.Request
+	p       transform.Pipeline
+	observe transform.Observer
+}
+
+// newValueCrypter returns a valueCrypter for req and a function that
+// zeroes its data keys once the request is done.
+func newValueCrypter(ctx context.Context, logger *slog.Logger, req *protocol.Request) (*valueCrypter, func(), error) {
+	ctx, zeroKeys := withDataKeyCache(ctx)
+	c, err := valueCrypterFor(ctx, logger, req)
+	if err != nil {
+		zeroKeys()
+		return nil, nil, err
+	}
+	return c, zeroKeys, nil
+}
+
+func valueCrypterFor(ctx context.Context, logger *slog.Logger, req *protocol.Request) (*valueCrypter, error) {
+	p, err := requestPipeline(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := deterministicKeys.checkPipeline(req.KeyId, p); err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, stageRequestKey{}, stageRequest{logger: logger, req: req})
+	return &valueCrypter{ctx: ctx, logger: logger, req: req, p: p, observe: stageObserver(ctx, logger)}, nil
+}
+
+// withKey returns a valueCrypter for a field that names its own key. A
+// deterministic key gets the siv,base64 pipeline; any other key uses the
+// request's pipeline.
+func (c *valueCrypter) withKey(keyID string) (*valueCrypter, error) {
+	if keyID == "" || keyID == c.req.KeyId {
+		return c, nil
+	}
+	req := *c.req
+	req.KeyId = keyID
+	if deterministicKeys.has(keyID) {
+		req.Pipeline = deterministicPipeline
+	}
+	return valueCrypterFor(c.ctx, c.logger, &req)
+}
+
+// encrypt runs plaintext through the pipeline, after checking the content
+// policy against checked (the value as the client sees it). The pipeline
+// must produce text, since the result is stored in a text field.
+func (c *valueCrypter) encrypt(plaintext, checked []byte) (string, error) {
+	if err := contentPolicies.check(c.logger, c.req.KeyId, checked); err != nil {
+		return "", err
+	}
+	out, err := c.p.Forward(c.ctx, plaintext, c.observe)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(out) {
+		return "", protocol.Errorf(protocol.CodeBadRequest, "pipeline %q produces binary output; end it with a text stage such as base64 to store it in a text field", c.p.String())
+	}
+	return string(out), nil
+}
+
+func (c *valueCrypter) decrypt(s string) ([]byte, error) {
+	return c.p.Reverse(c.ctx, []byte(s), c.observe)
+}
+
+// cryptFields performs EncryptFields and DecryptFields: the payload is a
+// JSON document, and only the values matched by req.Fields are encrypted
+// or decrypted, each on its own. The rest of the document passes through
+// untouched, so it stays queryable by systems that never see the
+// sensitive fields.
+//
+// An encrypted field holds the pipeline output as a JSON string. What is
+// encrypted is the value's JSON encoding, so numbers, objects and arrays
+// come back as they were. A field may name its own key, as in
+// "$.email@alias/dev-token-key"; with a deterministic key it is encrypted
+// with siv,base64, so equal values give equal tokens.
+func cryptFields(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+	encrypt := req.Operation == protocol.OpEncryptFields
+	if len(req.Fields) == 0 {
+		return nil, protocol.Errorf(protocol.CodeBadRequest, "%s needs at least one field", req.Operation)
+	}
+	c, zeroKeys, err := newValueCrypter(ctx, logger, req)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKeys()
+	paths := make([]*jsonpath.Path, len(req.Fields))
+	crypters := make([]*valueCrypter, len(req.Fields))
+	for i, entry := range req.Fields {
+		field, keyID := protocol.SplitFieldKey(entry)
+		p, err := jsonpath.Parse(field)
+		if err != nil {
+			return nil, protocol.Errorf(protocol.CodeBadRequest, "%v", err)
+		}
+		paths[i] = p
+		if crypters[i], err = c.withKey(keyID); err != nil {
+			return nil, err
+		}
+	}
+
+	doc, err := decodeJSON(req.Payload.Bytes())
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeBadRequest, "payload is not a JSON document: %v", err)
+	}
+
+	encryptValue := func(c *valueCrypter) func(v interface{}) (interface{}, error) {
+		return func(v interface{}) (interface{}, error) {
+			plaintext, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			// Check strings as they are, not quoted, so an already
+			// encrypted value is recognised
+			checked := plaintext
+			if s, ok := v.(string); ok {
+				checked = []byte(s)
+			}
+			return c.encrypt(plaintext, checked)
+		}
+	}
+	decryptValue := func(c *valueCrypter, path string) func(v interface{}) (interface{}, error) {
+		return func(v interface{}) (interface{}, error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, protocol.Errorf(protocol.CodeBadRequest, "field %s is not an encrypted string", path)
+			}
+			plaintext, err := c.decrypt(s)
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJSON(plaintext)
+			if err != nil {
+				return nil, protocol.Errorf(protocol.CodeBadRequest, "field %s did not decrypt to a JSON value: %v", path, err)
+			}
+			return value, nil
+		}
+	}
+
+	logger.Debug("Processing JSON fields", "fields", req.Fields, "pipeline", c.p.String(), "encrypt", encrypt)
+	total := 0
+	for i, path := range paths {
+		fn := encryptValue(crypters[i])
+		if !encrypt {
+			fn = decryptValue(crypters[i], path.String())
+		}
+		var n int
+		doc, n, err = path.Replace(doc, fn)
+		if err != nil {
+			var perr *protocol.Error
+			if errors.As(err, &perr) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("field %s: %w", path, err)
+		}
+		logger.Debug("Processed field", "field", path.String(), "matches", n)
+		total += n
+	}
+	logger.Debug("Processed JSON fields", "values", total)
+
+	return encodeJSON(doc)
+}
+
+// decodeJSON decodes a single JSON value, keeping numbers exact.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// encodeJSON encodes v compactly, without escaping <, > and &. Object
+// members come out in key order.
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,78 @@
+package enclave
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/attestation"
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+func withFIPS(t *testing.T) {
+	t.Cleanup(func() { fipsMode = false })
+	fipsMode = true
+}
+
+// withoutApproval takes alg off the approved list for the test.
+func withoutApproval(t *testing.T, alg string) {
+	old := fipsApprovedAlgorithms
+	t.Cleanup(func() { fipsApprovedAlgorithms = old })
+	fipsApprovedAlgorithms = maps.Clone(old)
+	delete(fipsApprovedAlgorithms, alg)
+}
+
+func TestAllowAlgorithm(t *testing.T) {
+	for _, alg := range []string{"AES-SIV", "FF3-1", "ChaCha20-Poly1305", ""} {
+		if err := allowAlgorithm(alg); err != nil {
+			t.Errorf("%q refused without --fips: %v", alg, err)
+		}
+	}
+	withFIPS(t)
+	for alg := range fipsApprovedAlgorithms {
+		if err := allowAlgorithm(alg); err != nil {
+			t.Errorf("approved %s refused: %v", alg, err)
+		}
+	}
+	for _, alg := range []string{"AES-SIV", "FF3-1", "ChaCha20-Poly1305", ""} {
+		if err := allowAlgorithm(alg); err == nil || !strings.Contains(err.Error(), "not FIPS approved") {
+			t.Errorf("%q under --fips: err = %v", alg, err)
+		}
+	}
+}
+
+// Every local crypto path asks allowAlgorithm first: with its algorithm
+// off the approved list, --fips refuses it.
+func TestFIPSGatesLocalCrypto(t *testing.T) {
+	withFIPS(t)
+	paths := []struct {
+		alg  string
+		name string
+		run  func() error
+	}{
+		{envelope.AlgorithmAES256GCM, "sealed traces", func() error {
+			_, err := newTraceAEAD(make([]byte, 32))
+			return err
+		}},
+		{attestation.KeyEncryptionAlgorithm, "recipient key", func() error {
+			return setupRecipientKey("nitro")
+		}},
+		{"HKDF-SHA-384", "peer channels", func() error {
+			p := &peerRoutes{target: "16:9003", ops: operationSet{}}
+			p.ops.Set("Encrypt")
+			return p.setup(vsock.HostCID, "nitro")
+		}},
+		{"HMAC_DRBG", "DRBG", func() error {
+			return setupEntropy(16, "unused", 0)
+		}},
+	}
+	for _, p := range paths {
+		t.Run(p.name, func(t *testing.T) {
+			withoutApproval(t, p.alg)
+			if err := p.run(); err == nil || !strings.Contains(err.Error(), p.alg+" is not FIPS approved") {
+				t.Fatalf("with %s not approved: err = %v", p.alg, err)
+			}
+		})
+	}
+}
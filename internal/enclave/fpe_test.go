@@ -0,0 +1,111 @@
+package enclave
+
+import (
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// withTokenKey sets up alias/dev-token-key as a deterministic key whose
+// wrapped data key the fake vsock-proxy unwraps.
+func withTokenKey(t *testing.T) {
+	old := deterministicKeys
+	t.Cleanup(func() { deterministicKeys = old })
+	deterministicKeys = deterministicKeySet{}
+	if err := deterministicKeys.Set("alias/dev-token-key=blob:" + strings.Repeat("k", 64)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFPE(t *testing.T) {
+	fakeProxy(t)
+	withTokenKey(t)
+
+	for _, in := range []string{"4111-1111-1111-1111", "078-05-1120", "123456"} {
+		resp := call(t, &protocol.Request{RequestId: "enc", Operation: protocol.OpFPEEncrypt, KeyId: "alias/dev-token-key", Payload: payload.FromString(in)})
+		if err := resp.Err(); err != nil {
+			t.Fatalf("%s: %v", in, err)
+		}
+		out := resp.Result.Reveal()
+		if len(out) != len(in) || out == in {
+			t.Fatalf("%s encrypted to %s", in, out)
+		}
+		for i := range in {
+			if isDigit, wasDigit := '0' <= out[i] && out[i] <= '9', '0' <= in[i] && in[i] <= '9'; isDigit != wasDigit || !wasDigit && out[i] != in[i] {
+				t.Fatalf("%s encrypted to %s: format not kept", in, out)
+			}
+		}
+
+		// Deterministic: the same input gives the same token
+		again := call(t, &protocol.Request{RequestId: "enc", Operation: protocol.OpFPEEncrypt, KeyId: "alias/dev-token-key", Payload: payload.FromString(in)})
+		if again.Result.Reveal() != out {
+			t.Fatalf("%s encrypted to %s, then %s", in, out, again.Result.Reveal())
+		}
+
+		resp = call(t, &protocol.Request{RequestId: "dec", Operation: protocol.OpFPEDecrypt, KeyId: "alias/dev-token-key", Payload: payload.FromString(out)})
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Result.Reveal() != in {
+			t.Fatalf("%s decrypted to %s, want %s", out, resp.Result.Reveal(), in)
+		}
+	}
+}
+
+func TestFPEValidation(t *testing.T) {
+	fakeProxy(t)
+	withTokenKey(t)
+
+	tests := []struct {
+		name string
+		req  *protocol.Request
+		code string
+	}{
+		{"too short", &protocol.Request{KeyId: "alias/dev-token-key", Payload: payload.FromString("12-345")}, protocol.CodeBadRequest},
+		{"letter in radix 10", &protocol.Request{KeyId: "alias/dev-token-key", Payload: payload.FromString("1234567x")}, protocol.CodeBadRequest},
+		{"radix 37", &protocol.Request{KeyId: "alias/dev-token-key", FPE: &protocol.FPE{Radix: 37}, Payload: payload.FromString("1234567")}, protocol.CodeBadRequest},
+		{"bad tweak", &protocol.Request{KeyId: "alias/dev-token-key", FPE: &protocol.FPE{Tweak: "abcd"}, Payload: payload.FromString("1234567")}, protocol.CodeBadRequest},
+		{"ordinary key", &protocol.Request{KeyId: "alias/dev-key", Payload: payload.FromString("1234567")}, protocol.CodePolicyDenied},
+		{"default key", &protocol.Request{Payload: payload.FromString("1234567")}, protocol.CodePolicyDenied},
+	}
+	for _, tt := range tests {
+		tt.req.RequestId, tt.req.Operation = "r1", protocol.OpFPEEncrypt
+		resp := call(t, tt.req)
+		if resp.Error == nil || resp.Error.Code != tt.code {
+			t.Errorf("%s: got %+v, want %s", tt.name, resp.Error, tt.code)
+		}
+	}
+
+	resp := call(t, &protocol.Request{RequestId: "r1", Operation: protocol.OpFPEEncrypt, KeyId: "alias/dev-token-key", Payload: payload.FromString("12345")})
+	if resp.Error == nil || resp.Error.Details["min_length"] != "6" || resp.Error.Details["max_length"] != "56" {
+		t.Fatalf("length limits not reported: %+v", resp.Error)
+	}
+}
+
+func TestFPEStage(t *testing.T) {
+	fakeProxy(t)
+	withTokenKey(t)
+	registerTestStages()
+
+	req := &protocol.Request{RequestId: "r1", Operation: protocol.OpEncryptColumns, KeyId: "alias/dev-token-key", Pipeline: "fpe", Columns: []string{"card"},
+		FPE: &protocol.FPE{Tweak: "00000000000001"}, Payload: payload.FromString("name,card\nalice,4111 1111 1111 1111\n")}
+	resp := call(t, req)
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(resp.Result.Reveal()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "alice,") || len(lines[1]) != len("alice,4111 1111 1111 1111") || lines[1] == "alice,4111 1111 1111 1111" {
+		t.Fatalf("got %q", resp.Result.Reveal())
+	}
+
+	req.Operation, req.Payload = protocol.OpDecryptColumns, resp.Result
+	resp = call(t, req)
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result.Reveal() != "name,card\nalice,4111 1111 1111 1111\n" {
+		t.Fatalf("got %q", resp.Result.Reveal())
+	}
+}
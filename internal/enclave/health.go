@@ -0,0 +1,45 @@
+// enclave/health.go
+package enclave
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync/atomic"
+
+	"nitro-dev-qemu/pkg/health"
+)
+
+// accepting is set while the accept loop takes connector connections:
+// from startup until a shutdown signal.
+var accepting atomic.Bool
+
+// serveHealth answers /healthz and /readyz over HTTP on a vsock port of
+// its own (set by --health-port), since the enclave has no network. With
+// --vsock-transport tcp it is a TCP port that docker-compose or
+// Kubernetes can probe directly. The enclave is ready once it accepts
+// connections and can reach the vsock-proxy. The listener stays open
+// during shutdown, so /readyz reports it.
+func serveHealth(cid, port uint32) (net.Listener, error) {
+	h := health.New(
+		health.Check{Name: "accepting", Run: func(ctx context.Context) error {
+			if !accepting.Load() {
+				return errors.New("not accepting connector connections")
+			}
+			return nil
+		}},
+		health.Check{Name: "vsock-proxy", Run: func(ctx context.Context) error {
+			return upstream.reachable(ctx)
+		}},
+	)
+	l, err := transport.Listen(cid, port)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		slog.Info("Serving health probes", "addr", l.Addr().String(), "paths", "/healthz,/readyz")
+		h.Serve(l)
+	}()
+	return l, nil
+}
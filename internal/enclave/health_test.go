@@ -0,0 +1,61 @@
+package enclave
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"nitro-dev-qemu/pkg/health"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// probe fetches /readyz from the health server on port.
+func probe(t *testing.T, port uint32) (int, *health.Report) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return transport.DialContext(ctx, 3, port)
+		},
+	}}
+	resp, err := client.Get("http://enclave/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r health.Report
+	json.NewDecoder(resp.Body).Decode(&r)
+	return resp.StatusCode, &r
+}
+
+func TestReadiness(t *testing.T) {
+	fakeProxy(t)
+	t.Cleanup(func() { accepting.Store(false) })
+
+	// Each server caches its report, so each state gets its own
+	serve := func(port uint32) {
+		l, err := serveHealth(3, port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+	}
+	serve(9002)
+	code, r := probe(t, 9002)
+	if code != http.StatusServiceUnavailable || r.Checks["accepting"] == "ok" || r.Checks["vsock-proxy"] != "ok" {
+		t.Fatalf("before accepting: %d %+v", code, r)
+	}
+
+	accepting.Store(true)
+	serve(9003)
+	if code, r := probe(t, 9003); code != http.StatusOK || !r.Ready {
+		t.Fatalf("accepting: %d %+v", code, r)
+	}
+
+	upstream = newUpstreamPool(vsock.HostCID, 8001, 1)
+	serve(9004)
+	if code, r := probe(t, 9004); code != http.StatusServiceUnavailable || r.Checks["vsock-proxy"] == "ok" {
+		t.Fatalf("vsock-proxy unreachable: %d %+v", code, r)
+	}
+}
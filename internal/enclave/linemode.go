@@ -0,0 +1,118 @@
+// enclave/linemode.go
+package enclave
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"time"
+
+	"nitro-dev-qemu/pkg/framing"
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// serveLineMode accepts connections for the line-delimited mode: every
+// newline-terminated line is encrypted and answered with the base64
+// CiphertextBlob on its own line. It exists so that
+//
+//	socat - VSOCK-CONNECT:3:9001
+//
+// can be used for manual testing without the connector binary.
+func serveLineMode(listener net.Listener) {
+	slog.Info("Line mode listening on vsock", "addr", listener.Addr().String())
+
+	connectionCount := 0
+	for {
+		conn, err := vsock.Accept(drainer.Listening(), listener)
+		if err != nil {
+			if drainer.Stopping() {
+				return
+			}
+			slog.Warn("Line mode accept failed", "err", err)
+			continue
+		}
+		connectionCount++
+		logger := logging.ForConn(conn, connectionCount).With("mode", "line")
+		logger.Info("Accepted line mode connection", connsAttr())
+		// Line mode connections share the --max-conns slots
+		drainer.Go(func() {
+			if !connLimit.Acquire(drainer.Done()) {
+				logger.Warn("Rejecting line mode connection: --max-conns reached", connsAttr())
+				fmt.Fprintln(conn, "ERROR: enclave is at its connection limit, retry later")
+				conn.Close()
+				return
+			}
+			defer connLimit.Release()
+			ctx, cancel := vsock.WithConn(drainer.Context(), conn)
+			defer cancel()
+			handleLineConnection(ctx, conn, logger)
+		})
+	}
+}
+
+// handleLineConnection encrypts lines until the client goes away or ctx,
+// the connection's context, ends.
+func handleLineConnection(ctx context.Context, conn net.Conn, logger *slog.Logger) {
+	startTime := time.Now()
+	defer func() {
+		// Never log the panic value as-is: it may carry request data
+		if r := recover(); r != nil {
+			logger.Error("Handler panicked", "panic", payload.DescribePanic(r), "stack", string(debug.Stack()))
+		}
+		conn.Close()
+		logger.Info("Connection closed", "duration", time.Since(startTime))
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), framing.MaxFrameSize)
+	writer := bufio.NewWriter(conn)
+
+	lineCount := 0
+	for {
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		if !scanner.Scan() {
+			break
+		}
+		lineCount++
+		line := scanner.Bytes()
+		// Tolerate CRLF from clients such as ncat -C
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		plaintext := payload.New(append([]byte(nil), line...))
+		// Lines carry no request ID, so each gets one here for the
+		// vsock-proxy and KMS logs
+		requestID := protocol.NewRequestID()
+		lineLogger := logger.With("line", lineCount, "request_id", requestID)
+		lineLogger.Debug("Line to encrypt", "bytes", plaintext.Len())
+
+		lineCtx, cancel := context.WithTimeout(protocol.WithRequestID(ctx, requestID), operationTimeouts.For(protocol.OpEncrypt, requestTimeout))
+		result, err := processRequest(lineCtx, lineLogger, &protocol.Request{Operation: protocol.OpEncrypt, RequestId: requestID, Payload: plaintext})
+		cancel()
+		if err != nil {
+			lineLogger.Warn("Encryption failed", "err", err)
+			fmt.Fprintf(writer, "ERROR: %v\n", err)
+		} else {
+			writer.Write(result)
+			writer.WriteByte('\n')
+		}
+		if writeTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		if err := writer.Flush(); err != nil {
+			logger.Warn("Write error", "err", err)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Warn("Read error", "err", err)
+	}
+}
@@ -0,0 +1,558 @@
+// enclave/main.go
+package enclave
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"nitro-dev-qemu/pkg/connlimit"
+	"nitro-dev-qemu/pkg/drbg"
+	"nitro-dev-qemu/pkg/envflag"
+	"nitro-dev-qemu/pkg/kmsclient"
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/profile"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/shutdown"
+	"nitro-dev-qemu/pkg/vsock"
+	"nitro-dev-qemu/pkg/watchdog"
+)
+
+// Main runs the enclave with its flags parsed from args into fs.
+// cmd/enclave passes flag.CommandLine. A program embedding the enclave
+// (cmd/allinone) passes a flag set of its own and t, the transport to
+// use in place of --vsock-transport, and sets up logging itself.
+func Main(fs *flag.FlagSet, args []string, t vsock.Transport) {
+	env := envflag.On(fs)
+	fs.BoolVar(&fipsMode, "fips", false, "Require the FIPS 140-3 crypto module and refuse non-approved algorithms")
+	listenCID := env.Uint32("listen-cid", 3, "Vsock CID to listen on for connector connections", "LISTEN_CID")
+	listenPort := env.Uint32("listen-port", 9000, "Vsock port to listen on for connector connections", "LISTEN_PORT", "VSOCK_PORT")
+	upstreamCID := env.Uint32("upstream-cid", vsock.HostCID, "Vsock CID of the vsock-proxy", "UPSTREAM_CID")
+	upstreamPort := env.Uint32("upstream-port", 8000, "Vsock port of the vsock-proxy", "UPSTREAM_PORT")
+	upstreamConns := fs.Int("upstream-conns", 2, "Persistent connections to the vsock-proxy, each carrying multiplexed requests")
+	attestedDecrypt := fs.Bool("attested-decrypt", true, "Send an attestation document with Decrypt so the plaintext comes back encrypted to the enclave's ephemeral key")
+	attestationFormatName := fs.String("attestation-format", "nitro", "Attestation evidence to send with Decrypt: nitro (attestation document), sev-snp (AMD SEV-SNP report) or tdx (Intel TDX quote), the last two simulated")
+	drbgReseedInterval := fs.Uint64("drbg-reseed-interval", drbg.DefaultReseedInterval, "Reseed the enclave DRBG after this many requests for random bytes")
+	entropySourceName := fs.String("entropy-source", "nsm", "Entropy for the enclave DRBG: nsm (simulated Nitro Secure Module) or kms (KMS GenerateRandom via the vsock-proxy)")
+	warmUp := fs.Bool("warm-up", false, "Open the vsock-proxy connections at startup instead of on first use")
+	linePort := fs.Uint("line-port", 9001, "Vsock port for the line-delimited socat/ncat mode (0 disables it)")
+	healthPort := fs.Uint("health-port", 9002, "Vsock port for the HTTP /healthz and /readyz probes (0 disables them)")
+	sloLatency := fs.Duration("slo-latency", 500*time.Millisecond, "Latency target for the request SLO")
+	sloObjective := fs.Float64("slo-objective", 0.99, "Fraction of requests that must meet the latency target")
+	sloShedBurn := fs.Float64("slo-shed-burn-rate", 0, "Shed new connections while the SLO burn rate exceeds this (0 disables shedding)")
+	sloReportInterval := fs.Duration("slo-report-interval", 30*time.Second, "How often to log the SLO report (0 disables it)")
+	fs.DurationVar(&requestTimeout, "request-timeout", 15*time.Second, "Budget for handling one request, including vsock-proxy and KMS time; connectors may ask for less")
+	fs.DurationVar(&readTimeout, "read-timeout", 10*time.Second, "Close a connector connection that hasn't sent its request within this long (0 disables)")
+	fs.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "Give up writing a response after this long (0 disables)")
+	fs.DurationVar(&idleTimeout, "idle-timeout", 5*time.Minute, "Close a line mode connection that sends no line for this long (0 disables)")
+	fs.StringVar(&defaultPipeline, "pipeline", "gzip,envelope,base64", "Stages for Transform requests that don't name a pipeline, applied left to right (built in: gzip, base64, hex, envelope, kms, siv, fpe)")
+	fs.Var(&contentPolicies, "content-policy", "Content rules per KMS key for data to encrypt, e.g. '*=deny-encrypted;alias/archive-key=deny-compressed,warn-compressible=1MiB'")
+	fs.Var(&deterministicKeys, "deterministic-key", "Set aside a KMS key for deterministic (joinable) siv encryption, as KEY=CiphertextBlob of a 64-byte data key wrapped by it (repeatable)")
+	fs.Var(shredding, "shred-key", "Enable crypto-shredding (RecordEncrypt, RecordDecrypt, Shred) with per-record keys derived from a root key, as KEY=CiphertextBlob of a 32-byte data key wrapped by it")
+	fs.StringVar(&shredding.statePath, "shred-state", "", "File keeping the sealed per-record crypto-shredding salts across restarts (default: memory only)")
+	fs.StringVar(&callouts.target, "callout", "", "gRPC callout service inside the enclave, as unix:PATH or a loopback HOST:PORT, that performs the operations in --callout-ops (see pkg/callout)")
+	fs.Var(callouts.ops, "callout-ops", "Comma-separated workload operations to forward to the --callout service (repeatable)")
+	fs.StringVar(&peers.target, "peer", "", "Peer enclave, as CID:PORT of its --peer-port, that performs the operations in --peer-ops over an attested channel through the vsock-proxy relay")
+	fs.Var(peers.ops, "peer-ops", "Comma-separated operations to hand to the --peer enclave (repeatable)")
+	fs.UintVar(&peers.port, "peer-port", 0, "Vsock port to serve operations handed over by peer enclaves (0 disables it)")
+	fs.StringVar(&peers.pcr0, "peer-pcr0", "", "Comma-separated hex PCR0 values accepted from peer enclaves, both ways (empty accepts any peer whose attestation verifies)")
+	fs.UintVar(&peers.relayPort, "relay-port", 8002, "Vsock port of the vsock-proxy relay (its --relay-port) on the --upstream-cid, for reaching the --peer")
+	fs.Var(&operationTimeouts, "operation-timeouts", "Per-operation budgets overriding --request-timeout, e.g. Encrypt=2s,EnvelopeDecrypt=5s")
+	traceFile := fs.String("trace-file", "", "Append a trace of every request (calls, decisions, timings; payloads redacted) to this JSON Lines file, for replay in tests")
+	traceKeyFile := fs.String("trace-key-file", "", "File holding a hex-encoded 32-byte key; with it, --trace-file seals payloads with AES-256-GCM instead of redacting them")
+	maxConns := fs.Int("max-conns", 256, "Connector connections served at once; further connections queue or get a busy error (0 means unlimited)")
+	connQueueTimeout := fs.Duration("conn-queue-timeout", time.Second, "How long a connection over --max-conns waits for a slot before getting a busy error (0 rejects at once)")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests on SIGINT/SIGTERM")
+	prof := profile.Register(fs)
+	var transportName *string
+	if t == nil {
+		transportName = env.String("vsock-transport", "vsock", "How to reach the connectors and the vsock-proxy: vsock, or tcp (tcp:HOST) to run on one machine without a VM, with ports standing in for vsock addresses", "VSOCK_TRANSPORT")
+		logging.RegisterFlags(fs)
+	}
+	// "enclave describe-pcrs [flags]" prints the PCRs an enclave started
+	// with the same flags would have, like nitro-cli describe-enclaves
+	describe := len(args) > 0 && args[0] == "describe-pcrs"
+	if describe {
+		args = args[1:]
+	}
+	fs.Parse(args)
+	if transportName != nil {
+		if err := logging.Setup("enclave"); err != nil {
+			logging.Fatal("Invalid logging flags", "err", err)
+		}
+		pt, err := vsock.ParseTransport(*transportName)
+		if err != nil {
+			logging.Fatal("Invalid --vsock-transport", "err", err)
+		}
+		t = pt
+	}
+	transport = t
+
+	rules := append(profile.Common(fs),
+		profile.Flag(fs, "trace-file", profile.Empty, "request traces record every request and its calls"),
+		profile.Flag(fs, "attested-decrypt", profile.Equals("true"), "without it, Decrypt plaintext and data keys cross vsock in the clear"),
+		profile.Rule{Setting: "peer channels without --peer-pcr0", Reason: "any enclave whose attestation verifies could hand over or receive requests", Violated: func() bool {
+			return (peers.target != "" || peers.port != 0) && peers.pcr0 == ""
+		}})
+	if err := prof.Enforce(rules...); err != nil {
+		logging.Fatal("Refusing to start", "profile", prof.Name(), "err", err)
+	}
+
+	if describe {
+		m, err := measureSelf(fs)
+		if err != nil {
+			logging.Fatal("Boot measurement failed", "err", err)
+		}
+		if err := describePCRs(os.Stdout, m, *listenCID); err != nil {
+			logging.Fatal("Failed to print the PCRs", "err", err)
+		}
+		return
+	}
+
+	slog.Info("Starting vsock encryption proxy, acting as intermediary between connector and vsock-proxy", "profile", prof.Name())
+
+	registerStages()
+	if err := checkPipeline(defaultPipeline); err != nil {
+		logging.Fatal("Invalid pipeline", "err", err)
+	}
+	deterministicKeys.warn()
+	if err := checkShredState(shredding.statePath); err != nil {
+		logging.Fatal("Invalid crypto-shredding flags", "err", err)
+	}
+	shredding.warn()
+	if err := callouts.setup(); err != nil {
+		logging.Fatal("Invalid callout flags", "err", err)
+	}
+	if *traceFile != "" {
+		w, err := openTraces(*traceFile, *traceKeyFile)
+		if err != nil {
+			logging.Fatal("Invalid trace flags", "err", err)
+		}
+		defer w.Close()
+		traces = w
+		slog.Info("Recording request traces", "file", *traceFile, "sealed", *traceKeyFile != "")
+	} else if *traceKeyFile != "" {
+		logging.Fatal("--trace-key-file needs --trace-file")
+	}
+
+	if fipsMode {
+		if err := fipsSelfCheck(); err != nil {
+			logging.Fatal("FIPS mode requested but unavailable", "err", err)
+		}
+	}
+
+	// Measure our own binary and configuration before serving anything
+	m, err := measureSelf(fs)
+	if err != nil {
+		logging.Fatal("Boot measurement failed", "err", err)
+	}
+	measurement = m
+	moduleID = fmt.Sprintf("enclave-cid%d", *listenCID)
+	slog.Info("Boot measurement",
+		"executable", measurement.ExecutablePath,
+		"executable_sha384", measurement.ExecutableSHA384,
+		"config_sha384", measurement.ConfigSHA384,
+		"pcr0", measurement.PCRs.PCR0.String(),
+		"pcr1", measurement.PCRs.PCR1.String(),
+		"pcr2", measurement.PCRs.PCR2.String())
+
+	if *attestedDecrypt {
+		if err := setupRecipientKey(*attestationFormatName); err != nil {
+			logging.Fatal("Attested Decrypt setup failed", "err", err)
+		}
+	}
+
+	// Create vsock listener (for connector connections)
+	slog.Info("Creating vsock listener", "cid", *listenCID, "port", *listenPort)
+	slog.Info("Forwarding KMS requests to vsock-proxy", "cid", *upstreamCID, "port", *upstreamPort, "conns", *upstreamConns)
+	upstream = newUpstreamPool(*upstreamCID, *upstreamPort, *upstreamConns)
+	if *warmUp {
+		start := time.Now()
+		ready := upstream.warmUp(drainer.Context())
+		slog.Info("Warm-up complete", "ready", ready, "conns", *upstreamConns, "duration", time.Since(start))
+	}
+	kmsclient.SetDefault(kmsclient.New(kmsclient.RoundTripFunc(upstream.roundTrip)))
+
+	// Probes answer from here on, not ready until the accept loop runs
+	if *healthPort != 0 {
+		healthListener, err := serveHealth(*listenCID, uint32(*healthPort))
+		if err != nil {
+			logging.Fatal("Failed to listen for health probes", "port", *healthPort, "err", err)
+		}
+		defer healthListener.Close()
+	}
+
+	if err := setupEntropy(*listenCID, *entropySourceName, *drbgReseedInterval); err != nil {
+		logging.Fatal("Entropy setup failed", "err", err)
+	}
+	if err := peers.setup(*upstreamCID, *attestationFormatName); err != nil {
+		logging.Fatal("Invalid peer flags", "err", err)
+	}
+	listener, err := transport.Listen(*listenCID, *listenPort)
+	if err != nil {
+		logging.Fatal("Failed to listen on vsock", "err", err)
+	}
+	defer listener.Close()
+
+	slog.Info("Listening on vsock", "addr", listener.Addr().String())
+
+	// Line-delimited mode for manual testing with socat/ncat
+	if *linePort != 0 {
+		lineListener, err := transport.Listen(*listenCID, uint32(*linePort))
+		if err != nil {
+			logging.Fatal("Failed to listen on line mode port", "port", *linePort, "err", err)
+		}
+		defer lineListener.Close()
+		go serveLineMode(lineListener)
+	}
+
+	// Channels from peer enclaves, through the vsock-proxy relay
+	if peers.port != 0 {
+		peerListener, err := transport.Listen(*listenCID, uint32(peers.port))
+		if err != nil {
+			logging.Fatal("Failed to listen on peer port", "port", peers.port, "err", err)
+		}
+		defer peerListener.Close()
+		slog.Info("Serving peer enclaves", "port", peers.port)
+		go peers.serve(peerListener)
+	}
+
+	// Stop accepting on SIGINT/SIGTERM: the accept loops' contexts end,
+	// closing the listeners, and the main loop then drains
+	shutdown.OnSignal(func(sig os.Signal) {
+		slog.Info("Received signal, no longer accepting connections", "signal", sig.String())
+		accepting.Store(false)
+		drainer.Stop()
+	})
+
+	connLimit = connlimit.New(*maxConns, *connQueueTimeout, connlimit.Metrics{})
+	slo = newSLOTracker(*sloLatency, *sloObjective, *sloShedBurn)
+	if *sloReportInterval > 0 {
+		go slo.reportEvery(*sloReportInterval)
+		go reportEntropyEvery(*sloReportInterval)
+	}
+
+	slog.Info("Ready to accept connections from connector")
+	accepting.Store(true)
+
+	connectionCount := 0
+	for {
+		// Accept connection
+		slog.Debug("Waiting for new connection")
+		conn, err := vsock.Accept(drainer.Listening(), listener)
+		if err != nil {
+			if drainer.Stopping() {
+				break
+			}
+			slog.Warn("Accept failed", "err", err)
+			continue
+		}
+
+		connectionCount++
+		connLogger := logging.ForConn(conn, connectionCount)
+		connLogger.Info("Accepted connection", connsAttr())
+
+		// Shed load while the latency SLO is being violated
+		if slo.shouldShed() {
+			connLogger.Warn("Shedding connection: SLO burn rate above threshold", "burn_rate", slo.burnRate(), "threshold", slo.shedBurn)
+			drainer.Go(func() { rejectBusy(conn, "enclave is shedding load, retry later") })
+			continue
+		}
+
+		// Handle connection in goroutine, once it gets a slot
+		queuedAt := slo.enqueue()
+		drainer.Go(func() {
+			if !connLimit.Acquire(drainer.Done()) {
+				connLogger.Warn("Rejecting connection: --max-conns reached", "waited", time.Since(queuedAt), connsAttr())
+				slo.done(queuedAt, time.Now(), false)
+				rejectBusy(conn, "enclave is at its connection limit, retry later")
+				return
+			}
+			defer connLimit.Release()
+			ctx, cancel := vsock.WithConn(drainer.Context(), conn)
+			defer cancel()
+			handleVsockConnection(ctx, conn, connLogger, queuedAt)
+		})
+	}
+
+	// Drain in-flight requests before exiting
+	slog.Info("Waiting for active connections to finish", "timeout", *shutdownTimeout, "active", drainer.Active())
+	if drainer.Wait(*shutdownTimeout) {
+		slog.Info("All connections finished")
+	} else {
+		slog.Warn("Shutdown timeout reached, closing active connections", "active", drainer.Active())
+	}
+	reportEntropy()
+	slog.Info("Shutdown complete")
+}
+
+// drainer tracks connection handlers so they can finish on shutdown.
+var drainer shutdown.Drainer
+
+// rejectBusy answers a rejected connection's request with a busy error so
+// the client can back off, without processing it.
+func rejectBusy(conn net.Conn, reason string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	req, err := protocol.ReadRequest(conn)
+	if err == io.EOF {
+		return
+	}
+	protocol.WriteResponse(conn, protocol.Failed(req, protocol.Errorf(protocol.CodeBusy, "%s", reason)))
+}
+
+// connLimit bounds the connector connections served at once (--max-conns).
+var connLimit *connlimit.Limiter
+
+// connsAttr describes connection slot utilization for log lines.
+func connsAttr() slog.Attr {
+	s := connLimit.Stats()
+	return slog.Group("conns", "in_use", s.InUse, "max", s.Max, "waiting", s.Waiting, "rejected", s.Rejected)
+}
+
+// readTimeout, writeTimeout and idleTimeout bound how long a connection
+// may wait for a request, for a response to be written, and between line
+// mode lines (set by --read-timeout, --write-timeout and --idle-timeout).
+var readTimeout, writeTimeout, idleTimeout time.Duration
+
+// handlerGrace is how long past its budget a request handler may run
+// before it is abandoned and the request answered with a timeout.
+const handlerGrace = time.Second
+
+// transport dials the vsock-proxy and listens for connectors (set by
+// --vsock-transport); tests swap in a vsock.Memory.
+var transport vsock.Transport = vsock.System{}
+
+// upstream carries requests to the vsock-proxy.
+var upstream *upstreamPool
+
+// slo tracks queue depth and request latency against the configured SLO.
+var slo *sloTracker
+
+// handleVsockConnection serves one connector connection. ctx is the
+// connection's context: it closes conn when it ends, and the request's
+// context derives from it.
+func handleVsockConnection(ctx context.Context, conn net.Conn, logger *slog.Logger, queuedAt time.Time) {
+	startTime := time.Now()
+	succeeded, sloRecorded := false, false
+	logger.Debug("Starting connection handler")
+	defer func() {
+		if !sloRecorded {
+			slo.done(queuedAt, startTime, succeeded)
+		}
+		// Never log the panic value as-is: it may carry request data
+		if r := recover(); r != nil {
+			logger.Error("Handler panicked", "panic", payload.DescribePanic(r), "stack", string(debug.Stack()))
+		}
+		conn.Close()
+		logger.Info("Connection closed", "duration", time.Since(startTime))
+	}()
+
+	// Read data from connector
+	logger.Debug("Reading data from connector")
+	readStart := time.Now()
+	if readTimeout > 0 {
+		conn.SetReadDeadline(readStart.Add(readTimeout))
+	}
+	if writeTimeout > 0 {
+		conn.SetWriteDeadline(readStart.Add(readTimeout + writeTimeout))
+	}
+	req, err := protocol.ReadRequest(conn)
+	if err != nil {
+		logger.Warn("Read error", "err", err)
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			err = protocol.Errorf(protocol.CodeTimeout, "no request received within %v", readTimeout)
+		}
+		if err != io.EOF {
+			// Best effort: tell the client why instead of just hanging up
+			protocol.WriteResponse(conn, protocol.Failed(req, err))
+		}
+		return
+	}
+	readTime := time.Since(readStart)
+
+	logger = logger.With("request_id", req.RequestId)
+	input := req.Payload
+	logger.Info("Received request", "operation", req.Operation, "bytes", input.Len(), "read_time", readTime)
+	logger.Debug("Input from connector", logging.Payload("input", input.Bytes()))
+
+	if isStreamOperation(req.Operation) {
+		succeeded = serveStream(ctx, conn, logger, req, func(ok bool) {
+			slo.done(queuedAt, startTime, ok)
+			sloRecorded = true
+		})
+		return
+	}
+
+	// The budget starts once we know the operation; time already spent
+	// queueing and reading is reported but not charged to it
+	budget := operationTimeouts.Budget(req, requestTimeout)
+	ctx, cancel := context.WithTimeout(protocol.WithRequestID(ctx, req.RequestId), budget)
+	defer cancel()
+	ctx, timing := withTiming(ctx)
+	ctx, trace := traces.start(ctx, req)
+	traceDecide(ctx, "budget", budget.String())
+	addStage(ctx, "queue", startTime.Sub(queuedAt))
+	addStage(ctx, "read", readTime)
+
+	// Perform the operation
+	opStart := time.Now()
+	result, err := watchdog.Run(ctx, handlerGrace, func() ([]byte, error) {
+		return processRequest(ctx, logger, req)
+	})
+	opTime := time.Since(opStart)
+	addStage(ctx, "process", opTime)
+	var perr *watchdog.PanicError
+	switch {
+	case errors.As(err, &perr):
+		// Never log the panic value as-is: it may carry request data
+		logger.Error("Handler panicked", "panic", payload.DescribePanic(perr.Value), "stack", string(perr.Stack))
+		err = protocol.Errorf(protocol.CodeInternal, "internal error")
+	case errors.Is(err, watchdog.ErrAbandoned):
+		logger.Error("Operation ignored its deadline, abandoning it", "operation", req.Operation, "budget", budget, "stuck", watchdog.Stuck())
+	}
+
+	// The response gets a fresh write deadline: the operation may have
+	// used up the one set before reading
+	if writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = protocol.Errorf(protocol.CodeTimeout, "%s did not complete within its %v budget: %v", req.Operation, budget, err)
+		}
+		logger.Warn("Operation failed", "operation", req.Operation, "err", err)
+		resp := protocol.Failed(req, err)
+		resp.Timing = timing.report(budget, time.Since(queuedAt))
+		traces.finish(trace, resp)
+		if err := protocol.WriteResponse(conn, resp); err != nil {
+			logger.Warn("Write error", "err", err)
+		}
+		return
+	}
+
+	// Send result back to connector
+	logger.Debug("Result to connector", logging.Payload("result", result))
+	sendStart := time.Now()
+	resp := protocol.OK(req, result)
+	resp.Timing = timing.report(budget, time.Since(queuedAt))
+	traces.finish(trace, resp)
+	if err := protocol.WriteResponse(conn, resp); err != nil {
+		logger.Warn("Write error", "err", err)
+		return
+	}
+
+	succeeded = true
+	logger.Info("Request completed",
+		"operation", req.Operation,
+		"input_bytes", input.Len(),
+		"output_bytes", len(result),
+		"op_time", opTime,
+		"send_time", time.Since(sendStart),
+		"total_time", time.Since(startTime))
+}
+
+// processRequest performs a connector request. KMS operations are
+// forwarded to the vsock-proxy; envelope operations run locally, and
+// workload operations go to the callout service. Operations in --peer-ops
+// go to the peer enclave instead.
+func processRequest(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+	if err := deterministicKeys.checkOperation(logger, req); err != nil {
+		traceDecide(ctx, "deterministic_key", "denied")
+		return nil, err
+	}
+	switch req.Operation {
+	case protocol.OpEncrypt, protocol.OpEnvelopeEncrypt, protocol.OpTransform, protocol.OpRecordEncrypt:
+		if err := contentPolicies.check(logger, req.KeyId, req.Payload.Bytes()); err != nil {
+			traceDecide(ctx, "content_policy", "denied")
+			return nil, err
+		}
+		traceDecide(ctx, "content_policy", "allowed")
+	}
+	if peers.handles(ctx, req.Operation) {
+		return traceCall(ctx, "peer", req, func() ([]byte, error) {
+			return peers.invoke(ctx, logger, req)
+		})
+	}
+
+	switch req.Operation {
+	case protocol.OpEncrypt, protocol.OpSign, protocol.OpVerify:
+		return forwardToVsockProxy(ctx, logger, req)
+	case protocol.OpDecrypt:
+		return decryptThroughProxy(ctx, logger, req)
+	case protocol.OpEnvelopeEncrypt:
+		return envelopeEncrypt(ctx, logger, req.RequestId, req.KeyId, req.Payload)
+	case protocol.OpEnvelopeDecrypt:
+		plaintext, err := envelopeDecrypt(ctx, logger, req.RequestId, req.Payload)
+		return plaintext.Bytes(), err
+	case protocol.OpTransform, protocol.OpReverseTransform:
+		return runPipeline(ctx, logger, req)
+	case protocol.OpEncryptFields, protocol.OpDecryptFields:
+		return cryptFields(ctx, logger, req)
+	case protocol.OpEncryptColumns, protocol.OpDecryptColumns:
+		return cryptColumns(ctx, logger, req)
+	case protocol.OpFPEEncrypt, protocol.OpFPEDecrypt:
+		return fpeOperation(ctx, logger, req)
+	case protocol.OpRecordEncrypt, protocol.OpRecordDecrypt, protocol.OpShred:
+		return shredOperation(ctx, logger, req)
+	default:
+		if callouts.handles(req.Operation) {
+			return traceCall(ctx, "callout", req, func() ([]byte, error) {
+				return callouts.invoke(ctx, logger, req)
+			})
+		}
+		return nil, protocol.Errorf(protocol.CodeUnsupportedOperation, "unsupported operation %q", req.Operation)
+	}
+}
+
+// forwardToVsockProxy sends req to the vsock-proxy and returns the raw
+// result: the CiphertextBlob for Encrypt, the plaintext for Decrypt. Errors
+// reported by the proxy are returned as *protocol.Error so their code (e.g.
+// kms_error) reaches the connector. The proxy is told how much of ctx's
+// deadline is left, so it gives up when we would stop waiting anyway.
+func forwardToVsockProxy(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+	return traceCall(ctx, "vsock-proxy", req, func() ([]byte, error) {
+		return sendToVsockProxy(ctx, logger, req)
+	})
+}
+
+// sendToVsockProxy does the work of forwardToVsockProxy, without tracing.
+func sendToVsockProxy(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+	up := *req
+	up.TimeoutMs = 0
+	if deadline, ok := ctx.Deadline(); ok {
+		up.TimeoutMs = max(1, time.Until(deadline).Milliseconds())
+	}
+
+	// Send request to vsock-proxy over a pooled connection
+	logger.Debug("Sending request to vsock-proxy", "operation", req.Operation, "timeout_ms", up.TimeoutMs, logging.Payload("payload", req.Payload.Bytes()))
+	start := time.Now()
+	resp, err := upstream.roundTrip(ctx, &up)
+	addStage(ctx, "upstream", time.Since(start))
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeUpstream, "vsock-proxy request failed: %v", err)
+	}
+	addUpstreamTiming(ctx, resp.Timing)
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	reply := resp.Result.Bytes()
+
+	if req.Operation == protocol.OpGenerateDataKey {
+		// the result carries the plaintext data key: never log it raw
+		logger.Debug("Received result from vsock-proxy", "operation", req.Operation, logging.Secret("result", reply))
+	} else {
+		logger.Debug("Received result from vsock-proxy", "operation", req.Operation, logging.Payload("result", reply))
+	}
+
+	return reply, nil
+}
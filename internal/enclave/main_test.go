@@ -0,0 +1,203 @@
+package enclave
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/drbg"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// testDataKey is the data key the fake vsock-proxy hands out, and
+// "wrapped" the CiphertextBlob standing for it.
+var testDataKey = bytes.Repeat([]byte{0x42}, 32)
+
+// fakeProxy stands in for the vsock-proxy on an in-memory transport. It
+// answers Encrypt with "blob:" plus the plaintext, Decrypt by undoing that
+// (or unwrapping testDataKey), and GenerateDataKey with testDataKey, and
+// records the requests it gets.
+func fakeProxy(t *testing.T) <-chan *protocol.Request {
+	t.Helper()
+	mem := &vsock.Memory{}
+	l, err := mem.Listen(vsock.HostCID, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	oldTransport, oldUpstream, oldSLO, oldRand := transport, upstream, slo, enclaveRand
+	t.Cleanup(func() { transport, upstream, slo, enclaveRand = oldTransport, oldUpstream, oldSLO, oldRand })
+	transport = mem
+	upstream = newUpstreamPool(vsock.HostCID, 8000, 1)
+	slo = newSLOTracker(time.Second, 0.99, 0)
+	if enclaveRand, err = drbg.New(rand.Reader, nil, drbg.DefaultReseedInterval); err != nil {
+		t.Fatal(err)
+	}
+	oldTimeout := requestTimeout
+	requestTimeout = 5 * time.Second
+	t.Cleanup(func() { requestTimeout = oldTimeout })
+
+	seen := make(chan *protocol.Request, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					req, err := protocol.ReadRequest(conn)
+					if err != nil {
+						return
+					}
+					seen <- req
+					protocol.WriteResponse(conn, proxyAnswer(req))
+				}
+			}()
+		}
+	}()
+	return seen
+}
+
+func proxyAnswer(req *protocol.Request) *protocol.Response {
+	switch req.Operation {
+	case protocol.OpEncrypt:
+		return protocol.OK(req, []byte("blob:"+req.Payload.Reveal()))
+	case protocol.OpDecrypt:
+		blob := req.Payload.Reveal()
+		switch {
+		case blob == "wrapped":
+			return protocol.OK(req, testDataKey)
+		case strings.HasPrefix(blob, "blob:"):
+			return protocol.OK(req, []byte(strings.TrimPrefix(blob, "blob:")))
+		}
+		return protocol.Failed(req, protocol.Errorf(protocol.CodeKMS, "KMS Decrypt failed with status 400").WithDetail("kms_error_type", "InvalidCiphertextException"))
+	case protocol.OpGenerateDataKey:
+		result, _ := json.Marshal(protocol.DataKey{KeyId: "alias/dev-key", Plaintext: payload.New(bytes.Clone(testDataKey)), CiphertextBlob: "wrapped"})
+		return protocol.OK(req, result)
+	}
+	return protocol.Failed(req, protocol.Errorf(protocol.CodeUnsupportedOperation, "unsupported operation %q", req.Operation))
+}
+
+var registerOnce sync.Once
+
+// registerTestStages registers the enclave's pipeline stages, as main
+// does, once for the test binary.
+func registerTestStages() {
+	registerOnce.Do(registerStages)
+}
+
+// call sends req to handleVsockConnection over a pipe and returns the
+// response, once the handler is done, so the test's cleanup can't race
+// with its bookkeeping.
+func call(t *testing.T, req *protocol.Request) *protocol.Response {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		handleVsockConnection(context.Background(), server, slog.New(slog.DiscardHandler), slo.enqueue())
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := protocol.WriteRequest(client, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := protocol.ReadResponse(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.RequestId != req.RequestId {
+		t.Fatalf("response for request %q, want %q", resp.RequestId, req.RequestId)
+	}
+	return resp
+}
+
+func TestEncryptForwardsToProxy(t *testing.T) {
+	seen := fakeProxy(t)
+
+	resp := call(t, &protocol.Request{RequestId: "r1", Operation: protocol.OpEncrypt, KeyId: "alias/dev-key", Payload: payload.FromString("hello")})
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result.Reveal() != "blob:hello" {
+		t.Fatalf("result = %q", resp.Result.Reveal())
+	}
+	if _, ok := resp.Timing.StagesMs["upstream"]; !ok {
+		t.Fatalf("timing has no upstream stage: %+v", resp.Timing)
+	}
+
+	// The proxy gets the same request, told how long it has left
+	up := <-seen
+	if up.RequestId != "r1" || up.KeyId != "alias/dev-key" || up.Payload.Reveal() != "hello" {
+		t.Fatalf("upstream request = %+v", up)
+	}
+	if up.TimeoutMs <= 0 || up.TimeoutMs > 5000 {
+		t.Fatalf("upstream timeout_ms = %d", up.TimeoutMs)
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	fakeProxy(t)
+
+	resp := call(t, &protocol.Request{RequestId: "enc", Operation: protocol.OpEnvelopeEncrypt, Payload: payload.FromString("secret")})
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(resp.Result.Bytes(), []byte("secret")) {
+		t.Fatalf("envelope contains the plaintext: %s", resp.Result.Bytes())
+	}
+	resp = call(t, &protocol.Request{RequestId: "dec", Operation: protocol.OpEnvelopeDecrypt, Payload: resp.Result})
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result.Reveal() != "secret" {
+		t.Fatalf("decrypted = %q", resp.Result.Reveal())
+	}
+}
+
+func TestProxyErrorPassesThrough(t *testing.T) {
+	fakeProxy(t)
+
+	resp := call(t, &protocol.Request{RequestId: "r1", Operation: protocol.OpDecrypt, Payload: payload.FromString("garbage")})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeKMS || resp.Error.Details["kms_error_type"] != "InvalidCiphertextException" {
+		t.Fatalf("got %+v", resp.Error)
+	}
+}
+
+func TestProxyUnreachable(t *testing.T) {
+	fakeProxy(t)
+	upstream = newUpstreamPool(vsock.HostCID, 8001, 1)
+
+	resp := call(t, &protocol.Request{RequestId: "r1", Operation: protocol.OpEncrypt, Payload: payload.FromString("x")})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeUpstream {
+		t.Fatalf("got %+v", resp.Error)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	fakeProxy(t)
+
+	resp := call(t, &protocol.Request{RequestId: "r1", Operation: "Frobnicate"})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeUnsupportedOperation {
+		t.Fatalf("unsupported op: %+v", resp.Error)
+	}
+	resp = call(t, &protocol.Request{RequestId: "r2", Operation: protocol.OpEnvelopeDecrypt, Payload: payload.FromString("not an envelope")})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeBadRequest {
+		t.Fatalf("bad envelope: %+v", resp.Error)
+	}
+}
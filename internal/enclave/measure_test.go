@@ -0,0 +1,44 @@
+package enclave
+
+import (
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/pcr"
+)
+
+func TestDescribePCRs(t *testing.T) {
+	fs := flag.NewFlagSet("enclave", flag.ContinueOnError)
+	maxConns := fs.Int("max-conns", 256, "")
+	m, err := measureSelf(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.PCRs.PCR0 == (pcr.Value{}) || m.PCRs.PCR1 == (pcr.Value{}) {
+		t.Fatalf("measurement: %+v", m)
+	}
+
+	// PCR1 follows the configuration; the others don't
+	*maxConns = 8
+	changed, err := measureSelf(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.PCRs.PCR1 == m.PCRs.PCR1 || changed.PCRs.PCR0 != m.PCRs.PCR0 || changed.PCRs.PCR2 != m.PCRs.PCR2 {
+		t.Fatalf("PCRs after changing --max-conns: %+v, before %+v", changed.PCRs.Measurements(), m.PCRs.Measurements())
+	}
+
+	var out strings.Builder
+	if err := describePCRs(&out, m, 16); err != nil {
+		t.Fatal(err)
+	}
+	var described []describedEnclave
+	if err := json.Unmarshal([]byte(out.String()), &described); err != nil {
+		t.Fatalf("%v in %s", err, out.String())
+	}
+	if len(described) != 1 || described[0].EnclaveCID != 16 || described[0].Measurements != m.PCRs.Measurements() {
+		t.Fatalf("describe-pcrs printed %s", out.String())
+	}
+}
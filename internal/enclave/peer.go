@@ -0,0 +1,285 @@
+// enclave/peer.go
+package enclave
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/attestation"
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/pcr"
+	"nitro-dev-qemu/pkg/peer"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// peers hands operations to another enclave on the same host (set by
+// --peer and --peer-ops) and serves the operations other enclaves hand to
+// this one (--peer-port), modeling enclave federation: a front-end
+// enclave can use keys only a key-holding enclave's KMS policy admits.
+// The enclaves talk over a pkg/peer channel through the vsock-proxy's
+// --relay-port. Both sides attest, and each checks the other's PCR0
+// against --peer-pcr0; the parent relays ciphertext it can't read.
+var peers = &peerRoutes{ops: operationSet{}}
+
+type peerRoutes struct {
+	target    string // --peer CID:PORT
+	ops       operationSet
+	port      uint   // --peer-port
+	pcr0      string // --peer-pcr0
+	relayPort uint   // --relay-port
+
+	cid, targetPort uint32
+	relayCID        uint32
+	allowed         [][]byte // PCR0 values accepted from peers
+	key             *rsa.PrivateKey
+	format          attestation.Format
+}
+
+// peerHandshakeTimeout bounds a channel handshake on the serving side.
+const peerHandshakeTimeout = 10 * time.Second
+
+// fromPeerKey marks the context of a request that arrived from a peer, so
+// it is never handed on to another peer.
+type fromPeerKey struct{}
+
+// setup checks the flags and creates the channel key. upstreamCID is where
+// the vsock-proxy relay listens.
+func (p *peerRoutes) setup(upstreamCID uint32, formatName string) error {
+	switch {
+	case p.target == "" && len(p.ops) == 0 && p.port == 0:
+		return nil
+	case p.target == "" && len(p.ops) > 0:
+		return fmt.Errorf("--peer-ops %s needs --peer to name the enclave", p.ops)
+	case p.target != "" && len(p.ops) == 0:
+		return fmt.Errorf("--peer needs --peer-ops to name the operations to hand over")
+	}
+	if p.target != "" {
+		cid, port, ok := strings.Cut(p.target, ":")
+		c, cerr := strconv.ParseUint(cid, 10, 32)
+		n, perr := strconv.ParseUint(port, 10, 32)
+		if !ok || cerr != nil || perr != nil {
+			return fmt.Errorf("--peer %q is not CID:PORT", p.target)
+		}
+		p.cid, p.targetPort = uint32(c), uint32(n)
+	}
+	for op := range p.ops {
+		switch {
+		case isStreamOperation(op):
+			return fmt.Errorf("%s can't be handed to a peer: streams stay on their connection", op)
+		case callouts.ops[op]:
+			return fmt.Errorf("%s is in both --callout-ops and --peer-ops", op)
+		}
+	}
+	for _, v := range strings.Split(p.pcr0, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		b, err := hex.DecodeString(v)
+		if err != nil || len(b) != pcr.Size {
+			return fmt.Errorf("--peer-pcr0 %q is not a hex-encoded %d-byte PCR", v, pcr.Size)
+		}
+		p.allowed = append(p.allowed, b)
+	}
+	// The channel wraps its session secrets with RSA-OAEP, derives its
+	// keys with HKDF and seals requests with AES-256-GCM
+	for _, alg := range []string{attestation.KeyEncryptionAlgorithm, "HKDF-SHA-384", envelope.AlgorithmAES256GCM} {
+		if err := allowAlgorithm(alg); err != nil {
+			return fmt.Errorf("peer channels: %w", err)
+		}
+	}
+	format, err := attestation.Lookup(formatName)
+	if err != nil {
+		return err
+	}
+	// A key of its own, so the channels work with --attested-decrypt off
+	key, err := attestation.GenerateRecipientKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate peer channel key: %v", err)
+	}
+	p.key, p.format, p.relayCID = key, format, upstreamCID
+
+	if len(p.allowed) == 0 {
+		slog.Warn("No --peer-pcr0 set: peer channels accept any enclave whose attestation verifies")
+	}
+	if p.target != "" {
+		slog.Info("Handing operations to a peer enclave", "peer", p.target, "relay_port", p.relayPort, "operations", p.ops.String())
+	}
+	return nil
+}
+
+// handles reports whether op goes to the peer. Requests that came from a
+// peer are always handled here.
+func (p *peerRoutes) handles(ctx context.Context, op string) bool {
+	return p.target != "" && p.ops[op] && ctx.Value(fromPeerKey{}) == nil
+}
+
+func (p *peerRoutes) config() *peer.Config {
+	return &peer.Config{Format: p.format, Claims: *attestedClaims(nil), Key: p.key, VerifyPeer: p.verify}
+}
+
+// verify accepts a peer whose PCR0 is in --peer-pcr0, or any peer when
+// the list is empty.
+func (p *peerRoutes) verify(a *attestation.Attested) error {
+	if len(p.allowed) == 0 {
+		return nil
+	}
+	for _, want := range p.allowed {
+		if bytes.Equal(a.PCRs[0], want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("PCR0 %s is not in --peer-pcr0", hex.EncodeToString(a.PCRs[0]))
+}
+
+// invoke hands req to the peer enclave over a new channel and returns its
+// result. Errors the peer reports reach the connector as they are; a peer
+// that can't be reached, or fails attestation, is an upstream_error.
+func (p *peerRoutes) invoke(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+	start := time.Now()
+	defer func() { addStage(ctx, "peer", time.Since(start)) }()
+
+	conn, err := transport.DialContext(ctx, p.relayCID, uint32(p.relayPort))
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeUpstream, "vsock-proxy relay unreachable: %v", err)
+	}
+	// The channel lives as long as the request: ending ctx closes it
+	ctx, cancel := vsock.WithConn(ctx, conn)
+	defer cancel()
+
+	if err := peer.RequestRelay(conn, p.cid, p.targetPort); err != nil {
+		return nil, protocol.Errorf(protocol.CodeUpstream, "%v", err)
+	}
+	ch, err := peer.Client(conn, p.config())
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeUpstream, "peer channel to %s failed: %v", p.target, err)
+	}
+	logger.Debug("Peer channel established", "peer", p.target, "format", ch.Peer().Format, "pcr0", hex.EncodeToString(ch.Peer().PCRs[0]))
+
+	fwd := *req
+	fwd.TimeoutMs = 0
+	if deadline, ok := ctx.Deadline(); ok {
+		fwd.TimeoutMs = max(1, time.Until(deadline).Milliseconds())
+	}
+	logger.Debug("Handing request to peer enclave", "operation", req.Operation, logging.Payload("payload", req.Payload.Bytes()))
+	if err := protocol.WriteRequest(ch, &fwd); err != nil {
+		return nil, protocol.Errorf(protocol.CodeUpstream, "failed to send to peer enclave: %v", err)
+	}
+	resp, err := protocol.ReadResponse(ch)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeUpstream, "no response from peer enclave: %v", err)
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	logger.Debug("Received result from peer enclave", "operation", req.Operation, logging.Payload("result", resp.Result.Bytes()))
+	return resp.Result.Bytes(), nil
+}
+
+// serve accepts channels from peer enclaves on listener until it is
+// closed. Each channel carries requests one at a time.
+func (p *peerRoutes) serve(listener net.Listener) {
+	connectionCount := 0
+	for {
+		conn, err := vsock.Accept(drainer.Listening(), listener)
+		if err != nil {
+			if drainer.Stopping() {
+				return
+			}
+			slog.Warn("Peer accept failed", "err", err)
+			continue
+		}
+		connectionCount++
+		logger := logging.ForConn(conn, connectionCount).With("mode", "peer")
+		drainer.Go(func() {
+			if !connLimit.Acquire(drainer.Done()) {
+				// No channel yet to send busy in
+				logger.Warn("Rejecting peer connection: --max-conns reached", connsAttr())
+				conn.Close()
+				return
+			}
+			defer connLimit.Release()
+			ctx, cancel := vsock.WithConn(drainer.Context(), conn)
+			defer cancel()
+			p.serveChannel(ctx, conn, logger)
+		})
+	}
+}
+
+// serveChannel runs the handshake on conn and serves the peer's requests
+// until it closes the channel or ctx, the connection's context, ends.
+func (p *peerRoutes) serveChannel(ctx context.Context, conn net.Conn, logger *slog.Logger) {
+	defer conn.Close()
+	start := time.Now()
+
+	conn.SetDeadline(start.Add(peerHandshakeTimeout))
+	ch, err := peer.Server(conn, p.config())
+	if err != nil {
+		logger.Warn("Peer channel handshake failed", "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	attested := ch.Peer()
+	logger = logger.With("peer_module_id", attested.ModuleID)
+	logger.Info("Peer channel established", "format", attested.Format, "pcr0", hex.EncodeToString(attested.PCRs[0]))
+
+	served := 0
+	for {
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		req, err := protocol.ReadRequest(ch)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Warn("Peer channel read error", "err", err)
+			}
+			break
+		}
+		p.serveRequest(ctx, ch, logger.With("request_id", req.RequestId), req)
+		served++
+	}
+	logger.Info("Peer channel closed", "requests", served, "duration", time.Since(start))
+}
+
+// serveRequest performs one request from a peer, within the budget the
+// peer sent, and writes the response to ch. connCtx is the channel's
+// connection context.
+func (p *peerRoutes) serveRequest(connCtx context.Context, ch *peer.Channel, logger *slog.Logger, req *protocol.Request) {
+	logger.Info("Received request from peer enclave", "operation", req.Operation, "bytes", req.Payload.Len())
+	budget := operationTimeouts.Budget(req, requestTimeout)
+	ctx, cancel := context.WithTimeout(protocol.WithRequestID(connCtx, req.RequestId), budget)
+	defer cancel()
+	ctx = context.WithValue(ctx, fromPeerKey{}, true)
+
+	var (
+		result []byte
+		err    error
+	)
+	if isStreamOperation(req.Operation) {
+		err = protocol.Errorf(protocol.CodeUnsupportedOperation, "%s can't be handed to a peer", req.Operation)
+	} else {
+		result, err = processRequest(ctx, logger, req)
+	}
+	resp := protocol.OK(req, result)
+	if err != nil {
+		logger.Warn("Peer request failed", "operation", req.Operation, "err", err)
+		resp = protocol.Failed(req, err)
+	}
+	if writeTimeout > 0 {
+		ch.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	if err := protocol.WriteResponse(ch, resp); err != nil {
+		logger.Warn("Peer channel write error", "err", err)
+	}
+}
@@ -0,0 +1,161 @@
+package enclave
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/pcr"
+	"nitro-dev-qemu/pkg/peer"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// parentRelay stands in for the vsock-proxy --relay-port on the fake
+// proxy's transport, and returns everything it relayed.
+func parentRelay(t *testing.T) func() []byte {
+	t.Helper()
+	mem := transport.(*vsock.Memory)
+	l, err := mem.Listen(vsock.HostCID, 8002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var (
+		mu   sync.Mutex
+		seen bytes.Buffer
+	)
+	record := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen.Write(p)
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				cid, port, err := peer.ReadRelayRequest(conn)
+				if err != nil {
+					return
+				}
+				target, err := mem.DialContext(context.Background(), cid, port)
+				peer.AnswerRelay(conn, err)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go func() { io.Copy(io.MultiWriter(target, record), conn); target.Close() }()
+				io.Copy(io.MultiWriter(conn, record), target)
+			}()
+		}
+	}()
+	return func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return bytes.Clone(seen.Bytes())
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// withPeer hands ops to a peer enclave at 16:9003, played by this same
+// test binary serving channels on the fake proxy's transport, and accepts
+// peers whose PCR0 is in pcr0.
+func withPeer(t *testing.T, ops, pcr0 string) {
+	t.Helper()
+	old := peers
+	t.Cleanup(func() { peers = old })
+	peers = &peerRoutes{target: "16:9003", ops: operationSet{}, port: 9003, pcr0: pcr0, relayPort: 8002}
+	peers.ops.Set(ops)
+	if err := peers.setup(vsock.HostCID, "nitro"); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := transport.Listen(16, 9003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				peers.serveChannel(context.Background(), conn, slog.New(slog.DiscardHandler))
+			}()
+		}
+	}()
+}
+
+func TestPeerChannel(t *testing.T) {
+	seen := fakeProxy(t)
+	relayed := parentRelay(t)
+	withPeer(t, "Encrypt", measurement.PCRs.PCR0.String())
+
+	resp := call(t, &protocol.Request{RequestId: "r1", Operation: protocol.OpEncrypt, Payload: payload.FromString("peer secret")})
+	if err := resp.Err(); err != nil || resp.Result.Reveal() != "blob:peer secret" {
+		t.Fatalf("Encrypt = %q, %v", resp.Result.Reveal(), err)
+	}
+	if _, ok := resp.Timing.StagesMs["peer"]; !ok {
+		t.Fatalf("timing has no peer stage: %+v", resp.Timing)
+	}
+	// The peer did the work, and the request wasn't handed on again
+	if req := <-seen; req.Operation != protocol.OpEncrypt || req.RequestId != "r1" {
+		t.Fatalf("vsock-proxy got %+v", req)
+	}
+	if relay := relayed(); len(relay) == 0 || bytes.Contains(relay, []byte("peer secret")) {
+		t.Fatalf("relay saw %d bytes, plaintext included: %v", len(relay), bytes.Contains(relay, []byte("peer secret")))
+	}
+}
+
+func TestPeerChannelRejectsPCR0(t *testing.T) {
+	seen := fakeProxy(t)
+	parentRelay(t)
+	withPeer(t, "Encrypt", pcr.MeasureBytes([]byte("another image")).String())
+
+	// Each side refuses the other; whichever does first, the channel fails
+	resp := call(t, &protocol.Request{RequestId: "r1", Operation: protocol.OpEncrypt, Payload: payload.FromString("x")})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeUpstream {
+		t.Fatalf("got %+v", resp.Error)
+	}
+	if len(seen) != 0 {
+		t.Fatalf("vsock-proxy got %d requests", len(seen))
+	}
+}
+
+func TestPeerSetup(t *testing.T) {
+	for flags, ok := range map[[3]string]bool{
+		{"16:9003", "Encrypt", ""}:       true,
+		{"", "", ""}:                     true,
+		{"", "Encrypt", ""}:              false,
+		{"16:9003", "", ""}:              false,
+		{"16", "Encrypt", ""}:            false,
+		{"16:9003", "StreamEncrypt", ""}: false,
+		{"16:9003", "Encrypt", "abcd"}:   false,
+	} {
+		p := &peerRoutes{target: flags[0], ops: operationSet{}, pcr0: flags[2]}
+		p.ops.Set(flags[1])
+		if err := p.setup(vsock.HostCID, "nitro"); (err == nil) != ok {
+			t.Errorf("%q: %v", flags, err)
+		}
+	}
+}
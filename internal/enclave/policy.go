@@ -0,0 +1,153 @@
+// enclave/policy.go
+package enclave
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/sniff"
+)
+
+// contentPolicies are the content rules for data the enclave is asked to
+// encrypt, by KMS key ID or alias. Set by --content-policy, e.g.
+//
+//	--content-policy '*=deny-encrypted;alias/archive-key=deny-compressed,warn-compressible=1MiB'
+//
+// "*" applies to keys that have no entry of their own, including requests
+// without a key_id. Being a flag, the policy is part of the enclave's
+// config measurement.
+var contentPolicies contentPolicySet
+
+// contentPolicy is the rule set for one key.
+type contentPolicy struct {
+	// denyEncrypted refuses data that already looks encrypted (KMS
+	// CiphertextBlobs, envelopes, PGP, high-entropy data): encrypting it
+	// again is almost always a bug in the caller, such as encrypting a
+	// field twice.
+	denyEncrypted bool
+	// denyCompressed refuses compressed archives.
+	denyCompressed bool
+	// warnCompressible logs a warning for compressible inputs of at least
+	// this many bytes, which would be cheaper to compress first; 0 disables
+	// it.
+	warnCompressible int
+}
+
+type contentPolicySet map[string]contentPolicy
+
+// Set parses a semicolon-separated list of key=rule,rule entries. It
+// implements flag.Value.
+func (s *contentPolicySet) Set(value string) error {
+	m := contentPolicySet{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, rules, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("%q is not key=rule,rule", entry)
+		}
+		var p contentPolicy
+		for _, rule := range strings.Split(rules, ",") {
+			rule = strings.TrimSpace(rule)
+			name, arg, _ := strings.Cut(rule, "=")
+			switch name {
+			case "":
+			case "deny-encrypted":
+				p.denyEncrypted = true
+			case "deny-compressed":
+				p.denyCompressed = true
+			case "warn-compressible":
+				n, err := parseSize(arg)
+				if err != nil {
+					return fmt.Errorf("invalid size for warn-compressible on %s: %v", key, err)
+				}
+				p.warnCompressible = n
+			default:
+				return fmt.Errorf("unknown content rule %q for %s (expected deny-encrypted, deny-compressed or warn-compressible=SIZE)", rule, key)
+			}
+		}
+		m[strings.TrimSpace(key)] = p
+	}
+	*s = m
+	return nil
+}
+
+func (s *contentPolicySet) String() string {
+	if s == nil {
+		return ""
+	}
+	entries := make([]string, 0, len(*s))
+	for key, p := range *s {
+		var rules []string
+		if p.denyEncrypted {
+			rules = append(rules, "deny-encrypted")
+		}
+		if p.denyCompressed {
+			rules = append(rules, "deny-compressed")
+		}
+		if p.warnCompressible > 0 {
+			rules = append(rules, "warn-compressible="+strconv.Itoa(p.warnCompressible))
+		}
+		entries = append(entries, key+"="+strings.Join(rules, ","))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ";")
+}
+
+// parseSize parses a byte count with an optional KiB, MiB or GiB suffix.
+func parseSize(s string) (int, error) {
+	mult := 1
+	for suffix, m := range map[string]int{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, mult = strings.TrimSuffix(s, suffix), m
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size", s)
+	}
+	return n * mult, nil
+}
+
+// check applies the policy for keyID to data about to be encrypted. A
+// denied input fails with policy_denied, which tells the connector which
+// rule refused it and what the data looked like.
+func (s contentPolicySet) check(logger *slog.Logger, keyID string, data []byte) error {
+	p, ok := s[keyID]
+	if !ok {
+		if p, ok = s["*"]; !ok {
+			return nil
+		}
+	}
+	key := keyID
+	if key == "" {
+		key = "the default key"
+	}
+
+	r := sniff.Classify(data)
+	deny := func(rule string) error {
+		logger.Warn("Content policy refused input", "rule", rule, "key_id", keyID, "kind", r.Kind, "format", r.Format, "bytes", len(data), "entropy", r.Entropy)
+		return protocol.Errorf(protocol.CodePolicyDenied, "content policy for %s refuses %s input (%s)", key, r.Kind, r.Format).
+			WithDetail("rule", rule).
+			WithDetail("kind", string(r.Kind)).
+			WithDetail("format", r.Format)
+	}
+	switch {
+	case p.denyEncrypted && r.Kind == sniff.Encrypted:
+		return deny("deny-encrypted")
+	case p.denyCompressed && r.Kind == sniff.Compressed:
+		return deny("deny-compressed")
+	}
+
+	if p.warnCompressible > 0 && len(data) >= p.warnCompressible && r.Compressible() {
+		logger.Warn("Large compressible input: compressing it before encryption would save space and time", "key_id", keyID, "bytes", len(data), "entropy", r.Entropy, "kind", r.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+// enclave/shred.go
+package enclave
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/shred"
+)
+
+// shredding holds the keyring for crypto-shredding (set by --shred-key and
+// --shred-state). RecordEncrypt gives every record its own key, derived
+// from one root data key, so that Shred can erase a record, say for a
+// GDPR erasure request, by destroying its key rather than by finding and
+// deleting every copy of its ciphertext.
+var shredding = &shredder{}
+
+// shredder unwraps the root key through the vsock-proxy on first use, and
+// keeps the keyring's state sealed in a file so records survive an
+// enclave restart.
+type shredder struct {
+	keyID     string
+	wrapped   string
+	statePath string
+
+	// mu serializes unwrapping, and changes to the keyring with the
+	// saving of its state, so the file never lags behind a ciphertext
+	// already handed out.
+	mu      sync.Mutex
+	keyring *shred.Keyring
+	saved   uint64
+}
+
+// Set takes KEY=CiphertextBlob, where the blob is a 32-byte data key
+// wrapped by that KMS key, from
+//
+//	aws kms generate-data-key-without-plaintext --key-id alias/dev-shred-key --key-spec AES_256
+//
+// It implements flag.Value.
+func (s *shredder) Set(value string) error {
+	key, blob, ok := strings.Cut(value, "=")
+	key, blob = strings.TrimSpace(key), strings.TrimSpace(blob)
+	if !ok || key == "" || blob == "" {
+		return fmt.Errorf("%q is not KEY=CiphertextBlob", value)
+	}
+	s.keyID, s.wrapped = key, blob
+	return nil
+}
+
+func (s *shredder) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.keyID
+}
+
+// warn logs at startup if records won't outlive the enclave.
+func (s *shredder) warn() {
+	if s.keyID != "" && s.statePath == "" {
+		slog.Warn("Crypto-shredding keys are kept in memory only: every record becomes unreadable when the enclave stops. Set --shred-state to keep them", "key_id", s.keyID)
+	}
+}
+
+// keyringFor returns the keyring, unwrapping the root key and loading the
+// saved state the first time, once it has checked that req may use it.
+// The caller must hold s.mu.
+func (s *shredder) keyringFor(ctx context.Context, logger *slog.Logger, req *protocol.Request) (*shred.Keyring, error) {
+	if s.keyID == "" {
+		return nil, protocol.Errorf(protocol.CodeUnsupportedOperation, "crypto-shredding isn't set up; start the enclave with --shred-key")
+	}
+	if req.KeyId != "" && req.KeyId != s.keyID {
+		return nil, protocol.Errorf(protocol.CodePolicyDenied, "%s records are keyed by %s, not %s", req.Operation, s.keyID, req.KeyId).
+			WithDetail("rule", "shred-key").
+			WithDetail("key_id", req.KeyId)
+	}
+	if req.RecordId == "" {
+		return nil, protocol.Errorf(protocol.CodeBadRequest, "%s needs a record ID", req.Operation)
+	}
+	if s.keyring != nil {
+		return s.keyring, nil
+	}
+
+	logger.Debug("Unwrapping crypto-shredding root key through vsock-proxy", "key_id", s.keyID)
+	root, err := decryptThroughProxy(ctx, logger, &protocol.Request{
+		Operation: protocol.OpDecrypt,
+		KeyId:     s.keyID,
+		RequestId: req.RequestId,
+		Payload:   payload.FromString(s.wrapped),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping crypto-shredding root key for %s failed: %w", s.keyID, err)
+	}
+	defer envelope.Zero(root)
+
+	var state []byte
+	if s.statePath != "" {
+		state, err = os.ReadFile(s.statePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read --shred-state: %v", err)
+		}
+	}
+	k, err := shred.New(root, state)
+	if err != nil {
+		return nil, fmt.Errorf("crypto-shredding state in %s: %v", s.statePath, err)
+	}
+	s.keyring, s.saved = k, k.Changes()
+	logger.Info("Crypto-shredding keyring ready", "key_id", s.keyID, "records", len(k.Records()))
+	return k, nil
+}
+
+// save writes the keyring's state if it changed, replacing the file in one
+// rename so a crash leaves either the old state or the new one. The caller
+// must hold s.mu.
+func (s *shredder) save() error {
+	if s.statePath == "" || s.keyring.Changes() == s.saved {
+		return nil
+	}
+	changes := s.keyring.Changes()
+	state, err := s.keyring.Save(enclaveRand)
+	if err != nil {
+		return err
+	}
+	tmp := s.statePath + ".tmp"
+	if err := os.WriteFile(tmp, state, 0o600); err != nil {
+		return fmt.Errorf("failed to write crypto-shredding state: %v", err)
+	}
+	if err := os.Rename(tmp, s.statePath); err != nil {
+		return fmt.Errorf("failed to write crypto-shredding state: %v", err)
+	}
+	s.saved = changes
+	return nil
+}
+
+// shredError turns the errors of pkg/shred into protocol errors.
+func shredError(recordID string, err error) error {
+	switch {
+	case errors.Is(err, shred.ErrShredded):
+		perr := protocol.Errorf(protocol.CodePolicyDenied, "record %q has been shredded", recordID).
+			WithDetail("rule", "shredded").
+			WithDetail("record_id", recordID)
+		if at, ok := shredding.keyring.Shredded(recordID); ok {
+			perr.WithDetail("shredded_at", at.Format(time.RFC3339))
+		}
+		return perr
+	case errors.Is(err, shred.ErrUnknownRecord):
+		return protocol.Errorf(protocol.CodeBadRequest, "no key for record %q: it was never encrypted here", recordID)
+	case errors.Is(err, shred.ErrOpen):
+		return protocol.Errorf(protocol.CodeBadRequest, "ciphertext failed authentication: it is damaged or belongs to another record than %q", recordID)
+	}
+	return err
+}
+
+// shredOperation performs RecordEncrypt, RecordDecrypt and Shred.
+func shredOperation(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+	s := shredding
+	s.mu.Lock()
+	k, err := s.keyringFor(ctx, logger, req)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+
+	switch req.Operation {
+	case protocol.OpRecordEncrypt:
+		defer s.mu.Unlock()
+		if err := allowAlgorithm(envelope.AlgorithmAES256GCM); err != nil {
+			return nil, err
+		}
+		ciphertext, err := k.Encrypt(enclaveRand, req.RecordId, req.Payload.Bytes())
+		if err != nil {
+			return nil, shredError(req.RecordId, err)
+		}
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+		return []byte(base64.StdEncoding.EncodeToString(ciphertext)), nil
+
+	case protocol.OpRecordDecrypt:
+		// Decrypting changes nothing, so it needn't wait for others
+		s.mu.Unlock()
+		ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(req.Payload.Bytes())))
+		if err != nil {
+			return nil, protocol.Errorf(protocol.CodeBadRequest, "record ciphertext isn't base64: %v", err)
+		}
+		plaintext, err := k.Decrypt(req.RecordId, ciphertext)
+		if err != nil {
+			return nil, shredError(req.RecordId, err)
+		}
+		return plaintext, nil
+
+	default: // protocol.OpShred
+		defer s.mu.Unlock()
+		hadKey := k.Shred(req.RecordId, time.Now())
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+		at, _ := k.Shredded(req.RecordId)
+		logger.Info("Record shredded", "record_id", req.RecordId, "had_key", hadKey)
+		return json.Marshal(&protocol.ShredResult{RecordId: req.RecordId, HadKey: hadKey, ShreddedAt: at})
+	}
+}
+
+// checkShredState checks --shred-state: its directory must exist, since
+// the state is replaced through a file written next to it.
+func checkShredState(path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("--shred-state directory: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package enclave
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// withShredKey sets up alias/dev-shred-key for crypto-shredding with a
+// root key the fake vsock-proxy unwraps, keeping state in statePath.
+func withShredKey(t *testing.T, statePath string) {
+	old := shredding
+	t.Cleanup(func() { shredding = old })
+	shredding = &shredder{statePath: statePath}
+	if err := shredding.Set("alias/dev-shred-key=blob:" + strings.Repeat("r", 32)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recordRequest(op, record, input string) *protocol.Request {
+	return &protocol.Request{RequestId: "r1", Operation: op, RecordId: record, Payload: payload.FromString(input)}
+}
+
+func TestShred(t *testing.T) {
+	fakeProxy(t)
+	withShredKey(t, "")
+
+	encrypt := func(record, plaintext string) string {
+		resp := call(t, recordRequest(protocol.OpRecordEncrypt, record, plaintext))
+		if err := resp.Err(); err != nil {
+			t.Fatalf("RecordEncrypt %s: %v", record, err)
+		}
+		return resp.Result.Reveal()
+	}
+	alice, bob := encrypt("user-1", "alice@example.com"), encrypt("user-2", "bob@example.com")
+
+	resp := call(t, recordRequest(protocol.OpRecordDecrypt, "user-1", alice))
+	if err := resp.Err(); err != nil || resp.Result.Reveal() != "alice@example.com" {
+		t.Fatalf("RecordDecrypt = %q, %v", resp.Result.Reveal(), err)
+	}
+	if resp := call(t, recordRequest(protocol.OpRecordDecrypt, "user-2", alice)); resp.Error == nil || resp.Error.Code != protocol.CodeBadRequest {
+		t.Fatalf("ciphertext of another record: %+v", resp.Error)
+	}
+
+	resp = call(t, recordRequest(protocol.OpShred, "user-1", ""))
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var r protocol.ShredResult
+	if err := json.Unmarshal(resp.Result.Bytes(), &r); err != nil || r.RecordId != "user-1" || !r.HadKey || r.ShreddedAt.IsZero() {
+		t.Fatalf("Shred = %s, %v", resp.Result.Reveal(), err)
+	}
+
+	for _, req := range []*protocol.Request{
+		recordRequest(protocol.OpRecordDecrypt, "user-1", alice),
+		recordRequest(protocol.OpRecordEncrypt, "user-1", "alice again"),
+	} {
+		resp := call(t, req)
+		if resp.Error == nil || resp.Error.Code != protocol.CodePolicyDenied || resp.Error.Details["rule"] != "shredded" || resp.Error.Details["shredded_at"] == "" {
+			t.Fatalf("%s after Shred: %+v", req.Operation, resp.Error)
+		}
+	}
+
+	// Other records are untouched, and shredding again is harmless
+	if resp := call(t, recordRequest(protocol.OpRecordDecrypt, "user-2", bob)); resp.Result.Reveal() != "bob@example.com" {
+		t.Fatalf("other record after Shred: %+v", resp.Error)
+	}
+	resp = call(t, recordRequest(protocol.OpShred, "user-1", ""))
+	if json.Unmarshal(resp.Result.Bytes(), &r); resp.Error != nil || r.HadKey {
+		t.Fatalf("second Shred = %s, %+v", resp.Result.Reveal(), resp.Error)
+	}
+}
+
+func TestShredState(t *testing.T) {
+	fakeProxy(t)
+	path := filepath.Join(t.TempDir(), "shred.state")
+	withShredKey(t, path)
+
+	resp := call(t, recordRequest(protocol.OpRecordEncrypt, "user-1", "alice"))
+	alice := resp.Result.Reveal()
+	resp = call(t, recordRequest(protocol.OpRecordEncrypt, "user-2", "bob"))
+	bob := resp.Result.Reveal()
+	call(t, recordRequest(protocol.OpShred, "user-2", ""))
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted enclave picks the records up from the state file
+	withShredKey(t, path)
+	if resp := call(t, recordRequest(protocol.OpRecordDecrypt, "user-1", alice)); resp.Result.Reveal() != "alice" {
+		t.Fatalf("after restart: %+v", resp.Error)
+	}
+	if resp := call(t, recordRequest(protocol.OpRecordDecrypt, "user-2", bob)); resp.Error == nil || resp.Error.Details["rule"] != "shredded" {
+		t.Fatalf("shredded record after restart: %+v", resp.Error)
+	}
+}
+
+func TestShredValidation(t *testing.T) {
+	fakeProxy(t)
+
+	withShredKey(t, "")
+	otherKey := recordRequest(protocol.OpRecordEncrypt, "user-1", "x")
+	otherKey.KeyId = "alias/dev-key"
+	tests := []struct {
+		name string
+		req  *protocol.Request
+		code string
+	}{
+		{"no record ID", recordRequest(protocol.OpRecordEncrypt, "", "x"), protocol.CodeBadRequest},
+		{"other key", otherKey, protocol.CodePolicyDenied},
+		{"unknown record", recordRequest(protocol.OpRecordDecrypt, "user-9", "AAAA"), protocol.CodeBadRequest},
+		{"not base64", recordRequest(protocol.OpRecordDecrypt, "user-1", "%%%"), protocol.CodeBadRequest},
+	}
+	for _, tt := range tests {
+		if resp := call(t, tt.req); resp.Error == nil || resp.Error.Code != tt.code {
+			t.Errorf("%s: got %+v, want %s", tt.name, resp.Error, tt.code)
+		}
+	}
+
+	shredding = &shredder{}
+	if resp := call(t, recordRequest(protocol.OpShred, "user-1", "")); resp.Error == nil || resp.Error.Code != protocol.CodeUnsupportedOperation {
+		t.Fatalf("without --shred-key: %+v", resp.Error)
+	}
+}
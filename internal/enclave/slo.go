@@ -0,0 +1,163 @@
+// enclave/slo.go
+package enclave
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The SLO is evaluated over the most recent sloWindow requests that
+// completed within sloMaxAge. Ageing samples out lets a shedding enclave
+// recover once the bad requests are old enough.
+const (
+	sloWindow = 1000
+	sloMaxAge = time.Minute
+)
+
+// sloSample is one completed request.
+type sloSample struct {
+	at        time.Time
+	queueWait time.Duration
+	latency   time.Duration
+	ok        bool
+}
+
+// sloTracker follows request queue depth and latency against a latency SLO:
+// objective (e.g. 0.99) of requests must succeed within target. The burn
+// rate is the observed bad fraction divided by the error budget
+// (1 - objective); a burn rate above 1 means the budget is being spent
+// faster than the SLO allows.
+type sloTracker struct {
+	target    time.Duration
+	objective float64
+	shedBurn  float64 // shed new connections above this burn rate (0 = never)
+
+	depth int64 // requests accepted but not yet answered
+
+	mu      sync.Mutex
+	samples []sloSample
+	next    int
+	shed    int64
+}
+
+func newSLOTracker(target time.Duration, objective, shedBurn float64) *sloTracker {
+	return &sloTracker{
+		target:    target,
+		objective: objective,
+		shedBurn:  shedBurn,
+		samples:   make([]sloSample, 0, sloWindow),
+	}
+}
+
+// enqueue records that a connection was accepted and returns the time it
+// entered the queue.
+func (t *sloTracker) enqueue() time.Time {
+	atomic.AddInt64(&t.depth, 1)
+	return time.Now()
+}
+
+// done records the outcome of a request that was enqueued at queuedAt and
+// started processing at startedAt.
+func (t *sloTracker) done(queuedAt, startedAt time.Time, ok bool) {
+	atomic.AddInt64(&t.depth, -1)
+	s := sloSample{
+		at:        time.Now(),
+		queueWait: startedAt.Sub(queuedAt),
+		latency:   time.Since(queuedAt),
+		ok:        ok,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < sloWindow {
+		t.samples = append(t.samples, s)
+	} else {
+		t.samples[t.next] = s
+		t.next = (t.next + 1) % sloWindow
+	}
+}
+
+// burnRate returns the current error-budget burn rate over the window.
+func (t *sloTracker) burnRate() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.burnRateLocked()
+}
+
+func (t *sloTracker) burnRateLocked() float64 {
+	if t.objective >= 1 {
+		return 0
+	}
+	cutoff := time.Now().Add(-sloMaxAge)
+	total, bad := 0, 0
+	for _, s := range t.samples {
+		if s.at.Before(cutoff) {
+			continue
+		}
+		total++
+		if !s.ok || s.latency > t.target {
+			bad++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / (1 - t.objective)
+}
+
+// shouldShed reports whether a new connection should be rejected because
+// the SLO is being violated. Shedding is disabled when shedBurn is 0.
+func (t *sloTracker) shouldShed() bool {
+	if t.shedBurn <= 0 || t.burnRate() <= t.shedBurn {
+		return false
+	}
+	atomic.AddInt64(&t.shed, 1)
+	return true
+}
+
+// report logs queue depth, latency percentiles and burn rate.
+func (t *sloTracker) report() {
+	t.mu.Lock()
+	cutoff := time.Now().Add(-sloMaxAge)
+	var latencies []time.Duration
+	var totalWait time.Duration
+	for _, s := range t.samples {
+		if s.at.Before(cutoff) {
+			continue
+		}
+		latencies = append(latencies, s.latency)
+		totalWait += s.queueWait
+	}
+	burn := t.burnRateLocked()
+	t.mu.Unlock()
+	n := len(latencies)
+
+	depth := atomic.LoadInt64(&t.depth)
+	shed := atomic.LoadInt64(&t.shed)
+	if n == 0 {
+		slog.Info("SLO report: no requests completed", "queue_depth", depth, "window", sloMaxAge, connsAttr())
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	slog.Info("SLO report",
+		"queue_depth", depth,
+		"window_requests", n,
+		"avg_queue_time", totalWait/time.Duration(n),
+		"p50", latencies[n/2],
+		"p99", latencies[(n*99)/100],
+		"target", t.target,
+		"objective", t.objective,
+		"burn_rate", burn,
+		"shed", shed,
+		connsAttr())
+}
+
+// reportEvery logs an SLO report at the given interval, forever.
+func (t *sloTracker) reportEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.report()
+	}
+}
@@ -0,0 +1,180 @@
+// enclave/stream.go
+package enclave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// defaultChunkSize is the chunk size of a StreamEncrypt that doesn't ask
+// for one.
+const defaultChunkSize = 1 << 20
+
+func isStreamOperation(op string) bool {
+	return op == protocol.OpStreamEncrypt || op == protocol.OpStreamDecrypt
+}
+
+// serveStream serves a StreamEncrypt or StreamDecrypt connection: the
+// opening request first, then one request per chunk until the final one.
+// Only one data key is fetched or unwrapped per stream, and only one chunk
+// is held in memory at a time, so payloads of any size can go through.
+// opened is called once the stream is open, or failed to open, so the
+// SLO counts opening the stream rather than the whole transfer. It
+// returns whether the stream completed. connCtx is the connection's
+// context.
+func serveStream(connCtx context.Context, conn net.Conn, logger *slog.Logger, first *protocol.Request, opened func(ok bool)) bool {
+	budget := operationTimeouts.Budget(first, requestTimeout)
+	ctx, cancel := context.WithTimeout(protocol.WithRequestID(connCtx, first.RequestId), budget)
+	ctx, timing := withTiming(ctx)
+	start := time.Now()
+	s, result, err := openStream(ctx, logger, first)
+	cancel()
+	if writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = protocol.Errorf(protocol.CodeTimeout, "opening the stream did not complete within its %v budget: %v", budget, err)
+		}
+		logger.Warn("Opening stream failed", "operation", first.Operation, "err", err)
+		resp := protocol.Failed(first, err)
+		resp.Timing = timing.report(budget, time.Since(start))
+		protocol.WriteResponse(conn, resp)
+		opened(false)
+		return false
+	}
+	resp := protocol.OK(first, result)
+	resp.Timing = timing.report(budget, time.Since(start))
+	if err := protocol.WriteResponse(conn, resp); err != nil {
+		logger.Warn("Write error", "err", err)
+		opened(false)
+		return false
+	}
+	opened(true)
+	logger.Info("Stream opened", "operation", first.Operation, "chunk_size", s.Header().ChunkSize, "key_id", s.Header().KeyId)
+
+	var inBytes, outBytes int
+	for {
+		// Chunks may be a while apart, such as when the connector reads
+		// from a slow pipe, but not longer than a request may take to
+		// arrive
+		if readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		req, err := protocol.ReadRequest(conn)
+		if err != nil {
+			if err == io.EOF {
+				logger.Warn("Connector closed the stream before its final chunk", "chunks", s.Chunks())
+			} else {
+				logger.Warn("Read error", "err", err, "chunks", s.Chunks())
+				protocol.WriteResponse(conn, protocol.Failed(req, err))
+			}
+			return false
+		}
+
+		var result []byte
+		switch {
+		case req.Operation != first.Operation:
+			err = protocol.Errorf(protocol.CodeBadRequest, "expected the next %s chunk, got %s", first.Operation, req.Operation)
+		case req.Stream == nil:
+			err = protocol.Errorf(protocol.CodeBadRequest, "%s chunk has no stream parameters", req.Operation)
+		case first.Operation == protocol.OpStreamEncrypt:
+			result, err = s.Seal(req.Payload.Bytes(), req.Stream.Final)
+		default:
+			result, err = s.Open(req.Payload.Bytes(), req.Stream.Final)
+		}
+		if writeTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		if err != nil {
+			var perr *protocol.Error
+			if !errors.As(err, &perr) {
+				err = protocol.Errorf(protocol.CodeBadRequest, "%v", err)
+			}
+			logger.Warn("Stream chunk failed", "chunk", s.Chunks(), "err", err)
+			protocol.WriteResponse(conn, protocol.Failed(req, err))
+			return false
+		}
+		logger.Debug("Stream chunk", "chunk", s.Chunks()-1, logging.Payload("input", req.Payload.Bytes()))
+		if err := protocol.WriteResponse(conn, protocol.OK(req, result)); err != nil {
+			logger.Warn("Write error", "err", err)
+			return false
+		}
+		inBytes += req.Payload.Len()
+		outBytes += len(result)
+		if req.Stream.Final {
+			logger.Info("Stream completed", "operation", first.Operation, "chunks", s.Chunks(), "input_bytes", inBytes, "output_bytes", outBytes, "duration", time.Since(start))
+			return true
+		}
+	}
+}
+
+// openStream starts the stream first asks for: a fresh data key for
+// StreamEncrypt, whose header is the result, or the header's data key,
+// unwrapped through KMS Decrypt, for StreamDecrypt.
+func openStream(ctx context.Context, logger *slog.Logger, first *protocol.Request) (*envelope.Stream, []byte, error) {
+	if err := deterministicKeys.checkOperation(logger, first); err != nil {
+		return nil, nil, err
+	}
+	if err := allowAlgorithm(envelope.AlgorithmAES256GCMStream); err != nil {
+		return nil, nil, err
+	}
+
+	if first.Operation == protocol.OpStreamDecrypt {
+		h, err := envelope.ParseStreamHeader(first.Payload.Bytes())
+		if err != nil {
+			return nil, nil, protocol.Errorf(protocol.CodeBadRequest, "%v", err)
+		}
+		logger.Debug("Unwrapping stream data key through vsock-proxy")
+		key, err := decryptThroughProxy(ctx, logger, &protocol.Request{
+			Operation: protocol.OpDecrypt,
+			RequestId: first.RequestId,
+			Payload:   payload.FromString(h.EncryptedDataKey),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("data key Decrypt failed: %w", err)
+		}
+		// The AES key schedule keeps its own copy
+		defer envelope.Zero(key)
+		s, err := envelope.OpenStream(h, key)
+		if err != nil {
+			return nil, nil, protocol.Errorf(protocol.CodeBadRequest, "%v", err)
+		}
+		return s, nil, nil
+	}
+
+	chunkSize := defaultChunkSize
+	if first.Stream != nil && first.Stream.ChunkSize != 0 {
+		chunkSize = first.Stream.ChunkSize
+	}
+	if chunkSize < 1 || chunkSize > envelope.MaxChunkSize {
+		return nil, nil, protocol.Errorf(protocol.CodeBadRequest, "chunk size must be 1 to %d bytes, got %d", envelope.MaxChunkSize, chunkSize)
+	}
+	logger.Debug("Requesting stream data key from vsock-proxy")
+	reply, err := forwardToVsockProxy(ctx, logger, &protocol.Request{Operation: protocol.OpGenerateDataKey, KeyId: first.KeyId, RequestId: first.RequestId})
+	if err != nil {
+		return nil, nil, fmt.Errorf("GenerateDataKey failed: %w", err)
+	}
+	var dataKey protocol.DataKey
+	if err := json.Unmarshal(reply, &dataKey); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse data key: %v", err)
+	}
+	defer envelope.Zero(dataKey.Plaintext.Bytes())
+	s, err := envelope.NewStream(enclaveRand, dataKey.Plaintext.Bytes(), dataKey.CiphertextBlob, dataKey.KeyId, chunkSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := s.Header().Marshal()
+	return s, header, err
+}
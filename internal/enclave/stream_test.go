@@ -0,0 +1,138 @@
+package enclave
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// streamConn opens a connection to handleVsockConnection for a stream.
+func streamConn(t *testing.T) (roundTrip func(*protocol.Request) *protocol.Response) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go handleVsockConnection(context.Background(), server, slog.New(slog.DiscardHandler), slo.enqueue())
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	return func(req *protocol.Request) *protocol.Response {
+		t.Helper()
+		req.RequestId = "s1"
+		if err := protocol.WriteRequest(client, req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := protocol.ReadResponse(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+}
+
+// encryptStream encrypts data in chunks of 100 bytes and returns the
+// header and the sealed chunks.
+func encryptStream(t *testing.T, data []byte) ([]byte, [][]byte) {
+	t.Helper()
+	rt := streamConn(t)
+	resp := rt(&protocol.Request{Operation: protocol.OpStreamEncrypt, Stream: &protocol.Stream{ChunkSize: 100}})
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	header := resp.Result.Bytes()
+	var chunks [][]byte
+	for {
+		n := min(100, len(data))
+		final := n < 100
+		resp := rt(&protocol.Request{Operation: protocol.OpStreamEncrypt, Stream: &protocol.Stream{Final: final}, Payload: payload.New(data[:n])})
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, resp.Result.Bytes())
+		data = data[n:]
+		if final {
+			return header, chunks
+		}
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	proxy := fakeProxy(t)
+	data := bytes.Repeat([]byte("0123456789"), 25)
+
+	header, chunks := encryptStream(t, data)
+	h, err := envelope.ParseStreamHeader(header)
+	if err != nil || h.ChunkSize != 100 || h.EncryptedDataKey != "wrapped" || len(chunks) != 3 {
+		t.Fatalf("header %s, %d chunks: %v", header, len(chunks), err)
+	}
+
+	rt := streamConn(t)
+	if resp := rt(&protocol.Request{Operation: protocol.OpStreamDecrypt, Payload: payload.New(header)}); resp.Err() != nil {
+		t.Fatal(resp.Err())
+	}
+	var got []byte
+	for i, c := range chunks {
+		resp := rt(&protocol.Request{Operation: protocol.OpStreamDecrypt, Stream: &protocol.Stream{Final: i == len(chunks)-1}, Payload: payload.New(c)})
+		if err := resp.Err(); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		got = append(got, resp.Result.Bytes()...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %q", got)
+	}
+
+	// One GenerateDataKey for the encrypting stream, one Decrypt for the
+	// decrypting one, however many chunks there are
+	var ops []string
+	for len(proxy) > 0 {
+		ops = append(ops, (<-proxy).Operation)
+	}
+	if strings.Join(ops, ",") != "GenerateDataKey,Decrypt" {
+		t.Fatalf("vsock-proxy got %v", ops)
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	fakeProxy(t)
+	header, chunks := encryptStream(t, bytes.Repeat([]byte("x"), 250))
+
+	rt := streamConn(t)
+	rt(&protocol.Request{Operation: protocol.OpStreamDecrypt, Payload: payload.New(header)})
+	rt(&protocol.Request{Operation: protocol.OpStreamDecrypt, Stream: &protocol.Stream{}, Payload: payload.New(chunks[0])})
+	resp := rt(&protocol.Request{Operation: protocol.OpStreamDecrypt, Stream: &protocol.Stream{Final: true}, Payload: payload.New(chunks[1])})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeBadRequest || !strings.Contains(resp.Error.Message, "truncated") {
+		t.Fatalf("truncated stream: %+v", resp.Error)
+	}
+}
+
+func TestStreamBadRequests(t *testing.T) {
+	fakeProxy(t)
+
+	rt := streamConn(t)
+	if resp := rt(&protocol.Request{Operation: protocol.OpStreamEncrypt, Stream: &protocol.Stream{ChunkSize: envelope.MaxChunkSize + 1}}); resp.Error == nil || resp.Error.Code != protocol.CodeBadRequest {
+		t.Fatalf("oversized chunks: %+v", resp.Error)
+	}
+
+	rt = streamConn(t)
+	if resp := rt(&protocol.Request{Operation: protocol.OpStreamDecrypt, Payload: payload.FromString("{}")}); resp.Error == nil || resp.Error.Code != protocol.CodeBadRequest {
+		t.Fatalf("bad header: %+v", resp.Error)
+	}
+
+	rt = streamConn(t)
+	rt(&protocol.Request{Operation: protocol.OpStreamEncrypt, Stream: &protocol.Stream{ChunkSize: 10}})
+	if resp := rt(&protocol.Request{Operation: protocol.OpEncrypt, Payload: payload.FromString("x")}); resp.Error == nil || resp.Error.Code != protocol.CodeBadRequest {
+		t.Fatalf("other operation in a stream: %+v", resp.Error)
+	}
+
+	rt = streamConn(t)
+	rt(&protocol.Request{Operation: protocol.OpStreamEncrypt, Stream: &protocol.Stream{ChunkSize: 10}})
+	if resp := rt(&protocol.Request{Operation: protocol.OpStreamEncrypt, Stream: &protocol.Stream{}, Payload: payload.FromString("short")}); resp.Error == nil || resp.Error.Code != protocol.CodeBadRequest {
+		t.Fatalf("short chunk before the final one: %+v", resp.Error)
+	}
+}
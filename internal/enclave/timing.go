@@ -0,0 +1,65 @@
+// enclave/timing.go
+package enclave
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// requestTimeout and operationTimeouts bound how long the enclave works on
+// one request (set by --request-timeout and --operation-timeouts).
+var (
+	requestTimeout    time.Duration
+	operationTimeouts protocol.Budgets
+)
+
+// requestTiming collects the stages of one request for the Timing in its
+// response. It travels in the request's context so the upstream calls deep
+// in envelope operations can add to it.
+type requestTiming struct {
+	mu     sync.Mutex
+	stages map[string]float64
+}
+
+type timingKey struct{}
+
+func withTiming(ctx context.Context) (context.Context, *requestTiming) {
+	t := &requestTiming{stages: make(map[string]float64)}
+	return context.WithValue(ctx, timingKey{}, t), t
+}
+
+// addStage adds d to the named stage of ctx's request, if it is timed.
+// Stages repeat for operations with several upstream calls, so they add up.
+func addStage(ctx context.Context, name string, d time.Duration) {
+	addStageMs(ctx, name, protocol.Ms(d))
+}
+
+func addStageMs(ctx context.Context, name string, ms float64) {
+	t, ok := ctx.Value(timingKey{}).(*requestTiming)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	t.stages[name] += ms
+	t.mu.Unlock()
+}
+
+// addUpstreamTiming folds the stages the vsock-proxy reported into ctx's
+// request, prefixed with "proxy_".
+func addUpstreamTiming(ctx context.Context, timing *protocol.Timing) {
+	if timing == nil {
+		return
+	}
+	for name, ms := range timing.StagesMs {
+		addStageMs(ctx, "proxy_"+name, ms)
+	}
+}
+
+func (t *requestTiming) report(budget, total time.Duration) *protocol.Timing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &protocol.Timing{BudgetMs: protocol.Ms(budget), TotalMs: protocol.Ms(total), StagesMs: t.stages}
+}
@@ -0,0 +1,384 @@
+// enclave/trace.go
+package enclave
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"nitro-dev-qemu/pkg/envelope"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/watchdog"
+)
+
+// A request trace is a complete record of what the enclave did for one
+// request: the request as it arrived, the decisions it took (budget,
+// content policy, route), every call it made to the vsock-proxy or the
+// callout service with its outcome, its timings and its response. With
+// --trace-file, the enclave appends one trace per request as a JSON line.
+//
+// Payloads never appear in a trace in the clear. By default they are
+// redacted to their length; with --trace-key-file they are sealed with
+// AES-256-GCM, so whoever holds the key can replay a trace with the data
+// that triggered a bug. replayTrace re-executes a trace against the
+// handler code, the recorded call outcomes standing in for the vsock-proxy
+// and KMS, which is how trace_test.go reproduces production requests.
+//
+// Streams are not traced: their chunks span several requests.
+
+const traceVersion = 1
+
+// traces writes the request traces (set by --trace-file and
+// --trace-key-file); nil when tracing is off.
+var traces *traceWriter
+
+type requestTrace struct {
+	Version      int             `json:"version"`
+	Timestamp    time.Time       `json:"timestamp"`
+	RequestID    string          `json:"request_id"`
+	ConfigSHA384 string          `json:"config_sha384,omitempty"`
+	Request      tracedRequest   `json:"request"`
+	Decisions    []traceDecision `json:"decisions,omitempty"`
+	Calls        []tracedCall    `json:"calls,omitempty"`
+	Response     tracedResponse  `json:"response"`
+
+	mu   sync.Mutex
+	aead cipher.AEAD
+}
+
+// tracedRequest is a request with its payload replaced by a tracedPayload,
+// which shadows the embedded Payload field in JSON.
+type tracedRequest struct {
+	*protocol.Request
+	Payload tracedPayload `json:"payload"`
+}
+
+// tracedPayload is a payload's length and, when traces are sealed, its
+// contents: a random nonce followed by the AES-256-GCM ciphertext, with
+// the request ID as additional data.
+type tracedPayload struct {
+	Bytes  int    `json:"bytes"`
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+type traceDecision struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// tracedCall is one call to another service on the request's behalf.
+// Service is "vsock-proxy" or "callout".
+type tracedCall struct {
+	Service    string          `json:"service"`
+	Request    tracedRequest   `json:"request"`
+	Result     tracedPayload   `json:"result"`
+	Error      *protocol.Error `json:"error,omitempty"`
+	DurationMs float64         `json:"duration_ms"`
+}
+
+type tracedResponse struct {
+	Status string           `json:"status"`
+	Error  *protocol.Error  `json:"error,omitempty"`
+	Result tracedPayload    `json:"result"`
+	Timing *protocol.Timing `json:"timing,omitempty"`
+}
+
+// traceWriter appends traces to a JSON Lines file. Like the connector's
+// transcript, a nil *traceWriter discards traces.
+type traceWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	aead cipher.AEAD
+}
+
+// openTraces opens the trace file at path. keyPath, if set, names a file
+// holding a hex-encoded 32-byte key to seal payloads with.
+func openTraces(path, keyPath string) (*traceWriter, error) {
+	var aead cipher.AEAD
+	if keyPath != "" {
+		key, err := readTraceKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		if aead, err = newTraceAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	return &traceWriter{file: f, enc: json.NewEncoder(f), aead: aead}, nil
+}
+
+// readTraceKey reads the hex-encoded 32-byte key in path.
+func readTraceKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trace key: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must hold 32 bytes, hex encoded (e.g. from openssl rand -hex 32)", path)
+	}
+	return key, nil
+}
+
+func newTraceAEAD(key []byte) (cipher.AEAD, error) {
+	if err := allowAlgorithm(envelope.AlgorithmAES256GCM); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type traceKey struct{}
+
+// start begins the trace of req and returns a context carrying it.
+func (w *traceWriter) start(ctx context.Context, req *protocol.Request) (context.Context, *requestTrace) {
+	if w == nil {
+		return ctx, nil
+	}
+	tr := &requestTrace{
+		Version:      traceVersion,
+		Timestamp:    time.Now().UTC(),
+		RequestID:    req.RequestId,
+		ConfigSHA384: measurement.ConfigSHA384,
+		aead:         w.aead,
+	}
+	tr.Request = tr.request(req)
+	return context.WithValue(ctx, traceKey{}, tr), tr
+}
+
+// finish completes tr with the response and appends it to the file.
+func (w *traceWriter) finish(tr *requestTrace, resp *protocol.Response) {
+	if w == nil || tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	tr.Response = tracedResponse{Status: resp.Status, Error: resp.Error, Result: tr.seal(resp.Result.Bytes()), Timing: resp.Timing}
+	tr.mu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(tr); err != nil {
+		slog.Warn("Failed to write request trace", "request_id", tr.RequestID, "err", err)
+	}
+}
+
+func (w *traceWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+func (tr *requestTrace) request(req *protocol.Request) tracedRequest {
+	r := *req
+	r.Payload = payload.Payload{}
+	return tracedRequest{Request: &r, Payload: tr.seal(req.Payload.Bytes())}
+}
+
+func (tr *requestTrace) seal(b []byte) tracedPayload {
+	p := tracedPayload{Bytes: len(b)}
+	if tr.aead != nil {
+		nonce := make([]byte, tr.aead.NonceSize(), tr.aead.NonceSize()+len(b)+tr.aead.Overhead())
+		rand.Read(nonce)
+		p.Sealed = tr.aead.Seal(nonce, nonce, b, []byte(tr.RequestID))
+	}
+	return p
+}
+
+// traceDecide records a decision taken for ctx's request, if it is traced.
+func traceDecide(ctx context.Context, name, value string) {
+	tr, ok := ctx.Value(traceKey{}).(*requestTrace)
+	if !ok {
+		return
+	}
+	tr.mu.Lock()
+	tr.Decisions = append(tr.Decisions, traceDecision{Name: name, Value: value})
+	tr.mu.Unlock()
+}
+
+// traceCall makes a call to service on behalf of ctx's request by running
+// call, and records it if the request is traced. When ctx is replaying a
+// trace, the recorded outcome is returned instead and call is not run.
+func traceCall(ctx context.Context, service string, req *protocol.Request, call func() ([]byte, error)) ([]byte, error) {
+	if r, ok := ctx.Value(replayKey{}).(*replayer); ok {
+		return r.next(service, req)
+	}
+	tr, ok := ctx.Value(traceKey{}).(*requestTrace)
+	if !ok {
+		return call()
+	}
+
+	start := time.Now()
+	result, err := call()
+	c := tracedCall{Service: service, Request: tr.request(req), Result: tr.seal(result), DurationMs: protocol.Ms(time.Since(start))}
+	if err != nil {
+		c.Error = protocol.Failed(req, err).Error
+	}
+	tr.mu.Lock()
+	tr.Calls = append(tr.Calls, c)
+	tr.mu.Unlock()
+	return result, err
+}
+
+// sealed reports whether tr's payloads were sealed rather than redacted.
+func (tr *requestTrace) sealed() bool {
+	return tr.Request.Payload.Sealed != nil
+}
+
+// readTraces reads the traces in a --trace-file.
+func readTraces(path string) ([]*requestTrace, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var traces []*requestTrace
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		tr := &requestTrace{}
+		if err := dec.Decode(tr); err != nil {
+			return nil, fmt.Errorf("%s: trace %d: %v", path, len(traces)+1, err)
+		}
+		if tr.Version != traceVersion {
+			return nil, fmt.Errorf("%s: trace %d has version %d, want %d", path, len(traces)+1, tr.Version, traceVersion)
+		}
+		traces = append(traces, tr)
+	}
+	return traces, nil
+}
+
+type replayKey struct{}
+
+// replayer answers the calls of a replayed request from its trace. Each
+// call gets the outcome of the first recorded call not yet used with the
+// same service, operation and key, so concurrent calls may be matched in
+// a different order than they were made, which for the same operation
+// and key makes no difference to the handler.
+type replayer struct {
+	mu    sync.Mutex
+	trace *requestTrace
+	used  []bool
+}
+
+func (r *replayer) next(service string, req *protocol.Request) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, c := range r.trace.Calls {
+		if r.used[i] || c.Service != service || c.Request.Operation != req.Operation || c.Request.KeyId != req.KeyId {
+			continue
+		}
+		r.used[i] = true
+		if c.Error != nil {
+			return nil, c.Error
+		}
+		return r.trace.open(c.Result)
+	}
+	return nil, protocol.Errorf(protocol.CodeInternal, "replay: the trace has no %s %s call for key %q left", service, req.Operation, req.KeyId)
+}
+
+// unused returns how many recorded calls the replay didn't make.
+func (r *replayer) unused() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, used := range r.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
+
+// open returns the contents of a sealed payload, or zeros of its length
+// for a redacted one.
+func (tr *requestTrace) open(p tracedPayload) ([]byte, error) {
+	if p.Sealed == nil {
+		return make([]byte, p.Bytes), nil
+	}
+	if tr.aead == nil {
+		return nil, errors.New("replay: the trace's payloads are sealed, and no trace key was given")
+	}
+	n := tr.aead.NonceSize()
+	if len(p.Sealed) < n {
+		return nil, errors.New("replay: sealed payload is truncated")
+	}
+	b, err := tr.aead.Open(nil, p.Sealed[:n], p.Sealed[n:], []byte(tr.RequestID))
+	if err != nil {
+		return nil, fmt.Errorf("replay: failed to open sealed payload (wrong trace key?): %v", err)
+	}
+	return b, nil
+}
+
+// replayTrace re-executes tr's request against the handler code with the
+// budget it had, answering its calls to the vsock-proxy and the callout
+// service from the trace, and returns the response the enclave gives now.
+// key is the --trace-key-file key for sealed traces, or nil. The enclave
+// configuration (pipelines, policies, keys) is the caller's; it should
+// match the one the trace was recorded with, as ConfigSHA384 tells.
+//
+// A redacted trace replays with zeros in place of the payloads, which
+// still reproduces bugs that depend on sizes, budgets or call outcomes
+// but not those that depend on the data.
+func replayTrace(tr *requestTrace, key []byte, logger *slog.Logger) (*protocol.Response, *replayer, error) {
+	if key != nil {
+		aead, err := newTraceAEAD(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		tr.aead = aead
+	}
+	data, err := tr.open(tr.Request.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := *tr.Request.Request
+	req.Payload = payload.New(data)
+
+	budget := requestTimeout
+	for _, d := range tr.Decisions {
+		if d.Name == "budget" {
+			if budget, err = time.ParseDuration(d.Value); err != nil {
+				return nil, nil, fmt.Errorf("replay: bad budget %q: %v", d.Value, err)
+			}
+		}
+	}
+
+	r := &replayer{trace: tr, used: make([]bool, len(tr.Calls))}
+	ctx, cancel := context.WithTimeout(protocol.WithRequestID(context.Background(), req.RequestId), budget)
+	defer cancel()
+	ctx = context.WithValue(ctx, replayKey{}, r)
+	ctx, timing := withTiming(ctx)
+
+	logger = logger.With("request_id", req.RequestId, "replay", true)
+	start := time.Now()
+	result, err := watchdog.Run(ctx, handlerGrace, func() ([]byte, error) {
+		return processRequest(ctx, logger, &req)
+	})
+	var resp *protocol.Response
+	if err != nil {
+		resp = protocol.Failed(&req, err)
+	} else {
+		resp = protocol.OK(&req, result)
+	}
+	resp.Timing = timing.report(budget, time.Since(start))
+	return resp, r, nil
+}
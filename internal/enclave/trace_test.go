@@ -0,0 +1,190 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// Traces recorded with --trace-file replay through TestReplayTraces:
+//
+//	go test ./internal/enclave -run TestReplayTraces -traces 'enclave-traces.jsonl' -trace-key-file trace.key -v
+var (
+	traceGlob    = flag.String("traces", "testdata/traces/*.jsonl", "Trace files for TestReplayTraces to replay")
+	traceKeyFlag = flag.String("trace-key-file", "", "Key the traces given by -traces were sealed with")
+)
+
+// recordTraces turns tracing on for the test, sealing payloads with key
+// unless it is nil, and returns the trace file's path.
+func recordTraces(t *testing.T, key []byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	path, keyPath := filepath.Join(dir, "traces.jsonl"), ""
+	if key != nil {
+		keyPath = filepath.Join(dir, "trace.key")
+		if err := os.WriteFile(keyPath, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := openTraces(path, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := traces
+	traces = w
+	t.Cleanup(func() { traces = old; w.Close() })
+	return path
+}
+
+// cutOffProxy points the enclave at a port nothing listens on, so a
+// replay that reached the vsock-proxy would fail.
+func cutOffProxy(t *testing.T) {
+	t.Helper()
+	upstream = newUpstreamPool(vsock.HostCID, 8999, 1)
+}
+
+// replayAll replays every trace in path and checks each ends as it did
+// when it was recorded, with the same result when it can tell.
+func replayAll(t *testing.T, path string, key []byte) []*requestTrace {
+	t.Helper()
+	recorded, err := readTraces(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range recorded {
+		resp, r, err := replayTrace(tr, key, slog.New(slog.DiscardHandler))
+		if err != nil {
+			t.Fatalf("replaying %s %s: %v", tr.RequestID, tr.Request.Operation, err)
+		}
+		if resp.Status != tr.Response.Status || errorCode(resp.Error) != errorCode(tr.Response.Error) {
+			t.Errorf("%s %s replayed as %s %v, recorded as %s %v", tr.RequestID, tr.Request.Operation, resp.Status, resp.Error, tr.Response.Status, tr.Response.Error)
+		}
+		if n := r.unused(); n != 0 {
+			t.Errorf("%s %s: replay made %d fewer calls than recorded", tr.RequestID, tr.Request.Operation, n)
+		}
+		if tr.sealed() && resp.Status == protocol.StatusOK && tr.Request.Operation == protocol.OpEncrypt {
+			want, err := tr.open(tr.Response.Result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.Result.Bytes()) != string(want) {
+				t.Errorf("%s Encrypt replayed with a different result", tr.RequestID)
+			}
+		}
+	}
+	return recorded
+}
+
+func errorCode(e *protocol.Error) string {
+	if e == nil {
+		return ""
+	}
+	return e.Code
+}
+
+func traceRequests() []*protocol.Request {
+	return []*protocol.Request{
+		{Version: protocol.Version, RequestId: "t-enc", Operation: protocol.OpEncrypt, KeyId: "alias/dev-key", Payload: payload.FromString("hello trace")},
+		{Version: protocol.Version, RequestId: "t-env", Operation: protocol.OpEnvelopeEncrypt, KeyId: "alias/dev-key", Payload: payload.FromString("hello trace")},
+		{Version: protocol.Version, RequestId: "t-bad", Operation: protocol.OpDecrypt, Payload: payload.FromString("not a blob")},
+	}
+}
+
+func TestTraceRecordAndReplay(t *testing.T) {
+	fakeProxy(t)
+	key := make([]byte, 32)
+	path := recordTraces(t, key)
+	for _, req := range traceRequests() {
+		call(t, req)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hello trace", base64.StdEncoding.EncodeToString([]byte("hello trace")), base64.StdEncoding.EncodeToString(testDataKey)} {
+		if strings.Contains(string(b), secret) {
+			t.Fatalf("trace file holds %q in the clear", secret)
+		}
+	}
+
+	cutOffProxy(t)
+	recorded := replayAll(t, path, key)
+	if len(recorded) != 3 {
+		t.Fatalf("recorded %d traces, want 3", len(recorded))
+	}
+	env := recorded[1]
+	if len(env.Calls) != 1 || env.Calls[0].Request.Operation != protocol.OpGenerateDataKey {
+		t.Fatalf("EnvelopeEncrypt trace calls: %+v", env.Calls)
+	}
+	if env.Decisions[0] != (traceDecision{Name: "budget", Value: "5s"}) {
+		t.Fatalf("EnvelopeEncrypt trace decisions: %+v", env.Decisions)
+	}
+	if bad := recorded[2]; errorCode(bad.Response.Error) != protocol.CodeKMS || bad.Calls[0].Error == nil {
+		t.Fatalf("failed Decrypt trace: %+v", bad.Response)
+	}
+
+	// The sealed payloads can't be opened without the key
+	if _, _, err := replayTrace(recorded[0], make([]byte, 32), slog.New(slog.DiscardHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := replayTrace(recorded[0], []byte(strings.Repeat("k", 32)), slog.New(slog.DiscardHandler)); err == nil {
+		t.Fatal("replay with the wrong trace key succeeded")
+	}
+}
+
+func TestTraceRedacted(t *testing.T) {
+	fakeProxy(t)
+	path := recordTraces(t, nil)
+	call(t, traceRequests()[0])
+
+	recorded, err := readTraces(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := recorded[0]
+	if tr.sealed() || tr.Request.Payload.Bytes != len("hello trace") || tr.Calls[0].Result.Sealed != nil {
+		t.Fatalf("redacted trace: %+v", tr)
+	}
+	// Zeros stand in for the payloads
+	cutOffProxy(t)
+	replayAll(t, path, nil)
+}
+
+// TestReplayTraces replays traces recorded by a running enclave. The
+// configuration flags the trace depended on, such as --pipeline or
+// --content-policy, must be set up here to match.
+func TestReplayTraces(t *testing.T) {
+	paths, err := filepath.Glob(*traceGlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Skipf("no traces match %s", *traceGlob)
+	}
+	var key []byte
+	if *traceKeyFlag != "" {
+		if key, err = readTraceKey(*traceKeyFlag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fakeProxy(t)
+	registerTestStages()
+	cutOffProxy(t)
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			for _, tr := range replayAll(t, path, key) {
+				t.Logf("%s %s: %s", tr.RequestID, tr.Request.Operation, tr.Response.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+// enclave/transform.go
+package enclave
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/transform"
+)
+
+// stages are the transformation stages Transform requests may use: the
+// built-in gzip, base64 and hex plus the enclave's encryption stages,
+// registered by registerStages. Code built into the enclave can register
+// more.
+var stages = transform.NewRegistry()
+
+// cipherStages names the registered stages that encrypt. Every pipeline
+// needs one: without it the result is only encoded plaintext, which the
+// connector would print and record as ciphertext. Code that registers an
+// encryption stage of its own adds it with mustRegisterCipher.
+var cipherStages = map[string]bool{}
+
+// defaultPipeline is used by Transform requests that don't name a
+// pipeline (set by --pipeline).
+var defaultPipeline string
+
+// stageRequestKey carries the request a pipeline is running for, so the
+// encryption stages can use its key_id, request_id and logger.
+type stageRequestKey struct{}
+
+type stageRequest struct {
+	logger *slog.Logger
+	req    *protocol.Request
+}
+
+// registerStages adds the enclave's encryption stages:
+//
+//   - envelope: EnvelopeEncrypt with a KMS data key, reversed by
+//     EnvelopeDecrypt. The output is a JSON envelope.
+//   - kms: KMS Encrypt through the vsock-proxy, reversed by Decrypt. KMS
+//     encrypts at most 4096 bytes, so put gzip first for larger payloads.
+//     The output is a base64 CiphertextBlob.
+//   - siv: deterministic AES-SIV under a --deterministic-key key (see
+//     deterministic.go).
+//   - fpe: FF3-1 format-preserving encryption under a --deterministic-key
+//     key (see fpe.go).
+func registerStages() {
+	mustRegisterCipher(transform.Func{
+		StageName: "envelope",
+		Fwd: func(ctx context.Context, data []byte) ([]byte, error) {
+			sr := stageRequestFrom(ctx)
+			return envelopeEncrypt(ctx, sr.logger, sr.req.RequestId, sr.req.KeyId, payload.New(data))
+		},
+		Rev: func(ctx context.Context, data []byte) ([]byte, error) {
+			sr := stageRequestFrom(ctx)
+			plaintext, err := envelopeDecrypt(ctx, sr.logger, sr.req.RequestId, payload.New(data))
+			return plaintext.Bytes(), err
+		},
+	})
+	mustRegisterCipher(transform.Func{
+		StageName: "kms",
+		Fwd: func(ctx context.Context, data []byte) ([]byte, error) {
+			sr := stageRequestFrom(ctx)
+			return forwardToVsockProxy(ctx, sr.logger, &protocol.Request{Operation: protocol.OpEncrypt, KeyId: sr.req.KeyId, RequestId: sr.req.RequestId, Payload: payload.New(data)})
+		},
+		Rev: func(ctx context.Context, data []byte) ([]byte, error) {
+			sr := stageRequestFrom(ctx)
+			return decryptThroughProxy(ctx, sr.logger, &protocol.Request{Operation: protocol.OpDecrypt, KeyId: sr.req.KeyId, RequestId: sr.req.RequestId, Payload: payload.New(data)})
+		},
+	})
+	mustRegisterCipher(sivStage())
+	mustRegisterCipher(fpeStage())
+}
+
+func mustRegister(s transform.Stage) {
+	if err := stages.Register(s); err != nil {
+		panic(err)
+	}
+}
+
+func mustRegisterCipher(s transform.Stage) {
+	mustRegister(s)
+	cipherStages[s.Name()] = true
+}
+
+// requireCipher refuses a pipeline without an encryption stage.
+func requireCipher(p transform.Pipeline) error {
+	for _, stage := range p {
+		if cipherStages[stage.Name()] {
+			return nil
+		}
+	}
+	names := make([]string, 0, len(cipherStages))
+	for name := range cipherStages {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return fmt.Errorf("it has no encryption stage (one of %s)", strings.Join(names, ", "))
+}
+
+func stageRequestFrom(ctx context.Context) stageRequest {
+	sr, _ := ctx.Value(stageRequestKey{}).(stageRequest)
+	if sr.logger == nil {
+		sr.logger = slog.Default()
+	}
+	if sr.req == nil {
+		sr.req = &protocol.Request{}
+	}
+	return sr
+}
+
+// runPipeline performs a Transform or ReverseTransform request. Each
+// stage's time is reported as a "transform_<stage>" timing stage.
+func runPipeline(ctx context.Context, logger *slog.Logger, req *protocol.Request) ([]byte, error) {
+	p, err := requestPipeline(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := deterministicKeys.checkPipeline(req.KeyId, p); err != nil {
+		return nil, err
+	}
+
+	traceDecide(ctx, "pipeline", p.String())
+
+	ctx = context.WithValue(ctx, stageRequestKey{}, stageRequest{logger: logger, req: req})
+	observe := stageObserver(ctx, logger)
+	logger.Debug("Running pipeline", "pipeline", p.String(), "reverse", req.Operation == protocol.OpReverseTransform)
+	if req.Operation == protocol.OpReverseTransform {
+		return p.Reverse(ctx, req.Payload.Bytes(), observe)
+	}
+	return p.Forward(ctx, req.Payload.Bytes(), observe)
+}
+
+// requestPipeline parses the pipeline req names, or else --pipeline (or
+// siv,base64 for a deterministic key).
+func requestPipeline(req *protocol.Request) (transform.Pipeline, error) {
+	spec := req.Pipeline
+	switch {
+	case spec != "":
+	case deterministicKeys.has(req.KeyId):
+		spec = deterministicPipeline
+	default:
+		spec = defaultPipeline
+	}
+	p, err := stages.Parse(spec)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeBadRequest, "invalid pipeline %q: %v (stages: %v)", spec, err, stages.Names())
+	}
+	if err := requireCipher(p); err != nil {
+		return nil, protocol.Errorf(protocol.CodeBadRequest, "invalid pipeline %q: %v", spec, err)
+	}
+	return p, nil
+}
+
+// stageObserver adds each stage's time to the request's timing.
+func stageObserver(ctx context.Context, logger *slog.Logger) transform.Observer {
+	return func(stage string, in, out int, d time.Duration) {
+		addStage(ctx, "transform_"+stage, d)
+		logger.Debug("Pipeline stage done", "stage", stage, "in_bytes", in, "out_bytes", out, "duration", d)
+	}
+}
+
+// checkPipeline validates --pipeline at startup.
+func checkPipeline(spec string) error {
+	p, err := stages.Parse(spec)
+	if err == nil {
+		err = requireCipher(p)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid --pipeline %q: %v", spec, err)
+	}
+	return nil
+}
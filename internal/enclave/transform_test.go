@@ -0,0 +1,43 @@
+package enclave
+
+import (
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// A pipeline that only compresses and encodes would hand back plaintext
+// the connector reports as ciphertext.
+func TestPipelineWithoutCipherRefused(t *testing.T) {
+	seen := fakeProxy(t)
+	registerTestStages()
+
+	for _, spec := range []string{"gzip,base64", "hex", "gzip,gzip,base64"} {
+		if err := checkPipeline(spec); err == nil || !strings.Contains(err.Error(), "no encryption stage") {
+			t.Errorf("--pipeline %s: err = %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"gzip,envelope,base64", "kms", "siv,base64", "fpe"} {
+		if err := checkPipeline(spec); err != nil {
+			t.Errorf("--pipeline %s: %v", spec, err)
+		}
+	}
+
+	for _, req := range []*protocol.Request{
+		{Operation: protocol.OpTransform, Pipeline: "gzip,base64", Payload: payload.FromString("hello")},
+		{Operation: protocol.OpReverseTransform, Pipeline: "gzip,base64", Payload: payload.FromString("H4sIAAAAAAAA")},
+		{Operation: protocol.OpEncryptFields, Pipeline: "base64", Fields: []string{"$.ssn"}, Payload: payload.FromString(`{"ssn":"123-45-6789"}`)},
+		{Operation: protocol.OpEncryptColumns, Pipeline: "hex", Columns: []string{"ssn"}, Payload: payload.FromString("ssn\n123-45-6789\n")},
+	} {
+		req.RequestId = "r1"
+		resp := call(t, req)
+		if resp.Error == nil || resp.Error.Code != protocol.CodeBadRequest || !strings.Contains(resp.Error.Message, "no encryption stage") {
+			t.Errorf("%s with %s: got %+v", req.Operation, req.Pipeline, resp.Error)
+		}
+	}
+	if len(seen) != 0 {
+		t.Fatalf("vsock-proxy got %d requests", len(seen))
+	}
+}
@@ -0,0 +1,210 @@
+// enclave/upstream.go
+package enclave
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// upstreamPool multiplexes requests to the vsock-proxy over a few
+// persistent connections instead of dialling one per request. Each request
+// is tagged with a Seq that the proxy echoes, so many requests can be in
+// flight on one connection. A broken connection is redialled on next use,
+// so the enclave recovers by itself when the proxy restarts.
+type upstreamPool struct {
+	cid, port uint32
+	next      uint32
+	slots     []upstreamSlot
+}
+
+type upstreamSlot struct {
+	mu   sync.Mutex
+	conn *upstreamConn
+}
+
+func newUpstreamPool(cid, port uint32, size int) *upstreamPool {
+	if size < 1 {
+		size = 1
+	}
+	return &upstreamPool{cid: cid, port: port, slots: make([]upstreamSlot, size)}
+}
+
+// roundTrip sends req to the vsock-proxy and waits for its response. If a
+// reused connection turns out to be dead (typically because the proxy
+// restarted), the request is retried once on a fresh connection. The
+// operations are safe to repeat: at worst KMS encrypts or generates a data
+// key twice and one result is discarded. It gives up when ctx is done.
+func (p *upstreamPool) roundTrip(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	slot := &p.slots[atomic.AddUint32(&p.next, 1)%uint32(len(p.slots))]
+
+	conn, fresh, err := p.get(ctx, slot)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.roundTrip(ctx, req)
+	if err != nil && !fresh && ctx.Err() == nil {
+		slog.Warn("Upstream connection to vsock-proxy lost, reconnecting", "err", err)
+		if conn, _, err = p.get(ctx, slot); err != nil {
+			return nil, err
+		}
+		resp, err = conn.roundTrip(ctx, req)
+	}
+	return resp, err
+}
+
+// warmUp dials every slot up front so the first requests don't pay for
+// connection setup, and returns how many connections are ready.
+func (p *upstreamPool) warmUp(ctx context.Context) int {
+	ready := 0
+	for i := range p.slots {
+		if _, _, err := p.get(ctx, &p.slots[i]); err != nil {
+			slog.Warn("Warm-up connection to vsock-proxy failed", "slot", i+1, "err", err)
+			continue
+		}
+		ready++
+	}
+	return ready
+}
+
+// reachable reports whether the vsock-proxy can be reached: the first
+// slot's connection is open, or a new one can be dialled. It sends no
+// request, which would cost a KMS call.
+func (p *upstreamPool) reachable(ctx context.Context) error {
+	_, _, err := p.get(ctx, &p.slots[0])
+	return err
+}
+
+// get returns the slot's connection, dialling a new one if there is none
+// or the previous one failed. fresh reports whether it was just dialled.
+// ctx bounds only the dial: the connection outlives the request that
+// opened it.
+func (p *upstreamPool) get(ctx context.Context, slot *upstreamSlot) (conn *upstreamConn, fresh bool, err error) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if slot.conn != nil && !slot.conn.broken() {
+		return slot.conn, false, nil
+	}
+
+	// Create vsock connection to vsock-proxy
+	slog.Info("Connecting to vsock-proxy", "cid", p.cid, "port", p.port)
+	c, err := transport.DialContext(ctx, p.cid, p.port)
+	if err != nil {
+		return nil, false, err
+	}
+	slog.Info("Connected to vsock-proxy", "local_addr", c.LocalAddr().String())
+	slot.conn = newUpstreamConn(c)
+	return slot.conn, true, nil
+}
+
+// upstreamConn is one persistent, multiplexed connection to the proxy.
+type upstreamConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]chan *protocol.Response
+	err     error // set once the connection has failed
+}
+
+func newUpstreamConn(conn net.Conn) *upstreamConn {
+	c := &upstreamConn{conn: conn, pending: make(map[uint64]chan *protocol.Response)}
+	go c.readLoop()
+	return c
+}
+
+func (c *upstreamConn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// roundTrip sends req under a new Seq and waits for the matching response.
+// The error is non-nil only if the connection failed or ctx is done; in
+// the latter case the connection stays usable and a late response is
+// dropped.
+func (c *upstreamConn) roundTrip(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.seq++
+	tagged := *req
+	tagged.Seq = c.seq
+	ch := make(chan *protocol.Response, 1)
+	c.pending[tagged.Seq] = ch
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	err := protocol.WriteRequest(c.conn, &tagged)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, c.failure()
+		}
+		return resp, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, tagged.Seq)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop delivers responses to their waiting requests until the
+// connection fails.
+func (c *upstreamConn) readLoop() {
+	for {
+		resp, err := protocol.ReadResponse(c.conn)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[resp.Seq]
+		delete(c.pending, resp.Seq)
+		c.mu.Unlock()
+		if !ok {
+			// Most likely the request timed out and stopped waiting
+			slog.Debug("Dropping vsock-proxy response for unknown seq", "seq", resp.Seq)
+			continue
+		}
+		ch <- resp
+	}
+}
+
+// fail marks the connection broken, closes it and releases every waiting
+// request.
+func (c *upstreamConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = fmt.Errorf("vsock-proxy connection failed: %v", err)
+	c.conn.Close()
+	for seq, ch := range c.pending {
+		close(ch)
+		delete(c.pending, seq)
+	}
+}
+
+func (c *upstreamConn) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
@@ -0,0 +1,220 @@
+// vsock-proxy/allowlist.go
+package vsockproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultAllowlistPath is where the official vsock-proxy looks for its
+// configuration.
+const defaultAllowlistPath = "/etc/nitro_enclaves/vsock-proxy.yaml"
+
+// allowedEndpoint is one entry of the allowlist: a TCP host and port the
+// proxy may forward to.
+type allowedEndpoint struct {
+	Address string
+	Port    int
+}
+
+// allowlist is the set of TCP endpoints --forward may target, read from a
+// configuration file in the format of the official vsock-proxy from
+// aws-nitro-enclaves-cli:
+//
+//	allowlist:
+//	- {address: kms.us-east-1.amazonaws.com, port: 443}
+//	- address: secretsmanager.us-east-1.amazonaws.com
+//	  port: 443
+//
+// Only this subset of YAML is understood: the allowlist key, list items in
+// flow or block style, plain or quoted scalars and comments. That covers
+// the files the official tool ships and documents; anything else is an
+// error rather than being silently misread.
+type allowlist []allowedEndpoint
+
+// allows reports whether host:port is on the list. Host names are compared
+// case-insensitively and must match as written: the proxy checks the name
+// it was asked to forward to, not what it resolves to.
+func (a allowlist) allows(host string, port int) bool {
+	for _, e := range a {
+		if strings.EqualFold(e.Address, host) && e.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAllowlist reads an allowlist configuration file.
+func loadAllowlist(path string) (allowlist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open allowlist: %v", err)
+	}
+	defer f.Close()
+
+	var (
+		list    allowlist
+		inList  bool
+		current map[string]string // block-style item being read
+		lineNum int
+	)
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		e, err := endpointFrom(current)
+		if err != nil {
+			return err
+		}
+		list = append(list, e)
+		current = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		line := stripComment(scanner.Text())
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "---" {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		text := strings.TrimSpace(line)
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", path, lineNum, fmt.Sprintf(format, args...))
+		}
+
+		switch {
+		case !indented && !strings.HasPrefix(text, "-"):
+			if err := finish(); err != nil {
+				return nil, fail("%v", err)
+			}
+			key, value, ok := strings.Cut(text, ":")
+			if !ok {
+				return nil, fail("expected key: value, got %q", text)
+			}
+			if strings.TrimSpace(key) != "allowlist" {
+				return nil, fail("unsupported key %q (only allowlist is understood)", key)
+			}
+			if v := strings.TrimSpace(value); v != "" && v != "[]" {
+				return nil, fail("allowlist must be a list")
+			}
+			inList = true
+		case !inList:
+			return nil, fail("list item outside allowlist")
+		case strings.HasPrefix(text, "-"):
+			if err := finish(); err != nil {
+				return nil, fail("%v", err)
+			}
+			item := strings.TrimSpace(strings.TrimPrefix(text, "-"))
+			if strings.HasPrefix(item, "{") {
+				fields, err := parseFlowMap(item)
+				if err != nil {
+					return nil, fail("%v", err)
+				}
+				e, err := endpointFrom(fields)
+				if err != nil {
+					return nil, fail("%v", err)
+				}
+				list = append(list, e)
+				continue
+			}
+			current = map[string]string{}
+			if item != "" {
+				if err := addField(current, item); err != nil {
+					return nil, fail("%v", err)
+				}
+			}
+		case current != nil:
+			if err := addField(current, text); err != nil {
+				return nil, fail("%v", err)
+			}
+		default:
+			return nil, fail("unexpected %q", text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read allowlist: %v", err)
+	}
+	if err := finish(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return list, nil
+}
+
+// stripComment removes a # comment that isn't inside quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseFlowMap parses {key: value, key: value}.
+func parseFlowMap(s string) (map[string]string, error) {
+	if !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("unterminated {")
+	}
+	fields := map[string]string{}
+	for _, pair := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		if err := addField(fields, pair); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+func addField(fields map[string]string, pair string) error {
+	key, value, ok := strings.Cut(pair, ":")
+	if !ok {
+		return fmt.Errorf("expected key: value, got %q", strings.TrimSpace(pair))
+	}
+	key = strings.TrimSpace(key)
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	fields[key] = value
+	return nil
+}
+
+// endpointFrom checks an allowlist item's fields.
+func endpointFrom(fields map[string]string) (allowedEndpoint, error) {
+	var e allowedEndpoint
+	for key, value := range fields {
+		switch key {
+		case "address":
+			e.Address = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 1 || port > 65535 {
+				return e, fmt.Errorf("invalid port %q", value)
+			}
+			e.Port = port
+		default:
+			return e, fmt.Errorf("unsupported allowlist field %q (expected address and port)", key)
+		}
+	}
+	if e.Address == "" || e.Port == 0 {
+		return e, fmt.Errorf("allowlist entry needs both address and port")
+	}
+	if strings.ContainsAny(e.Address, "/ ") || net.ParseIP(e.Address) == nil && strings.Contains(e.Address, ":") {
+		return e, fmt.Errorf("invalid address %q", e.Address)
+	}
+	return e, nil
+}
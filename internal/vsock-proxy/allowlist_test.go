@@ -0,0 +1,141 @@
+package vsockproxy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeAllowlist(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "vsock-proxy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadAllowlist(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want allowlist
+	}{
+		{"flow", "allowlist:\n- {address: kms.us-east-1.amazonaws.com, port: 443}\n- {address: \"10.0.0.1\", port: '8443'}\n",
+			allowlist{{"kms.us-east-1.amazonaws.com", 443}, {"10.0.0.1", 8443}}},
+		{"block", "allowlist:\n- address: secretsmanager.us-east-1.amazonaws.com\n  port: 443\n-\n  port: 80\n  address: example.com\n",
+			allowlist{{"secretsmanager.us-east-1.amazonaws.com", 443}, {"example.com", 80}}},
+		{"mixed", "allowlist:\n- {address: a.example, port: 1}\n- address: b.example\n  port: 65535\n- {address: c.example, port: 2}\n",
+			allowlist{{"a.example", 1}, {"b.example", 65535}, {"c.example", 2}}},
+		{"comments and blank lines", "# vsock-proxy configuration\n---\n\nallowlist: # endpoints\n\n  # KMS\n- address: kms.example # the regional endpoint\n\n  port: 443\n- {address: \"a#b.example\", port: 443}   # quoted # is kept\n",
+			allowlist{{"kms.example", 443}, {"a#b.example", 443}}},
+		{"empty", "allowlist: []\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadAllowlist(writeAllowlist(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAllowlistRejects(t *testing.T) {
+	tests := []struct {
+		name, file, wantErr string
+	}{
+		{"other key", "endpoints:\n- {address: a.example, port: 443}\n", "unsupported key"},
+		{"not a list", "allowlist: a.example\n", "must be a list"},
+		{"no key", "kms.example 443\n", "expected key: value"},
+		{"item outside list", "- {address: a.example, port: 443}\n", "outside allowlist"},
+		{"unterminated flow", "allowlist:\n- {address: a.example, port: 443\n", "unterminated"},
+		{"flow without colon", "allowlist:\n- {address a.example, port: 443}\n", "expected key: value"},
+		{"block without colon", "allowlist:\n- address: a.example\n  port 443\n", "expected key: value"},
+		{"stray line", "allowlist:\n- {address: a.example, port: 443}\n  port: 80\n", "unexpected"},
+		{"unknown field", "allowlist:\n- {address: a.example, port: 443, proto: tcp}\n", "unsupported allowlist field"},
+		{"missing port", "allowlist:\n- address: a.example\n", "needs both"},
+		{"missing address", "allowlist:\n- {port: 443}\n", "needs both"},
+		{"empty item", "allowlist:\n-\n", "needs both"},
+		{"bad address", "allowlist:\n- {address: a.example/path, port: 443}\n", "invalid address"},
+		{"port with host", "allowlist:\n- {address: a.example:443, port: 443}\n", "invalid address"},
+		{"port zero", "allowlist:\n- {address: a.example, port: 0}\n", "invalid port"},
+		{"port too large", "allowlist:\n- {address: a.example, port: 65536}\n", "invalid port"},
+		{"negative port", "allowlist:\n- {address: a.example, port: -1}\n", "invalid port"},
+		{"named port", "allowlist:\n- address: a.example\n  port: https\n", "invalid port"},
+		{"port with junk", "allowlist:\n- {address: a.example, port: 443x}\n", "invalid port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeAllowlist(t, tt.file)
+			got, err := loadAllowlist(path)
+			if err == nil {
+				t.Fatalf("loaded %v", got)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) || !strings.HasPrefix(err.Error(), path) {
+				t.Fatalf("err = %v, want %q with the file name", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadAllowlistMissing(t *testing.T) {
+	if _, err := loadAllowlist(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("loaded a missing file")
+	}
+}
+
+func TestAllowlistAllows(t *testing.T) {
+	list := allowlist{{"kms.us-east-1.amazonaws.com", 443}, {"10.0.0.1", 8443}}
+	tests := []struct {
+		host string
+		port int
+		want bool
+	}{
+		{"kms.us-east-1.amazonaws.com", 443, true},
+		{"KMS.us-east-1.AmazonAWS.com", 443, true},
+		{"10.0.0.1", 8443, true},
+		{"kms.us-east-1.amazonaws.com", 8443, false},
+		{"10.0.0.1", 443, false},
+		{"kms.us-west-2.amazonaws.com", 443, false},
+		{"us-east-1.amazonaws.com", 443, false},
+		{"kms.us-east-1.amazonaws.com.evil.example", 443, false},
+		{"", 443, false},
+	}
+	for _, tt := range tests {
+		if got := list.allows(tt.host, tt.port); got != tt.want {
+			t.Errorf("allows(%q, %d) = %v, want %v", tt.host, tt.port, got, tt.want)
+		}
+	}
+	if (allowlist{}).allows("kms.us-east-1.amazonaws.com", 443) {
+		t.Error("an empty allowlist allows an endpoint")
+	}
+}
+
+func TestForwardListSet(t *testing.T) {
+	var l forwardList
+	if err := l.Set("8001=secretsmanager.us-east-1.amazonaws.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set(" 8002 = [::1]:8443"); err != nil {
+		t.Fatal(err)
+	}
+	want := forwardList{{8001, "secretsmanager.us-east-1.amazonaws.com", 443}, {8002, "::1", 8443}}
+	if !slices.Equal(l, want) {
+		t.Fatalf("got %v, want %v", l, want)
+	}
+	if s := l.String(); s != "8001=secretsmanager.us-east-1.amazonaws.com:443,8002=[::1]:8443" {
+		t.Fatalf("String() = %q", s)
+	}
+
+	for _, bad := range []string{"8001", "x=a.example:443", "8001=a.example", "8001=a.example:0", "8001=a.example:65536", "8001=a.example:https"} {
+		if err := l.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// vsock-proxy/dns.go
+package vsockproxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache is a DialContext for kmsTransport that caches host lookups for
+// ttl, so new KMS connections don't wait on the resolver. If every cached
+// address fails to connect, the entry is dropped and the host resolved
+// again: when the LocalStack container is recreated with a new IP, the
+// next connection finds it without waiting for the TTL.
+type dnsCache struct {
+	ttl        time.Duration
+	dialer     net.Dialer
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:        ttl,
+		dialer:     net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		lookupHost: net.DefaultResolver.LookupHost,
+		entries:    make(map[string]dnsEntry),
+	}
+}
+
+func (c *dnsCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, cached, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dialAny(ctx, network, addrs, port)
+	if err != nil && cached {
+		slog.Warn("Connecting to cached addresses failed, re-resolving", "host", host, "addrs", addrs, "err", err)
+		c.forget(host)
+		if addrs, _, err = c.lookup(ctx, host); err != nil {
+			return nil, err
+		}
+		conn, err = c.dialAny(ctx, network, addrs, port)
+	}
+	return conn, err
+}
+
+// lookup returns host's addresses and whether they came from the cache.
+// A failed lookup is not cached, and an expired entry is not used in its
+// place: the next dial asks the resolver again.
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, bool, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, true, nil
+	}
+
+	addrs, err := c.lookupHost(ctx, host)
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, false, nil
+}
+
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+}
+
+// dialAny tries each address in turn and returns the first connection.
+func (c *dnsCache) dialAny(ctx context.Context, network string, addrs []string, port string) (net.Conn, error) {
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := c.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
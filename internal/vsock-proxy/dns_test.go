@@ -0,0 +1,186 @@
+package vsockproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers lookups from addrs, or with err, and counts them.
+type fakeResolver struct {
+	mu      sync.Mutex
+	addrs   []string
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return slices.Clone(r.addrs), r.err
+}
+
+func (r *fakeResolver) set(addrs []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.err = addrs, err
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// dnsTestServer accepts connections on 127.0.0.1 and returns its port.
+func dnsTestServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func newTestDNSCache(ttl time.Duration, r *fakeResolver) *dnsCache {
+	c := newDNSCache(ttl)
+	c.dialer.Timeout = time.Second
+	c.lookupHost = r.lookupHost
+	return c
+}
+
+func dial(t *testing.T, c *dnsCache, addr string) error {
+	t.Helper()
+	conn, err := c.DialContext(t.Context(), "tcp", addr)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	addr := net.JoinHostPort("kms.test", dnsTestServer(t))
+	r := &fakeResolver{addrs: []string{"127.0.0.1"}}
+	c := newTestDNSCache(50*time.Millisecond, r)
+
+	for range 3 {
+		if err := dial(t, c, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := r.count(); n != 1 {
+		t.Fatalf("%d lookups within the TTL, want 1", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := dial(t, c, addr); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.count(); n != 2 {
+		t.Fatalf("%d lookups after the TTL expired, want 2", n)
+	}
+}
+
+func TestDNSCacheIPLiteral(t *testing.T) {
+	r := &fakeResolver{err: errors.New("no lookups expected")}
+	c := newTestDNSCache(time.Minute, r)
+	if err := dial(t, c, net.JoinHostPort("127.0.0.1", dnsTestServer(t))); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.count(); n != 0 {
+		t.Fatalf("%d lookups for an IP address", n)
+	}
+}
+
+func TestDNSCacheLookupFailure(t *testing.T) {
+	addr := net.JoinHostPort("kms.test", dnsTestServer(t))
+	lookupErr := &net.DNSError{Err: "no such host", Name: "kms.test", IsNotFound: true}
+	r := &fakeResolver{err: lookupErr}
+	c := newTestDNSCache(time.Minute, r)
+
+	if err := dial(t, c, addr); !errors.Is(err, lookupErr) {
+		t.Fatalf("err = %v, want the lookup error", err)
+	}
+	// the failure isn't cached: once the host resolves, it is used
+	r.set([]string{"127.0.0.1"}, nil)
+	if err := dial(t, c, addr); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.count(); n != 2 {
+		t.Fatalf("%d lookups, want 2", n)
+	}
+
+	// nor is an expired entry used when the lookup fails
+	c.mu.Lock()
+	c.entries["kms.test"] = dnsEntry{addrs: []string{"127.0.0.1"}, expires: time.Now().Add(-time.Second)}
+	c.mu.Unlock()
+	r.set(nil, lookupErr)
+	if err := dial(t, c, addr); !errors.Is(err, lookupErr) {
+		t.Fatalf("err = %v with an expired entry, want the lookup error", err)
+	}
+}
+
+// When the cached addresses stop answering, the host is resolved again
+// straight away rather than after the TTL.
+func TestDNSCacheReResolve(t *testing.T) {
+	addr := net.JoinHostPort("kms.test", dnsTestServer(t))
+	// nothing listens on 127.0.0.2 at the server's port
+	r := &fakeResolver{addrs: []string{"127.0.0.2"}}
+	c := newTestDNSCache(time.Minute, r)
+
+	// a fresh lookup that fails to connect is not retried
+	if err := dial(t, c, addr); err == nil {
+		t.Fatal("connected to 127.0.0.2")
+	}
+	if n := r.count(); n != 1 {
+		t.Fatalf("%d lookups, want 1", n)
+	}
+
+	r.set([]string{"127.0.0.1"}, nil)
+	if err := dial(t, c, addr); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.count(); n != 2 {
+		t.Fatalf("%d lookups, want 2", n)
+	}
+	// and the new address is cached
+	if err := dial(t, c, addr); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.count(); n != 2 {
+		t.Fatalf("%d lookups after re-resolving, want 2", n)
+	}
+
+	// a lookup failure while re-resolving is returned and leaves nothing
+	// cached
+	c.mu.Lock()
+	c.entries["kms.test"] = dnsEntry{addrs: []string{"127.0.0.2"}, expires: time.Now().Add(time.Minute)}
+	c.mu.Unlock()
+	lookupErr := errors.New("resolver down")
+	r.set(nil, lookupErr)
+	if err := dial(t, c, addr); !errors.Is(err, lookupErr) {
+		t.Fatalf("err = %v, want the lookup error", err)
+	}
+	c.mu.Lock()
+	_, cached := c.entries["kms.test"]
+	c.mu.Unlock()
+	if cached {
+		t.Fatal("the unreachable addresses are still cached")
+	}
+}
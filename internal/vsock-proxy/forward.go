@@ -0,0 +1,199 @@
+// vsock-proxy/forward.go
+package vsockproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// forwards are the raw vsock-to-TCP forwards set by --forward.
+var forwards forwardList
+
+// forwardDialTimeout bounds connecting to a forward's TCP endpoint.
+const forwardDialTimeout = 10 * time.Second
+
+// forwardRule forwards connections on a vsock port to a TCP endpoint,
+// like one instance of the official vsock-proxy:
+//
+//	vsock-proxy 8001 secretsmanager.us-east-1.amazonaws.com 443
+type forwardRule struct {
+	VsockPort uint32
+	Host      string
+	Port      int
+}
+
+func (r forwardRule) target() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// forwardList collects repeated --forward VSOCK_PORT=HOST:PORT flags. It
+// implements flag.Value.
+type forwardList []forwardRule
+
+func (l *forwardList) Set(s string) error {
+	port, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("%q is not VSOCK_PORT=HOST:PORT", s)
+	}
+	vsockPort, err := strconv.ParseUint(strings.TrimSpace(port), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid vsock port %q", port)
+	}
+	host, tcpPort, err := net.SplitHostPort(strings.TrimSpace(target))
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %v", target, err)
+	}
+	p, err := strconv.Atoi(tcpPort)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid TCP port %q", tcpPort)
+	}
+	*l = append(*l, forwardRule{VsockPort: uint32(vsockPort), Host: host, Port: p})
+	return nil
+}
+
+func (l *forwardList) String() string {
+	if l == nil {
+		return ""
+	}
+	rules := make([]string, len(*l))
+	for i, r := range *l {
+		rules[i] = fmt.Sprintf("%d=%s", r.VsockPort, r.target())
+	}
+	return strings.Join(rules, ",")
+}
+
+// startForwards checks every --forward against the allowlist and starts
+// listening for it. The listeners are closed on shutdown with the KMS
+// listener; they share its --max-conns slots.
+func startForwards(cid uint32, allowlistPath string) ([]net.Listener, error) {
+	if len(forwards) == 0 {
+		return nil, nil
+	}
+	allowed, err := loadAllowlist(allowlistPath)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Loaded forwarding allowlist", "path", allowlistPath, "entries", len(allowed))
+
+	var listeners []net.Listener
+	for _, rule := range forwards {
+		if !allowed.allows(rule.Host, rule.Port) {
+			closeAll(listeners)
+			return nil, fmt.Errorf("forward to %s is not in the allowlist %s", rule.target(), allowlistPath)
+		}
+		l, err := transport.Listen(cid, rule.VsockPort)
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("failed to listen on vsock port %d: %v", rule.VsockPort, err)
+		}
+		listeners = append(listeners, l)
+		slog.Info("Forwarding vsock port to TCP", "vsock_port", rule.VsockPort, "target", rule.target())
+		go serveForward(l, rule)
+	}
+	return listeners, nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// serveForward accepts connections for one forward until its listener is
+// closed.
+func serveForward(listener net.Listener, rule forwardRule) {
+	connectionCount := 0
+	for {
+		conn, err := vsock.Accept(drainer.Listening(), listener)
+		if err != nil {
+			if drainer.Stopping() {
+				return
+			}
+			slog.Warn("Forward accept failed", "vsock_port", rule.VsockPort, "err", err)
+			continue
+		}
+		connectionCount++
+		logger := logging.ForConn(conn, connectionCount).With("mode", "forward", "target", rule.target())
+		drainer.Go(func() {
+			if !connLimit.Acquire(drainer.Done()) {
+				// Raw bytes: there is no protocol to send busy in
+				logger.Warn("Rejecting forward connection: --max-conns reached", connsAttr())
+				conn.Close()
+				return
+			}
+			defer connLimit.Release()
+			// Forwards end when the proxy stops accepting, as they
+			// can't be told apart from idle connections
+			ctx, cancel := vsock.WithConn(drainer.Listening(), conn)
+			defer cancel()
+			forward(ctx, conn, rule, logger)
+		})
+	}
+}
+
+// halfCloser is implemented by connections that can shut down their
+// sending side, so one direction can finish while the other carries on.
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// forward connects conn to the rule's TCP endpoint and copies bytes both
+// ways until both sides are done or ctx, the connection's context, ends.
+// The proxy never looks at the bytes: TLS runs end to end between the
+// enclave and the service.
+func forward(ctx context.Context, conn net.Conn, rule forwardRule, logger *slog.Logger) {
+	start := time.Now()
+
+	dialer := net.Dialer{Timeout: forwardDialTimeout}
+	upstream, err := dialer.DialContext(ctx, "tcp", rule.target())
+	if err != nil {
+		logger.Warn("Forward dial failed", "err", err)
+		forwardConnections.With("dial_error").Inc()
+		return
+	}
+	defer upstream.Close()
+	forwardConnections.With("connected").Inc()
+	logger.Info("Forwarding connection", "remote", upstream.RemoteAddr().String())
+
+	sent, received := splice(ctx, conn, upstream)
+	forwardBytes.With("to_target").Add(sent)
+	forwardBytes.With("to_enclave").Add(received)
+	logger.Info("Forward closed", "bytes_to_target", sent, "bytes_to_enclave", received, "duration", time.Since(start))
+}
+
+// splice copies bytes between a and b both ways until both directions are
+// done or ctx ends, and returns how many bytes went each way.
+func splice(ctx context.Context, a, b net.Conn) (aToB, bToA int64) {
+	// Closing both ends unblocks the copies
+	stop := context.AfterFunc(ctx, func() {
+		a.Close()
+		b.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn, n *int64) {
+		defer wg.Done()
+		*n, _ = io.Copy(dst, src)
+		if hc, ok := dst.(halfCloser); ok {
+			hc.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go copyHalf(b, a, &aToB)
+	go copyHalf(a, b, &bToA)
+	wg.Wait()
+	return aToB, bToA
+}
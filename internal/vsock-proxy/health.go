@@ -0,0 +1,49 @@
+// vsock-proxy/health.go
+package vsockproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+
+	"nitro-dev-qemu/pkg/health"
+)
+
+// accepting is set while the accept loop takes enclave connections: from
+// startup until a shutdown signal.
+var accepting atomic.Bool
+
+// serveHealth answers /healthz and /readyz over HTTP on port (set by
+// --health-port). The proxy is ready once it accepts enclave connections
+// and KMS answers a ListKeys call made with its credentials, so a probe
+// also catches a wrong endpoint or expired credentials. The listener
+// stays open during shutdown, so /readyz reports it.
+func serveHealth(port uint32, kmsTarget string) (net.Listener, error) {
+	h := health.New(
+		health.Check{Name: "accepting", Run: func(ctx context.Context) error {
+			if !accepting.Load() {
+				return errors.New("not accepting enclave connections")
+			}
+			return nil
+		}},
+		health.Check{Name: "kms", Run: func(ctx context.Context) error {
+			var out KMSListKeysResponse
+			if err := callKMS(ctx, slog.Default(), kmsTarget, "ListKeys", struct{ Limit int }{Limit: 1}, &out); err != nil {
+				return fmt.Errorf("KMS ListKeys failed: %v", err)
+			}
+			return nil
+		}},
+	)
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		slog.Info("Serving health probes", "url", fmt.Sprintf("http://localhost:%d/readyz", port))
+		h.Serve(l)
+	}()
+	return l, nil
+}
@@ -0,0 +1,132 @@
+// vsock-proxy/hedge.go
+package vsockproxy
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// hedgeable lists the KMS actions that may be sent twice: they have no side
+// effects and both attempts give an equally good answer. Encrypt,
+// GenerateDataKey and Sign are left out since each call produces new
+// material (and is billed).
+var hedgeable = map[string]bool{
+	"Decrypt":     true,
+	"Verify":      true,
+	"ListKeys":    true,
+	"ListAliases": true,
+}
+
+// kmsHedger is set when --hedge is given.
+var kmsHedger *hedger
+
+const (
+	hedgeWindow     = 100 // latency samples kept per action
+	hedgeMinSamples = 20  // no hedging until this many have been seen
+)
+
+// hedger sends a second attempt of a slow KMS call once the first has been
+// outstanding for longer than the action's recent p95 latency, returns
+// whichever answers first and cancels the other. At most one extra
+// attempt is sent, so hedging costs roughly 5% more KMS calls.
+type hedger struct {
+	minDelay time.Duration
+
+	mu      sync.Mutex
+	samples map[string]*latencyWindow
+}
+
+// latencyWindow is a ring of the most recent successful call latencies.
+type latencyWindow struct {
+	durations []time.Duration
+	next      int
+}
+
+func newHedger(minDelay time.Duration) *hedger {
+	return &hedger{minDelay: minDelay, samples: make(map[string]*latencyWindow)}
+}
+
+// observe records the latency of a successful call.
+func (h *hedger) observe(action string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w := h.samples[action]
+	if w == nil {
+		w = &latencyWindow{}
+		h.samples[action] = w
+	}
+	if len(w.durations) < hedgeWindow {
+		w.durations = append(w.durations, d)
+		return
+	}
+	w.durations[w.next] = d
+	w.next = (w.next + 1) % hedgeWindow
+}
+
+// delay returns how long to wait before hedging action, or false while
+// there are too few samples to estimate the p95.
+func (h *hedger) delay(action string) (time.Duration, bool) {
+	h.mu.Lock()
+	w := h.samples[action]
+	if w == nil || len(w.durations) < hedgeMinSamples {
+		h.mu.Unlock()
+		return 0, false
+	}
+	sorted := slices.Clone(w.durations)
+	h.mu.Unlock()
+
+	slices.Sort(sorted)
+	p95 := sorted[len(sorted)*95/100]
+	return max(p95, h.minDelay), true
+}
+
+// send performs a hedged KMS call.
+func (h *hedger) send(ctx context.Context, logger *slog.Logger, kmsTarget, action string, reqBody []byte) ([]byte, error) {
+	delay, ok := h.delay(action)
+	if !ok {
+		return sendKMS(ctx, kmsTarget, action, reqBody)
+	}
+
+	// Cancelling ctx on return aborts whichever attempt is still running
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		body  []byte
+		err   error
+		hedge bool
+	}
+	results := make(chan attempt, 2)
+	launch := func(hedge bool) {
+		go func() {
+			body, err := sendKMS(ctx, kmsTarget, action, reqBody)
+			results <- attempt{body, err, hedge}
+		}()
+	}
+
+	launch(false)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case r := <-results:
+		return r.body, r.err
+	case <-timer.C:
+	}
+
+	logger.Info("KMS call still running, sending hedged request", "action", action, "delay", delay)
+	kmsHedgesSent.With(action).Inc()
+	launch(true)
+
+	// The first answer wins, even an error: hedging is for tail latency,
+	// not a retry
+	r := <-results
+	if r.hedge {
+		kmsHedgesWon.With(action).Inc()
+		logger.Info("Hedged KMS call answered first", "action", action)
+	}
+	return r.body, r.err
+}
@@ -0,0 +1,150 @@
+package vsockproxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// hedgeKMS serves the nth KMS call with attempts[n]; it fails the test if
+// there are more calls than attempts.
+func hedgeKMS(t *testing.T, attempts ...http.HandlerFunc) string {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		if n > len(attempts) {
+			t.Errorf("KMS got call %d, expected %d", n, len(attempts))
+			return
+		}
+		attempts[n-1](w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// answer replies with status and body after delay.
+func answer(delay time.Duration, status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+// stall never answers; it closes cancelled once the call is abandoned.
+func stall(cancelled chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client hanging up once the body
+		// has been read
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// primedHedger has seen enough Decrypt calls to hedge after delay.
+func primedHedger(delay time.Duration) *hedger {
+	h := newHedger(0)
+	for range hedgeMinSamples {
+		h.observe("Decrypt", delay)
+	}
+	return h
+}
+
+func waitCancelled(t *testing.T, cancelled chan struct{}) {
+	t.Helper()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the losing attempt was not cancelled")
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	h := newHedger(5 * time.Millisecond)
+	for i := range hedgeMinSamples - 1 {
+		h.observe("Decrypt", time.Duration(i+1)*time.Millisecond)
+	}
+	if _, ok := h.delay("Decrypt"); ok {
+		t.Fatal("hedging with too few samples")
+	}
+	h.observe("Decrypt", 100*time.Millisecond)
+	if d, ok := h.delay("Decrypt"); !ok || d != 100*time.Millisecond {
+		t.Fatalf("delay = %v, %v, want the p95 of 100ms", d, ok)
+	}
+	if _, ok := h.delay("Verify"); ok {
+		t.Fatal("hedging an action with no samples")
+	}
+
+	// the window keeps only the latest samples, and minDelay is a floor
+	for range hedgeWindow {
+		h.observe("Decrypt", time.Millisecond)
+	}
+	if d, _ := h.delay("Decrypt"); d != 5*time.Millisecond {
+		t.Fatalf("delay = %v, want the 5ms floor", d)
+	}
+}
+
+func TestHedgeFastFirstAttempt(t *testing.T) {
+	target := hedgeKMS(t, answer(0, http.StatusOK, `{"Plaintext":"first"}`))
+	// a delay no loaded test machine reaches, so no hedge is ever due
+	body, err := primedHedger(500*time.Millisecond).send(t.Context(), slog.New(slog.DiscardHandler), target, "Decrypt", []byte("{}"))
+	if err != nil || string(body) != `{"Plaintext":"first"}` {
+		t.Fatalf("body %q, err %v", body, err)
+	}
+	// hedgeKMS fails the test if a hedge is sent after the fact
+	time.Sleep(600 * time.Millisecond)
+}
+
+func TestHedgeWins(t *testing.T) {
+	cancelled := make(chan struct{})
+	target := hedgeKMS(t, stall(cancelled), answer(0, http.StatusOK, `{"Plaintext":"hedge"}`))
+
+	start := time.Now()
+	body, err := primedHedger(20*time.Millisecond).send(t.Context(), slog.New(slog.DiscardHandler), target, "Decrypt", []byte("{}"))
+	if err != nil || string(body) != `{"Plaintext":"hedge"}` {
+		t.Fatalf("body %q, err %v", body, err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("answered after %v, want just after the 20ms hedge delay", elapsed)
+	}
+	waitCancelled(t, cancelled)
+}
+
+func TestHedgeFirstAttemptWinsAfterHedging(t *testing.T) {
+	cancelled := make(chan struct{})
+	target := hedgeKMS(t, answer(40*time.Millisecond, http.StatusOK, `{"Plaintext":"first"}`), stall(cancelled))
+
+	body, err := primedHedger(20*time.Millisecond).send(t.Context(), slog.New(slog.DiscardHandler), target, "Decrypt", []byte("{}"))
+	if err != nil || string(body) != `{"Plaintext":"first"}` {
+		t.Fatalf("body %q, err %v", body, err)
+	}
+	waitCancelled(t, cancelled)
+}
+
+// The first answer wins even when it is an error: a hedge is not a retry.
+func TestHedgeWinnerError(t *testing.T) {
+	cancelled := make(chan struct{})
+	target := hedgeKMS(t, stall(cancelled), answer(0, http.StatusBadRequest, `{"__type":"InvalidCiphertextException"}`))
+
+	_, err := primedHedger(20*time.Millisecond).send(t.Context(), slog.New(slog.DiscardHandler), target, "Decrypt", []byte("{}"))
+	var perr *protocol.Error
+	if !errors.As(err, &perr) || perr.Code != protocol.CodeKMS || perr.Details["kms_error_type"] != "InvalidCiphertextException" {
+		t.Fatalf("err = %#v, want the hedge's KMS error", err)
+	}
+	waitCancelled(t, cancelled)
+}
@@ -0,0 +1,281 @@
+// vsock-proxy/keypolicy.go
+package vsockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nitro-dev-qemu/pkg/attestation"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// keyPolicies are the key policies set by --key-policy, keyed by short key
+// ID (see shortKeyName).
+var keyPolicies = keyPolicySet{}
+
+// recipientConditionPrefix starts the condition keys KMS fills in from
+// the attestation document of a Decrypt request's Recipient.
+const recipientConditionPrefix = "kms:recipientattestation:"
+
+// keyPolicy is the part of a KMS key policy the proxy can evaluate: the
+// statements that apply to kms:Decrypt and have conditions on
+// kms:RecipientAttestation:PCR0 to PCR8 or :ImageSha384. The rest of a
+// real policy depends on principals the simulation doesn't model, so it
+// is ignored and the proxy's credentials are trusted to be allowed.
+//
+// As in KMS, a matching Deny statement denies; and when there are Allow
+// statements with recipient conditions, a Decrypt must match one of them,
+// which a Decrypt without a Recipient never does.
+type keyPolicy struct {
+	file       string
+	statements []policyStatement
+	unmodeled  []string // condition keys ignored, for the startup warning
+}
+
+type policyStatement struct {
+	sid        string
+	deny       bool
+	conditions []policyCondition
+}
+
+// policyCondition is one condition key under one operator, such as
+// "StringEqualsIgnoreCase": {"kms:RecipientAttestation:PCR0": [...]}.
+type policyCondition struct {
+	operator string
+	key      string
+	values   []string
+}
+
+// policyDocument is the JSON of a key policy, as from
+//
+//	aws kms get-key-policy --key-id KEY --policy-name default --output text
+type policyDocument struct {
+	Statement oneOrMany[policyStatementJSON]
+}
+
+type policyStatementJSON struct {
+	Sid       string
+	Effect    string
+	Action    oneOrMany[string]
+	Condition map[string]map[string]oneOrMany[string]
+}
+
+// oneOrMany decodes the policy grammar's "a value or a list of values".
+type oneOrMany[T any] []T
+
+func (o *oneOrMany[T]) UnmarshalJSON(data []byte) error {
+	var one T
+	if err := json.Unmarshal(data, &one); err == nil {
+		*o = []T{one}
+		return nil
+	}
+	var many []T
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*o = many
+	return nil
+}
+
+// parseKeyPolicy parses a key policy document, keeping the statements
+// keyPolicy describes.
+func parseKeyPolicy(file string, data []byte) (*keyPolicy, error) {
+	var doc policyDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse key policy %s: %v", file, err)
+	}
+	p := &keyPolicy{file: file}
+	unmodeled := map[string]bool{}
+	for i, s := range doc.Statement {
+		if !appliesToDecrypt(s.Action) {
+			continue
+		}
+		st := policyStatement{sid: s.Sid, deny: strings.EqualFold(s.Effect, "Deny")}
+		if st.sid == "" {
+			st.sid = "Statement " + strconv.Itoa(i)
+		}
+		for operator, keys := range s.Condition {
+			for key, values := range keys {
+				if !strings.HasPrefix(strings.ToLower(key), recipientConditionPrefix) {
+					unmodeled[key] = true
+					continue
+				}
+				if _, ok := conditionOperators[operator]; !ok {
+					return nil, fmt.Errorf("key policy %s: %s: unsupported condition operator %q for %s", file, st.sid, operator, key)
+				}
+				if _, ok := recipientPCR(key); !ok {
+					return nil, fmt.Errorf("key policy %s: %s: unknown condition key %q", file, st.sid, key)
+				}
+				st.conditions = append(st.conditions, policyCondition{operator: operator, key: key, values: values})
+			}
+		}
+		if len(st.conditions) > 0 {
+			p.statements = append(p.statements, st)
+		}
+	}
+	if len(p.statements) == 0 {
+		return nil, fmt.Errorf("key policy %s has no kms:Decrypt statements with kms:RecipientAttestation conditions", file)
+	}
+	for key := range unmodeled {
+		p.unmodeled = append(p.unmodeled, key)
+	}
+	sort.Strings(p.unmodeled)
+	return p, nil
+}
+
+// appliesToDecrypt reports whether a statement's actions include
+// kms:Decrypt. Action names are case-insensitive.
+func appliesToDecrypt(actions []string) bool {
+	for _, a := range actions {
+		switch strings.ToLower(a) {
+		case "kms:decrypt", "kms:*", "*":
+			return true
+		}
+	}
+	return false
+}
+
+// recipientPCR maps a kms:RecipientAttestation condition key to a PCR
+// index. ImageSha384 is the image measurement, PCR0.
+func recipientPCR(key string) (int, bool) {
+	name := strings.TrimPrefix(strings.ToLower(key), recipientConditionPrefix)
+	if name == "imagesha384" {
+		return 0, true
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(name, "pcr"))
+	if !strings.HasPrefix(name, "pcr") || err != nil || i < 0 || i > 8 {
+		return 0, false
+	}
+	return i, true
+}
+
+// conditionOperators are the string operators key policies use with PCR
+// values. The negated ones match when the key is missing, as in IAM.
+var conditionOperators = map[string]struct{ negated, ignoreCase bool }{
+	"StringEquals":              {false, false},
+	"StringEqualsIgnoreCase":    {false, true},
+	"StringNotEquals":           {true, false},
+	"StringNotEqualsIgnoreCase": {true, true},
+}
+
+// matches reports whether the condition holds for recipient, which is nil
+// when the Decrypt has no Recipient.
+func (c policyCondition) matches(recipient *attestation.Attested) bool {
+	op := conditionOperators[c.operator]
+	var value string
+	if recipient != nil {
+		i, _ := recipientPCR(c.key)
+		if pcr, ok := recipient.PCRs[i]; ok {
+			value = hex.EncodeToString(pcr)
+		}
+	}
+	if value == "" {
+		return op.negated
+	}
+	for _, want := range c.values {
+		if want == value || op.ignoreCase && strings.EqualFold(want, value) {
+			return !op.negated
+		}
+	}
+	return op.negated
+}
+
+func (s policyStatement) matches(recipient *attestation.Attested) bool {
+	for _, c := range s.conditions {
+		if !c.matches(recipient) {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate returns the statement that decides a Decrypt for recipient and
+// whether it is allowed. The statement is empty when no Allow statement
+// matched.
+func (p *keyPolicy) evaluate(recipient *attestation.Attested) (string, bool) {
+	allowed, allows := "", false
+	for _, s := range p.statements {
+		switch {
+		case s.deny && s.matches(recipient):
+			return s.sid, false
+		case !s.deny:
+			allows = true
+			if allowed == "" && s.matches(recipient) {
+				allowed = s.sid
+			}
+		}
+	}
+	return allowed, !allows || allowed != ""
+}
+
+// keyPolicySet collects repeated --key-policy KEY=FILE flags. It
+// implements flag.Value, loading each policy as it is set so a bad
+// policy is a usage error.
+type keyPolicySet map[string]*keyPolicy
+
+func (s *keyPolicySet) Set(value string) error {
+	key, file, ok := strings.Cut(value, "=")
+	key, file = strings.TrimSpace(key), strings.TrimSpace(file)
+	if !ok || key == "" || file == "" {
+		return fmt.Errorf("%q is not KEY=FILE", value)
+	}
+	short := shortKeyName(key)
+	if strings.HasPrefix(short, "alias/") {
+		return fmt.Errorf("key policies belong to keys, not aliases: name %s by key ID or ARN", key)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	p, err := parseKeyPolicy(file, data)
+	if err != nil {
+		return err
+	}
+	(*s)[short] = p
+	return nil
+}
+
+func (s *keyPolicySet) String() string {
+	if s == nil {
+		return ""
+	}
+	keys := make([]string, 0, len(*s))
+	for k, p := range *s {
+		keys = append(keys, k+"="+p.file)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// check returns a policy_denied error, with the errorType KMS would send,
+// unless the policy of keyARN, the key KMS decrypted with, allows the
+// Decrypt for recipient. Keys without a --key-policy are not checked.
+func (s keyPolicySet) check(keyARN string, recipient *attestation.Attested) error {
+	p, ok := s[shortKeyName(keyARN)]
+	if !ok {
+		return nil
+	}
+	sid, allowed := p.evaluate(recipient)
+	if allowed {
+		return nil
+	}
+	deniedKeys.Inc()
+	reason := "no statement allows kms:Decrypt"
+	if sid != "" {
+		reason = sid + " denies kms:Decrypt"
+	}
+	if recipient == nil {
+		reason += " without a Recipient attestation document"
+	} else {
+		reason += " for the attested PCRs"
+	}
+	return protocol.Errorf(protocol.CodePolicyDenied, "key policy of %q: %s", keyARN, reason).
+		WithDetail("rule", "key-policy").
+		WithDetail("key_id", keyARN).
+		WithDetail("kms_error_type", "AccessDeniedException")
+}
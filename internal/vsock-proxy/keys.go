@@ -0,0 +1,119 @@
+// vsock-proxy/keys.go
+package vsockproxy
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// allowedKeys restricts which KMS keys enclaves may use; nil when
+// --allowed-keys is empty, which allows any key the proxy's credentials
+// can use.
+var allowedKeys *keyAllowlist
+
+// aliasRefreshInterval bounds how often the allowlist asks KMS which keys
+// its aliases point at.
+const aliasRefreshInterval = time.Minute
+
+// keyAllowlist holds the keys from --allowed-keys: key IDs, key ARNs,
+// alias names or alias ARNs. A key named in a request is allowed when it
+// matches an entry as written, so an enclave that asks for alias/dev-key
+// needs alias/dev-key on the list, not the key it points at. ARNs and
+// their short forms are interchangeable.
+//
+// Decrypt requests usually don't name a key at all; KMS finds it from the
+// CiphertextBlob and reports its ARN. For those, the listed aliases are
+// resolved through ListAliases so a key allowed by alias can decrypt too.
+type keyAllowlist struct {
+	entries map[string]bool // short names
+	aliases bool            // whether any entry is an alias
+
+	mu        sync.Mutex
+	aliasKeys map[string]bool // key IDs the listed aliases pointed at
+	resolved  time.Time
+}
+
+// newKeyAllowlist parses a comma-separated list. It returns nil for an
+// empty list.
+func newKeyAllowlist(list string) *keyAllowlist {
+	a := &keyAllowlist{entries: map[string]bool{}}
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			short := shortKeyName(key)
+			a.entries[short] = true
+			a.aliases = a.aliases || strings.HasPrefix(short, "alias/")
+		}
+	}
+	if len(a.entries) == 0 {
+		return nil
+	}
+	return a
+}
+
+// shortKeyName strips the ARN prefix from a key or alias ARN, leaving the
+// key ID or "alias/name".
+func shortKeyName(key string) string {
+	if !strings.HasPrefix(key, "arn:") {
+		return key
+	}
+	resource := key[strings.LastIndex(key, ":")+1:]
+	return strings.TrimPrefix(resource, "key/")
+}
+
+// check returns a policy_denied error unless keyID, as named in a
+// request, is allowed.
+func (a *keyAllowlist) check(keyID string) error {
+	if a == nil || a.entries[shortKeyName(keyID)] {
+		return nil
+	}
+	return keyDenied(keyID)
+}
+
+// checkResolved is check for a key ARN reported by KMS, which also
+// accepts keys that a listed alias points at.
+func (a *keyAllowlist) checkResolved(ctx context.Context, logger *slog.Logger, kmsTarget, keyARN string) error {
+	if a == nil || a.entries[shortKeyName(keyARN)] {
+		return nil
+	}
+	if a.aliases && a.aliasTarget(ctx, logger, kmsTarget, shortKeyName(keyARN)) {
+		return nil
+	}
+	return keyDenied(keyARN)
+}
+
+// aliasTarget reports whether one of the listed aliases points at keyID,
+// refreshing the alias targets from KMS when they are older than
+// aliasRefreshInterval.
+func (a *keyAllowlist) aliasTarget(ctx context.Context, logger *slog.Logger, kmsTarget, keyID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.aliasKeys[keyID] || time.Since(a.resolved) < aliasRefreshInterval {
+		return a.aliasKeys[keyID]
+	}
+
+	var aliases KMSListAliasesResponse
+	if err := callKMS(ctx, logger, kmsTarget, "ListAliases", struct{}{}, &aliases); err != nil {
+		logger.Warn("Failed to resolve allowed key aliases", "err", err)
+		return false
+	}
+	a.aliasKeys = map[string]bool{}
+	for _, alias := range aliases.Aliases {
+		if a.entries[alias.AliasName] && alias.TargetKeyId != "" {
+			a.aliasKeys[alias.TargetKeyId] = true
+		}
+	}
+	a.resolved = time.Now()
+	return a.aliasKeys[keyID]
+}
+
+func keyDenied(keyID string) error {
+	deniedKeys.Inc()
+	return protocol.Errorf(protocol.CodePolicyDenied, "KMS key %q is not allowed by this vsock-proxy", keyID).
+		WithDetail("rule", "allowed-keys").
+		WithDetail("key_id", keyID)
+}
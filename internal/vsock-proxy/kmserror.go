@@ -0,0 +1,44 @@
+// vsock-proxy/kmserror.go
+package vsockproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// retryableKMSErrors are the KMS exceptions that may succeed when the same
+// request is sent again, besides any 5xx.
+var retryableKMSErrors = map[string]bool{
+	"ThrottlingException":        true,
+	"KMSInternalException":       true,
+	"DependencyTimeoutException": true,
+	"LimitExceededException":     true,
+}
+
+// kmsError turns a KMS error response into a kms_error with the HTTP
+// status and KMS exception type as details, retryable when KMS was
+// throttling or failing rather than rejecting the request.
+func kmsError(action string, status int, body []byte) *protocol.Error {
+	var kmsErr struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(body, &kmsErr)
+	// __type may be namespaced, as in "com.amazonaws.kms#NotFoundException"
+	errType := kmsErr.Type
+	if i := strings.LastIndexByte(errType, '#'); i >= 0 {
+		errType = errType[i+1:]
+	}
+
+	err := protocol.Errorf(protocol.CodeKMS, "KMS %s failed with status %d: %s", action, status, string(body)).
+		WithRetryable(status == http.StatusTooManyRequests || status >= 500 || retryableKMSErrors[errType]).
+		WithDetail("kms_status", strconv.Itoa(status))
+	if errType != "" {
+		err.WithDetail("kms_error_type", errType)
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+// vsock-proxy/limit.go
+package vsockproxy
+
+import (
+	"context"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// kmsLimit bounds concurrent KMS calls; nil when --kms-max-concurrency is 0.
+var kmsLimit *kmsLimiter
+
+// kmsLimiter caps the number of KMS HTTP calls in flight so a burst of
+// enclave requests queues inside the proxy instead of tripping the KMS
+// request rate quota (or overwhelming LocalStack) and turning into a storm
+// of throttling errors and retries. Calls that wait in the queue longer
+// than timeout fail with a busy error, so the enclave can back off.
+type kmsLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newKMSLimiter(max int, timeout time.Duration) *kmsLimiter {
+	return &kmsLimiter{slots: make(chan struct{}, max), timeout: timeout}
+}
+
+// acquire waits for a free slot and returns the function that frees it.
+// It gives up when ctx is cancelled (a hedged attempt that lost) or the
+// queue timeout passes.
+func (l *kmsLimiter) acquire(ctx context.Context) (release func(), err error) {
+	release = func() {
+		<-l.slots
+		kmsInflight.Dec()
+	}
+
+	// Fast path: a slot is free
+	select {
+	case l.slots <- struct{}{}:
+		kmsInflight.Inc()
+		kmsQueueTime.Observe(0)
+		return release, nil
+	default:
+	}
+
+	kmsQueueDepth.Inc()
+	defer kmsQueueDepth.Dec()
+	start := time.Now()
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		kmsInflight.Inc()
+		kmsQueueTime.Observe(time.Since(start).Seconds())
+		return release, nil
+	case <-timer.C:
+		kmsQueueTimeouts.Inc()
+		return nil, protocol.Errorf(protocol.CodeBusy, "KMS concurrency limit reached: queued for %v", l.timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,117 @@
+package vsockproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+func withKMSLimit(t *testing.T, l *kmsLimiter) {
+	old := kmsLimit
+	t.Cleanup(func() { kmsLimit = old })
+	kmsLimit = l
+}
+
+func TestKMSLimiterSaturation(t *testing.T) {
+	l := newKMSLimiter(2, 50*time.Millisecond)
+	ctx := t.Context()
+	release1, err := l.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := l.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a third call queues for the timeout, then is turned away as busy
+	start := time.Now()
+	_, err = l.acquire(ctx)
+	var perr *protocol.Error
+	if !errors.As(err, &perr) || perr.Code != protocol.CodeBusy {
+		t.Fatalf("err = %v, want a busy error", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("gave up after %v, want the 50ms queue timeout", waited)
+	}
+
+	// a queued call gets the first slot released
+	acquired := make(chan error)
+	go func() {
+		release, err := l.acquire(ctx)
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release1()
+	if err := <-acquired; err != nil {
+		t.Fatalf("queued call: %v", err)
+	}
+	release2()
+	if n := len(l.slots); n != 0 {
+		t.Fatalf("%d slots still taken", n)
+	}
+}
+
+func TestKMSLimiterCancelled(t *testing.T) {
+	l := newKMSLimiter(1, time.Hour)
+	release, err := l.acquire(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+	release()
+	// neither the cancelled nor the timed-out call kept a slot
+	if n := len(l.slots); n != 0 {
+		t.Fatalf("%d slots still taken", n)
+	}
+}
+
+// A KMS call frees its slot however it ends.
+func TestKMSLimiterReleasedOnError(t *testing.T) {
+	l := newKMSLimiter(1, 50*time.Millisecond)
+	withKMSLimit(t, l)
+
+	kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"ThrottlingException"}`))
+	}))
+	defer kms.Close()
+	// a port with nothing listening
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := "http://" + ln.Addr().String()
+	ln.Close()
+
+	ctx := t.Context()
+	for i := range 3 {
+		if _, err := sendKMS(ctx, kms.URL, "Decrypt", []byte("{}")); err == nil {
+			t.Fatalf("call %d: KMS error not returned", i)
+		}
+		if _, err := sendKMS(ctx, unreachable, "Decrypt", []byte("{}")); err == nil {
+			t.Fatalf("call %d: connection error not returned", i)
+		}
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := sendKMS(cancelled, kms.URL, "Decrypt", []byte("{}")); err == nil {
+			t.Fatalf("call %d: cancelled call succeeded", i)
+		}
+		if n := len(l.slots); n != 0 {
+			t.Fatalf("call %d: %d slots still taken", i, n)
+		}
+	}
+}
@@ -0,0 +1,791 @@
+// vsock-proxy/main.go
+package vsockproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"nitro-dev-qemu/pkg/attestation"
+	"nitro-dev-qemu/pkg/connlimit"
+	"nitro-dev-qemu/pkg/envflag"
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/profile"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/shutdown"
+	"nitro-dev-qemu/pkg/vsock"
+	"nitro-dev-qemu/pkg/watchdog"
+)
+
+type KMSEncryptRequest struct {
+	KeyId     string `json:"KeyId"`
+	Plaintext string `json:"Plaintext"`
+}
+
+type KMSEncryptResponse struct {
+	CiphertextBlob string `json:"CiphertextBlob"`
+	KeyId          string `json:"KeyId"`
+}
+
+type KMSDecryptRequest struct {
+	CiphertextBlob string `json:"CiphertextBlob"`
+	KeyId          string `json:"KeyId,omitempty"`
+}
+
+type KMSDecryptResponse struct {
+	Plaintext string `json:"Plaintext"`
+	KeyId     string `json:"KeyId"`
+}
+
+type KMSGenerateDataKeyRequest struct {
+	KeyId   string `json:"KeyId"`
+	KeySpec string `json:"KeySpec"`
+}
+
+type KMSGenerateDataKeyResponse struct {
+	CiphertextBlob string `json:"CiphertextBlob"`
+	Plaintext      string `json:"Plaintext"`
+	KeyId          string `json:"KeyId"`
+}
+
+type KMSGenerateRandomRequest struct {
+	NumberOfBytes int `json:"NumberOfBytes"`
+}
+
+type KMSGenerateRandomResponse struct {
+	Plaintext string `json:"Plaintext"`
+}
+
+type KMSListKeysResponse struct {
+	Keys []struct {
+		KeyId string `json:"KeyId"`
+	} `json:"Keys"`
+}
+
+type KMSListAliasesResponse struct {
+	Aliases []struct {
+		AliasName   string `json:"AliasName"`
+		TargetKeyId string `json:"TargetKeyId"`
+	} `json:"Aliases"`
+}
+
+// Main runs the vsock-proxy with its flags parsed from args into fs.
+// cmd/vsock-proxy passes flag.CommandLine. A program embedding the proxy
+// (cmd/allinone) passes a flag set of its own and t, the transport to
+// listen on in place of --vsock-transport, and sets up logging itself.
+func Main(fs *flag.FlagSet, args []string, t vsock.Transport) {
+	env := envflag.On(fs)
+	listenCID := env.Uint32("listen-cid", vsock.HostCID, "Vsock CID to listen on for enclave connections", "LISTEN_CID")
+	listenPort := env.Uint32("listen-port", 8000, "Vsock port to listen on for enclave connections", "LISTEN_PORT", "VSOCK_PORT")
+	kmsTarget := env.String("kms-target", "http://localhost:4566", "KMS endpoint to forward requests to (e.g. https://kms.us-east-1.amazonaws.com)", "KMS_TARGET")
+	region := env.String("region", "us-east-1", "AWS region KMS requests are signed for", "AWS_REGION", "AWS_DEFAULT_REGION")
+	dnsCacheTTL := env.Duration("dns-cache-ttl", 30*time.Second, "How long to cache DNS lookups of the KMS endpoint (0 disables caching)", "DNS_CACHE_TTL")
+	metricsPort := env.Uint32("metrics-port", 9102, "HTTP port for the Prometheus /metrics endpoint (0 disables it)", "METRICS_PORT")
+	healthPort := env.Uint32("health-port", 9103, "HTTP port for the /healthz and /readyz probes (0 disables them)", "HEALTH_PORT")
+	warmUpConns := env.Uint32("warm-up-conns", 0, "Open this many KMS connections at startup so the first requests skip the handshakes (0 disables warm-up)", "WARM_UP_CONNS")
+	kmsMaxConcurrency := env.Uint32("kms-max-concurrency", 32, "Maximum concurrent KMS calls; further calls queue (0 means unlimited)", "KMS_MAX_CONCURRENCY")
+	kmsQueueTimeout := env.Duration("kms-queue-timeout", 5*time.Second, "Fail a KMS call as busy after it has queued this long for a concurrency slot", "KMS_QUEUE_TIMEOUT")
+	kmsRateLimit := env.Float64("kms-rate-limit", 0, "Maximum KMS calls per second (0 means unlimited)", "KMS_RATE_LIMIT")
+	kmsRateBurst := env.Uint32("kms-rate-burst", 0, "KMS calls allowed in a burst above --kms-rate-limit (0 means one second's worth)", "KMS_RATE_BURST")
+	kmsRateFile := env.String("kms-rate-file", "", "State file shared by proxies on this host so --kms-rate-limit applies to all of them together", "KMS_RATE_FILE")
+	allowedKeyList := env.String("allowed-keys", "", "Comma-separated KMS key IDs, key ARNs or aliases enclaves may use (empty allows any key)", "ALLOWED_KEYS")
+	fs.Var(&keyPolicies, "key-policy", "Evaluate the kms:RecipientAttestation conditions of a KMS key policy JSON file for Decrypt, as KEY=FILE with KEY a key ID or ARN (repeatable)")
+	hedge := fs.Bool("hedge", false, "Hedge idempotent KMS calls: send a second attempt once the first has taken longer than the recent p95 latency")
+	hedgeMinDelay := fs.Duration("hedge-min-delay", 10*time.Millisecond, "Never hedge sooner than this, however low the p95")
+	fs.DurationVar(&requestTimeout, "request-timeout", 10*time.Second, "Budget for handling one request, including KMS queueing and retries; enclaves may ask for less")
+	fs.DurationVar(&idleTimeout, "idle-timeout", 5*time.Minute, "Close an enclave connection that sends no request for this long (0 disables)")
+	fs.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "Give up writing a response after this long (0 disables)")
+	fs.Var(&operationTimeouts, "operation-timeouts", "Per-operation budgets overriding --request-timeout, e.g. Decrypt=2s,GenerateDataKey=3s")
+	maxConns := env.Uint32("max-conns", 64, "Enclave connections served at once; further connections queue or get a busy error (0 means unlimited)", "MAX_CONNS")
+	connQueueTimeout := env.Duration("conn-queue-timeout", time.Second, "How long a connection over --max-conns waits for a slot before getting a busy error (0 rejects at once)", "CONN_QUEUE_TIMEOUT")
+	fs.Var(&forwards, "forward", "Forward raw connections on a vsock port to a TCP endpoint in the allowlist, as VSOCK_PORT=HOST:PORT (repeatable)")
+	relayPort := env.Uint32("relay-port", 0, "Vsock port where enclaves ask for an end-to-end encrypted channel to another enclave on this host, which the proxy relays without being able to read (0 disables it)", "RELAY_PORT")
+	allowlistPath := env.String("allowlist-config", defaultAllowlistPath, "YAML allowlist of TCP endpoints --forward may target, in the official vsock-proxy format", "VSOCK_PROXY_CONFIG")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests on SIGINT/SIGTERM")
+	prof := profile.Register(fs)
+	var transportName *string
+	if t == nil {
+		transportName = env.String("vsock-transport", "vsock", "How to reach the enclaves: vsock, or tcp (tcp:HOST) to run on one machine without a VM, with ports standing in for vsock addresses", "VSOCK_TRANSPORT")
+		logging.RegisterFlags(fs)
+	}
+	fs.Parse(args)
+	if transportName != nil {
+		if err := logging.Setup("vsock-proxy"); err != nil {
+			logging.Fatal("Invalid logging flags", "err", err)
+		}
+		pt, err := vsock.ParseTransport(*transportName)
+		if err != nil {
+			logging.Fatal("Invalid --vsock-transport", "err", err)
+		}
+		t = pt
+	}
+	transport = t
+
+	slog.Info("Starting vsock proxy for KMS encryption", "profile", prof.Name())
+
+	target := *kmsTarget
+	slog.Info("KMS target", "url", target)
+	setupKMSAuth(*region)
+	rules := append(profile.Common(fs),
+		profile.Flag(fs, "kms-target", profile.HTTPS, "KMS requests and the data keys in their responses would cross the network unencrypted"),
+		profile.Rule{Setting: "unsigned KMS requests", Reason: "no AWS credentials were found, and only LocalStack accepts unsigned requests", Violated: func() bool { return kmsCredentials == nil }})
+	if err := prof.Enforce(rules...); err != nil {
+		logging.Fatal("Refusing to start", "profile", prof.Name(), "err", err)
+	}
+	if *kmsMaxConcurrency > 0 {
+		kmsLimit = newKMSLimiter(int(*kmsMaxConcurrency), *kmsQueueTimeout)
+		slog.Info("Limiting concurrent KMS calls", "max", *kmsMaxConcurrency, "queue_timeout", *kmsQueueTimeout)
+	}
+	if *kmsRateLimit > 0 {
+		b, err := newTokenBucket(*kmsRateLimit, int(*kmsRateBurst), *kmsQueueTimeout, *kmsRateFile)
+		if err != nil {
+			logging.Fatal("KMS rate limit setup failed", "err", err)
+		}
+		kmsRate = b
+		slog.Info("Limiting KMS call rate", "per_second", *kmsRateLimit, "burst", b.burst, "shared_file", *kmsRateFile)
+	}
+	if allowedKeys = newKeyAllowlist(*allowedKeyList); allowedKeys != nil {
+		slog.Info("Restricting KMS keys", "allowed_keys", *allowedKeyList)
+	}
+	for key, p := range keyPolicies {
+		slog.Info("Enforcing key policy recipient conditions", "key_id", key, "file", p.file, "statements", len(p.statements))
+		if len(p.unmodeled) > 0 {
+			slog.Warn("Ignoring key policy conditions the simulation doesn't model", "key_id", key, "condition_keys", p.unmodeled)
+		}
+	}
+	if *hedge {
+		kmsHedger = newHedger(*hedgeMinDelay)
+		slog.Info("Hedging idempotent KMS calls after the p95 latency", "min_delay", *hedgeMinDelay)
+	}
+	if *dnsCacheTTL > 0 {
+		kmsTransport.DialContext = newDNSCache(*dnsCacheTTL).DialContext
+		slog.Info("Caching KMS endpoint DNS lookups", "ttl", *dnsCacheTTL)
+	}
+
+	// Probes answer from the start, not ready until the accept loop runs
+	if *healthPort != 0 {
+		healthListener, err := serveHealth(*healthPort, target)
+		if err != nil {
+			logging.Fatal("Failed to listen for health probes", "port", *healthPort, "err", err)
+		}
+		defer healthListener.Close()
+	}
+
+	// Check KMS keys and aliases on startup
+	slog.Info("Checking KMS configuration")
+	if err := checkKMSConfiguration(target); err != nil {
+		slog.Warn("KMS configuration check failed", "err", err)
+	} else {
+		slog.Info("KMS configuration verified successfully")
+	}
+
+	if *warmUpConns > 0 {
+		warmUpKMS(target, int(*warmUpConns))
+	}
+
+	// Create vsock listener (for enclave connections)
+	slog.Info("Creating vsock listener", "cid", *listenCID, "port", *listenPort)
+
+	// Listen on vsock address with retry logic
+	var listener net.Listener
+	var err error
+	maxRetries := 5
+	for i := 0; i < maxRetries; i++ {
+		listener, err = transport.Listen(*listenCID, *listenPort)
+		if err != nil {
+			if i < maxRetries-1 {
+				slog.Warn("Listen failed, retrying in 2 seconds", "attempt", i+1, "max_attempts", maxRetries, "err", err)
+				time.Sleep(2 * time.Second)
+				continue
+			} else {
+				logging.Fatal("Failed to listen on vsock", "attempts", maxRetries, "err", err)
+			}
+		}
+		break
+	}
+	defer listener.Close()
+
+	slog.Info("Listening on vsock", "addr", listener.Addr().String())
+
+	if *metricsPort != 0 {
+		metricsServer := serveMetrics(*metricsPort)
+		defer metricsServer.Close()
+	}
+
+	forwardListeners, err := startForwards(*listenCID, *allowlistPath)
+	if err != nil {
+		logging.Fatal("Forwarding setup failed", "err", err)
+	}
+	defer closeAll(forwardListeners)
+	relayListener, err := startRelay(*listenCID, *relayPort)
+	if err != nil {
+		logging.Fatal("Relay setup failed", "err", err)
+	}
+	if relayListener != nil {
+		defer relayListener.Close()
+	}
+
+	// Stop accepting on SIGINT/SIGTERM: the accept loops' contexts end,
+	// closing the listeners, and the main loop then drains
+	shutdown.OnSignal(func(sig os.Signal) {
+		slog.Info("Received signal, no longer accepting connections", "signal", sig.String())
+		accepting.Store(false)
+		drainer.Stop()
+	})
+
+	connLimit = connlimit.New(int(*maxConns), *connQueueTimeout, connlimit.Metrics{
+		InUse:    connSlotsInUse,
+		Waiting:  connQueueDepth,
+		Rejected: connsRejected,
+	})
+	connSlotsMax.Add(int64(*maxConns))
+
+	slog.Info("Ready to accept connections")
+	accepting.Store(true)
+
+	connectionCount := 0
+	for {
+		// Accept connection
+		slog.Debug("Waiting for new connection")
+		conn, err := vsock.Accept(drainer.Listening(), listener)
+		if err != nil {
+			if drainer.Stopping() {
+				break
+			}
+			slog.Warn("Accept failed", "err", err)
+			continue
+		}
+
+		connectionCount++
+		connectionsAccepted.Inc()
+		connLogger := logging.ForConn(conn, connectionCount)
+		connLogger.Info("Accepted connection", connsAttr())
+
+		// Handle connection in goroutine, once it gets a slot
+		connID := connectionCount
+		drainer.Go(func() {
+			if !connLimit.Acquire(drainer.Done()) {
+				connLogger.Warn("Rejecting connection: --max-conns reached", connsAttr())
+				rejectBusy(conn)
+				return
+			}
+			defer connLimit.Release()
+			ctx, cancel := vsock.WithConn(drainer.Context(), conn)
+			defer cancel()
+			handleVsockConnection(ctx, conn, connID, target)
+		})
+	}
+
+	// Drain in-flight KMS requests before exiting
+	slog.Info("Waiting for active connections to finish", "timeout", *shutdownTimeout, "active", drainer.Active())
+	if drainer.Wait(*shutdownTimeout) {
+		slog.Info("All connections finished")
+	} else {
+		slog.Warn("Shutdown timeout reached, closing active connections", "active", drainer.Active())
+	}
+	slog.Info("Shutdown complete")
+}
+
+// transport listens for enclave connections (set by --vsock-transport);
+// tests swap in a vsock.Memory.
+var transport vsock.Transport = vsock.System{}
+
+// drainer tracks connection handlers so they can finish on shutdown.
+var drainer shutdown.Drainer
+
+// connLimit bounds the enclave connections served at once (--max-conns).
+var connLimit *connlimit.Limiter
+
+// connsAttr describes connection slot utilization for log lines.
+func connsAttr() slog.Attr {
+	s := connLimit.Stats()
+	return slog.Group("conns", "in_use", s.InUse, "max", s.Max, "waiting", s.Waiting, "rejected", s.Rejected)
+}
+
+// rejectBusy answers the first request on a connection that got no slot
+// with a busy error, so the enclave backs off instead of waiting on a
+// connection nobody serves, and closes it.
+func rejectBusy(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	req, err := protocol.ReadRequest(conn)
+	if err == io.EOF {
+		return
+	}
+	protocol.WriteResponse(conn, protocol.Failed(req, protocol.Errorf(protocol.CodeBusy, "vsock-proxy is at its connection limit, retry later")))
+}
+
+func checkKMSConfiguration(kmsTarget string) error {
+	// List available keys
+	var keys KMSListKeysResponse
+	if err := callKMS(drainer.Context(), slog.Default(), kmsTarget, "ListKeys", struct{}{}, &keys); err != nil {
+		return fmt.Errorf("failed to list keys: %v", err)
+	}
+	slog.Info("Available KMS keys", "count", len(keys.Keys))
+	for _, key := range keys.Keys {
+		slog.Info("KMS key", "key_id", key.KeyId)
+	}
+
+	// List aliases
+	var aliases KMSListAliasesResponse
+	if err := callKMS(drainer.Context(), slog.Default(), kmsTarget, "ListAliases", struct{}{}, &aliases); err != nil {
+		return fmt.Errorf("failed to list aliases: %v", err)
+	}
+	slog.Info("Available KMS aliases", "count", len(aliases.Aliases))
+	for _, alias := range aliases.Aliases {
+		slog.Info("KMS alias", "alias", alias.AliasName, "key_id", alias.TargetKeyId)
+	}
+
+	return nil
+}
+
+// handleVsockConnection serves requests from one enclave connection. The
+// enclave keeps connections open and multiplexes requests on them, so each
+// request is handled in its own goroutine and answered, in completion
+// order, with the request's Seq echoed back. ctx is the connection's
+// context: it closes conn when it ends, and request contexts derive from
+// it.
+func handleVsockConnection(ctx context.Context, conn net.Conn, connID int, kmsTarget string) {
+	startTime := time.Now()
+	logger := logging.ForConn(conn, connID)
+	logger.Debug("Starting connection handler")
+	activeConnections.Inc()
+	defer activeConnections.Dec()
+
+	var (
+		inflight sync.WaitGroup
+		writeMu  sync.Mutex
+	)
+	respond := func(resp *protocol.Response) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if writeTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		return protocol.WriteResponse(conn, resp)
+	}
+	defer func() {
+		// Let in-flight requests answer before closing
+		inflight.Wait()
+		conn.Close()
+		logger.Info("Connection closed", "duration", time.Since(startTime))
+	}()
+
+	// On shutdown stop reading new requests; in-flight ones still complete
+	stop := context.AfterFunc(drainer.Listening(), func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	for requestNum := 1; ; requestNum++ {
+		// Read request from vsock
+		logger.Debug("Reading request from client")
+		readStart := time.Now()
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(readStart.Add(idleTimeout))
+			// Shutdown may have set an immediate deadline just before
+			if drainer.Stopping() {
+				logger.Info("Shutting down, no longer reading requests")
+				return
+			}
+		}
+		req, err := protocol.ReadRequest(conn)
+		if err != nil {
+			var (
+				perr *protocol.Error
+				nerr net.Error
+			)
+			switch {
+			case err == io.EOF:
+				logger.Info("Client closed connection", "requests", requestNum-1)
+				return
+			case drainer.Stopping():
+				logger.Info("Shutting down, no longer reading requests")
+				return
+			case errors.As(err, &nerr) && nerr.Timeout():
+				// The enclave redials on its next request
+				logger.Info("Closing idle connection", "idle_timeout", idleTimeout, "requests", requestNum-1)
+				return
+			case errors.As(err, &perr):
+				// The frame was intact: answer and keep serving
+				logger.Warn("Bad request", "err", err)
+				respond(protocol.Failed(req, err))
+				continue
+			default:
+				logger.Warn("Read error", "err", err)
+				return
+			}
+		}
+		readTime := time.Since(readStart)
+
+		inflight.Add(1)
+		reqLogger := logger.With("request_num", requestNum, "request_id", req.RequestId, "seq", req.Seq)
+		go func() {
+			defer inflight.Done()
+			resp := handleRequest(ctx, reqLogger, req, readTime, kmsTarget)
+			sendStart := time.Now()
+			if err := respond(resp); err != nil {
+				reqLogger.Warn("Write error", "err", err)
+				return
+			}
+			reqLogger.Debug("Response sent", "duration", time.Since(sendStart))
+		}()
+	}
+}
+
+// requestTimeout and operationTimeouts bound how long one request may take
+// (set by --request-timeout and --operation-timeouts); idleTimeout and
+// writeTimeout bound how long a connection may sit without a request and
+// how long writing a response may block.
+var (
+	requestTimeout    time.Duration
+	operationTimeouts protocol.Budgets
+	idleTimeout       time.Duration
+	writeTimeout      time.Duration
+)
+
+// handlerGrace is how long past its budget a request handler may run
+// before it is abandoned and the request answered with a timeout.
+const handlerGrace = time.Second
+
+// handleRequest performs one KMS operation and returns the response, with
+// its stage timings and the budget that applied. connCtx is the context
+// of the connection req arrived on.
+func handleRequest(connCtx context.Context, logger *slog.Logger, req *protocol.Request, readTime time.Duration, kmsTarget string) (resp *protocol.Response) {
+	startTime := time.Now()
+	budget := operationTimeouts.Budget(req, requestTimeout)
+	ctx, cancel := context.WithTimeout(protocol.WithRequestID(connCtx, req.RequestId), budget)
+	defer cancel()
+	var kmsTime time.Duration
+	activeRequests.Inc()
+	requestsTotal.With(operationLabel(req.Operation)).Inc()
+	bytesReceived.Add(int64(req.Payload.Len()))
+	defer func() {
+		// Never log the panic value as-is: it may carry request data
+		if r := recover(); r != nil {
+			logger.Error("Handler panicked", "panic", payload.DescribePanic(r), "stack", string(debug.Stack()))
+			resp = protocol.Failed(req, protocol.Errorf(protocol.CodeInternal, "internal error"))
+		}
+		activeRequests.Dec()
+		bytesSent.Add(int64(resp.Result.Len()))
+		resp.Timing = &protocol.Timing{
+			BudgetMs: protocol.Ms(budget),
+			TotalMs:  protocol.Ms(readTime + time.Since(startTime)),
+			StagesMs: map[string]float64{"read": protocol.Ms(readTime), "kms": protocol.Ms(kmsTime)},
+		}
+	}()
+
+	logger.Info("Received request", "operation", req.Operation, "bytes", req.Payload.Len(), "read_time", readTime)
+	logger.Debug("Request input", logging.Payload("input", req.Payload.Bytes()))
+
+	// Perform the KMS operation
+	logger.Debug("Sending request to KMS", "operation", req.Operation)
+	kmsStart := time.Now()
+	result, err := watchdog.Run(ctx, handlerGrace, func() ([]byte, error) {
+		return performKMS(ctx, logger, req, kmsTarget)
+	})
+	kmsTime = time.Since(kmsStart)
+	var perr *watchdog.PanicError
+	switch {
+	case errors.As(err, &perr):
+		// Never log the panic value as-is: it may carry request data
+		logger.Error("Handler panicked", "panic", payload.DescribePanic(perr.Value), "stack", string(perr.Stack))
+		err = protocol.Errorf(protocol.CodeInternal, "internal error")
+	case errors.Is(err, watchdog.ErrAbandoned):
+		logger.Error("KMS operation ignored its deadline, abandoning it", "operation", req.Operation, "budget", budget, "stuck", watchdog.Stuck())
+		abandonedRequests.Inc()
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = protocol.Errorf(protocol.CodeTimeout, "%s did not complete within its %v budget: %v", req.Operation, budget, err)
+		}
+		logger.Warn("KMS operation failed", "operation", req.Operation, "err", err)
+		return protocol.Failed(req, err)
+	}
+	logger.Info("KMS operation completed", "operation", req.Operation, "kms_time", kmsTime, "result_bytes", len(result), "total_time", time.Since(startTime))
+	if req.Operation == protocol.OpGenerateDataKey {
+		// the result carries the plaintext data key: never log it raw
+		logger.Debug("Request result", logging.Secret("result", result))
+	} else {
+		logger.Debug("Request result", logging.Payload("result", result))
+	}
+	return protocol.OK(req, result)
+}
+
+// performKMS runs the KMS calls for req and returns the result payload.
+func performKMS(ctx context.Context, logger *slog.Logger, req *protocol.Request, kmsTarget string) ([]byte, error) {
+	input := req.Payload
+	var (
+		result []byte
+		err    error
+	)
+	switch req.Operation {
+	case protocol.OpEncrypt:
+		var keyID, encrypted string
+		if keyID, err = keyIDFor(req, defaultKeyID); err == nil {
+			encrypted, err = encryptWithKMS(ctx, logger, input, keyID, kmsTarget)
+			result = []byte(encrypted)
+		}
+	case protocol.OpDecrypt:
+		result, err = decryptForRequest(ctx, logger, req, kmsTarget)
+	case protocol.OpGenerateDataKey:
+		var (
+			keyID   string
+			dataKey *protocol.DataKey
+		)
+		if keyID, err = keyIDFor(req, defaultKeyID); err == nil {
+			dataKey, err = generateDataKeyWithKMS(ctx, logger, keyID, kmsTarget)
+		}
+		if err == nil {
+			result, err = json.Marshal(dataKey)
+		}
+	case protocol.OpSign:
+		result, err = signWithKMS(ctx, logger, req, kmsTarget)
+	case protocol.OpVerify:
+		result, err = verifyWithKMS(ctx, logger, req, kmsTarget)
+	case protocol.OpGenerateRandom:
+		result, err = generateRandomWithKMS(ctx, logger, req.NumberOfBytes, kmsTarget)
+	default:
+		err = protocol.Errorf(protocol.CodeUnsupportedOperation, "unsupported operation %q", req.Operation)
+	}
+	return result, err
+}
+
+// defaultKeyID is used when a request doesn't name a KMS key.
+const defaultKeyID = "alias/dev-key"
+
+// keyIDFor returns the KMS key a request asked for, or def when it didn't
+// name one. Either way the key must pass --allowed-keys.
+func keyIDFor(req *protocol.Request, def string) (string, error) {
+	keyID := req.KeyId
+	if keyID == "" {
+		keyID = def
+	}
+	return keyID, allowedKeys.check(keyID)
+}
+
+func encryptWithKMS(ctx context.Context, logger *slog.Logger, plaintext payload.Payload, keyID, kmsTarget string) (string, error) {
+	// Base64 encode the plaintext as required by AWS KMS API
+	plaintextBase64 := base64.StdEncoding.EncodeToString(plaintext.Bytes())
+
+	// Create KMS encrypt request
+	req := KMSEncryptRequest{
+		KeyId:     keyID,
+		Plaintext: plaintextBase64,
+	}
+
+	var kmsResp KMSEncryptResponse
+	if err := callKMS(ctx, logger, kmsTarget, "Encrypt", req, &kmsResp); err != nil {
+		return "", err
+	}
+
+	logger.Debug("KMS encrypted", "key_id", kmsResp.KeyId, logging.Payload("ciphertext_blob", []byte(kmsResp.CiphertextBlob)))
+
+	return kmsResp.CiphertextBlob, nil
+}
+
+// decryptWithKMS decrypts a CiphertextBlob. KMS works out the key from the
+// blob itself; when keyID is set, KMS also checks the blob was encrypted
+// under that key. Without a keyID, the key KMS used must pass
+// --allowed-keys before the plaintext is returned. recipient is what the
+// request's attestation evidence attests, nil without a Recipient; the
+// --key-policy of the key KMS used is evaluated against it.
+func decryptWithKMS(ctx context.Context, logger *slog.Logger, ciphertextBlob, keyID, kmsTarget string, recipient *attestation.Attested) (payload.Payload, error) {
+	if keyID != "" {
+		if err := allowedKeys.check(keyID); err != nil {
+			return payload.Payload{}, err
+		}
+	}
+	req := KMSDecryptRequest{
+		CiphertextBlob: ciphertextBlob,
+		KeyId:          keyID,
+	}
+
+	var kmsResp KMSDecryptResponse
+	if err := callKMS(ctx, logger, kmsTarget, "Decrypt", req, &kmsResp); err != nil {
+		return payload.Payload{}, err
+	}
+	if keyID == "" {
+		if err := allowedKeys.checkResolved(ctx, logger, kmsTarget, kmsResp.KeyId); err != nil {
+			return payload.Payload{}, err
+		}
+	}
+	// Like KMS, check the key policy of the key that did the decrypting
+	if err := keyPolicies.check(kmsResp.KeyId, recipient); err != nil {
+		return payload.Payload{}, err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(kmsResp.Plaintext)
+	if err != nil {
+		return payload.Payload{}, fmt.Errorf("failed to decode KMS plaintext: %v", err)
+	}
+
+	logger.Debug("KMS decrypted", "key_id", kmsResp.KeyId, "bytes", len(plaintext))
+
+	return payload.New(plaintext), nil
+}
+
+// generateDataKeyWithKMS asks KMS for a fresh AES-256 data key, returning
+// both the plaintext key and its CiphertextBlob.
+func generateDataKeyWithKMS(ctx context.Context, logger *slog.Logger, keyID, kmsTarget string) (*protocol.DataKey, error) {
+	req := KMSGenerateDataKeyRequest{
+		KeyId:   keyID,
+		KeySpec: "AES_256",
+	}
+
+	var kmsResp KMSGenerateDataKeyResponse
+	if err := callKMS(ctx, logger, kmsTarget, "GenerateDataKey", req, &kmsResp); err != nil {
+		return nil, err
+	}
+
+	plaintextKey, err := base64.StdEncoding.DecodeString(kmsResp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode data key: %v", err)
+	}
+
+	logger.Debug("KMS generated data key", "key_id", kmsResp.KeyId, "bytes", len(plaintextKey))
+
+	return &protocol.DataKey{
+		KeyId:          kmsResp.KeyId,
+		Plaintext:      payload.New(plaintextKey),
+		CiphertextBlob: kmsResp.CiphertextBlob,
+	}, nil
+}
+
+// generateRandomWithKMS returns n random bytes from KMS GenerateRandom,
+// which accepts 1 to 1024 bytes per call.
+func generateRandomWithKMS(ctx context.Context, logger *slog.Logger, n int, kmsTarget string) ([]byte, error) {
+	if n < 1 || n > protocol.MaxRandomBytes {
+		return nil, protocol.Errorf(protocol.CodeBadRequest, "number_of_bytes must be 1 to %d, got %d", protocol.MaxRandomBytes, n)
+	}
+
+	var kmsResp KMSGenerateRandomResponse
+	if err := callKMS(ctx, logger, kmsTarget, "GenerateRandom", KMSGenerateRandomRequest{NumberOfBytes: n}, &kmsResp); err != nil {
+		return nil, err
+	}
+
+	random, err := base64.StdEncoding.DecodeString(kmsResp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode random bytes: %v", err)
+	}
+	if len(random) != n {
+		return nil, fmt.Errorf("KMS returned %d random bytes, asked for %d", len(random), n)
+	}
+	return random, nil
+}
+
+// callKMS sends a TrentService request for the given action to the KMS
+// target and decodes the JSON response into out. ctx bounds the whole call,
+// including time queued for the concurrency and rate limits.
+func callKMS(ctx context.Context, logger *slog.Logger, kmsTarget, action string, in, out interface{}) error {
+	reqBody, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	logger.Debug("KMS request", "action", action, logging.Payload("json", reqBody))
+
+	// Send request to KMS, hedged if enabled for this action
+	var respBody []byte
+	if kmsHedger != nil && hedgeable[action] {
+		respBody, err = kmsHedger.send(ctx, logger, kmsTarget, action, reqBody)
+	} else {
+		respBody, err = sendKMS(ctx, kmsTarget, action, reqBody)
+	}
+	if err != nil {
+		return err
+	}
+
+	// GenerateDataKey responses carry the plaintext data key: never log them raw
+	if action == "GenerateDataKey" {
+		logger.Debug("KMS response", "action", action, logging.Secret("json", respBody))
+	} else {
+		logger.Debug("KMS response", "action", action, logging.Payload("json", respBody))
+	}
+
+	// Parse KMS response
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to parse KMS response: %v", err)
+	}
+	return nil
+}
+
+// sendKMS performs one KMS HTTP call and returns the body of a successful
+// response. An attempt cancelled through ctx (the losing side of a hedged
+// call) is not counted in the latency or error metrics.
+func sendKMS(ctx context.Context, kmsTarget, action string, reqBody []byte) ([]byte, error) {
+	// Wait for a rate limit token and then a concurrency slot before
+	// signing, so the signature's timestamp doesn't age in the queue
+	if kmsRate != nil {
+		if err := kmsRate.take(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if kmsLimit != nil {
+		release, err := kmsLimit.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	// Create HTTP request to KMS
+	httpReq, err := newKMSRequest(ctx, kmsTarget, action, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record whether the call got a pooled connection or paid for a new one
+	httpReq = httpReq.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				kmsConnections.With("reused").Inc()
+			} else {
+				kmsConnections.With("new").Inc()
+			}
+		},
+	}))
+
+	kmsStart := time.Now()
+	resp, err := kmsClient.Do(httpReq)
+	if err != nil {
+		if ctx.Err() == nil {
+			kmsErrors.With("network").Inc()
+		}
+		return nil, protocol.Errorf(protocol.CodeKMS, "failed to send request to KMS: %v", err).WithRetryable(true)
+	}
+	defer resp.Body.Close()
+	kmsProtocols.With(resp.Proto).Inc()
+
+	// Read response; reading it to the end lets the connection be reused
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if ctx.Err() == nil {
+			kmsErrors.With("network").Inc()
+		}
+		return nil, fmt.Errorf("failed to read KMS response: %v", err)
+	}
+	elapsed := time.Since(kmsStart)
+	kmsLatency.With(action).Observe(elapsed.Seconds())
+
+	if resp.StatusCode != http.StatusOK {
+		kmsErrors.With(strconv.Itoa(resp.StatusCode)).Inc()
+		return nil, kmsError(action, resp.StatusCode, respBody)
+	}
+	if kmsHedger != nil {
+		kmsHedger.observe(action, elapsed)
+	}
+	return respBody, nil
+}
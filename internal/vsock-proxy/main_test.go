@@ -0,0 +1,447 @@
+package vsockproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/attestation"
+	"nitro-dev-qemu/pkg/framing"
+	"nitro-dev-qemu/pkg/payload"
+	"nitro-dev-qemu/pkg/pcr"
+	"nitro-dev-qemu/pkg/peer"
+	"nitro-dev-qemu/pkg/protocol"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+// fakeKMS is a TrentService stand-in that records the calls it gets and
+// answers them from handlers keyed by action.
+type fakeKMS struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	calls []kmsCall
+}
+
+type kmsCall struct {
+	Action       string
+	ContentType  string
+	InvocationID string
+	Body         map[string]interface{}
+}
+
+func newFakeKMS(t *testing.T, handlers map[string]func(body map[string]interface{}) (int, interface{})) *fakeKMS {
+	f := &fakeKMS{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "TrentService.")
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		f.calls = append(f.calls, kmsCall{Action: action, ContentType: r.Header.Get("Content-Type"), InvocationID: r.Header.Get(invocationIDHeader), Body: body})
+		f.mu.Unlock()
+
+		handler, ok := handlers[action]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"__type":"UnsupportedOperationException"}`)
+			return
+		}
+		status, out := handler(body)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(out)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeKMS) lastCall(t *testing.T) kmsCall {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.calls) == 0 {
+		t.Fatal("KMS was not called")
+	}
+	return f.calls[len(f.calls)-1]
+}
+
+// echoKMS answers Encrypt with the plaintext wrapped in a fake blob,
+// Decrypt by undoing that, and GenerateDataKey with a fixed key.
+func echoKMS(t *testing.T) *fakeKMS {
+	return newFakeKMS(t, map[string]func(map[string]interface{}) (int, interface{}){
+		"Encrypt": func(body map[string]interface{}) (int, interface{}) {
+			return http.StatusOK, KMSEncryptResponse{CiphertextBlob: "blob:" + body["Plaintext"].(string), KeyId: "arn:aws:kms:us-east-1:000000000000:key/k1"}
+		},
+		"Decrypt": func(body map[string]interface{}) (int, interface{}) {
+			blob := body["CiphertextBlob"].(string)
+			if !strings.HasPrefix(blob, "blob:") {
+				return http.StatusBadRequest, map[string]string{"__type": "com.amazonaws.kms#InvalidCiphertextException"}
+			}
+			return http.StatusOK, KMSDecryptResponse{Plaintext: strings.TrimPrefix(blob, "blob:"), KeyId: "arn:aws:kms:us-east-1:000000000000:key/k1"}
+		},
+		"GenerateDataKey": func(body map[string]interface{}) (int, interface{}) {
+			return http.StatusOK, KMSGenerateDataKeyResponse{
+				CiphertextBlob: "wrapped",
+				Plaintext:      base64.StdEncoding.EncodeToString(make([]byte, 32)),
+				KeyId:          "arn:aws:kms:us-east-1:000000000000:key/k1",
+			}
+		},
+	})
+}
+
+func withRequestTimeout(t *testing.T, d time.Duration) {
+	old := requestTimeout
+	requestTimeout = d
+	t.Cleanup(func() { requestTimeout = old })
+}
+
+func TestKMSRequestConstruction(t *testing.T) {
+	kms := echoKMS(t)
+	ctx := t.Context()
+	logger := slog.New(slog.DiscardHandler)
+
+	blob, err := encryptWithKMS(ctx, logger, payload.FromString("hello"), "alias/dev-key", kms.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := kms.lastCall(t)
+	if call.Action != "Encrypt" || call.ContentType != "application/x-amz-json-1.1" {
+		t.Fatalf("Encrypt call = %+v", call)
+	}
+	if call.Body["KeyId"] != "alias/dev-key" || call.Body["Plaintext"] != base64.StdEncoding.EncodeToString([]byte("hello")) {
+		t.Fatalf("Encrypt body = %v", call.Body)
+	}
+
+	plaintext, err := decryptWithKMS(ctx, logger, blob, "alias/dev-key", kms.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext.Reveal() != "hello" {
+		t.Fatalf("Decrypt = %q", plaintext.Reveal())
+	}
+	if call := kms.lastCall(t); call.Action != "Decrypt" || call.Body["CiphertextBlob"] != blob || call.Body["KeyId"] != "alias/dev-key" {
+		t.Fatalf("Decrypt call = %+v", call)
+	}
+
+	// Without a key ID, KeyId is left out so KMS works it out from the blob
+	if _, err := decryptWithKMS(ctx, logger, blob, "", kms.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kms.lastCall(t).Body["KeyId"]; ok {
+		t.Fatalf("Decrypt without a key sent KeyId: %v", kms.lastCall(t).Body)
+	}
+
+	dataKey, err := generateDataKeyWithKMS(ctx, logger, "alias/dev-key", kms.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call := kms.lastCall(t); call.Action != "GenerateDataKey" || call.Body["KeySpec"] != "AES_256" || call.Body["KeyId"] != "alias/dev-key" {
+		t.Fatalf("GenerateDataKey call = %+v", call)
+	}
+	if dataKey.Plaintext.Len() != 32 || dataKey.CiphertextBlob != "wrapped" {
+		t.Fatalf("GenerateDataKey = %+v", dataKey)
+	}
+}
+
+func TestKMSErrorMapping(t *testing.T) {
+	kms := newFakeKMS(t, map[string]func(map[string]interface{}) (int, interface{}){
+		"Encrypt": func(map[string]interface{}) (int, interface{}) {
+			return http.StatusBadRequest, map[string]string{"__type": "ThrottlingException", "message": "slow down"}
+		},
+		"Decrypt": func(map[string]interface{}) (int, interface{}) {
+			return http.StatusBadRequest, map[string]string{"__type": "com.amazonaws.kms#NotFoundException"}
+		},
+	})
+	ctx := t.Context()
+	logger := slog.New(slog.DiscardHandler)
+
+	_, err := encryptWithKMS(ctx, logger, payload.FromString("x"), "alias/dev-key", kms.URL)
+	var perr *protocol.Error
+	if !errors.As(err, &perr) || perr.Code != protocol.CodeKMS || !perr.Retryable || perr.Details["kms_error_type"] != "ThrottlingException" || perr.Details["kms_status"] != "400" {
+		t.Fatalf("throttled: err = %#v", err)
+	}
+
+	_, err = decryptWithKMS(ctx, logger, "blob", "alias/dev-key", kms.URL, nil)
+	if !errors.As(err, &perr) || perr.Code != protocol.CodeKMS || perr.Retryable || perr.Details["kms_error_type"] != "NotFoundException" {
+		t.Fatalf("not found: err = %#v", err)
+	}
+}
+
+// serve runs handleVsockConnection on one end of an in-memory vsock
+// connection and returns the other.
+func serve(t *testing.T, kmsTarget string) net.Conn {
+	t.Helper()
+	var mem vsock.Memory
+	l, err := mem.Listen(vsock.AnyCID, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		handleVsockConnection(context.Background(), conn, 1, kmsTarget)
+	}()
+	conn, err := mem.DialContext(context.Background(), vsock.LocalCID, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+func TestHandleVsockConnection(t *testing.T) {
+	withRequestTimeout(t, 5*time.Second)
+	kms := echoKMS(t)
+	conn := serve(t, kms.URL)
+
+	// Requests are multiplexed: send them all before reading any answer
+	reqs := []*protocol.Request{
+		{Seq: 1, RequestId: "enc", Operation: protocol.OpEncrypt, Payload: payload.FromString("hello")},
+		{Seq: 2, RequestId: "dec", Operation: protocol.OpDecrypt, Payload: payload.FromString("blob:" + base64.StdEncoding.EncodeToString([]byte("world")))},
+		{Seq: 3, RequestId: "gdk", Operation: protocol.OpGenerateDataKey},
+		{Seq: 4, RequestId: "nope", Operation: "Frobnicate"},
+	}
+	for _, req := range reqs {
+		if err := protocol.WriteRequest(conn, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[uint64]*protocol.Response{}
+	for range reqs {
+		resp, err := protocol.ReadResponse(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[resp.Seq] = resp
+	}
+
+	if resp := got[1]; resp.RequestId != "enc" || resp.Err() != nil || resp.Result.Reveal() != "blob:"+base64.StdEncoding.EncodeToString([]byte("hello")) {
+		t.Fatalf("Encrypt: %+v", resp)
+	}
+	if resp := got[2]; resp.RequestId != "dec" || resp.Err() != nil || resp.Result.Reveal() != "world" {
+		t.Fatalf("Decrypt: %+v", resp)
+	}
+	if resp := got[3]; resp.Err() != nil {
+		t.Fatalf("GenerateDataKey: %v", resp.Err())
+	} else {
+		var dk protocol.DataKey
+		if err := json.Unmarshal(resp.Result.Bytes(), &dk); err != nil || dk.CiphertextBlob != "wrapped" || dk.Plaintext.Len() != 32 {
+			t.Fatalf("GenerateDataKey: %+v, %v", dk, err)
+		}
+	}
+	if resp := got[4]; resp.Error == nil || resp.Error.Code != protocol.CodeUnsupportedOperation {
+		t.Fatalf("unsupported op: %+v", resp)
+	}
+	for _, resp := range got {
+		if resp.Timing == nil || resp.Timing.BudgetMs != 5000 {
+			t.Fatalf("seq %d: timing %+v", resp.Seq, resp.Timing)
+		}
+	}
+
+	// Each KMS call carries the ID of the request it was made for
+	kms.mu.Lock()
+	defer kms.mu.Unlock()
+	ids := map[string]string{}
+	for _, call := range kms.calls {
+		ids[call.Action] = call.InvocationID
+	}
+	if ids["Encrypt"] != "enc" || ids["Decrypt"] != "dec" || ids["GenerateDataKey"] != "gdk" {
+		t.Fatalf("KMS invocation IDs by action: %v", ids)
+	}
+}
+
+func TestHandleVsockConnectionBadRequest(t *testing.T) {
+	withRequestTimeout(t, 5*time.Second)
+	kms := echoKMS(t)
+	conn := serve(t, kms.URL)
+
+	// A request from another protocol version is answered with its
+	// RequestId, and the connection keeps serving
+	data, _ := json.Marshal(map[string]interface{}{"version": 99, "request_id": "old", "operation": "Encrypt"})
+	if err := framing.WriteFrame(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := protocol.ReadResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.RequestId != "old" || resp.Error == nil || resp.Error.Code != protocol.CodeBadRequest {
+		t.Fatalf("bad version: %+v", resp)
+	}
+
+	if err := protocol.WriteRequest(conn, &protocol.Request{Seq: 9, RequestId: "next", Operation: protocol.OpEncrypt, Payload: payload.FromString("x")}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = protocol.ReadResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Seq != 9 || resp.Err() != nil {
+		t.Fatalf("after bad request: %+v", resp)
+	}
+}
+
+func TestHandleVsockConnectionKMSFailure(t *testing.T) {
+	withRequestTimeout(t, 5*time.Second)
+	kms := echoKMS(t)
+	conn := serve(t, kms.URL)
+
+	if err := protocol.WriteRequest(conn, &protocol.Request{Seq: 1, RequestId: "r1", Operation: protocol.OpDecrypt, Payload: payload.FromString("garbage")}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := protocol.ReadResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error == nil || resp.Error.Code != protocol.CodeKMS || resp.Error.Details["kms_error_type"] != "InvalidCiphertextException" {
+		t.Fatalf("got %+v", resp.Error)
+	}
+}
+
+func TestKeyPolicyRecipientConditions(t *testing.T) {
+	kms := echoKMS(t)
+	logger := slog.New(slog.DiscardHandler)
+	key, err := attestation.GenerateRecipientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := pcr.MeasureBytes([]byte("trusted image"))
+	recipient := func(t *testing.T, format string, image pcr.Value) *protocol.Recipient {
+		t.Helper()
+		f, err := attestation.Lookup(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		evidence, err := f.Generate(&attestation.Claims{
+			ModuleID:         "test",
+			ExecutableSHA384: strings.Repeat("00", pcr.Size),
+			ConfigSHA384:     strings.Repeat("00", pcr.Size),
+			PCRs:             pcr.Set{PCR0: image},
+			PublicKey:        &key.PublicKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &protocol.Recipient{KeyEncryptionAlgorithm: attestation.KeyEncryptionAlgorithm, AttestationDocument: evidence}
+	}
+
+	// A policy as the Nitro Enclaves docs write it, with an admin
+	// statement the proxy ignores and a Deny for a revoked image
+	policy := `{
+	  "Version": "2012-10-17",
+	  "Statement": [
+	    {"Sid": "Enable IAM policies", "Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::000000000000:root"}, "Action": "kms:*", "Resource": "*"},
+	    {"Sid": "Enclave decrypt", "Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::000000000000:role/enclave"}, "Action": ["kms:Decrypt"], "Resource": "*",
+	     "Condition": {"StringEqualsIgnoreCase": {"kms:RecipientAttestation:ImageSha384": "` + strings.ToUpper(trusted.String()) + `"}, "Bool": {"aws:SecureTransport": "true"}}},
+	    {"Sid": "Revoked image", "Effect": "Deny", "Principal": "*", "Action": "kms:Decrypt", "Resource": "*",
+	     "Condition": {"StringEquals": {"kms:RecipientAttestation:PCR0": ["` + strings.Repeat("ff", pcr.Size) + `"]}}}
+	  ]
+	}`
+	file := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(file, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := keyPolicies
+	keyPolicies = keyPolicySet{}
+	t.Cleanup(func() { keyPolicies = old })
+	if err := keyPolicies.Set("arn:aws:kms:us-east-1:000000000000:key/k1=" + file); err != nil {
+		t.Fatal(err)
+	}
+	if p := keyPolicies["k1"]; len(p.statements) != 2 || strings.Join(p.unmodeled, ",") != "aws:SecureTransport" {
+		t.Fatalf("parsed policy %+v", p)
+	}
+	if err := keyPolicies.Set("alias/dev-key=" + file); err == nil {
+		t.Fatal("key policy accepted for an alias")
+	}
+
+	blob := "blob:" + base64.StdEncoding.EncodeToString([]byte("secret"))
+	for _, format := range []string{"nitro", "sev-snp"} {
+		sealed, err := decryptForRequest(t.Context(), logger, &protocol.Request{Payload: payload.FromString(blob), Recipient: recipient(t, format, trusted)}, kms.URL)
+		if err != nil {
+			t.Fatalf("%s with the trusted image: %v", format, err)
+		}
+		if plaintext, err := attestation.OpenForRecipient(key, sealed); err != nil || string(plaintext) != "secret" {
+			t.Fatalf("%s: opened %q, %v", format, plaintext, err)
+		}
+	}
+
+	for name, r := range map[string]*protocol.Recipient{
+		"no recipient":  nil,
+		"other image":   recipient(t, "nitro", pcr.MeasureBytes([]byte("other image"))),
+		"revoked image": recipient(t, "tdx", pcr.Value(bytes.Repeat([]byte{0xff}, pcr.Size))),
+	} {
+		_, err := decryptForRequest(t.Context(), logger, &protocol.Request{Payload: payload.FromString(blob), Recipient: r}, kms.URL)
+		var perr *protocol.Error
+		if !errors.As(err, &perr) || perr.Code != protocol.CodePolicyDenied || perr.Details["rule"] != "key-policy" || perr.Details["key_id"] != "arn:aws:kms:us-east-1:000000000000:key/k1" {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	var mem vsock.Memory
+	oldTransport := transport
+	transport = &mem
+	t.Cleanup(func() { transport = oldTransport })
+
+	// The enclave at 16:9003 echoes whatever the relay brings it
+	target, err := mem.Listen(16, 9003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	l, err := startRelay(vsock.HostCID, 8002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	relayTo := func(cid, port uint32) (net.Conn, error) {
+		conn, err := mem.DialContext(context.Background(), vsock.HostCID, 8002)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		return conn, peer.RequestRelay(conn, cid, port)
+	}
+	conn, err := relayTo(16, 9003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := framing.WriteFrame(conn, []byte("sealed record")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := framing.ReadFrame(conn); err != nil || string(got) != "sealed record" {
+		t.Fatalf("relayed %q, %v", got, err)
+	}
+
+	// Nothing listens on 17:9003
+	if _, err := relayTo(17, 9003); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("relay to a missing enclave: %v", err)
+	}
+}
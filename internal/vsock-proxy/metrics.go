@@ -0,0 +1,75 @@
+// vsock-proxy/metrics.go
+package vsockproxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"nitro-dev-qemu/pkg/metrics"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	connectionsAccepted = registry.Counter("vsock_proxy_connections_accepted_total", "Vsock connections accepted from enclaves.")
+	activeConnections   = registry.Gauge("vsock_proxy_active_connections", "Vsock connection handlers currently running.")
+	connSlotsInUse      = registry.Gauge("vsock_proxy_conn_slots_in_use", "Enclave connections holding one of the --max-conns slots.")
+	connSlotsMax        = registry.Gauge("vsock_proxy_conn_slots_max", "The --max-conns limit (0 means unlimited).")
+	connQueueDepth      = registry.Gauge("vsock_proxy_conn_queue_depth", "Enclave connections waiting for a slot.")
+	connsRejected       = registry.Counter("vsock_proxy_conns_rejected_total", "Enclave connections rejected as busy because no slot was free within --conn-queue-timeout.")
+	forwardConnections  = registry.CounterVec("vsock_proxy_forward_connections_total", "Raw --forward connections, by outcome (\"connected\" or \"dial_error\").", "outcome")
+	forwardBytes        = registry.CounterVec("vsock_proxy_forward_bytes_total", "Bytes copied by --forward connections, by direction.", "direction")
+	relayConnections    = registry.CounterVec("vsock_proxy_relay_connections_total", "Enclave-to-enclave --relay-port connections, by outcome (\"connected\", \"dial_error\" or \"bad_request\").", "outcome")
+	relayBytes          = registry.Counter("vsock_proxy_relay_bytes_total", "Encrypted bytes copied between enclaves by --relay-port connections, both directions.")
+	activeRequests      = registry.Gauge("vsock_proxy_active_requests", "Requests currently being handled.")
+	requestsTotal       = registry.CounterVec("vsock_proxy_requests_total", "Requests handled, by operation.", "operation")
+	kmsLatency          = registry.HistogramVec("vsock_proxy_kms_request_duration_seconds", "Latency of KMS HTTP calls, by action.", "action", metrics.DefaultLatencyBuckets)
+	kmsErrors           = registry.CounterVec("vsock_proxy_kms_errors_total", "Failed KMS calls, by HTTP status code (\"network\" when no response was received).", "status")
+	kmsInflight         = registry.Gauge("vsock_proxy_kms_inflight", "KMS calls currently holding a concurrency slot.")
+	kmsQueueDepth       = registry.Gauge("vsock_proxy_kms_queue_depth", "KMS calls waiting for a concurrency slot.")
+	kmsQueueTime        = registry.Histogram("vsock_proxy_kms_queue_seconds", "Time KMS calls waited for a concurrency slot.", metrics.DefaultLatencyBuckets)
+	kmsQueueTimeouts    = registry.Counter("vsock_proxy_kms_queue_timeouts_total", "KMS calls rejected as busy after waiting --kms-queue-timeout for a slot.")
+	kmsRateWaitTime     = registry.Histogram("vsock_proxy_kms_rate_wait_seconds", "Time KMS calls waited for a --kms-rate-limit token.", metrics.DefaultLatencyBuckets)
+	kmsRateTimeouts     = registry.Counter("vsock_proxy_kms_rate_timeouts_total", "KMS calls rejected as busy because no rate limit token was available within --kms-queue-timeout.")
+	kmsHedgesSent       = registry.CounterVec("vsock_proxy_kms_hedges_sent_total", "Second attempts sent for slow KMS calls, by action.", "action")
+	kmsHedgesWon        = registry.CounterVec("vsock_proxy_kms_hedges_won_total", "Hedged KMS calls where the second attempt answered first, by action.", "action")
+	kmsConnections      = registry.CounterVec("vsock_proxy_kms_connections_total", "Connections used for KMS calls: \"reused\" from the idle pool or \"new\".", "state")
+	kmsProtocols        = registry.CounterVec("vsock_proxy_kms_responses_by_protocol_total", "KMS responses by HTTP protocol version.", "proto")
+	deniedKeys          = registry.Counter("vsock_proxy_denied_keys_total", "Requests refused because their KMS key is not in --allowed-keys or its --key-policy denies them.")
+	abandonedRequests   = registry.Counter("vsock_proxy_abandoned_requests_total", "Requests answered with a timeout because their handler ignored its deadline.")
+	bytesReceived       = registry.Counter("vsock_proxy_bytes_received_total", "Request payload bytes received from enclaves.")
+	bytesSent           = registry.Counter("vsock_proxy_bytes_sent_total", "Result payload bytes sent to enclaves.")
+	warmupReady         = registry.Gauge("vsock_proxy_warmup_ready", "1 once KMS warm-up has completed successfully (0 when disabled or failed).")
+)
+
+// operationLabel bounds the operation label to known operations, since the
+// value comes from the client.
+func operationLabel(op string) string {
+	switch op {
+	case protocol.OpEncrypt, protocol.OpDecrypt, protocol.OpGenerateDataKey, protocol.OpSign, protocol.OpVerify, protocol.OpGenerateRandom:
+		return op
+	default:
+		return "other"
+	}
+}
+
+// serveMetrics exposes the registry in Prometheus text format on
+// port/metrics.
+func serveMetrics(port uint32) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.WritePrometheus(w)
+	})
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	go func() {
+		slog.Info("Serving metrics", "url", fmt.Sprintf("http://localhost:%d/metrics", port))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Metrics server failed", "err", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,150 @@
+// vsock-proxy/ratelimit.go
+package vsockproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// kmsRate limits the KMS request rate; nil when --kms-rate-limit is 0.
+var kmsRate *tokenBucket
+
+// tokenBucket limits KMS calls per second. KMS quotas are per account and
+// region, not per process, so when several proxies run on one parent
+// instance they can share one bucket through a state file: every take locks
+// the file with flock(2), refills the bucket from the time elapsed since the
+// last take and writes it back. Without a file the state lives in memory
+// and only limits this process.
+//
+// All proxies sharing a file must be started with the same rate and burst;
+// the file holds only the token count and the time of the last refill.
+type tokenBucket struct {
+	rate    float64 // tokens per second
+	burst   float64 // bucket capacity
+	timeout time.Duration
+
+	mu     sync.Mutex
+	file   *os.File // nil for a process-local bucket
+	tokens float64
+	last   time.Time
+}
+
+// bucketStateSize is the size of the state file: the token count as
+// float64 bits and the last refill time in Unix nanoseconds.
+const bucketStateSize = 16
+
+func newTokenBucket(rate float64, burst int, timeout time.Duration, path string) (*tokenBucket, error) {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	b := &tokenBucket{rate: rate, burst: float64(burst), timeout: timeout, tokens: float64(burst), last: time.Now()}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open rate limit file: %v", err)
+		}
+		b.file = f
+	}
+	return b, nil
+}
+
+// take waits for a token. It gives up when ctx is cancelled (a hedged
+// attempt that lost) or the queue timeout passes, returning a busy error
+// so the enclave can back off.
+func (b *tokenBucket) take(ctx context.Context) error {
+	start := time.Now()
+	deadline := start.Add(b.timeout)
+	for {
+		wait, err := b.reserve(time.Now())
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			kmsRateWaitTime.Observe(time.Since(start).Seconds())
+			return nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			kmsRateTimeouts.Inc()
+			return protocol.Errorf(protocol.CodeBusy, "KMS rate limit of %g/s reached: no token within %v", b.rate, b.timeout)
+		}
+		// Another process may take the token we're waiting for, so look
+		// again after sleeping rather than assuming it's ours
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// reserve takes a token if one is available and returns 0, or else returns
+// how long until the next token.
+func (b *tokenBucket) reserve(now time.Time) (time.Duration, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file != nil {
+		if err := unix.Flock(int(b.file.Fd()), unix.LOCK_EX); err != nil {
+			return 0, fmt.Errorf("failed to lock rate limit file: %v", err)
+		}
+		defer unix.Flock(int(b.file.Fd()), unix.LOCK_UN)
+		if err := b.load(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Refill; a clock step backwards refills nothing
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), nil
+	}
+	b.tokens--
+	if b.file != nil {
+		return 0, b.store()
+	}
+	return 0, nil
+}
+
+// load reads the shared state. An empty file (the first proxy to start)
+// keeps the full bucket set up by newTokenBucket.
+func (b *tokenBucket) load() error {
+	var buf [bucketStateSize]byte
+	n, err := b.file.ReadAt(buf[:], 0)
+	switch {
+	case n == 0 && err == io.EOF:
+		return nil
+	case n < bucketStateSize && err == io.EOF:
+		return fmt.Errorf("rate limit file is truncated: %d bytes", n)
+	case n < bucketStateSize:
+		return fmt.Errorf("failed to read rate limit file: %v", err)
+	}
+	b.tokens = math.Min(b.burst, math.Float64frombits(binary.BigEndian.Uint64(buf[:8])))
+	b.last = time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:])))
+	return nil
+}
+
+func (b *tokenBucket) store() error {
+	var buf [bucketStateSize]byte
+	binary.BigEndian.PutUint64(buf[:8], math.Float64bits(b.tokens))
+	binary.BigEndian.PutUint64(buf[8:], uint64(b.last.UnixNano()))
+	if _, err := b.file.WriteAt(buf[:], 0); err != nil {
+		return fmt.Errorf("failed to write rate limit file: %v", err)
+	}
+	return nil
+}
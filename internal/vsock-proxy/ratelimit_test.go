@@ -0,0 +1,183 @@
+package vsockproxy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// drain takes every token available at now and returns how many it got.
+func drain(t *testing.T, b *tokenBucket, now time.Time) int {
+	t.Helper()
+	for n := 0; ; n++ {
+		wait, err := b.reserve(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait > 0 {
+			return n
+		}
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	b, err := newTokenBucket(10, 3, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := b.last
+	if n := drain(t, b, now); n != 3 {
+		t.Fatalf("took %d tokens from a full bucket, want the burst of 3", n)
+	}
+	wait, _ := b.reserve(now)
+	if wait != 100*time.Millisecond {
+		t.Fatalf("empty bucket waits %v, want 100ms at 10/s", wait)
+	}
+	if n := drain(t, b, now.Add(250*time.Millisecond)); n != 2 {
+		t.Fatalf("took %d tokens after 250ms, want 2", n)
+	}
+	// the half token left over counts towards the next one
+	if wait, _ := b.reserve(now.Add(250 * time.Millisecond)); wait != 50*time.Millisecond {
+		t.Fatalf("waits %v with half a token, want 50ms", wait)
+	}
+	// a clock step backwards refills nothing
+	if n := drain(t, b, now); n != 0 {
+		t.Fatalf("took %d tokens after the clock went back", n)
+	}
+}
+
+func TestTokenBucketBurstCap(t *testing.T) {
+	b, err := newTokenBucket(10, 3, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := drain(t, b, b.last.Add(time.Hour)); n != 3 {
+		t.Fatalf("took %d tokens after an hour idle, want the burst of 3", n)
+	}
+
+	// without --kms-rate-burst, the burst is one second's worth
+	b, err = newTokenBucket(2.5, 0, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := drain(t, b, b.last.Add(time.Hour)); n != 3 {
+		t.Fatalf("took %d tokens at 2.5/s, want a burst of 3", n)
+	}
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	b, err := newTokenBucket(20, 1, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := t.Context()
+	if err := b.take(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the next token is 50ms away, within the queue timeout
+	start := time.Now()
+	if err := b.take(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Fatalf("second take returned after %v, want about 50ms", waited)
+	}
+}
+
+func TestTokenBucketTimeout(t *testing.T) {
+	b, err := newTokenBucket(1, 1, 100*time.Millisecond, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.take(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	// the next token is a second away, past the 100ms queue timeout, so
+	// take gives up at once rather than waiting out the timeout
+	start := time.Now()
+	err = b.take(t.Context())
+	var perr *protocol.Error
+	if !errors.As(err, &perr) || perr.Code != protocol.CodeBusy {
+		t.Fatalf("err = %v, want a busy error", err)
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Fatalf("take gave up after %v", waited)
+	}
+
+	b, err = newTokenBucket(1, 1, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.take(t.Context())
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.take(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled take: err = %v", err)
+	}
+}
+
+func TestTokenBucketSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kms-rate")
+	a, err := newTokenBucket(10, 4, time.Second, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.file.Close()
+	b, err := newTokenBucket(10, 4, time.Second, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.file.Close()
+
+	now := a.last
+	for i := range 3 {
+		if wait, err := a.reserve(now); err != nil || wait != 0 {
+			t.Fatalf("take %d from a: wait %v, err %v", i, wait, err)
+		}
+	}
+	// b sees what a took from the file, not its own full bucket
+	if n := drain(t, b, now); n != 1 {
+		t.Fatalf("b took %d tokens, want the 1 that a left", n)
+	}
+	if n := drain(t, a, now); n != 0 {
+		t.Fatalf("a took %d tokens after b emptied the bucket", n)
+	}
+	// and both see the refill
+	if n := drain(t, b, now.Add(200*time.Millisecond)); n != 2 {
+		t.Fatalf("b took %d tokens after 200ms, want 2", n)
+	}
+}
+
+func TestTokenBucketBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kms-rate")
+	if err := os.WriteFile(path, []byte("short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := newTokenBucket(10, 1, time.Second, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.file.Close()
+	if _, err := b.reserve(time.Now()); err == nil {
+		t.Fatal("reserve accepted a truncated state file")
+	}
+
+	// a file that can't be read is an error, not an empty bucket
+	dir := t.TempDir()
+	b, err = newTokenBucket(10, 1, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.file, err = os.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer b.file.Close()
+	if err := b.load(); err == nil {
+		t.Fatal("load ignored a read error")
+	}
+}
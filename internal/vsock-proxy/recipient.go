@@ -0,0 +1,48 @@
+// vsock-proxy/recipient.go
+package vsockproxy
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+
+	"nitro-dev-qemu/pkg/attestation"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// decryptForRequest performs KMS Decrypt for req. If the request carries a
+// Recipient, the proxy plays the part of the KMS service boundary: the
+// plaintext is only returned as CiphertextForRecipient, encrypted to the
+// public key in the enclave's attestation evidence, so it never travels
+// back over vsock in the clear.
+func decryptForRequest(ctx context.Context, logger *slog.Logger, req *protocol.Request, kmsTarget string) ([]byte, error) {
+	if req.Recipient == nil {
+		decrypted, err := decryptWithKMS(ctx, logger, req.Payload.Reveal(), req.KeyId, kmsTarget, nil)
+		return decrypted.Bytes(), err
+	}
+
+	// Check the recipient before spending a KMS call on it
+	if req.Recipient.KeyEncryptionAlgorithm != attestation.KeyEncryptionAlgorithm {
+		return nil, protocol.Errorf(protocol.CodeBadRequest, "unsupported key encryption algorithm %q", req.Recipient.KeyEncryptionAlgorithm)
+	}
+	// Unlike KMS, which takes Nitro attestation documents only, accept
+	// every format the simulation models
+	attested, err := attestation.Verify(req.Recipient.AttestationDocument)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeBadRequest, "%v", err)
+	}
+	logger.Info("Decrypt for attested enclave", "format", attested.Format, "module_id", attested.ModuleID, "pcr0", hex.EncodeToString(attested.PCRs[0]))
+
+	decrypted, err := decryptWithKMS(ctx, logger, req.Payload.Reveal(), req.KeyId, kmsTarget, attested)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(decrypted.Bytes())
+
+	sealed, err := attestation.SealForRecipient(attested.PublicKey, decrypted.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Wrapped plaintext as CiphertextForRecipient", "plaintext_bytes", decrypted.Len(), "sealed_bytes", len(sealed))
+	return sealed, nil
+}
@@ -0,0 +1,105 @@
+// vsock-proxy/relay.go
+package vsockproxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"nitro-dev-qemu/pkg/logging"
+	"nitro-dev-qemu/pkg/peer"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+const (
+	// relayRequestTimeout bounds waiting for the relay request.
+	relayRequestTimeout = 10 * time.Second
+	// relayDialTimeout bounds connecting to the enclave a relay targets.
+	relayDialTimeout = 5 * time.Second
+)
+
+// startRelay listens on the --relay-port for enclaves that want a channel
+// to another enclave on this host. It returns nil when port is 0.
+func startRelay(cid, port uint32) (net.Listener, error) {
+	if port == 0 {
+		return nil, nil
+	}
+	l, err := transport.Listen(cid, port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on relay port %d: %v", port, err)
+	}
+	slog.Info("Relaying enclave-to-enclave channels", "port", port)
+	go serveRelay(l)
+	return l, nil
+}
+
+// serveRelay accepts relay connections until the listener is closed.
+func serveRelay(listener net.Listener) {
+	connectionCount := 0
+	for {
+		conn, err := vsock.Accept(drainer.Listening(), listener)
+		if err != nil {
+			if drainer.Stopping() {
+				return
+			}
+			slog.Warn("Relay accept failed", "err", err)
+			continue
+		}
+		connectionCount++
+		logger := logging.ForConn(conn, connectionCount).With("mode", "relay")
+		drainer.Go(func() {
+			if !connLimit.Acquire(drainer.Done()) {
+				logger.Warn("Rejecting relay connection: --max-conns reached", connsAttr())
+				peer.AnswerRelay(conn, fmt.Errorf("vsock-proxy is at its connection limit"))
+				conn.Close()
+				return
+			}
+			defer connLimit.Release()
+			// Like forwards, relays end when the proxy stops accepting
+			ctx, cancel := vsock.WithConn(drainer.Listening(), conn)
+			defer cancel()
+			relay(ctx, conn, logger)
+		})
+	}
+}
+
+// relay reads which enclave conn wants to reach, dials it and copies bytes
+// both ways until ctx, the connection's context, ends. Everything after
+// the relay request is the two enclaves' encrypted channel (see pkg/peer):
+// the proxy can drop it, but not read it.
+func relay(ctx context.Context, conn net.Conn, logger *slog.Logger) {
+	start := time.Now()
+
+	conn.SetReadDeadline(start.Add(relayRequestTimeout))
+	cid, port, err := peer.ReadRelayRequest(conn)
+	if err != nil {
+		logger.Warn("Bad relay request", "err", err)
+		relayConnections.With("bad_request").Inc()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	logger = logger.With("target_cid", cid, "target_port", port)
+
+	dialCtx, cancel := context.WithTimeout(ctx, relayDialTimeout)
+	target, err := transport.DialContext(dialCtx, cid, port)
+	cancel()
+	if err != nil {
+		logger.Warn("Relay dial failed", "err", err)
+		relayConnections.With("dial_error").Inc()
+		peer.AnswerRelay(conn, err)
+		return
+	}
+	defer target.Close()
+	if err := peer.AnswerRelay(conn, nil); err != nil {
+		logger.Warn("Relay reply failed", "err", err)
+		return
+	}
+	relayConnections.With("connected").Inc()
+	logger.Info("Relaying enclave channel")
+
+	sent, received := splice(ctx, conn, target)
+	relayBytes.Add(sent + received)
+	logger.Info("Relay closed", "bytes_to_target", sent, "bytes_to_source", received, "duration", time.Since(start))
+}
@@ -0,0 +1,146 @@
+// vsock-proxy/sign.go
+package vsockproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+type KMSSignRequest struct {
+	KeyId            string `json:"KeyId"`
+	Message          string `json:"Message"`
+	MessageType      string `json:"MessageType"`
+	SigningAlgorithm string `json:"SigningAlgorithm"`
+}
+
+type KMSSignResponse struct {
+	KeyId            string `json:"KeyId"`
+	Signature        string `json:"Signature"`
+	SigningAlgorithm string `json:"SigningAlgorithm"`
+}
+
+type KMSVerifyRequest struct {
+	KeyId            string `json:"KeyId"`
+	Message          string `json:"Message"`
+	MessageType      string `json:"MessageType"`
+	Signature        string `json:"Signature"`
+	SigningAlgorithm string `json:"SigningAlgorithm"`
+}
+
+type KMSVerifyResponse struct {
+	KeyId            string `json:"KeyId"`
+	SignatureValid   bool   `json:"SignatureValid"`
+	SigningAlgorithm string `json:"SigningAlgorithm"`
+}
+
+// defaultSigningKeyID is used by Sign and Verify when a request doesn't
+// name a key; Encrypt's default is a symmetric key that can't sign.
+const defaultSigningKeyID = "alias/dev-signing-key"
+
+// defaultSigningAlgorithm suits the RSA key created by make setup-kms.
+const defaultSigningAlgorithm = "RSASSA_PSS_SHA_256"
+
+// signingAlgorithms are the KMS signing algorithms. Checking them here
+// turns a typo into a bad_request instead of a KMS round trip.
+var signingAlgorithms = map[string]bool{
+	"RSASSA_PSS_SHA_256":        true,
+	"RSASSA_PSS_SHA_384":        true,
+	"RSASSA_PSS_SHA_512":        true,
+	"RSASSA_PKCS1_V1_5_SHA_256": true,
+	"RSASSA_PKCS1_V1_5_SHA_384": true,
+	"RSASSA_PKCS1_V1_5_SHA_512": true,
+	"ECDSA_SHA_256":             true,
+	"ECDSA_SHA_384":             true,
+	"ECDSA_SHA_512":             true,
+}
+
+// signingParams returns the request's signing parameters with defaults
+// filled in, or a bad_request error.
+func signingParams(req *protocol.Request) (protocol.Signing, error) {
+	var s protocol.Signing
+	if req.Signing != nil {
+		s = *req.Signing
+	}
+	if s.SigningAlgorithm == "" {
+		s.SigningAlgorithm = defaultSigningAlgorithm
+	}
+	if !signingAlgorithms[s.SigningAlgorithm] {
+		return s, protocol.Errorf(protocol.CodeBadRequest, "unsupported signing algorithm %q", s.SigningAlgorithm)
+	}
+	switch s.MessageType {
+	case "":
+		s.MessageType = "RAW"
+	case "RAW", "DIGEST":
+	default:
+		return s, protocol.Errorf(protocol.CodeBadRequest, "message type must be RAW or DIGEST, not %q", s.MessageType)
+	}
+	return s, nil
+}
+
+// signWithKMS signs the request payload and returns the base64 signature.
+func signWithKMS(ctx context.Context, logger *slog.Logger, req *protocol.Request, kmsTarget string) ([]byte, error) {
+	params, err := signingParams(req)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := keyIDFor(req, defaultSigningKeyID)
+	if err != nil {
+		return nil, err
+	}
+	in := KMSSignRequest{
+		KeyId:            keyID,
+		Message:          base64.StdEncoding.EncodeToString(req.Payload.Bytes()),
+		MessageType:      params.MessageType,
+		SigningAlgorithm: params.SigningAlgorithm,
+	}
+	var out KMSSignResponse
+	if err := callKMS(ctx, logger, kmsTarget, "Sign", in, &out); err != nil {
+		return nil, err
+	}
+	logger.Debug("KMS signed", "key_id", out.KeyId, "signing_algorithm", out.SigningAlgorithm)
+	return []byte(out.Signature), nil
+}
+
+// verifyWithKMS checks a signature over the request payload. KMS answers
+// an invalid signature with KMSInvalidSignatureException rather than
+// SignatureValid=false; it is reported as CodeInvalidSignature so clients
+// can tell it apart from a KMS failure.
+func verifyWithKMS(ctx context.Context, logger *slog.Logger, req *protocol.Request, kmsTarget string) ([]byte, error) {
+	params, err := signingParams(req)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := keyIDFor(req, defaultSigningKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if params.Signature == "" {
+		return nil, protocol.Errorf(protocol.CodeBadRequest, "Verify needs a signature")
+	}
+	in := KMSVerifyRequest{
+		KeyId:            keyID,
+		Message:          base64.StdEncoding.EncodeToString(req.Payload.Bytes()),
+		MessageType:      params.MessageType,
+		Signature:        params.Signature,
+		SigningAlgorithm: params.SigningAlgorithm,
+	}
+	var out KMSVerifyResponse
+	err = callKMS(ctx, logger, kmsTarget, "Verify", in, &out)
+	var perr *protocol.Error
+	if errors.As(err, &perr) && perr.Details["kms_error_type"] == "KMSInvalidSignatureException" {
+		return nil, protocol.Errorf(protocol.CodeInvalidSignature, "signature is not valid for this message, key and algorithm")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !out.SignatureValid {
+		return nil, protocol.Errorf(protocol.CodeInvalidSignature, "signature is not valid for this message, key and algorithm")
+	}
+	logger.Debug("KMS verified signature", "key_id", out.KeyId, "signing_algorithm", out.SigningAlgorithm)
+	return json.Marshal(protocol.Verification{KeyId: out.KeyId, SigningAlgorithm: out.SigningAlgorithm, SignatureValid: true})
+}
@@ -0,0 +1,68 @@
+// vsock-proxy/warmup.go
+package vsockproxy
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// kmsClient is shared by every KMS call so connections (and their TLS
+// sessions) are kept alive and reused, including the ones opened by
+// warmUpKMS.
+var kmsClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: kmsTransport,
+}
+
+var kmsTransport = newKMSTransport()
+
+// newKMSTransport keeps up to 16 idle connections per host for reuse and
+// negotiates HTTP/2 over TLS where the endpoint supports it (AWS KMS); plain
+// http:// targets such as LocalStack stay on HTTP/1.1 keep-alive.
+// ForceAttemptHTTP2 must stay set: without it, net/http turns HTTP/2 off
+// as soon as a custom DialContext is installed, which the DNS cache does.
+func newKMSTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = 16
+	t.IdleConnTimeout = 90 * time.Second
+	t.ForceAttemptHTTP2 = true
+	return t
+}
+
+// warmUpKMS opens conns connections to the KMS endpoint before the first
+// enclave request arrives. Each runs a cheap ListKeys call concurrently,
+// which pays for the TCP and TLS handshakes and leaves the connections
+// idle in kmsClient's pool.
+func warmUpKMS(kmsTarget string, conns int) {
+	slog.Info("Warming up KMS connections", "conns", conns)
+	start := time.Now()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out KMSListKeysResponse
+			if err := callKMS(drainer.Context(), slog.Default(), kmsTarget, "ListKeys", struct{ Limit int }{Limit: 1}, &out); err != nil {
+				slog.Warn("Warm-up call failed", "err", err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		slog.Warn("KMS warm-up incomplete", "failed", failed, "conns", conns, "duration", time.Since(start))
+		return
+	}
+	warmupReady.Inc()
+	slog.Info("KMS warm-up complete", "conns", conns, "duration", time.Since(start))
+}
@@ -0,0 +1,177 @@
+// Package attestation simulates the Nitro Enclaves attestation flow for KMS
+// Decrypt. A real enclave asks the Nitro Security Module for an attestation
+// document that embeds an ephemeral public key, and KMS then returns the
+// plaintext as CiphertextForRecipient, encrypted to that key, so it is never
+// visible outside the enclave.
+//
+// Here the document is plain JSON built by the enclave itself rather than a
+// COSE_Sign1 structure signed by the Nitro hypervisor, so nothing stops the
+// parent instance from forging one. It exercises the same data flow, not
+// the same trust model.
+//
+// The document is one Format among others: simulated AMD SEV-SNP reports
+// and Intel TDX quotes model the same flow on other confidential-computing
+// stacks, and Verify accepts any of them.
+package attestation
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// KeyEncryptionAlgorithm is the only recipient key algorithm supported,
+// named as in the KMS RecipientInfo API.
+const KeyEncryptionAlgorithm = "RSAES_OAEP_SHA_256"
+
+// RecipientKeyBits is the size of the enclave's ephemeral RSA key.
+const RecipientKeyBits = 2048
+
+// Document is a simulated attestation document. PCRs holds the enclave's
+// measurements by register index, as pkg/pcr computes them. PublicKey is
+// the enclave's ephemeral recipient key in PKIX DER form; byte fields are
+// base64 encoded in JSON.
+type Document struct {
+	ModuleID         string         `json:"module_id"`
+	Timestamp        int64          `json:"timestamp"` // milliseconds since the Unix epoch
+	Digest           string         `json:"digest"`
+	ExecutableSHA384 string         `json:"executable_sha384"`
+	ConfigSHA384     string         `json:"config_sha384"`
+	PCRs             map[int][]byte `json:"pcrs,omitempty"`
+	PublicKey        []byte         `json:"public_key"`
+}
+
+// NewDocument returns a document for pub, stamped with the current time.
+func NewDocument(moduleID string, pub *rsa.PublicKey, executableSHA384, configSHA384 string, pcrs map[int][]byte) (*Document, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode recipient key: %v", err)
+	}
+	return &Document{
+		ModuleID:         moduleID,
+		Timestamp:        time.Now().UnixMilli(),
+		Digest:           "SHA384",
+		ExecutableSHA384: executableSHA384,
+		ConfigSHA384:     configSHA384,
+		PCRs:             pcrs,
+		PublicKey:        der,
+	}, nil
+}
+
+// Marshal encodes the document.
+func (d *Document) Marshal() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+// Parse decodes a document produced by Marshal.
+func Parse(data []byte) (*Document, error) {
+	var d Document
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("failed to parse attestation document: %v", err)
+	}
+	if len(d.PublicKey) == 0 {
+		return nil, fmt.Errorf("attestation document has no public key")
+	}
+	return &d, nil
+}
+
+// RecipientKey returns the RSA public key embedded in the document.
+func (d *Document) RecipientKey() (*rsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(d.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse recipient key: %v", err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("recipient key is %T, not RSA", key)
+	}
+	return pub, nil
+}
+
+// GenerateRecipientKey creates the enclave's ephemeral key pair.
+func GenerateRecipientKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, RecipientKeyBits)
+}
+
+// SealForRecipient encrypts plaintext so only the holder of pub's private
+// key can read it: a random AES-256 key, wrapped with RSA-OAEP-SHA256,
+// encrypts the plaintext with AES-256-GCM. The result is
+//
+//	2-byte big-endian wrapped key length | wrapped key | GCM nonce | ciphertext
+//
+// (real KMS returns a CMS EnvelopedData structure instead).
+func SealForRecipient(pub *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate content key: %v", err)
+	}
+	defer clear(key[:])
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key[:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap content key: %v", err)
+	}
+	gcm, err := newGCM(key[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	out := binary.BigEndian.AppendUint16(nil, uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// OpenForRecipient decrypts the output of SealForRecipient with priv.
+func OpenForRecipient(priv *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("CiphertextForRecipient too short")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < n {
+		return nil, fmt.Errorf("CiphertextForRecipient too short")
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, data[:n], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap content key: %v", err)
+	}
+	defer clear(key)
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data = data[n:]
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("CiphertextForRecipient too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("CiphertextForRecipient authentication failed")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return gcm, nil
+}
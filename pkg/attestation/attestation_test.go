@@ -0,0 +1,70 @@
+package attestation
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealOpenThroughDocument(t *testing.T) {
+	key, err := GenerateRecipientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := NewDocument("enclave-test", &key.PublicKey, "exe", "cfg", map[int][]byte{0: {0xaa}, 2: {0xbb}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := doc.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What the vsock-proxy does with the document it receives
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.PCRs[2], []byte{0xbb}) {
+		t.Fatalf("PCRs after parsing: %v", parsed.PCRs)
+	}
+	pub, err := parsed.RecipientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("data key material")
+	sealed, err := SealForRecipient(pub, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Fatal("sealed output contains the plaintext")
+	}
+
+	got, err := OpenForRecipient(key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("got %q, want %q", got, plaintext)
+	}
+}
+
+func TestOpenRejectsOtherKeyAndTampering(t *testing.T) {
+	key, _ := GenerateRecipientKey()
+	other, _ := GenerateRecipientKey()
+	sealed, err := SealForRecipient(&key.PublicKey, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenForRecipient(other, sealed); err == nil {
+		t.Fatal("opened with the wrong key")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := OpenForRecipient(key, sealed); err == nil {
+		t.Fatal("opened a tampered ciphertext")
+	}
+	if _, err := OpenForRecipient(key, sealed[:10]); err == nil {
+		t.Fatal("opened a truncated ciphertext")
+	}
+}
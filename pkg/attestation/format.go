@@ -0,0 +1,172 @@
+package attestation
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"nitro-dev-qemu/pkg/pcr"
+)
+
+// Format generates and verifies attestation evidence of one kind: the
+// Nitro attestation document, an AMD SEV-SNP attestation report or an
+// Intel TDX quote. The enclave generates evidence in its --attestation-
+// format; the vsock-proxy, playing KMS, verifies whichever it is sent.
+type Format interface {
+	// Name identifies the format: "nitro", "sev-snp" or "tdx".
+	Name() string
+	// Generate returns evidence of c, binding c.PublicKey to the
+	// measurements.
+	Generate(c *Claims) ([]byte, error)
+	// Verify checks evidence in this format and returns what it attests.
+	Verify(evidence []byte) (*Attested, error)
+}
+
+// Claims is what an enclave attests to.
+type Claims struct {
+	ModuleID         string
+	ExecutableSHA384 string
+	ConfigSHA384     string
+	PCRs             pcr.Set
+	PublicKey        *rsa.PublicKey
+}
+
+// Attested is what verified evidence attests, in the same terms whatever
+// the format. PCRs maps the format's measurements onto Nitro PCR indexes,
+// so policies written against PCRs apply to every format: the launch
+// measurement is always PCR0. ModuleID is empty for formats that don't
+// carry one.
+type Attested struct {
+	Format    string
+	ModuleID  string
+	PCRs      map[int][]byte
+	PublicKey *rsa.PublicKey
+}
+
+var formats = map[string]Format{}
+
+// register adds f to the formats Lookup and Verify know.
+func register(f Format) {
+	formats[f.Name()] = f
+}
+
+func init() {
+	register(nitroFormat{})
+	register(snpFormat{})
+	register(tdxFormat{})
+}
+
+// Formats returns the names of the known formats, sorted.
+func Formats() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the format called name.
+func Lookup(name string) (Format, error) {
+	f, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown attestation format %q (expected %s)", name, strings.Join(Formats(), ", "))
+	}
+	return f, nil
+}
+
+// Verify checks evidence in any known format. The simulated SEV-SNP and
+// TDX evidence names its format in a "format" field; evidence without one
+// is a Nitro attestation document.
+func Verify(evidence []byte) (*Attested, error) {
+	var tag struct {
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(evidence, &tag); err != nil {
+		return nil, fmt.Errorf("failed to parse attestation evidence: %v", err)
+	}
+	name := tag.Format
+	if name == "" {
+		name = "nitro"
+	}
+	f, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Verify(evidence)
+}
+
+// nitroFormat is the Nitro attestation document, Document.
+type nitroFormat struct{}
+
+func (nitroFormat) Name() string { return "nitro" }
+
+func (nitroFormat) Generate(c *Claims) ([]byte, error) {
+	doc, err := NewDocument(c.ModuleID, c.PublicKey, c.ExecutableSHA384, c.ConfigSHA384, c.PCRs.Map())
+	if err != nil {
+		return nil, err
+	}
+	return doc.Marshal()
+}
+
+func (nitroFormat) Verify(evidence []byte) (*Attested, error) {
+	doc, err := Parse(evidence)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := doc.RecipientKey()
+	if err != nil {
+		return nil, err
+	}
+	return &Attested{Format: "nitro", ModuleID: doc.ModuleID, PCRs: doc.PCRs, PublicKey: pub}, nil
+}
+
+// reportData returns the 64 bytes of user data the SEV-SNP and TDX formats
+// bind a key with: the SHA-512 of its PKIX DER encoding. Unlike the Nitro
+// document, their evidence has no room for the key itself, so it travels
+// next to the evidence and the verifier checks it against this digest.
+func reportData(pub *rsa.PublicKey) ([]byte, []byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode recipient key: %v", err)
+	}
+	sum := sha512.Sum512(der)
+	return der, sum[:], nil
+}
+
+// boundKey parses the key that came with the evidence and checks that
+// reportData binds it.
+func boundKey(der, data []byte) (*rsa.PublicKey, error) {
+	sum := sha512.Sum512(der)
+	if !hmac.Equal(sum[:], data) {
+		return nil, fmt.Errorf("report data doesn't match the recipient key")
+	}
+	doc := Document{PublicKey: der}
+	return doc.RecipientKey()
+}
+
+// simulatedSignature stands in for the signature of a hardware key (the
+// SEV-SNP VCEK, the TDX quoting enclave's attestation key) over body: an
+// HMAC-SHA-384 under a key anyone can derive from the format name. It
+// catches evidence altered on the way, but like the unsigned Nitro
+// document it proves nothing about where the evidence came from.
+func simulatedSignature(format string, body []byte) []byte {
+	key := sha512.Sum384([]byte("nitro-dev-qemu simulated " + format + " platform key"))
+	mac := hmac.New(sha512.New384, key[:])
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// checkSignature verifies the simulated signature of evidence whose
+// signature field has been cleared to give body.
+func checkSignature(format string, body, signature []byte) error {
+	if !hmac.Equal(simulatedSignature(format, body), signature) {
+		return fmt.Errorf("%s evidence signature is invalid", format)
+	}
+	return nil
+}
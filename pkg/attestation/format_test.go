@@ -0,0 +1,107 @@
+package attestation
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"nitro-dev-qemu/pkg/pcr"
+)
+
+func testClaims(t *testing.T) *Claims {
+	t.Helper()
+	key, err := GenerateRecipientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Claims{
+		ModuleID:         "enclave-cid3",
+		ExecutableSHA384: strings.Repeat("ab", pcr.Size),
+		ConfigSHA384:     strings.Repeat("cd", pcr.Size),
+		PCRs: pcr.Set{
+			PCR0: pcr.MeasureBytes([]byte("binary")),
+			PCR1: pcr.MeasureBytes([]byte("config")),
+			PCR2: pcr.MeasureBytes([]byte("app")),
+		},
+		PublicKey: &key.PublicKey,
+	}
+}
+
+func TestFormats(t *testing.T) {
+	c := testClaims(t)
+	if got := strings.Join(Formats(), ","); got != "nitro,sev-snp,tdx" {
+		t.Fatalf("Formats() = %s", got)
+	}
+	for _, name := range Formats() {
+		t.Run(name, func(t *testing.T) {
+			f, err := Lookup(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			evidence, err := f.Generate(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Verify tells the formats apart by themselves
+			a, err := Verify(evidence)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Format != name || !bytes.Equal(a.PCRs[0], c.PCRs.PCR0[:]) || !a.PublicKey.Equal(c.PublicKey) {
+				t.Fatalf("attested %+v", a)
+			}
+		})
+	}
+	if _, err := Lookup("sgx"); err == nil {
+		t.Fatal("Lookup accepted an unknown format")
+	}
+}
+
+// tamper decodes evidence, lets change edit it and re-encodes it.
+func tamper(t *testing.T, evidence []byte, change func(map[string]any)) []byte {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal(evidence, &m); err != nil {
+		t.Fatal(err)
+	}
+	change(m)
+	out, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	c := testClaims(t)
+	other := testClaims(t)
+	otherKey := func(f Format) any {
+		evidence, err := f.Generate(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]any
+		json.Unmarshal(evidence, &m)
+		return m["public_key"]
+	}
+	forged := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, pcr.Size))
+
+	snp, _ := Lookup("sev-snp")
+	tdx, _ := Lookup("tdx")
+	snpEvidence, _ := snp.Generate(c)
+	tdxEvidence, _ := tdx.Generate(c)
+	for name, evidence := range map[string][]byte{
+		"sev-snp measurement": tamper(t, snpEvidence, func(m map[string]any) { m["report"].(map[string]any)["measurement"] = forged }),
+		"sev-snp key":         tamper(t, snpEvidence, func(m map[string]any) { m["public_key"] = otherKey(snp) }),
+		"tdx mr_td":           tamper(t, tdxEvidence, func(m map[string]any) { m["quote"].(map[string]any)["td_report"].(map[string]any)["mr_td"] = forged }),
+		"tdx key":             tamper(t, tdxEvidence, func(m map[string]any) { m["public_key"] = otherKey(tdx) }),
+		"unknown format":      tamper(t, tdxEvidence, func(m map[string]any) { m["format"] = "sgx" }),
+	} {
+		if _, err := Verify(evidence); err == nil {
+			t.Errorf("%s: tampered evidence verified", name)
+		}
+	}
+}
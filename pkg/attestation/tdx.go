@@ -0,0 +1,116 @@
+package attestation
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"nitro-dev-qemu/pkg/pcr"
+)
+
+// tdxQuote is a simulated Intel TDX quote (version 4), with the header and
+// the TD report body fields that matter to a verifier. MRTD, the build-time
+// measurement of the trust domain, is PCR0; RTMR0 and RTMR2, the runtime
+// registers firmware and the OS extend with the boot configuration and
+// the application, are PCR1 and PCR2; MRCONFIGID is the boot
+// configuration digest; REPORTDATA binds the recipient key (see
+// reportData). Byte fields are base64 encoded in JSON.
+type tdxQuote struct {
+	Header    tdxHeader `json:"header"`
+	Body      tdReport  `json:"td_report"`
+	Signature []byte    `json:"signature"`
+}
+
+type tdxHeader struct {
+	Version            uint16 `json:"version"`
+	AttestationKeyType uint16 `json:"attestation_key_type"`
+	TEEType            uint32 `json:"tee_type"`
+	QEVendorID         []byte `json:"qe_vendor_id"`
+}
+
+type tdReport struct {
+	TEETCBSVN  []byte    `json:"tee_tcb_svn"`
+	MRSEAM     []byte    `json:"mr_seam"`
+	MRTD       []byte    `json:"mr_td"`
+	MRConfigID []byte    `json:"mr_config_id"`
+	RTMR       [4][]byte `json:"rtmr"`
+	ReportData []byte    `json:"report_data"`
+}
+
+type tdxEvidence struct {
+	Format    string   `json:"format"`
+	Quote     tdxQuote `json:"quote"`
+	PublicKey []byte   `json:"public_key"`
+}
+
+const (
+	tdxQuoteVersion = 4
+	// tdxECDSAP256 is the attestation key type ECDSA-256-with-P-256.
+	tdxECDSAP256 = 2
+	// tdxTEEType marks a TDX quote (0x00 is SGX).
+	tdxTEEType = 0x81
+)
+
+// tdxIntelQEVendorID is the vendor ID of Intel's quoting enclave.
+var tdxIntelQEVendorID, _ = hex.DecodeString("939a7233f79c4ca9940a0db3957f0607")
+
+// tdxFormat is the simulated TDX quote.
+type tdxFormat struct{}
+
+func (tdxFormat) Name() string { return "tdx" }
+
+func (f tdxFormat) Generate(c *Claims) ([]byte, error) {
+	der, data, err := reportData(c.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	config, err := hex.DecodeString(c.ConfigSHA384)
+	if err != nil {
+		return nil, fmt.Errorf("bad config digest: %v", err)
+	}
+	seam := sha512.Sum384([]byte("nitro-dev-qemu simulated TDX module"))
+
+	q := tdxQuote{
+		Header: tdxHeader{Version: tdxQuoteVersion, AttestationKeyType: tdxECDSAP256, TEEType: tdxTEEType, QEVendorID: tdxIntelQEVendorID},
+		Body: tdReport{
+			TEETCBSVN:  make([]byte, 16),
+			MRSEAM:     seam[:],
+			MRTD:       c.PCRs.PCR0[:],
+			MRConfigID: config,
+			RTMR:       [4][]byte{c.PCRs.PCR1[:], make([]byte, pcr.Size), c.PCRs.PCR2[:], make([]byte, pcr.Size)},
+			ReportData: data,
+		},
+	}
+	body, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	q.Signature = simulatedSignature(f.Name(), body)
+	return json.Marshal(tdxEvidence{Format: f.Name(), Quote: q, PublicKey: der})
+}
+
+func (f tdxFormat) Verify(evidence []byte) (*Attested, error) {
+	var e tdxEvidence
+	if err := json.Unmarshal(evidence, &e); err != nil {
+		return nil, fmt.Errorf("failed to parse TDX quote: %v", err)
+	}
+	q := e.Quote
+	if q.Header.Version != tdxQuoteVersion || q.Header.TEEType != tdxTEEType || len(q.Body.MRTD) != pcr.Size || len(q.Body.ReportData) != sha512.Size {
+		return nil, fmt.Errorf("malformed TDX quote")
+	}
+	signature := q.Signature
+	q.Signature = nil
+	body, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignature(f.Name(), body, signature); err != nil {
+		return nil, err
+	}
+	pub, err := boundKey(e.PublicKey, q.Body.ReportData)
+	if err != nil {
+		return nil, err
+	}
+	return &Attested{Format: f.Name(), PCRs: map[int][]byte{0: q.Body.MRTD, 1: q.Body.RTMR[0], 2: q.Body.RTMR[2]}, PublicKey: pub}, nil
+}
@@ -0,0 +1,250 @@
+package awsauth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials are AWS access keys, optionally temporary.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time // zero for long-lived keys
+	Source          string    // where the credentials came from, for logging
+}
+
+// Provider supplies credentials.
+type Provider interface {
+	Retrieve() (Credentials, error)
+}
+
+// EnvProvider reads AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+type EnvProvider struct{}
+
+func (EnvProvider) Retrieve() (Credentials, error) {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return Credentials{}, fmt.Errorf("AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not set")
+	}
+	return Credentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN"), Source: "environment"}, nil
+}
+
+// SharedFileProvider reads static keys for the AWS_PROFILE profile
+// ("default" if unset) from the shared credentials file
+// (AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials), then from the shared
+// config file (AWS_CONFIG_FILE or ~/.aws/config).
+type SharedFileProvider struct{}
+
+func (SharedFileProvider) Retrieve() (Credentials, error) {
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	home, _ := os.UserHomeDir()
+
+	credsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credsFile == "" {
+		credsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+
+	// The config file names non-default profiles "profile <name>"
+	configSection := "profile " + profile
+	if profile == "default" {
+		configSection = "default"
+	}
+
+	for _, f := range []struct{ path, section string }{
+		{credsFile, profile},
+		{configFile, configSection},
+	} {
+		values, err := readINISection(f.path, f.section)
+		if err != nil {
+			continue
+		}
+		if values["aws_access_key_id"] != "" && values["aws_secret_access_key"] != "" {
+			return Credentials{
+				AccessKeyID:     values["aws_access_key_id"],
+				SecretAccessKey: values["aws_secret_access_key"],
+				SessionToken:    values["aws_session_token"],
+				Source:          fmt.Sprintf("%s [%s]", f.path, f.section),
+			}, nil
+		}
+	}
+	return Credentials{}, fmt.Errorf("no keys for profile %q in %s or %s", profile, credsFile, configFile)
+}
+
+// readINISection returns the key/value pairs of one [section] of an INI
+// file, with keys lower-cased.
+func readINISection(path, section string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	found, in := false, false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			in = strings.TrimSpace(line[1:len(line)-1]) == section
+			found = found || in
+			continue
+		}
+		if !in {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			values[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("section [%s] not found in %s", section, path)
+	}
+	return values, nil
+}
+
+// IMDSProvider fetches the instance role's temporary credentials from the
+// EC2 instance metadata service (IMDSv2). It is skipped when
+// AWS_EC2_METADATA_DISABLED=true.
+type IMDSProvider struct {
+	// Endpoint defaults to http://169.254.169.254.
+	Endpoint string
+}
+
+func (p IMDSProvider) Retrieve() (Credentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return Credentials{}, fmt.Errorf("instance metadata disabled")
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	// Off EC2 the address doesn't answer at all: fail fast
+	client := &http.Client{Timeout: time.Second}
+
+	// IMDSv2 session token
+	tokenReq, err := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := imdsGet(client, tokenReq)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("instance metadata unavailable: %v", err)
+	}
+
+	get := func(path string) (string, error) {
+		req, err := http.NewRequest("GET", endpoint+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		return imdsGet(client, req)
+	}
+
+	roles, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return Credentials{}, fmt.Errorf("no instance role: %v", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return Credentials{}, fmt.Errorf("no instance role attached")
+	}
+
+	body, err := get("/latest/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to fetch role credentials: %v", err)
+	}
+	var out struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(body), &out); err != nil {
+		return Credentials{}, fmt.Errorf("failed to parse role credentials: %v", err)
+	}
+	return Credentials{
+		AccessKeyID:     out.AccessKeyId,
+		SecretAccessKey: out.SecretAccessKey,
+		SessionToken:    out.Token,
+		Expires:         out.Expiration,
+		Source:          "instance role " + role,
+	}, nil
+}
+
+func imdsGet(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: status %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+	return string(body), nil
+}
+
+// refreshWindow is how long before expiry temporary credentials are
+// refreshed.
+const refreshWindow = 5 * time.Minute
+
+// Chain tries each provider in order and caches the first credentials
+// found until shortly before they expire.
+type Chain struct {
+	Providers []Provider
+
+	mu     sync.Mutex
+	cached *Credentials
+}
+
+// DefaultChain follows the standard AWS order: environment, shared
+// credentials/config files, then EC2 instance metadata.
+func DefaultChain() *Chain {
+	return &Chain{Providers: []Provider{EnvProvider{}, SharedFileProvider{}, IMDSProvider{}}}
+}
+
+func (c *Chain) Retrieve() (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached != nil && (c.cached.Expires.IsZero() || time.Until(c.cached.Expires) > refreshWindow) {
+		return *c.cached, nil
+	}
+
+	var errs []string
+	for _, p := range c.Providers {
+		creds, err := p.Retrieve()
+		if err == nil {
+			c.cached = &creds
+			return creds, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return Credentials{}, fmt.Errorf("no AWS credentials found: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,55 @@
+package awsauth
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// get-vanilla from the AWS Signature Version 4 test suite.
+func TestSignGetVanilla(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	creds := Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	Sign(req, nil, "service", "us-east-1", creds, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("Authorization =\n  %s\nwant\n  %s", got, want)
+	}
+}
+
+func TestSignAddsSessionToken(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://kms.us-east-1.amazonaws.com/", nil)
+	req.Header.Set("X-Amz-Target", "TrentService.Encrypt")
+	Sign(req, []byte("{}"), "kms", "us-east-1", Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, time.Now())
+
+	if req.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Fatal("session token header not set")
+	}
+	auth := req.Header.Get("Authorization")
+	if want := "SignedHeaders=host;x-amz-date;x-amz-security-token;x-amz-target,"; !strings.Contains(auth, want) {
+		t.Fatalf("Authorization %q does not contain %q", auth, want)
+	}
+}
+
+func TestSharedFileProviderProfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials")
+	os.WriteFile(path, []byte("[default]\naws_access_key_id = A\naws_secret_access_key = B\n\n[dev]\naws_access_key_id=C\naws_secret_access_key=D\n"), 0600)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", path)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "missing"))
+	t.Setenv("AWS_PROFILE", "dev")
+
+	creds, err := SharedFileProvider{}.Retrieve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "C" || creds.SecretAccessKey != "D" {
+		t.Fatalf("got %q/%q, want C/D", creds.AccessKeyID, creds.SecretAccessKey)
+	}
+}
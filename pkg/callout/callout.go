@@ -0,0 +1,225 @@
+// Package callout lets a workload attach its own business logic to the
+// enclave without changing it: the enclave hands the operations it is
+// told to forward to a gRPC service the workload runs inside the enclave,
+// and returns that service's answer to the connector. The service
+// implements the one RPC in callout.proto and listens on a unix socket or
+// a loopback port, so the request never leaves the enclave.
+//
+// This package speaks just enough gRPC for that RPC, unary calls over
+// cleartext HTTP/2 with protobuf messages, to keep the enclave free of the
+// grpc-go dependency:
+//
+//	client, err := callout.New("unix:///run/workload.sock")
+//	resp, err := client.Invoke(ctx, &callout.Request{Operation: "Score", Payload: data})
+//
+// A failed call with a gRPC status returns a *Status. Serve runs the
+// service side, for Go workloads and tests.
+package callout
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/framing"
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// Path is the HTTP/2 path of the Invoke RPC, from the package and service
+// in callout.proto.
+const Path = "/nitro.callout.v1.Callout/Invoke"
+
+// MaxMessageSize bounds the messages either side accepts. It matches
+// pkg/framing's limit, since a bigger result couldn't reach the connector
+// anyway.
+const MaxMessageSize = framing.MaxFrameSize
+
+// Request is an InvokeRequest: the connector request handed to the service.
+type Request struct {
+	Operation string
+	RequestId string
+	KeyId     string
+	Payload   []byte
+}
+
+// Response is an InvokeResponse.
+type Response struct {
+	Result []byte
+}
+
+// Status is a gRPC status other than OK, returned by the service or sent
+// back to the client.
+type Status struct {
+	Code    protocol.GRPCCode
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("gRPC status %d: %s", s.Code, s.Message)
+}
+
+// Client calls a callout service. It is safe for concurrent use; calls
+// share one HTTP/2 connection.
+type Client struct {
+	target string
+	http   *http.Client
+}
+
+// New returns a client for the service at target: unix:PATH (or
+// unix:///PATH) for a unix socket, or HOST:PORT where HOST is localhost
+// or a loopback address. Other hosts are refused, since a service outside
+// the enclave would see the plaintext. No connection is made until the
+// first call.
+func New(target string) (*Client, error) {
+	network, addr, err := ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		Protocols: cleartextHTTP2(),
+	}
+	return &Client{target: target, http: &http.Client{Transport: transport}}, nil
+}
+
+// ParseTarget splits a --callout address into the network and address to
+// dial.
+func ParseTarget(target string) (network, addr string, err error) {
+	if path, ok := strings.CutPrefix(target, "unix:"); ok {
+		// unix:///run/x.sock is the absolute path /run/x.sock
+		path = strings.TrimPrefix(path, "//")
+		if path == "" {
+			return "", "", fmt.Errorf("callout target %q has no socket path", target)
+		}
+		return "unix", path, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", fmt.Errorf("callout target %q is neither unix:PATH nor HOST:PORT: %v", target, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("callout target %q has an invalid port", target)
+	}
+	if ip := net.ParseIP(host); !strings.EqualFold(host, "localhost") && (ip == nil || !ip.IsLoopback()) {
+		return "", "", fmt.Errorf("callout target %q is not a loopback address; the service must run inside the enclave", target)
+	}
+	return "tcp", target, nil
+}
+
+// cleartextHTTP2 selects HTTP/2 without TLS and with prior knowledge, as
+// gRPC uses it for local services.
+func cleartextHTTP2() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// Invoke calls the service with req. The service is told ctx's deadline
+// through grpc-timeout. An error from the service is a *Status; other
+// errors mean the call didn't complete.
+func (c *Client) Invoke(ctx context.Context, req *Request) (*Response, error) {
+	body := frame(req.marshal())
+	// The authority is only a label on a unix socket
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost"+Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("Te", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		hreq.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", max(1, time.Until(deadline).Milliseconds())))
+	}
+
+	hresp, err := c.http.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("callout service at %s: %w", c.target, err)
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("callout service at %s answered HTTP %s", c.target, hresp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(hresp.Body, 5+MaxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("callout service at %s: reading the response: %w", c.target, err)
+	}
+
+	// The status is in the trailers, or in the headers of a response
+	// without a message ("Trailers-Only")
+	if st, err := statusOf(hresp.Trailer, hresp.Header); err != nil || st != nil {
+		if err != nil {
+			return nil, fmt.Errorf("callout service at %s: %v", c.target, err)
+		}
+		return nil, st
+	}
+	msg, err := unframe(data)
+	if err != nil {
+		return nil, fmt.Errorf("callout service at %s: %v", c.target, err)
+	}
+	resp, err := unmarshalResponse(msg)
+	if err != nil {
+		return nil, fmt.Errorf("callout service at %s: %v", c.target, err)
+	}
+	return resp, nil
+}
+
+// statusOf returns the gRPC status in the trailers or headers, nil for OK.
+func statusOf(trailer, header http.Header) (*Status, error) {
+	h := trailer
+	if h.Get("Grpc-Status") == "" {
+		h = header
+	}
+	value := h.Get("Grpc-Status")
+	if value == "" {
+		return nil, errors.New("response has no grpc-status")
+	}
+	code, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid grpc-status %q", value)
+	}
+	if code == uint64(protocol.GRPCOK) {
+		return nil, nil
+	}
+	message := h.Get("Grpc-Message")
+	if m, err := url.PathUnescape(message); err == nil {
+		message = m
+	}
+	return &Status{Code: protocol.GRPCCode(code), Message: message}, nil
+}
+
+// frame prefixes msg with gRPC's message header: an uncompressed flag and
+// the length.
+func frame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// unframe returns the one message in a unary call's body.
+func unframe(data []byte) ([]byte, error) {
+	if len(data) < 5 {
+		return nil, errors.New("message is missing or cut short")
+	}
+	if data[0] != 0 {
+		return nil, errors.New("message is compressed, which isn't supported")
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if n > MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is over the %d byte limit", n, MaxMessageSize)
+	}
+	if uint64(len(data)-5) != uint64(n) {
+		return nil, fmt.Errorf("body holds %d bytes for a message of %d", len(data)-5, n)
+	}
+	return data[5:], nil
+}
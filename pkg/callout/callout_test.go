@@ -0,0 +1,144 @@
+package callout
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// serve runs fn on a unix socket and returns a client for it.
+func serve(t *testing.T, fn HandlerFunc) *Client {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "callout.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go Serve(l, fn)
+	c, err := New("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestInvoke(t *testing.T) {
+	var got *Request
+	var deadline time.Duration
+	c := serve(t, func(ctx context.Context, req *Request) (*Response, error) {
+		got = req
+		if d, ok := ctx.Deadline(); ok {
+			deadline = time.Until(d)
+		}
+		return &Response{Result: append([]byte("scored:"), req.Payload...)}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req := &Request{Operation: "Score", RequestId: "r1", KeyId: "alias/dev-key", Payload: []byte{0, 1, 2, 0xff}}
+	resp, err := c.Invoke(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Result, []byte("scored:\x00\x01\x02\xff")) {
+		t.Fatalf("result %q", resp.Result)
+	}
+	if got.Operation != "Score" || got.RequestId != "r1" || got.KeyId != "alias/dev-key" || !bytes.Equal(got.Payload, req.Payload) {
+		t.Fatalf("service got %+v", got)
+	}
+	if deadline <= 0 || deadline > 5*time.Second {
+		t.Fatalf("service deadline %v", deadline)
+	}
+
+	// Empty fields and an empty result survive too
+	if resp, err := c.Invoke(context.Background(), &Request{Operation: "Empty"}); err != nil || len(resp.Result) != len("scored:") {
+		t.Fatalf("empty payload: %q, %v", resp.Result, err)
+	}
+}
+
+func TestInvokeStatus(t *testing.T) {
+	c := serve(t, func(ctx context.Context, req *Request) (*Response, error) {
+		switch req.Operation {
+		case "Denied":
+			return nil, &Status{Code: protocol.GRPCPermissionDenied, Message: "not for you: 100% sure\n"}
+		case "Busy":
+			return nil, protocol.Errorf(protocol.CodeBusy, "queue full")
+		}
+		return nil, errors.New("boom")
+	})
+
+	tests := []struct {
+		op      string
+		code    protocol.GRPCCode
+		message string
+	}{
+		{"Denied", protocol.GRPCPermissionDenied, "not for you: 100% sure\n"},
+		{"Busy", protocol.GRPCResourceExhausted, "queue full"},
+		{"Other", protocol.GRPCUnknown, "boom"},
+	}
+	for _, tt := range tests {
+		_, err := c.Invoke(context.Background(), &Request{Operation: tt.op})
+		var st *Status
+		if !errors.As(err, &st) || st.Code != tt.code || st.Message != tt.message {
+			t.Errorf("%s: %v", tt.op, err)
+		}
+	}
+}
+
+func TestInvokeUnreachable(t *testing.T) {
+	c, err := New("unix://" + filepath.Join(t.TempDir(), "missing.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Invoke(context.Background(), &Request{Operation: "Score"})
+	var st *Status
+	if err == nil || errors.As(err, &st) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target, network, addr string
+	}{
+		{"unix:///run/workload.sock", "unix", "/run/workload.sock"},
+		{"unix:workload.sock", "unix", "workload.sock"},
+		{"localhost:50051", "tcp", "localhost:50051"},
+		{"127.0.0.1:50051", "tcp", "127.0.0.1:50051"},
+		{"[::1]:50051", "tcp", "[::1]:50051"},
+	}
+	for _, tt := range tests {
+		network, addr, err := ParseTarget(tt.target)
+		if err != nil || network != tt.network || addr != tt.addr {
+			t.Errorf("%s: %s %s, %v", tt.target, network, addr, err)
+		}
+	}
+	for _, target := range []string{"unix:", "10.0.0.5:50051", "example.com:50051", "localhost", "localhost:http"} {
+		if _, _, err := ParseTarget(target); err == nil {
+			t.Errorf("%s accepted", target)
+		}
+	}
+}
+
+func TestWireSkipsUnknownFields(t *testing.T) {
+	msg := (&Request{Operation: "Score", Payload: []byte("x")}).marshal()
+	// A varint field 9 and a fixed32 field 10 the client doesn't know
+	msg = append(msg, 9<<3|0, 0x96, 0x01, 10<<3|5, 1, 2, 3, 4)
+	r, err := unmarshalRequest(msg)
+	if err != nil || r.Operation != "Score" || string(r.Payload) != "x" {
+		t.Fatalf("got %+v, %v", r, err)
+	}
+	for _, bad := range [][]byte{{0x0a}, {0x0a, 5, 'a'}, {0x00}, {1<<3 | 3}} {
+		if _, err := unmarshalRequest(bad); err == nil || !strings.Contains(err.Error(), "malformed") {
+			t.Errorf("% x: %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package callout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// HandlerFunc performs one Invoke call. Returning a *Status, or a
+// *protocol.Error, which is sent as its gRPC code, fails the call with
+// that status; any other error is sent as Unknown.
+type HandlerFunc func(ctx context.Context, req *Request) (*Response, error)
+
+// Serve answers Invoke calls on l with fn until l is closed. It is the
+// service side for Go workloads that don't want grpc-go, and for tests;
+// any gRPC server generated from callout.proto works the same.
+func Serve(l net.Listener, fn HandlerFunc) error {
+	srv := &http.Server{Handler: Handler(fn), Protocols: cleartextHTTP2()}
+	return srv.Serve(l)
+}
+
+// Handler returns the http.Handler for Serve, which needs an HTTP/2
+// server.
+func Handler(fn HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		if r.URL.Path != Path {
+			writeStatus(w.Header(), protocol.GRPCUnimplemented, fmt.Sprintf("unknown method %s", r.URL.Path))
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, 5+MaxMessageSize+1))
+		if err != nil {
+			writeStatus(w.Header(), protocol.GRPCInternal, err.Error())
+			return
+		}
+		msg, err := unframe(data)
+		var req *Request
+		if err == nil {
+			req, err = unmarshalRequest(msg)
+		}
+		if err != nil {
+			writeStatus(w.Header(), protocol.GRPCInvalidArgument, err.Error())
+			return
+		}
+
+		ctx := r.Context()
+		if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		resp, err := fn(ctx, req)
+		if err != nil {
+			var st *Status
+			var perr *protocol.Error
+			switch {
+			case errors.As(err, &st):
+				writeStatus(w.Header(), st.Code, st.Message)
+			case errors.As(err, &perr):
+				writeStatus(w.Header(), perr.GRPCCode(), err.Error())
+			default:
+				writeStatus(w.Header(), protocol.GRPCUnknown, err.Error())
+			}
+			return
+		}
+
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Write(frame(resp.marshal()))
+		writeStatus(w.Header(), protocol.GRPCOK, "")
+	})
+}
+
+// writeStatus sets the status headers, or trailers once the body is
+// written, percent-encoding the message as gRPC requires.
+func writeStatus(h http.Header, code protocol.GRPCCode, message string) {
+	h.Set("Grpc-Status", strconv.FormatUint(uint64(code), 10))
+	if message == "" {
+		return
+	}
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	h.Set("Grpc-Message", b.String())
+}
+
+// parseTimeout parses a grpc-timeout header such as "250m".
+func parseTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	unit := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}[s[len(s)-1]]
+	if unit == 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
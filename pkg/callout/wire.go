@@ -0,0 +1,103 @@
+package callout
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The messages in callout.proto have only string and bytes fields, so they
+// are encoded by hand in the protobuf wire format: each set field is a
+// tag (field number and wire type 2) followed by a length and the bytes.
+// Empty fields are left out, as proto3 does. Decoding skips fields it
+// doesn't know, so the service may add its own.
+
+const wireBytes = 2
+
+var errMalformed = errors.New("malformed protobuf message")
+
+func (r *Request) marshal() []byte {
+	var b []byte
+	b = appendField(b, 1, []byte(r.Operation))
+	b = appendField(b, 2, []byte(r.RequestId))
+	b = appendField(b, 3, []byte(r.KeyId))
+	return appendField(b, 4, r.Payload)
+}
+
+func unmarshalRequest(msg []byte) (*Request, error) {
+	r := &Request{}
+	err := eachField(msg, func(num uint64, v []byte) {
+		switch num {
+		case 1:
+			r.Operation = string(v)
+		case 2:
+			r.RequestId = string(v)
+		case 3:
+			r.KeyId = string(v)
+		case 4:
+			r.Payload = v
+		}
+	})
+	return r, err
+}
+
+func (r *Response) marshal() []byte {
+	return appendField(nil, 1, r.Result)
+}
+
+func unmarshalResponse(msg []byte) (*Response, error) {
+	r := &Response{}
+	err := eachField(msg, func(num uint64, v []byte) {
+		if num == 1 {
+			r.Result = v
+		}
+	})
+	return r, err
+}
+
+func appendField(b []byte, num uint64, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, num<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// eachField calls fn with each length-delimited field in msg, skipping
+// fields of the other wire types.
+func eachField(msg []byte, fn func(num uint64, v []byte)) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 || tag>>3 == 0 {
+			return errMalformed
+		}
+		msg = msg[n:]
+		var skip uint64
+		switch tag & 7 {
+		case 0: // varint
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return errMalformed
+			}
+			skip = uint64(n)
+		case 1: // fixed64
+			skip = 8
+		case 5: // fixed32
+			skip = 4
+		case wireBytes:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || length > uint64(len(msg)-n) {
+				return errMalformed
+			}
+			fn(tag>>3, msg[n:n+int(length)])
+			skip = uint64(n) + length
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d", errMalformed, tag&7)
+		}
+		if skip > uint64(len(msg)) {
+			return errMalformed
+		}
+		msg = msg[skip:]
+	}
+	return nil
+}
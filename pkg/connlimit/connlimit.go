@@ -0,0 +1,138 @@
+// Package connlimit bounds how many connections a vsock server handles at
+// once. Without it, every accepted connection gets its own goroutine, so a
+// connection flood turns into unbounded memory use and KMS load. With it,
+// at most Max connections are served; further connections either wait for
+// a slot for a bounded time or are turned away at once, and the server
+// answers them with a busy error so clients back off.
+package connlimit
+
+import (
+	"sync/atomic"
+	"time"
+
+	"nitro-dev-qemu/pkg/metrics"
+)
+
+// Limiter hands out connection slots. A nil *Limiter is unlimited.
+type Limiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	metrics      Metrics
+
+	waiting  atomic.Int64
+	rejected atomic.Uint64
+}
+
+// Metrics are optional instruments a Limiter keeps up to date; any may be
+// nil.
+type Metrics struct {
+	InUse    *metrics.Gauge   // connections holding a slot
+	Waiting  *metrics.Gauge   // connections queued for a slot
+	Rejected *metrics.Counter // connections turned away as busy
+}
+
+// Stats is a snapshot of a Limiter's utilization.
+type Stats struct {
+	InUse    int
+	Max      int
+	Waiting  int
+	Rejected uint64
+}
+
+// New returns a Limiter serving at most max connections at once. When all
+// slots are taken, a new connection waits up to queueTimeout for one (0
+// rejects it immediately). At most max connections wait at a time, so the
+// queue is bounded too. New returns nil, an unlimited Limiter, when max is
+// 0 or less.
+func New(max int, queueTimeout time.Duration, m Metrics) *Limiter {
+	if max <= 0 {
+		return nil
+	}
+	return &Limiter{slots: make(chan struct{}, max), queueTimeout: queueTimeout, metrics: m}
+}
+
+// Acquire takes a slot for a new connection and reports whether it got
+// one. It returns false when the connection should be rejected: all slots
+// stayed busy for the queue timeout, the queue was full, or stop was
+// closed (the server is shutting down). Each successful Acquire must be
+// paired with a Release.
+func (l *Limiter) Acquire(stop <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+
+	// Fast path: a slot is free
+	select {
+	case l.slots <- struct{}{}:
+		inc(l.metrics.InUse)
+		return true
+	default:
+	}
+
+	if l.queueTimeout <= 0 || l.waiting.Add(1) > int64(cap(l.slots)) {
+		if l.queueTimeout > 0 {
+			l.waiting.Add(-1)
+		}
+		return l.reject()
+	}
+	inc(l.metrics.Waiting)
+	defer func() {
+		l.waiting.Add(-1)
+		dec(l.metrics.Waiting)
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		inc(l.metrics.InUse)
+		return true
+	case <-timer.C:
+		return l.reject()
+	case <-stop:
+		return l.reject()
+	}
+}
+
+func (l *Limiter) reject() bool {
+	l.rejected.Add(1)
+	if l.metrics.Rejected != nil {
+		l.metrics.Rejected.Inc()
+	}
+	return false
+}
+
+// Release frees a slot taken by Acquire.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+	dec(l.metrics.InUse)
+}
+
+// Stats returns the current utilization. Max is 0 for an unlimited
+// Limiter.
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	return Stats{
+		InUse:    len(l.slots),
+		Max:      cap(l.slots),
+		Waiting:  int(l.waiting.Load()),
+		Rejected: l.rejected.Load(),
+	}
+}
+
+func inc(g *metrics.Gauge) {
+	if g != nil {
+		g.Inc()
+	}
+}
+
+func dec(g *metrics.Gauge) {
+	if g != nil {
+		g.Dec()
+	}
+}
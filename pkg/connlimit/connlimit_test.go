@@ -0,0 +1,108 @@
+package connlimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/metrics"
+)
+
+func TestRejectWhenFull(t *testing.T) {
+	rejected := metrics.NewCounter()
+	l := New(2, 0, Metrics{Rejected: rejected})
+	if !l.Acquire(nil) || !l.Acquire(nil) {
+		t.Fatal("free slots were refused")
+	}
+	if l.Acquire(nil) {
+		t.Fatal("third connection got a slot")
+	}
+	if s := l.Stats(); s.InUse != 2 || s.Max != 2 || s.Rejected != 1 || rejected.Value() != 1 {
+		t.Fatalf("stats %+v, rejected metric %d", s, rejected.Value())
+	}
+	l.Release()
+	if !l.Acquire(nil) {
+		t.Fatal("released slot was refused")
+	}
+}
+
+func TestQueueWaitsForSlot(t *testing.T) {
+	waiting := metrics.NewGauge()
+	l := New(1, time.Second, Metrics{Waiting: waiting})
+	l.Acquire(nil)
+
+	got := make(chan bool)
+	go func() { got <- l.Acquire(nil) }()
+	for l.Stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if waiting.Value() != 1 {
+		t.Fatalf("waiting gauge %d, want 1", waiting.Value())
+	}
+	l.Release()
+	if !<-got {
+		t.Fatal("queued connection didn't get the released slot")
+	}
+	if waiting.Value() != 0 {
+		t.Fatalf("waiting gauge %d after acquiring, want 0", waiting.Value())
+	}
+}
+
+func TestQueueTimeoutAndStop(t *testing.T) {
+	l := New(1, 20*time.Millisecond, Metrics{})
+	l.Acquire(nil)
+	start := time.Now()
+	if l.Acquire(nil) {
+		t.Fatal("got a slot that was never released")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("gave up before the queue timeout")
+	}
+
+	l = New(1, time.Hour, Metrics{})
+	l.Acquire(nil)
+	stop := make(chan struct{})
+	close(stop)
+	if l.Acquire(stop) {
+		t.Fatal("got a slot after stop")
+	}
+}
+
+func TestQueueIsBounded(t *testing.T) {
+	l := New(2, time.Hour, Metrics{})
+	l.Acquire(nil)
+	l.Acquire(nil)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Acquire(stop)
+		}()
+	}
+	for l.Stats().Waiting != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if l.Acquire(stop) {
+		t.Fatal("a full queue accepted another connection")
+	}
+	close(stop)
+	wg.Wait()
+	if s := l.Stats(); s.Waiting != 0 || s.Rejected != 3 {
+		t.Fatalf("stats %+v, want nobody waiting and 3 rejected", s)
+	}
+}
+
+func TestNilIsUnlimited(t *testing.T) {
+	var l *Limiter = New(0, time.Second, Metrics{})
+	for range 100 {
+		if !l.Acquire(nil) {
+			t.Fatal("unlimited Limiter refused a connection")
+		}
+	}
+	l.Release()
+	if s := l.Stats(); s.Max != 0 {
+		t.Fatalf("stats %+v", s)
+	}
+}
@@ -0,0 +1,187 @@
+// Package drbg implements HMAC_DRBG with SHA-256 (NIST SP 800-90A) for
+// enclave-local random numbers. Real enclaves have no hardware RNG of their
+// own: they seed a DRBG from the Nitro Secure Module or from KMS
+// GenerateRandom and reseed it periodically. This package models that,
+// including continuous health tests on the entropy input (NIST SP 800-90B,
+// see health.go) and counters for reseeds and health test failures.
+package drbg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// seedBytes is the entropy input per (re)seed: the 256-bit security
+	// strength of HMAC_DRBG with SHA-256.
+	seedBytes = 32
+	// nonceBytes is the instantiation nonce, half the security strength.
+	nonceBytes = 16
+	// maxRequestBytes is the largest single Generate call (2^19 bits).
+	maxRequestBytes = 1 << 16
+
+	// DefaultReseedInterval is the number of Generate calls between
+	// reseeds. SP 800-90A allows up to 2^48; reseeding far more often
+	// keeps the reseed path exercised in development.
+	DefaultReseedInterval = 4096
+)
+
+// ErrHealthTest is returned when the entropy source fails a health test.
+// The failure is permanent for that DRBG: once its reseed is due, every
+// read fails until the process is restarted with a working source.
+var ErrHealthTest = errors.New("entropy source failed health test")
+
+// Stats are the DRBG's counters since instantiation.
+type Stats struct {
+	Reseeds        uint64 // reseeds after instantiation
+	Requests       uint64 // Generate calls
+	Bytes          uint64 // bytes generated
+	EntropyBytes   uint64 // bytes read from the entropy source
+	RepetitionFail uint64 // repetition count test failures
+	ProportionFail uint64 // adaptive proportion test failures
+}
+
+// DRBG is an HMAC_DRBG seeded from an entropy source. It implements
+// io.Reader and is safe for concurrent use.
+type DRBG struct {
+	source   io.Reader
+	health   *healthTests
+	interval uint64
+
+	mu      sync.Mutex
+	k, v    []byte
+	counter uint64 // Generate calls since the last (re)seed
+	stats   Stats
+}
+
+// New instantiates a DRBG from source. The source's first 1024 bytes are
+// used only for the SP 800-90B start-up health tests; after that, every
+// byte read from it is tested continuously. personalization may be nil;
+// reseedInterval of 0 means DefaultReseedInterval.
+func New(source io.Reader, personalization []byte, reseedInterval uint64) (*DRBG, error) {
+	if reseedInterval == 0 {
+		reseedInterval = DefaultReseedInterval
+	}
+	d := &DRBG{source: source, health: newHealthTests(), interval: reseedInterval}
+
+	startup := make([]byte, startupSamples)
+	if err := d.readEntropy(startup); err != nil {
+		return nil, fmt.Errorf("start-up health test: %w", err)
+	}
+
+	seed := make([]byte, seedBytes+nonceBytes, seedBytes+nonceBytes+len(personalization))
+	if err := d.readEntropy(seed); err != nil {
+		return nil, err
+	}
+	seed = append(seed, personalization...)
+
+	d.k = make([]byte, sha256.Size)
+	d.v = make([]byte, sha256.Size)
+	for i := range d.v {
+		d.v[i] = 0x01
+	}
+	d.update(seed)
+	clear(seed)
+	d.counter = 1
+	return d, nil
+}
+
+// Read fills p with random bytes, reseeding first when the reseed interval
+// has been reached.
+func (d *DRBG) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for n := 0; n < len(p); {
+		chunk := min(len(p)-n, maxRequestBytes)
+		if err := d.generate(p[n : n+chunk]); err != nil {
+			return n, err
+		}
+		n += chunk
+	}
+	return len(p), nil
+}
+
+// Reseed mixes fresh entropy into the state now, regardless of the
+// reseed interval.
+func (d *DRBG) Reseed() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reseed()
+}
+
+// Stats returns a snapshot of the counters.
+func (d *DRBG) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := d.stats
+	s.RepetitionFail, s.ProportionFail = d.health.failures()
+	return s
+}
+
+func (d *DRBG) generate(out []byte) error {
+	if d.counter > d.interval {
+		if err := d.reseed(); err != nil {
+			return err
+		}
+	}
+	for n := 0; n < len(out); {
+		d.v = d.hmac(d.v)
+		n += copy(out[n:], d.v)
+	}
+	d.update(nil)
+	d.counter++
+	d.stats.Requests++
+	d.stats.Bytes += uint64(len(out))
+	return nil
+}
+
+func (d *DRBG) reseed() error {
+	entropy := make([]byte, seedBytes)
+	if err := d.readEntropy(entropy); err != nil {
+		return err
+	}
+	d.update(entropy)
+	clear(entropy)
+	d.counter = 1
+	d.stats.Reseeds++
+	return nil
+}
+
+// readEntropy fills buf from the source and runs it through the health
+// tests.
+func (d *DRBG) readEntropy(buf []byte) error {
+	if d.health.failed() {
+		return ErrHealthTest
+	}
+	if _, err := io.ReadFull(d.source, buf); err != nil {
+		return fmt.Errorf("failed to read entropy: %v", err)
+	}
+	d.stats.EntropyBytes += uint64(len(buf))
+	if !d.health.test(buf) {
+		return ErrHealthTest
+	}
+	return nil
+}
+
+// update is the HMAC_DRBG Update function (SP 800-90A 10.1.2.2).
+func (d *DRBG) update(data []byte) {
+	d.k = d.hmac(d.v, []byte{0x00}, data)
+	d.v = d.hmac(d.v)
+	if len(data) == 0 {
+		return
+	}
+	d.k = d.hmac(d.v, []byte{0x01}, data)
+	d.v = d.hmac(d.v)
+}
+
+func (d *DRBG) hmac(parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, d.k)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,176 @@
+package drbg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+)
+
+// seeded returns a deterministic, health-test-passing entropy source.
+func seeded(b byte) io.Reader {
+	return rand.NewChaCha8([32]byte{b})
+}
+
+func TestSameEntropySameOutput(t *testing.T) {
+	a, err := New(seeded(1), []byte("enclave"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := New(seeded(1), []byte("enclave"), 0)
+	c, _ := New(seeded(1), []byte("other"), 0)
+
+	out := func(d *DRBG) []byte {
+		buf := make([]byte, 100)
+		if _, err := d.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	x, y, z := out(a), out(b), out(c)
+	if !bytes.Equal(x, y) {
+		t.Fatal("same entropy and personalization gave different output")
+	}
+	if bytes.Equal(x, z) {
+		t.Fatal("personalization string was ignored")
+	}
+	if bytes.Equal(x, out(a)) {
+		t.Fatal("consecutive reads returned the same bytes")
+	}
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// The first HMAC_DRBG SHA-256 vector of NIST CAVP's drbgvectors_pr_false
+// (no prediction resistance, personalization or additional input):
+// instantiate, reseed, then generate twice and check the second output.
+func TestCAVPVector(t *testing.T) {
+	entropy := unhex("06032cd5eed33f39265f49ecb142c511da9aff2af71203bffaf34a9ca5bd9c0d")
+	nonce := unhex("0e66f71edc43e42a45ad3c6fc6cdc4df")
+	reseed := unhex("01920a4e669ed3a85ae8a33b35a74ad7fb2a6bb4cf395ce00334a9c9a5a5d552")
+	want := unhex("76fc79fe9b50beccc991a11b5635783a83536add03c157fb30645e611c2898bb" +
+		"2b1bc215000209208cd506cb28da2a51bdb03826aaf2bd2335d576d519160842" +
+		"e7158ad0949d1a9ec3e66ea1b1a064b005de914eac2e9d4f2d72a8616a802254" +
+		"22918250ff66a41bd2f864a6a38cc5b6499dc43f7f2bd09e1e0f8f5885935124")
+
+	// the start-up health test samples come first and are discarded
+	startup := make([]byte, startupSamples)
+	seeded(5).Read(startup)
+	d, err := New(io.MultiReader(bytes.NewReader(startup), bytes.NewReader(entropy), bytes.NewReader(nonce), bytes.NewReader(reseed)), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Reseed(); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	for range 2 {
+		if _, err := d.Read(got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x\nwant %x", got, want)
+	}
+}
+
+func TestReseedInterval(t *testing.T) {
+	d, err := New(seeded(2), nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	for range 7 {
+		d.Read(buf)
+	}
+	// Generate calls 4 and 7 each come after 3 since the last (re)seed
+	s := d.Stats()
+	if s.Reseeds != 2 || s.Requests != 7 {
+		t.Fatalf("got %d reseeds after %d requests, want 2 after 7", s.Reseeds, s.Requests)
+	}
+	if want := uint64(startupSamples + seedBytes + nonceBytes + 2*seedBytes); s.EntropyBytes != want {
+		t.Fatalf("read %d entropy bytes, want %d", s.EntropyBytes, want)
+	}
+}
+
+func TestLargeReadIsSplit(t *testing.T) {
+	d, _ := New(seeded(3), nil, 0)
+	buf := make([]byte, 3*maxRequestBytes+5)
+	if n, err := d.Read(buf); err != nil || n != len(buf) {
+		t.Fatalf("Read = %d, %v", n, err)
+	}
+	if s := d.Stats(); s.Requests != 4 {
+		t.Fatalf("got %d Generate calls, want 4", s.Requests)
+	}
+}
+
+func TestStuckSourceFailsStartup(t *testing.T) {
+	_, err := New(bytes.NewReader(make([]byte, 4096)), nil, 0)
+	if !errors.Is(err, ErrHealthTest) {
+		t.Fatalf("got %v, want ErrHealthTest", err)
+	}
+}
+
+// failingAfter passes good entropy for n bytes, then repeats one byte.
+type failingAfter struct {
+	good io.Reader
+	n    int
+}
+
+func (f *failingAfter) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		clear(p)
+		return len(p), nil
+	}
+	k := min(len(p), f.n)
+	f.good.Read(p[:k])
+	f.n -= k
+	return k, nil
+}
+
+func TestHealthFailureAtReseedIsSticky(t *testing.T) {
+	src := &failingAfter{good: seeded(4), n: startupSamples + seedBytes + nonceBytes}
+	d, err := New(src, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if _, err := d.Read(buf); err != nil {
+		t.Fatalf("first read: %v", err)
+	}
+	for range 2 {
+		if _, err := d.Read(buf); !errors.Is(err, ErrHealthTest) {
+			t.Fatalf("got %v, want ErrHealthTest", err)
+		}
+	}
+	if s := d.Stats(); s.RepetitionFail != 1 || s.Reseeds != 0 {
+		t.Fatalf("stats %+v: want one repetition failure and no reseeds", s)
+	}
+}
+
+func TestAdaptiveProportion(t *testing.T) {
+	// Every other byte is 0x42: no runs, but far too common
+	buf := make([]byte, proportionWindow)
+	for i := range buf {
+		if i%2 == 0 {
+			buf[i] = 0x42
+		} else {
+			buf[i] = byte(i)
+		}
+	}
+	h := newHealthTests()
+	if h.test(buf) {
+		t.Fatal("biased input passed")
+	}
+	if rep, prop := h.failures(); rep != 0 || prop != 1 {
+		t.Fatalf("failures = %d repetition, %d proportion; want 0, 1", rep, prop)
+	}
+}
@@ -0,0 +1,80 @@
+package drbg
+
+// Continuous health tests on the entropy input, from NIST SP 800-90B
+// section 4.4. Each byte is one sample. The cutoffs assume a conservative
+// min-entropy of 4 bits per byte and a false positive rate of 2^-20, so a
+// working source practically never trips them while a stuck or heavily
+// biased one does within a few hundred bytes.
+const (
+	// repetitionCutoff is C = 1 + ceil(20/H) for H = 4: this many
+	// identical bytes in a row fail the repetition count test.
+	repetitionCutoff = 6
+	// proportionWindow and proportionCutoff are the adaptive proportion
+	// test's window size W for non-binary samples and its cutoff for
+	// H = 4 (SP 800-90B Table 2).
+	proportionWindow = 512
+	proportionCutoff = 62
+	// startupSamples are tested, and discarded, before the first seed.
+	startupSamples = 1024
+)
+
+// healthTests keeps the state of both tests across reads, so a run of
+// repeated bytes split between two reads is still caught. Failures are
+// sticky. The DRBG's mutex guards it.
+type healthTests struct {
+	// Repetition count test
+	last    byte
+	repeats int
+
+	// Adaptive proportion test
+	first   byte // sample the current window counts
+	seen    int  // samples in the current window
+	matches int  // occurrences of first in the current window
+
+	repetitionFail uint64
+	proportionFail uint64
+}
+
+func newHealthTests() *healthTests {
+	return &healthTests{}
+}
+
+// test runs every byte of buf through both tests and reports whether they
+// all passed.
+func (h *healthTests) test(buf []byte) bool {
+	ok := true
+	for _, b := range buf {
+		if h.repeats > 0 && b == h.last {
+			h.repeats++
+			if h.repeats == repetitionCutoff {
+				h.repetitionFail++
+				ok = false
+			}
+		} else {
+			h.last, h.repeats = b, 1
+		}
+
+		if h.seen == 0 {
+			h.first, h.matches = b, 1
+		} else if b == h.first {
+			h.matches++
+			if h.matches == proportionCutoff {
+				h.proportionFail++
+				ok = false
+			}
+		}
+		h.seen++
+		if h.seen == proportionWindow {
+			h.seen = 0
+		}
+	}
+	return ok
+}
+
+func (h *healthTests) failed() bool {
+	return h.repetitionFail > 0 || h.proportionFail > 0
+}
+
+func (h *healthTests) failures() (repetition, proportion uint64) {
+	return h.repetitionFail, h.proportionFail
+}
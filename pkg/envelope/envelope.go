@@ -0,0 +1,122 @@
+// Package envelope implements the envelope-encryption format produced by
+// the enclave: data is encrypted locally with a KMS data key, and the
+// envelope carries the KMS-encrypted copy of that key so it can be
+// unwrapped again through KMS Decrypt.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Version is the current envelope format version.
+const Version = 1
+
+// AlgorithmAES256GCM is the only algorithm currently supported.
+const AlgorithmAES256GCM = "AES-256-GCM"
+
+// Envelope is the serialized result of envelope encryption. Byte fields are
+// base64 encoded in JSON.
+type Envelope struct {
+	Version          int    `json:"version"`
+	Algorithm        string `json:"algorithm"`
+	KeyId            string `json:"key_id,omitempty"`
+	EncryptedDataKey string `json:"encrypted_data_key"`
+	Nonce            []byte `json:"nonce"`
+	Ciphertext       []byte `json:"ciphertext"`
+}
+
+// additionalData binds the envelope header to the ciphertext so the
+// algorithm or wrapped key can't be swapped without failing authentication.
+func (e *Envelope) additionalData() []byte {
+	return []byte(fmt.Sprintf("v%d|%s|%s", e.Version, e.Algorithm, e.EncryptedDataKey))
+}
+
+// Seal encrypts plaintext with the 32-byte dataKey using AES-256-GCM and
+// returns an envelope carrying encryptedDataKey (the KMS CiphertextBlob of
+// dataKey) alongside the ciphertext. The nonce is read from random, such as
+// crypto/rand.Reader or the enclave's DRBG.
+func Seal(random io.Reader, dataKey, plaintext []byte, encryptedDataKey, keyID string) (*Envelope, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{
+		Version:          Version,
+		Algorithm:        AlgorithmAES256GCM,
+		KeyId:            keyID,
+		EncryptedDataKey: encryptedDataKey,
+		Nonce:            make([]byte, gcm.NonceSize()),
+	}
+	if _, err := io.ReadFull(random, env.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	env.Ciphertext = gcm.Seal(nil, env.Nonce, plaintext, env.additionalData())
+	return env, nil
+}
+
+// Open decrypts the envelope with dataKey, the plaintext form of
+// EncryptedDataKey.
+func (e *Envelope) Open(dataKey []byte) ([]byte, error) {
+	if e.Version != Version {
+		return nil, fmt.Errorf("unsupported envelope version %d", e.Version)
+	}
+	if e.Algorithm != AlgorithmAES256GCM {
+		return nil, fmt.Errorf("unsupported envelope algorithm %q", e.Algorithm)
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length %d", len(e.Nonce))
+	}
+	plaintext, err := gcm.Open(nil, e.Nonce, e.Ciphertext, e.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("envelope authentication failed: %v", err)
+	}
+	return plaintext, nil
+}
+
+// Marshal returns the JSON encoding of the envelope.
+func (e *Envelope) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Parse decodes a JSON envelope.
+func Parse(data []byte) (*Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("failed to parse envelope: %v", err)
+	}
+	if e.EncryptedDataKey == "" {
+		return nil, fmt.Errorf("envelope has no encrypted data key")
+	}
+	return &e, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("data key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return gcm, nil
+}
+
+// Zero overwrites key material in place once it's no longer needed.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
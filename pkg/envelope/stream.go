@@ -0,0 +1,186 @@
+package envelope
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// AlgorithmAES256GCMStream is the algorithm of streams: AES-256-GCM over
+// fixed-size chunks, with nonces built as in the STREAM construction
+// (Hoang, Reyhanitabar, Rogaway and Vizár, "Online Authenticated-Encryption
+// and its Nonce-Reuse Misuse-Resistance"): a random prefix, the chunk's
+// index and a flag marking the last chunk. Chunks can't be reordered,
+// dropped or duplicated, and a stream cut off after any chunk fails to
+// decrypt, because its last chunk wasn't sealed as the last.
+const AlgorithmAES256GCMStream = "AES-256-GCM-STREAM"
+
+// MaxChunkSize bounds a stream's chunks, so either side can refuse to
+// buffer more than this per chunk.
+const MaxChunkSize = 16 << 20
+
+// streamPrefixSize is the size of the random nonce prefix; with 4 bytes of
+// index and 1 of flag it makes up the 12-byte GCM nonce.
+const streamPrefixSize = 7
+
+// ErrTruncated is returned when the chunk given as the last one wasn't
+// sealed as the last: the stream was cut off.
+var ErrTruncated = errors.New("stream is truncated: it ends without its final chunk")
+
+// StreamHeader describes a stream and carries its KMS-encrypted data key.
+// It is sent ahead of the chunks; byte fields are base64 encoded in JSON.
+type StreamHeader struct {
+	Version          int    `json:"version"`
+	Algorithm        string `json:"algorithm"`
+	KeyId            string `json:"key_id,omitempty"`
+	EncryptedDataKey string `json:"encrypted_data_key"`
+	NoncePrefix      []byte `json:"nonce_prefix"`
+	ChunkSize        int    `json:"chunk_size"`
+}
+
+// additionalData binds every chunk to the header, so chunks can't be
+// moved between streams.
+func (h *StreamHeader) additionalData() []byte {
+	return []byte(fmt.Sprintf("v%d|%s|%s|%x|%d", h.Version, h.Algorithm, h.EncryptedDataKey, h.NoncePrefix, h.ChunkSize))
+}
+
+// Marshal returns the JSON encoding of the header.
+func (h *StreamHeader) Marshal() ([]byte, error) {
+	return json.Marshal(h)
+}
+
+// ParseStreamHeader decodes a JSON stream header.
+func ParseStreamHeader(data []byte) (*StreamHeader, error) {
+	var h StreamHeader
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("failed to parse stream header: %v", err)
+	}
+	if h.EncryptedDataKey == "" {
+		return nil, fmt.Errorf("stream header has no encrypted data key")
+	}
+	return &h, nil
+}
+
+// Stream seals or opens the chunks of one stream, in order. It is not
+// safe for concurrent use.
+type Stream struct {
+	header *StreamHeader
+	aad    []byte
+	gcm    cipher.AEAD
+	next   uint64
+	done   bool
+}
+
+// NewStream starts a stream sealed with the 32-byte dataKey in chunks of
+// chunkSize bytes. The nonce prefix is read from random, such as
+// crypto/rand.Reader or the enclave's DRBG.
+func NewStream(random io.Reader, dataKey []byte, encryptedDataKey, keyID string, chunkSize int) (*Stream, error) {
+	if chunkSize < 1 || chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("chunk size must be 1 to %d bytes, got %d", MaxChunkSize, chunkSize)
+	}
+	h := &StreamHeader{
+		Version:          Version,
+		Algorithm:        AlgorithmAES256GCMStream,
+		KeyId:            keyID,
+		EncryptedDataKey: encryptedDataKey,
+		NoncePrefix:      make([]byte, streamPrefixSize),
+		ChunkSize:        chunkSize,
+	}
+	if _, err := io.ReadFull(random, h.NoncePrefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce prefix: %v", err)
+	}
+	return OpenStream(h, dataKey)
+}
+
+// OpenStream continues the stream h describes with dataKey, the plaintext
+// form of its EncryptedDataKey, to open its chunks.
+func OpenStream(h *StreamHeader, dataKey []byte) (*Stream, error) {
+	if h.Version != Version {
+		return nil, fmt.Errorf("unsupported stream version %d", h.Version)
+	}
+	if h.Algorithm != AlgorithmAES256GCMStream {
+		return nil, fmt.Errorf("unsupported stream algorithm %q", h.Algorithm)
+	}
+	if len(h.NoncePrefix) != streamPrefixSize {
+		return nil, fmt.Errorf("invalid nonce prefix length %d", len(h.NoncePrefix))
+	}
+	if h.ChunkSize < 1 || h.ChunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("chunk size must be 1 to %d bytes, got %d", MaxChunkSize, h.ChunkSize)
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{header: h, aad: h.additionalData(), gcm: gcm}, nil
+}
+
+// Header returns the stream's header.
+func (s *Stream) Header() *StreamHeader {
+	return s.header
+}
+
+// Chunks returns how many chunks have been sealed or opened.
+func (s *Stream) Chunks() uint64 {
+	return s.next
+}
+
+func (s *Stream) nonce(final bool) ([]byte, error) {
+	if s.done {
+		return nil, fmt.Errorf("stream already ended with its final chunk")
+	}
+	if s.next > math.MaxUint32 {
+		return nil, fmt.Errorf("stream has too many chunks")
+	}
+	nonce := make([]byte, s.gcm.NonceSize())
+	copy(nonce, s.header.NoncePrefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], uint32(s.next))
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce, nil
+}
+
+// Seal encrypts the next chunk, which may be shorter than the chunk size
+// only if it is the final one. Every stream ends with a final chunk, which
+// may be empty.
+func (s *Stream) Seal(plaintext []byte, final bool) ([]byte, error) {
+	if len(plaintext) > s.header.ChunkSize || !final && len(plaintext) != s.header.ChunkSize {
+		return nil, fmt.Errorf("chunk %d is %d bytes; chunks must be %d bytes, except the final one which may be shorter", s.next, len(plaintext), s.header.ChunkSize)
+	}
+	nonce, err := s.nonce(final)
+	if err != nil {
+		return nil, err
+	}
+	s.next++
+	s.done = final
+	return s.gcm.Seal(nil, nonce, plaintext, s.aad), nil
+}
+
+// Open decrypts the next chunk. final says whether the caller has seen the
+// end of the stream after it; a stream that was cut off fails here with
+// ErrTruncated.
+func (s *Stream) Open(ciphertext []byte, final bool) ([]byte, error) {
+	nonce, err := s.nonce(final)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.gcm.Open(nil, nonce, ciphertext, s.aad)
+	if err != nil {
+		// Tell apart the cut-off streams from the damaged ones
+		nonce[len(nonce)-1] ^= 1
+		if _, ferr := s.gcm.Open(nil, nonce, ciphertext, s.aad); ferr == nil {
+			if final {
+				return nil, ErrTruncated
+			}
+			return nil, fmt.Errorf("chunk %d is the final chunk, but more data follows it", s.next)
+		}
+		return nil, fmt.Errorf("chunk %d failed authentication: it is damaged, out of order, or from another stream", s.next)
+	}
+	s.next++
+	s.done = final
+	return plaintext, nil
+}
@@ -0,0 +1,114 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sealAll seals data in chunks of chunkSize and returns the header and the
+// sealed chunks.
+func sealAll(t *testing.T, key, data []byte, chunkSize int) (*StreamHeader, [][]byte) {
+	t.Helper()
+	s, err := NewStream(rand.Reader, key, "wrapped-key", "alias/dev-key", chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		// A stream whose length is a multiple of the chunk size ends
+		// with an empty final chunk
+		n := min(chunkSize, len(data))
+		final := n < chunkSize
+		c, err := s.Seal(data[:n], final)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, c)
+		data = data[n:]
+		if final {
+			return s.Header(), chunks
+		}
+	}
+}
+
+func openAll(key []byte, h *StreamHeader, chunks [][]byte) ([]byte, error) {
+	s, err := OpenStream(h, key)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	for i, c := range chunks {
+		p, err := s.Open(c, i == len(chunks)-1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p...)
+	}
+	return out, nil
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	for _, size := range []int{0, 1, 99, 100, 101, 1000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		h, chunks := sealAll(t, key, data, 100)
+		if want := size/100 + 1; len(chunks) != want {
+			t.Fatalf("%d bytes: %d chunks, want %d", size, len(chunks), want)
+		}
+
+		// The header survives its JSON encoding
+		enc, _ := h.Marshal()
+		h, err := ParseStreamHeader(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := openAll(key, h, chunks)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: round trip changed the data", size)
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	h, chunks := sealAll(t, key, bytes.Repeat([]byte("x"), 350), 100)
+
+	if _, err := openAll(key, h, chunks[:2]); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("truncated stream: %v", err)
+	}
+	swapped := [][]byte{chunks[1], chunks[0], chunks[2], chunks[3]}
+	if _, err := openAll(key, h, swapped); err == nil || !strings.Contains(err.Error(), "chunk 0 failed authentication") {
+		t.Fatalf("reordered chunks: %v", err)
+	}
+	extended := append(append([][]byte{}, chunks...), chunks[3])
+	if _, err := openAll(key, h, extended); err == nil || !strings.Contains(err.Error(), "more data follows") {
+		t.Fatalf("data after the final chunk: %v", err)
+	}
+
+	other := *h
+	other.ChunkSize = 99
+	if _, err := openAll(key, &other, chunks); err == nil {
+		t.Fatal("changed header accepted")
+	}
+
+	s, _ := NewStream(rand.Reader, key, "wrapped-key", "", 100)
+	if _, err := s.Seal(make([]byte, 50), false); err == nil {
+		t.Fatal("short chunk before the final one accepted")
+	}
+	s.Seal(nil, true)
+	if _, err := s.Seal(nil, true); err == nil {
+		t.Fatal("chunk after the final one accepted")
+	}
+	if _, err := NewStream(rand.Reader, key, "wrapped-key", "", MaxChunkSize+1); err == nil {
+		t.Fatal("oversized chunks accepted")
+	}
+}
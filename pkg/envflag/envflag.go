@@ -0,0 +1,129 @@
+// Package envflag defines command-line flags whose defaults can be
+// overridden from the environment, so the same binary can be configured by
+// flags on the command line or by Environment= lines in a systemd unit or
+// docker-compose file. An explicit flag always wins over the environment.
+package envflag
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FlagSet defines flags on a flag.FlagSet. Programs are given a flag set
+// of their own rather than using flag.CommandLine, so that one process can
+// run several components each with its own flags (cmd/allinone).
+type FlagSet struct {
+	fs *flag.FlagSet
+}
+
+// On returns a FlagSet defining flags on fs.
+func On(fs *flag.FlagSet) FlagSet {
+	return FlagSet{fs}
+}
+
+// Uint32 defines a uint32 flag. Its default is taken from the first of envs
+// that is set, falling back to def; an unparsable environment value is
+// logged and ignored.
+func (f FlagSet) Uint32(name string, def uint32, usage string, envs ...string) *uint32 {
+	v := def
+	if env, s, ok := lookup(envs); ok {
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			slog.Warn("Invalid environment value, using default", "env", env, "value", s, "default", def)
+		} else {
+			v = uint32(n)
+		}
+	}
+	p := new(uint32)
+	*p = v
+	f.fs.Var((*uint32Value)(p), name, describe(usage, envs))
+	return p
+}
+
+// String defines a string flag. Its default is taken from the first of envs
+// that is set, falling back to def.
+func (f FlagSet) String(name, def, usage string, envs ...string) *string {
+	if _, s, ok := lookup(envs); ok {
+		def = s
+	}
+	return f.fs.String(name, def, describe(usage, envs))
+}
+
+// Bool defines a bool flag. Its default is taken from the first of envs
+// that is set, falling back to def; an unparsable environment value is
+// logged and ignored.
+func (f FlagSet) Bool(name string, def bool, usage string, envs ...string) *bool {
+	if env, s, ok := lookup(envs); ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			slog.Warn("Invalid environment value, using default", "env", env, "value", s, "default", def)
+		} else {
+			def = b
+		}
+	}
+	return f.fs.Bool(name, def, describe(usage, envs))
+}
+
+// Float64 defines a float64 flag. Its default is taken from the first of
+// envs that is set, falling back to def; an unparsable environment value is
+// logged and ignored.
+func (f FlagSet) Float64(name string, def float64, usage string, envs ...string) *float64 {
+	if env, s, ok := lookup(envs); ok {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			slog.Warn("Invalid environment value, using default", "env", env, "value", s, "default", def)
+		} else {
+			def = v
+		}
+	}
+	return f.fs.Float64(name, def, describe(usage, envs))
+}
+
+// Duration defines a time.Duration flag. Its default is taken from the first
+// of envs that is set, falling back to def; an unparsable environment value
+// is logged and ignored.
+func (f FlagSet) Duration(name string, def time.Duration, usage string, envs ...string) *time.Duration {
+	if env, s, ok := lookup(envs); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			slog.Warn("Invalid environment value, using default", "env", env, "value", s, "default", def)
+		} else {
+			def = d
+		}
+	}
+	return f.fs.Duration(name, def, describe(usage, envs))
+}
+
+func lookup(envs []string) (string, string, bool) {
+	for _, env := range envs {
+		if s, ok := os.LookupEnv(env); ok && s != "" {
+			return env, s, true
+		}
+	}
+	return "", "", false
+}
+
+func describe(usage string, envs []string) string {
+	if len(envs) == 0 {
+		return usage
+	}
+	return fmt.Sprintf("%s (env %s)", usage, strings.Join(envs, ", "))
+}
+
+type uint32Value uint32
+
+func (v *uint32Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return fmt.Errorf("must be an unsigned 32-bit integer")
+	}
+	*v = uint32Value(n)
+	return nil
+}
+
+func (v *uint32Value) String() string { return strconv.FormatUint(uint64(*v), 10) }
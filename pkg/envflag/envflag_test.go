@@ -0,0 +1,120 @@
+package envflag
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flags defines one flag of each kind, reading ENVFLAG_TEST_* from the
+// environment, and parses args.
+type flags struct {
+	fs       *flag.FlagSet
+	port     *uint32
+	host     *string
+	rate     *float64
+	interval *time.Duration
+	verbose  *bool
+}
+
+func parse(t *testing.T, args ...string) flags {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := On(fs)
+	v := flags{
+		fs:       fs,
+		port:     f.Uint32("port", 5000, "port", "ENVFLAG_TEST_PORT"),
+		host:     f.String("host", "localhost", "host", "ENVFLAG_TEST_HOST", "ENVFLAG_TEST_HOST_FALLBACK"),
+		rate:     f.Float64("rate", 1.5, "rate", "ENVFLAG_TEST_RATE"),
+		interval: f.Duration("interval", time.Second, "interval", "ENVFLAG_TEST_INTERVAL"),
+		verbose:  f.Bool("verbose", false, "verbose", "ENVFLAG_TEST_VERBOSE"),
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDefaults(t *testing.T) {
+	v := parse(t)
+	if *v.port != 5000 || *v.host != "localhost" || *v.rate != 1.5 || *v.interval != time.Second || *v.verbose {
+		t.Fatalf("got %d %q %g %v %v", *v.port, *v.host, *v.rate, *v.interval, *v.verbose)
+	}
+}
+
+func TestEnvironmentOverridesDefault(t *testing.T) {
+	t.Setenv("ENVFLAG_TEST_PORT", "6000")
+	t.Setenv("ENVFLAG_TEST_HOST", "kms.example")
+	t.Setenv("ENVFLAG_TEST_RATE", "2.5")
+	t.Setenv("ENVFLAG_TEST_INTERVAL", "5s")
+	t.Setenv("ENVFLAG_TEST_VERBOSE", "true")
+	v := parse(t)
+	if *v.port != 6000 || *v.host != "kms.example" || *v.rate != 2.5 || *v.interval != 5*time.Second || !*v.verbose {
+		t.Fatalf("got %d %q %g %v %v", *v.port, *v.host, *v.rate, *v.interval, *v.verbose)
+	}
+}
+
+func TestFlagOverridesEnvironment(t *testing.T) {
+	t.Setenv("ENVFLAG_TEST_PORT", "6000")
+	t.Setenv("ENVFLAG_TEST_HOST", "kms.example")
+	t.Setenv("ENVFLAG_TEST_RATE", "2.5")
+	t.Setenv("ENVFLAG_TEST_INTERVAL", "5s")
+	t.Setenv("ENVFLAG_TEST_VERBOSE", "true")
+	v := parse(t, "--port", "7000", "--host", "flag.example", "--rate", "3", "--interval", "1m", "--verbose=false")
+	if *v.port != 7000 || *v.host != "flag.example" || *v.rate != 3 || *v.interval != time.Minute || *v.verbose {
+		t.Fatalf("got %d %q %g %v %v", *v.port, *v.host, *v.rate, *v.interval, *v.verbose)
+	}
+}
+
+func TestFirstSetEnvironmentWins(t *testing.T) {
+	t.Setenv("ENVFLAG_TEST_HOST_FALLBACK", "fallback.example")
+	if v := parse(t); *v.host != "fallback.example" {
+		t.Fatalf("host = %q, want the fallback variable", *v.host)
+	}
+	t.Setenv("ENVFLAG_TEST_HOST", "kms.example")
+	if v := parse(t); *v.host != "kms.example" {
+		t.Fatalf("host = %q, want the first variable", *v.host)
+	}
+	// an empty variable counts as unset
+	t.Setenv("ENVFLAG_TEST_HOST", "")
+	if v := parse(t); *v.host != "fallback.example" {
+		t.Fatalf("host = %q with the first variable empty", *v.host)
+	}
+}
+
+func TestInvalidEnvironmentKeepsDefault(t *testing.T) {
+	t.Setenv("ENVFLAG_TEST_PORT", "-1")
+	t.Setenv("ENVFLAG_TEST_RATE", "fast")
+	t.Setenv("ENVFLAG_TEST_INTERVAL", "5")
+	t.Setenv("ENVFLAG_TEST_VERBOSE", "yes")
+	v := parse(t)
+	if *v.port != 5000 || *v.rate != 1.5 || *v.interval != time.Second || *v.verbose {
+		t.Fatalf("got %d %g %v %v", *v.port, *v.rate, *v.interval, *v.verbose)
+	}
+}
+
+func TestUint32Flag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	On(fs).Uint32("port", 5000, "port")
+	for _, bad := range []string{"-1", "4294967296", "x"} {
+		if err := fs.Parse([]string{"--port", bad}); err == nil {
+			t.Errorf("--port %s was accepted", bad)
+		}
+	}
+}
+
+func TestUsageNamesEnvironment(t *testing.T) {
+	v := parse(t)
+	if usage := v.fs.Lookup("host").Usage; !strings.HasSuffix(usage, "(env ENVFLAG_TEST_HOST, ENVFLAG_TEST_HOST_FALLBACK)") {
+		t.Fatalf("usage = %q", usage)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	On(fs).String("plain", "", "no environment")
+	if usage := fs.Lookup("plain").Usage; usage != "no environment" {
+		t.Fatalf("usage = %q", usage)
+	}
+}
@@ -0,0 +1,218 @@
+// Package ff3 implements FF3-1 format-preserving encryption (NIST SP
+// 800-38G Revision 1): it encrypts a string of numerals in some radix to
+// another string of the same length in the same radix, so a 16-digit card
+// number encrypts to 16 digits and a 9-digit SSN to 9 digits. Like any
+// deterministic scheme, equal inputs under the same key and tweak give
+// equal outputs.
+//
+// FF3-1 is only as strong as its domain is large: the standard requires
+// radix^length >= 1,000,000, and even then short inputs can be guessed
+// by trying every value through the encryption oracle. Use the tweak to
+// separate domains (for example one per field) where that matters.
+package ff3
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+// TweakSize is the length of an FF3-1 tweak in bytes (56 bits).
+const TweakSize = 7
+
+// MinRadix and MaxRadix bound the radix FF3-1 supports.
+const (
+	MinRadix = 2
+	MaxRadix = 1 << 16
+)
+
+// minDomain is the smallest radix^length FF3-1 allows.
+const minDomain = 1_000_000
+
+var (
+	// ErrRadix is returned for a radix outside MinRadix to MaxRadix.
+	ErrRadix = errors.New("ff3: radix out of range")
+	// ErrLength is returned for input shorter than MinLen or longer than
+	// MaxLen for its radix.
+	ErrLength = errors.New("ff3: input length out of range")
+	// ErrNumeral is returned for a numeral not less than the radix.
+	ErrNumeral = errors.New("ff3: numeral out of range for radix")
+	// ErrTweak is returned for a tweak that isn't TweakSize bytes.
+	ErrTweak = errors.New("ff3: tweak must be 7 bytes")
+)
+
+// Cipher is FF3-1 under one AES key.
+type Cipher struct {
+	block cipher.Block
+}
+
+// New returns FF3-1 under key, which is 16, 24 or 32 bytes (AES-128,
+// AES-192 or AES-256).
+func New(key []byte) (*Cipher, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("ff3: invalid key size %d (want 16, 24 or 32 bytes)", len(key))
+	}
+	// FF3 runs AES under the byte-reversed key
+	rev := slices.Clone(key)
+	slices.Reverse(rev)
+	defer clear(rev)
+	block, err := aes.NewCipher(rev)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{block: block}, nil
+}
+
+// MinLen returns the shortest input FF3-1 accepts in radix: at least 2
+// numerals, and enough that radix^length >= 1,000,000.
+func MinLen(radix int) int {
+	n := 1
+	for d := radix; d < minDomain; d *= radix {
+		n++
+	}
+	return max(n, 2)
+}
+
+// MaxLen returns the longest input FF3-1 accepts in radix,
+// 2*floor(log_radix(2^96)), which keeps each half within the 96 bits a
+// round encrypts.
+func MaxLen(radix int) int {
+	limit := new(big.Int).Lsh(big.NewInt(1), 96)
+	r := big.NewInt(int64(radix))
+	n := 0
+	for d := new(big.Int).Set(r); d.Cmp(limit) <= 0; d.Mul(d, r) {
+		n++
+	}
+	return 2 * n
+}
+
+// Encrypt encrypts numerals (each less than radix) under tweak and returns
+// as many numerals in the same radix.
+func (c *Cipher) Encrypt(radix int, tweak []byte, numerals []uint16) ([]uint16, error) {
+	tl, tr, err := splitTweak(tweak)
+	if err != nil {
+		return nil, err
+	}
+	return c.crypt(radix, tl, tr, numerals, true)
+}
+
+// Decrypt reverses Encrypt.
+func (c *Cipher) Decrypt(radix int, tweak []byte, numerals []uint16) ([]uint16, error) {
+	tl, tr, err := splitTweak(tweak)
+	if err != nil {
+		return nil, err
+	}
+	return c.crypt(radix, tl, tr, numerals, false)
+}
+
+// splitTweak turns a 56-bit FF3-1 tweak into the two 32-bit halves FF3's
+// rounds use: TL is the first 28 bits, TR the last 24 bits followed by
+// bits 28 to 31, each padded with four zero bits.
+func splitTweak(tweak []byte) (tl, tr [4]byte, err error) {
+	if len(tweak) != TweakSize {
+		return tl, tr, ErrTweak
+	}
+	tl = [4]byte{tweak[0], tweak[1], tweak[2], tweak[3] & 0xf0}
+	tr = [4]byte{tweak[4], tweak[5], tweak[6], tweak[3] << 4}
+	return tl, tr, nil
+}
+
+// crypt runs the eight Feistel rounds of FF3 (SP 800-38G, algorithms 9
+// and 10) with the given tweak halves.
+func (c *Cipher) crypt(radix int, tl, tr [4]byte, x []uint16, encrypt bool) ([]uint16, error) {
+	if radix < MinRadix || radix > MaxRadix {
+		return nil, fmt.Errorf("%w: %d (want %d to %d)", ErrRadix, radix, MinRadix, MaxRadix)
+	}
+	n := len(x)
+	if minLen, maxLen := MinLen(radix), MaxLen(radix); n < minLen || n > maxLen {
+		return nil, fmt.Errorf("%w: %d numerals in radix %d (want %d to %d)", ErrLength, n, radix, minLen, maxLen)
+	}
+	for _, d := range x {
+		if int(d) >= radix {
+			return nil, fmt.Errorf("%w: %d in radix %d", ErrNumeral, d, radix)
+		}
+	}
+
+	u := (n + 1) / 2
+	v := n - u
+	a, b := slices.Clone(x[:u]), slices.Clone(x[u:])
+	bigRadix := big.NewInt(int64(radix))
+	modU := new(big.Int).Exp(bigRadix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(bigRadix, big.NewInt(int64(v)), nil)
+
+	var p, s [aes.BlockSize]byte
+	y, num := new(big.Int), new(big.Int)
+	for r := 0; r < 8; r++ {
+		i := r
+		if !encrypt {
+			i = 7 - r
+		}
+		m, mod, w := u, modU, tr
+		if i%2 == 1 {
+			m, mod, w = v, modV, tl
+		}
+
+		// P = W xor [i]^4 || [NUM_radix(REV(B))]^12, where B is the half
+		// fed into the round function (A when decrypting)
+		in, out := b, a
+		if !encrypt {
+			in, out = a, b
+		}
+		copy(p[:4], w[:])
+		p[3] ^= byte(i)
+		clear(p[4:])
+		numRev(in, bigRadix, num).FillBytes(p[4:])
+
+		// S = REVB(CIPH_REVB(K)(REVB(P)))
+		slices.Reverse(p[:])
+		c.block.Encrypt(s[:], p[:])
+		slices.Reverse(s[:])
+		y.SetBytes(s[:])
+
+		// c = (NUM_radix(REV(A)) ± y) mod radix^m
+		numRev(out, bigRadix, num)
+		if encrypt {
+			num.Add(num, y)
+		} else {
+			num.Sub(num, y)
+		}
+		num.Mod(num, mod)
+		next := strRev(num, bigRadix, m)
+
+		if encrypt {
+			a, b = b, next
+		} else {
+			a, b = next, a
+		}
+	}
+	return append(a, b...), nil
+}
+
+// numRev returns NUM_radix(REV(x)) in z: x read least significant numeral
+// first.
+func numRev(x []uint16, radix, z *big.Int) *big.Int {
+	z.SetInt64(0)
+	d := new(big.Int)
+	for i := len(x) - 1; i >= 0; i-- {
+		z.Mul(z, radix)
+		z.Add(z, d.SetUint64(uint64(x[i])))
+	}
+	return z
+}
+
+// strRev returns REV(STR^m_radix(z)): the m numerals of z, least
+// significant first. z is consumed.
+func strRev(z, radix *big.Int, m int) []uint16 {
+	out := make([]uint16, m)
+	d := new(big.Int)
+	for i := range out {
+		z.DivMod(z, radix, d)
+		out[i] = uint16(d.Uint64())
+	}
+	return out
+}
@@ -0,0 +1,190 @@
+package ff3
+
+import (
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const base36 = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func numerals(s string) []uint16 {
+	out := make([]uint16, len(s))
+	for i := range s {
+		out[i] = uint16(strings.IndexByte(base36, s[i]))
+	}
+	return out
+}
+
+func str(x []uint16) string {
+	var b strings.Builder
+	for _, d := range x {
+		b.WriteByte(base36[d])
+	}
+	return b.String()
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// NIST's FF3 samples, with their original 64-bit tweaks; FF3-1 differs
+// only in how its 56-bit tweak is split into the same two halves.
+func TestFF3Samples(t *testing.T) {
+	tests := []struct {
+		key, tweak string
+		radix      int
+		pt, ct     string
+	}{
+		{"ef4359d8d580aa4f7f036d6f04fc6a94", "d8e7920afa330a73", 10, "890121234567890000", "750918814058654607"},
+		{"ef4359d8d580aa4f7f036d6f04fc6a94", "9a768a92f60e12d8", 10, "890121234567890000", "018989839189395384"},
+		{"ef4359d8d580aa4f7f036d6f04fc6a94", "d8e7920afa330a73", 10, "89012123456789000000789000000", "48598367162252569629397416226"},
+		{"ef4359d8d580aa4f7f036d6f04fc6a94", "0000000000000000", 10, "89012123456789000000789000000", "34695224821734535122613701434"},
+		{"ef4359d8d580aa4f7f036d6f04fc6a94", "9a768a92f60e12d8", 26, "0123456789abcdefghi", "g2pk40i992fn20cjakb"},
+	}
+	for _, tt := range tests {
+		c, err := New(unhex(tt.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tweak := unhex(tt.tweak)
+		tl, tr := [4]byte(tweak[:4]), [4]byte(tweak[4:])
+		ct, err := c.crypt(tt.radix, tl, tr, numerals(tt.pt), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str(ct) != tt.ct {
+			t.Errorf("encrypt %s = %s, want %s", tt.pt, str(ct), tt.ct)
+		}
+		pt, err := c.crypt(tt.radix, tl, tr, ct, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str(pt) != tt.pt {
+			t.Errorf("decrypt %s = %s, want %s", tt.ct, str(pt), tt.pt)
+		}
+	}
+}
+
+// The FF3-1 example from the mysto/python-fpe reference implementation.
+func TestFF31Vector(t *testing.T) {
+	c, err := New(unhex("2de79d232df5585d68ce47882ae256d6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tweak := unhex("cbd09280979564")
+	ct, err := c.Encrypt(10, tweak, numerals("3992520240"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str(ct) != "8901801106" {
+		t.Fatalf("encrypt = %s, want 8901801106", str(ct))
+	}
+	pt, err := c.Decrypt(10, tweak, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str(pt) != "3992520240" {
+		t.Fatalf("decrypt = %s", str(pt))
+	}
+}
+
+func TestSplitTweak(t *testing.T) {
+	tl, tr, err := splitTweak(unhex("d8e7920afa330a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tl != [4]byte{0xd8, 0xe7, 0x92, 0x00} || tr != [4]byte{0xfa, 0x33, 0x0a, 0xa0} {
+		t.Fatalf("splitTweak = %x, %x", tl, tr)
+	}
+	if _, _, err := splitTweak(make([]byte, 8)); !errors.Is(err, ErrTweak) {
+		t.Fatalf("8-byte tweak: err = %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	c, err := New(unhex("2de79d232df5585d68ce47882ae256d6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tweak := unhex("cbd09280979564")
+	for _, radix := range []int{2, 10, 26, 36, 1 << 16} {
+		for _, n := range []int{MinLen(radix), MinLen(radix) + 1, MaxLen(radix)} {
+			pt := make([]uint16, n)
+			for i := range pt {
+				pt[i] = uint16((i*7 + 3) % radix)
+			}
+			ct, err := c.Encrypt(radix, tweak, pt)
+			if err != nil {
+				t.Fatalf("radix %d, length %d: %v", radix, n, err)
+			}
+			if len(ct) != n || slices.Equal(ct, pt) {
+				t.Fatalf("radix %d, length %d: ciphertext %v", radix, n, ct)
+			}
+			got, err := c.Decrypt(radix, tweak, ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, pt) {
+				t.Fatalf("radix %d, length %d: round trip %v, want %v", radix, n, got, pt)
+			}
+		}
+	}
+}
+
+func TestTweakChangesCiphertext(t *testing.T) {
+	c, _ := New(make([]byte, 32))
+	pt := numerals("4111111111111111")
+	a, _ := c.Encrypt(10, make([]byte, TweakSize), pt)
+	b, _ := c.Encrypt(10, []byte{0, 0, 0, 0, 0, 0, 1}, pt)
+	if slices.Equal(a, b) {
+		t.Fatal("different tweaks gave the same ciphertext")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct{ radix, min, max int }{
+		{2, 20, 192},
+		{10, 6, 56},
+		{26, 5, 40},
+		{36, 4, 36},
+		{1 << 16, 2, 12},
+	}
+	for _, tt := range tests {
+		if got := MinLen(tt.radix); got != tt.min {
+			t.Errorf("MinLen(%d) = %d, want %d", tt.radix, got, tt.min)
+		}
+		if got := MaxLen(tt.radix); got != tt.max {
+			t.Errorf("MaxLen(%d) = %d, want %d", tt.radix, got, tt.max)
+		}
+	}
+}
+
+func TestValidation(t *testing.T) {
+	c, _ := New(make([]byte, 16))
+	tweak := make([]byte, TweakSize)
+	if _, err := c.Encrypt(10, tweak, numerals("12345")); !errors.Is(err, ErrLength) {
+		t.Errorf("too short: err = %v", err)
+	}
+	if _, err := c.Encrypt(10, tweak, make([]uint16, 57)); !errors.Is(err, ErrLength) {
+		t.Errorf("too long: err = %v", err)
+	}
+	if _, err := c.Encrypt(1, tweak, make([]uint16, 30)); !errors.Is(err, ErrRadix) {
+		t.Errorf("radix 1: err = %v", err)
+	}
+	if _, err := c.Encrypt(10, tweak, numerals("12345a")); !errors.Is(err, ErrNumeral) {
+		t.Errorf("numeral 10 in radix 10: err = %v", err)
+	}
+	if _, err := c.Encrypt(10, tweak[:6], numerals("123456")); !errors.Is(err, ErrTweak) {
+		t.Errorf("short tweak: err = %v", err)
+	}
+	if _, err := New(make([]byte, 20)); err == nil {
+		t.Error("New accepted a 20-byte key")
+	}
+}
@@ -0,0 +1,96 @@
+// Package framing implements the length-prefixed message format shared by
+// the connector, enclave and vsock-proxy. Every message is sent as a 4-byte
+// big-endian length followed by exactly that many payload bytes, so
+// payloads of any size survive short reads on the stream socket.
+package framing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// HeaderSize is the length of the big-endian length prefix.
+const HeaderSize = 4
+
+// MaxFrameSize bounds a single frame so a corrupt or hostile length prefix
+// can't make the reader allocate unbounded memory.
+const MaxFrameSize = 64 << 20 // 64 MiB
+
+// SmallFrameSize is the largest payload sent on the fast path: header and
+// payload are copied into one pooled buffer and sent with a single write.
+// Most requests (short strings, CiphertextBlobs) fit.
+const SmallFrameSize = 1024
+
+// framePool holds scratch buffers for small frames and frame headers.
+// Buffers are pointers to arrays so Get and Put don't allocate.
+var framePool = sync.Pool{
+	New: func() interface{} { return new([HeaderSize + SmallFrameSize]byte) },
+}
+
+// WriteFrame writes data as a single length-prefixed frame.
+func WriteFrame(w io.Writer, data []byte) error {
+	if len(data) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds maximum of %d bytes", len(data), MaxFrameSize)
+	}
+	buf := framePool.Get().(*[HeaderSize + SmallFrameSize]byte)
+	defer framePool.Put(buf)
+	binary.BigEndian.PutUint32(buf[:HeaderSize], uint32(len(data)))
+
+	// Fast path: one write, no allocation
+	if len(data) <= SmallFrameSize {
+		n := copy(buf[HeaderSize:], data)
+		if _, err := w.Write(buf[:HeaderSize+n]); err != nil {
+			return fmt.Errorf("failed to write frame: %w", err)
+		}
+		return nil
+	}
+
+	// Larger frames: header and payload in one writev where the connection
+	// supports it, without copying the payload
+	var err error
+	bufs := net.Buffers{buf[:HeaderSize], data}
+	if vw, ok := w.(vectoredWriter); ok {
+		_, err = vw.WriteBuffers(bufs)
+	} else {
+		// writev on TCP and Unix sockets, one write per buffer otherwise
+		_, err = bufs.WriteTo(w)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	return nil
+}
+
+// vectoredWriter is implemented by connections that can send several
+// buffers with a single writev(2), such as *vsock.Conn.
+type vectoredWriter interface {
+	WriteBuffers(bufs [][]byte) (int64, error)
+}
+
+// ReadFrame reads one length-prefixed frame and returns its payload. It
+// returns io.EOF if the peer closed the connection before sending a header.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	// The header goes through a pooled buffer so the only allocation is
+	// the returned payload
+	buf := framePool.Get().(*[HeaderSize + SmallFrameSize]byte)
+	_, err := io.ReadFull(r, buf[:HeaderSize])
+	size := binary.BigEndian.Uint32(buf[:HeaderSize])
+	framePool.Put(buf)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read frame header: %w", err)
+	}
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds maximum of %d bytes", size, MaxFrameSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed to read frame payload (%d bytes): %w", size, err)
+	}
+	return data, nil
+}
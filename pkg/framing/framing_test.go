@@ -0,0 +1,190 @@
+package framing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// countingWriter counts Write and WriteBuffers calls so benchmarks can
+// report the syscalls a vsock connection would make.
+type countingWriter struct{ writes int }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func (w *countingWriter) WriteBuffers(bufs [][]byte) (int64, error) {
+	w.writes++
+	var n int64
+	for _, b := range bufs {
+		n += int64(len(b))
+	}
+	return n, nil
+}
+
+func benchmarkWriteFrame(b *testing.B, size int) {
+	data := bytes.Repeat([]byte("a"), size)
+	w := &countingWriter{}
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		if err := WriteFrame(w, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWriteFrame32(b *testing.B)  { benchmarkWriteFrame(b, 32) }
+func BenchmarkWriteFrame1K(b *testing.B)  { benchmarkWriteFrame(b, 1024) }
+func BenchmarkWriteFrame64K(b *testing.B) { benchmarkWriteFrame(b, 64<<10) }
+
+func benchmarkReadFrame(b *testing.B, size int) {
+	var frame bytes.Buffer
+	WriteFrame(&frame, bytes.Repeat([]byte("a"), size))
+	r := bytes.NewReader(frame.Bytes())
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		r.Seek(0, io.SeekStart)
+		if _, err := ReadFrame(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadFrame32(b *testing.B)  { benchmarkReadFrame(b, 32) }
+func BenchmarkReadFrame1K(b *testing.B)  { benchmarkReadFrame(b, 1024) }
+func BenchmarkReadFrame64K(b *testing.B) { benchmarkReadFrame(b, 64<<10) }
+
+func TestRoundTripAroundFastPathBoundary(t *testing.T) {
+	for _, size := range []int{0, 1, SmallFrameSize - 1, SmallFrameSize, SmallFrameSize + 1, 64 << 10} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		var buf bytes.Buffer
+		if err := WriteFrame(&buf, data); err != nil {
+			t.Fatalf("size %d: WriteFrame: %v", size, err)
+		}
+		if buf.Len() != HeaderSize+size {
+			t.Fatalf("size %d: wrote %d bytes, want %d", size, buf.Len(), HeaderSize+size)
+		}
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("size %d: ReadFrame: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: payload mismatch", size)
+		}
+	}
+}
+
+func TestSmallFrameIsOneWrite(t *testing.T) {
+	w := &countingWriter{}
+	if err := WriteFrame(w, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 1 {
+		t.Fatalf("small frame took %d writes, want 1", w.writes)
+	}
+}
+
+func TestSmallFrameAllocations(t *testing.T) {
+	data := []byte("hello world")
+	allocs := testing.AllocsPerRun(100, func() {
+		WriteFrame(io.Discard, data)
+	})
+	if allocs != 0 {
+		t.Fatalf("WriteFrame allocated %.0f times per small frame, want 0", allocs)
+	}
+}
+
+func TestLargeFrameIsOneVectoredWrite(t *testing.T) {
+	w := &countingWriter{}
+	if err := WriteFrame(w, make([]byte, SmallFrameSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 1 {
+		t.Fatalf("large frame took %d writes, want 1", w.writes)
+	}
+}
+
+func TestLargeFrameOverTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback TCP: %v", err)
+	}
+	defer l.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 100<<10)
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		errc <- WriteFrame(conn, data)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, err := ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("payload mismatch")
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	var frame bytes.Buffer
+	WriteFrame(&frame, []byte("hello"))
+	whole := frame.Bytes()
+
+	tests := []struct {
+		name    string
+		input   []byte
+		wantEOF bool
+		wantErr error
+	}{
+		{"closed before a header", nil, true, nil},
+		{"truncated header", whole[:2], false, io.ErrUnexpectedEOF},
+		{"truncated payload", whole[:len(whole)-1], false, io.ErrUnexpectedEOF},
+		{"oversized", []byte{0xff, 0xff, 0xff, 0xff}, false, nil},
+	}
+	for _, tt := range tests {
+		_, err := ReadFrame(bytes.NewReader(tt.input))
+		switch {
+		case err == nil:
+			t.Errorf("%s: no error", tt.name)
+		case tt.wantEOF != (err == io.EOF):
+			t.Errorf("%s: err = %v, want io.EOF only for a clean close", tt.name, err)
+		case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	w := &countingWriter{}
+	if err := WriteFrame(w, make([]byte, MaxFrameSize+1)); err == nil {
+		t.Fatal("oversized frame written")
+	}
+	if w.writes != 0 {
+		t.Fatalf("%d writes for a rejected frame", w.writes)
+	}
+}
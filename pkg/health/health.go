@@ -0,0 +1,141 @@
+// Package health serves the liveness and readiness probes that
+// orchestrators such as docker-compose and Kubernetes poll:
+//
+//	GET /healthz  200 while the process is serving at all
+//	GET /readyz   200 when every readiness check passes, 503 otherwise
+//
+// /readyz answers with the result of each check as JSON. Checks run
+// concurrently under a timeout, and a result is reused for CacheFor so
+// frequent probes don't turn into a stream of KMS calls.
+//
+//	h := health.New(health.Check{Name: "kms", Run: probeKMS})
+//	go h.Serve(listener)
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check is one readiness condition. Run returns nil when it holds.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Report is the /readyz response body.
+type Report struct {
+	Ready bool `json:"ready"`
+	// Checks has "ok" or the error for each check.
+	Checks map[string]string `json:"checks"`
+}
+
+// Server answers the probes.
+type Server struct {
+	// Timeout bounds each check; a check that takes longer fails.
+	Timeout time.Duration
+	// CacheFor is how long a readiness report is reused.
+	CacheFor time.Duration
+
+	checks []Check
+
+	mu       sync.Mutex
+	last     *Report
+	lastTime time.Time
+}
+
+// New returns a server for checks, with a 3s Timeout and a 2s CacheFor.
+func New(checks ...Check) *Server {
+	return &Server{Timeout: 3 * time.Second, CacheFor: 2 * time.Second, checks: checks}
+}
+
+// Ready runs the checks, or returns the cached report if it is recent
+// enough. Changes in readiness are logged.
+func (s *Server) Ready(ctx context.Context) *Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != nil && time.Since(s.lastTime) < s.CacheFor {
+		return s.last
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	report := &Report{Ready: true, Checks: make(map[string]string, len(s.checks))}
+	// A check that ignores ctx is left behind rather than holding up
+	// the probe
+	type result struct {
+		i   int
+		err error
+	}
+	done := make(chan result, len(s.checks))
+	for i, c := range s.checks {
+		go func() { done <- result{i, c.Run(ctx)} }()
+	}
+	results := make([]error, len(s.checks))
+	answered := make([]bool, len(s.checks))
+wait:
+	for range s.checks {
+		select {
+		case r := <-done:
+			results[r.i], answered[r.i] = r.err, true
+		case <-ctx.Done():
+			for i := range results {
+				if !answered[i] {
+					results[i] = fmt.Errorf("no answer within %v", s.Timeout)
+				}
+			}
+			break wait
+		}
+	}
+	var failing []string
+	for i, c := range s.checks {
+		if err := results[i]; err != nil {
+			report.Ready = false
+			report.Checks[c.Name] = err.Error()
+			failing = append(failing, c.Name)
+			continue
+		}
+		report.Checks[c.Name] = "ok"
+	}
+
+	switch {
+	case report.Ready && (s.last == nil || !s.last.Ready):
+		slog.Info("Ready")
+	case !report.Ready && (s.last == nil || s.last.Ready):
+		slog.Warn("Not ready", "failing", strings.Join(failing, ","))
+	}
+	s.last, s.lastTime = report, time.Now()
+	return report
+}
+
+// Handler returns the handler for /healthz and /readyz.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := s.Ready(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+	return mux
+}
+
+// Serve answers probes on l until l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	srv := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	return srv.Serve(l)
+}
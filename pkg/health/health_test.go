@@ -0,0 +1,87 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbes(t *testing.T) {
+	var calls atomic.Int32
+	var kmsDown atomic.Bool
+	kmsDown.Store(true)
+	s := New(
+		Check{Name: "serving", Run: func(ctx context.Context) error { return nil }},
+		Check{Name: "kms", Run: func(ctx context.Context) error {
+			calls.Add(1)
+			if kmsDown.Load() {
+				return errors.New("KMS ListKeys failed: connection refused")
+			}
+			return nil
+		}},
+	)
+	s.CacheFor = time.Hour
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	get := func(path string) (int, *Report) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r Report
+		json.NewDecoder(resp.Body).Decode(&r)
+		return resp.StatusCode, &r
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz: %d", code)
+	}
+	code, r := get("/readyz")
+	if code != http.StatusServiceUnavailable || r.Ready || r.Checks["kms"] != "KMS ListKeys failed: connection refused" || r.Checks["serving"] != "ok" {
+		t.Fatalf("/readyz: %d %+v", code, r)
+	}
+
+	// The report is cached, so KMS recovering shows only once it expires
+	kmsDown.Store(false)
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Fatalf("cached /readyz: %d after %d checks", code, calls.Load())
+	}
+	s.mu.Lock()
+	s.lastTime = time.Time{}
+	s.mu.Unlock()
+	if code, r := get("/readyz"); code != http.StatusOK || !r.Ready {
+		t.Fatalf("/readyz after recovery: %d %+v", code, r)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	s := New(
+		Check{Name: "slow", Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		Check{Name: "stuck", Run: func(ctx context.Context) error {
+			<-block
+			return nil
+		}},
+	)
+	s.Timeout = 10 * time.Millisecond
+	start := time.Now()
+	r := s.Ready(context.Background())
+	if r.Ready || r.Checks["slow"] == "ok" || r.Checks["stuck"] != "no answer within 10ms" {
+		t.Fatalf("got %+v", r)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("a stuck check held up the probe for %v", time.Since(start))
+	}
+}
@@ -0,0 +1,205 @@
+// Package jsonpath evaluates a subset of JSONPath against JSON documents
+// decoded into interface{} values (maps, slices, strings, json.Number and
+// so on), and replaces the values it matches. It is what field-level
+// encryption uses to pick the fields of a document to encrypt:
+//
+//	$.ssn
+//	$.card.number
+//	$.customers[*].email
+//	$['billing address'].street
+//	$.items[0].price
+//
+// A path starts at the root "$" and is followed by steps: ".name" or
+// "['name']" selects an object member, "[n]" an array element (negative n
+// counts from the end), and ".*" or "[*]" every member or element.
+// Recursive descent (".."), filters and slices are not supported.
+package jsonpath
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Path is a parsed JSONPath.
+type Path struct {
+	raw   string
+	steps []step
+}
+
+type stepKind int
+
+const (
+	stepName stepKind = iota
+	stepIndex
+	stepWildcard
+)
+
+type step struct {
+	kind  stepKind
+	name  string
+	index int
+}
+
+// Parse parses a JSONPath such as $.customers[*].email.
+func Parse(s string) (*Path, error) {
+	raw := strings.TrimSpace(s)
+	if !strings.HasPrefix(raw, "$") {
+		return nil, fmt.Errorf("path %q must start with $", s)
+	}
+	p := &Path{raw: raw}
+	rest := raw[1:]
+	for rest != "" {
+		var (
+			st  step
+			err error
+		)
+		switch rest[0] {
+		case '.':
+			st, rest, err = parseDot(rest[1:])
+		case '[':
+			st, rest, err = parseBracket(rest[1:])
+		default:
+			err = fmt.Errorf("unexpected %q", rest[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: %v", s, err)
+		}
+		p.steps = append(p.steps, st)
+	}
+	return p, nil
+}
+
+// parseDot parses the step after a '.', returning the unparsed rest.
+func parseDot(s string) (step, string, error) {
+	if strings.HasPrefix(s, ".") {
+		return step{}, "", fmt.Errorf("recursive descent (..) is not supported")
+	}
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		end = len(s)
+	}
+	name := s[:end]
+	switch {
+	case name == "":
+		return step{}, "", fmt.Errorf("empty member name")
+	case name == "*":
+		return step{kind: stepWildcard}, s[end:], nil
+	}
+	return step{kind: stepName, name: name}, s[end:], nil
+}
+
+// parseBracket parses the step after a '[', returning the unparsed rest.
+func parseBracket(s string) (step, string, error) {
+	if s != "" && (s[0] == '\'' || s[0] == '"') {
+		quote := s[0]
+		var name strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '\\' && i+1 < len(s):
+				i++
+				name.WriteByte(s[i])
+			case c == quote:
+				if !strings.HasPrefix(s[i+1:], "]") {
+					return step{}, "", fmt.Errorf("expected ] after quoted name")
+				}
+				return step{kind: stepName, name: name.String()}, s[i+2:], nil
+			default:
+				name.WriteByte(c)
+			}
+		}
+		return step{}, "", fmt.Errorf("unterminated quoted name")
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return step{}, "", fmt.Errorf("missing ]")
+	}
+	inner := strings.TrimSpace(s[:end])
+	if inner == "*" {
+		return step{kind: stepWildcard}, s[end+1:], nil
+	}
+	n, err := strconv.Atoi(inner)
+	if err != nil {
+		return step{}, "", fmt.Errorf("unsupported selector [%s] (expected a quoted name, an index or *)", inner)
+	}
+	return step{kind: stepIndex, index: n}, s[end+1:], nil
+}
+
+func (p *Path) String() string { return p.raw }
+
+// Replace calls fn with every value p matches in doc and puts fn's result
+// in its place, modifying doc's maps and slices. It returns the document,
+// which is only a different value when p is "$" itself, and the number of
+// values replaced. Members and elements that don't exist are not matches:
+// a path to an optional field matches nothing in documents without it.
+// Object members matched by a wildcard are visited in key order.
+func (p *Path) Replace(doc interface{}, fn func(v interface{}) (interface{}, error)) (interface{}, int, error) {
+	return replace(doc, p.steps, fn)
+}
+
+func replace(v interface{}, steps []step, fn func(interface{}) (interface{}, error)) (interface{}, int, error) {
+	if len(steps) == 0 {
+		nv, err := fn(v)
+		if err != nil {
+			return v, 0, err
+		}
+		return nv, 1, nil
+	}
+	st, rest := steps[0], steps[1:]
+
+	switch node := v.(type) {
+	case map[string]interface{}:
+		var keys []string
+		switch st.kind {
+		case stepName:
+			if _, ok := node[st.name]; ok {
+				keys = []string{st.name}
+			}
+		case stepWildcard:
+			for k := range node {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+		}
+		total := 0
+		for _, k := range keys {
+			nv, n, err := replace(node[k], rest, fn)
+			total += n
+			if err != nil {
+				return v, total, err
+			}
+			node[k] = nv
+		}
+		return v, total, nil
+
+	case []interface{}:
+		var indexes []int
+		switch st.kind {
+		case stepIndex:
+			i := st.index
+			if i < 0 {
+				i += len(node)
+			}
+			if i >= 0 && i < len(node) {
+				indexes = []int{i}
+			}
+		case stepWildcard:
+			for i := range node {
+				indexes = append(indexes, i)
+			}
+		}
+		total := 0
+		for _, i := range indexes {
+			nv, n, err := replace(node[i], rest, fn)
+			total += n
+			if err != nil {
+				return v, total, err
+			}
+			node[i] = nv
+		}
+		return v, total, nil
+	}
+	return v, 0, nil
+}
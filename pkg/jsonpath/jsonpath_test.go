@@ -0,0 +1,105 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const doc = `{
+	"name": "Ada",
+	"ssn": "123-45-6789",
+	"card": {"number": "4111111111111111", "expiry": "12/30"},
+	"billing address": {"street": "1 Main St"},
+	"customers": [
+		{"email": "a@example.com", "age": 36},
+		{"email": "b@example.com"},
+		{"name": "no email"}
+	]
+}`
+
+// mark replaces every match of path in doc with "X" and returns the
+// document re-encoded, along with the number of matches.
+func mark(t *testing.T, path string) (string, int) {
+	t.Helper()
+	p, err := Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+	v, n, err := p.Replace(v, func(interface{}) (interface{}, error) { return "X", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(v)
+	return string(out), n
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		path string
+		n    int
+		want []string // substrings of the result
+	}{
+		{"$.ssn", 1, []string{`"ssn":"X"`, `"name":"Ada"`}},
+		{"$.card.number", 1, []string{`"number":"X"`, `"expiry":"12/30"`}},
+		{"$['billing address'].street", 1, []string{`"street":"X"`}},
+		{`$["card"]["expiry"]`, 1, []string{`"expiry":"X"`}},
+		{"$.customers[*].email", 2, []string{`{"age":36,"email":"X"}`, `{"email":"X"}`, `{"name":"no email"}`}},
+		{"$.customers[-1].name", 1, []string{`{"name":"X"}`}},
+		{"$.customers[0]", 1, []string{`"customers":["X",`}},
+		{"$.card.*", 2, []string{`"card":{"expiry":"X","number":"X"}`}},
+		{"$.missing", 0, []string{`"ssn":"123-45-6789"`}},
+		{"$.customers[7].email", 0, nil},
+		{"$.ssn.deeper", 0, nil},
+		{"$", 1, []string{`"X"`}},
+	}
+	for _, tt := range tests {
+		out, n := mark(t, tt.path)
+		if n != tt.n {
+			t.Errorf("%s: %d matches, want %d", tt.path, n, tt.n)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(out, w) {
+				t.Errorf("%s: result %s does not contain %s", tt.path, out, w)
+			}
+		}
+	}
+}
+
+func TestReplaceError(t *testing.T) {
+	p, _ := Parse("$.customers[*].email")
+	var v interface{}
+	json.Unmarshal([]byte(doc), &v)
+	boom := errors.New("boom")
+	calls := 0
+	_, _, err := p.Replace(v, func(interface{}) (interface{}, error) {
+		calls++
+		return nil, boom
+	})
+	if !errors.Is(err, boom) || calls != 1 {
+		t.Fatalf("err = %v after %d calls, want boom after 1", err, calls)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, path := range []string{
+		"ssn",
+		"$..ssn",
+		"$.",
+		"$.a[",
+		"$.a[1:2]",
+		"$.a[?(@.x)]",
+		"$['unterminated]",
+		"$['a'x",
+		"$x",
+	} {
+		if _, err := Parse(path); err == nil {
+			t.Errorf("Parse(%q) succeeded", path)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package kmsclient is the enclave-side API for KMS operations that go
+// through the vsock-proxy, in the spirit of the kmstool library real
+// enclaves use. It sends protocol requests over any RoundTripper (the
+// enclave's pooled vsock connections) and returns plain Go values.
+package kmsclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// RoundTripper sends a request to the vsock-proxy and returns its
+// response. The error is for transport failures only; an error response
+// is returned as a Response.
+type RoundTripper interface {
+	RoundTrip(ctx context.Context, req *protocol.Request) (*protocol.Response, error)
+}
+
+// RoundTripFunc adapts a function to a RoundTripper.
+type RoundTripFunc func(ctx context.Context, req *protocol.Request) (*protocol.Response, error)
+
+func (f RoundTripFunc) RoundTrip(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	return f(ctx, req)
+}
+
+// Client performs KMS operations through a RoundTripper.
+type Client struct {
+	rt RoundTripper
+}
+
+// New returns a Client that sends requests over rt.
+func New(rt RoundTripper) *Client {
+	return &Client{rt: rt}
+}
+
+// defaultClient is used by the package-level functions.
+var defaultClient *Client
+
+// SetDefault sets the Client used by the package-level functions.
+func SetDefault(c *Client) {
+	defaultClient = c
+}
+
+// GenerateRandom returns n random bytes from KMS using the default
+// Client. It panics if SetDefault hasn't been called.
+func GenerateRandom(ctx context.Context, n int) ([]byte, error) {
+	return mustDefault().GenerateRandom(ctx, n)
+}
+
+// Reader returns the default Client's Reader.
+func Reader(timeout time.Duration) io.Reader {
+	return mustDefault().Reader(timeout)
+}
+
+func mustDefault() *Client {
+	if defaultClient == nil {
+		panic("kmsclient: no default Client, call SetDefault first")
+	}
+	return defaultClient
+}
+
+// GenerateRandom returns n random bytes from KMS GenerateRandom. n must be
+// between 1 and protocol.MaxRandomBytes; use Reader for more.
+func (c *Client) GenerateRandom(ctx context.Context, n int) ([]byte, error) {
+	if n < 1 || n > protocol.MaxRandomBytes {
+		return nil, fmt.Errorf("kmsclient: GenerateRandom of %d bytes, must be 1 to %d", n, protocol.MaxRandomBytes)
+	}
+	// Tagged with the request being served, if any
+	id := protocol.RequestID(ctx)
+	if id == "" {
+		id = protocol.NewRequestID()
+	}
+	resp, err := c.roundTrip(ctx, &protocol.Request{
+		Operation:     protocol.OpGenerateRandom,
+		RequestId:     id,
+		NumberOfBytes: n,
+	})
+	if err != nil {
+		return nil, err
+	}
+	random := resp.Result.Bytes()
+	if len(random) != n {
+		return nil, fmt.Errorf("kmsclient: GenerateRandom returned %d bytes, asked for %d", len(random), n)
+	}
+	return random, nil
+}
+
+// roundTrip sends req with the time left before ctx's deadline as its
+// timeout and returns the successful response, or the error it carries.
+func (c *Client) roundTrip(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		req.TimeoutMs = max(1, time.Until(deadline).Milliseconds())
+	}
+	resp, err := c.rt.RoundTrip(ctx, req)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeUpstream, "vsock-proxy request failed: %v", err)
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Reader returns an io.Reader of KMS random bytes, for use as an entropy
+// source. Each Read makes as many GenerateRandom calls as it needs, each
+// bounded by timeout.
+func (c *Client) Reader(timeout time.Duration) io.Reader {
+	return &randomReader{c: c, timeout: timeout}
+}
+
+type randomReader struct {
+	c       *Client
+	timeout time.Duration
+}
+
+func (r *randomReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		random, err := r.c.GenerateRandom(ctx, min(len(p)-n, protocol.MaxRandomBytes))
+		cancel()
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], random)
+	}
+	return n, nil
+}
@@ -0,0 +1,92 @@
+package kmsclient
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"nitro-dev-qemu/pkg/protocol"
+)
+
+// fakeProxy answers GenerateRandom like the vsock-proxy and records the
+// requested sizes.
+type fakeProxy struct {
+	sizes []int
+	fail  error
+}
+
+func (f *fakeProxy) RoundTrip(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	if req.Operation != protocol.OpGenerateRandom {
+		return protocol.Failed(req, protocol.Errorf(protocol.CodeUnsupportedOperation, "unexpected %s", req.Operation)), nil
+	}
+	f.sizes = append(f.sizes, req.NumberOfBytes)
+	if f.fail != nil {
+		return protocol.Failed(req, f.fail), nil
+	}
+	random := make([]byte, req.NumberOfBytes)
+	rand.Read(random)
+	return protocol.OK(req, random), nil
+}
+
+func TestGenerateRandom(t *testing.T) {
+	c := New(&fakeProxy{})
+	random, err := c.GenerateRandom(context.Background(), 32)
+	if err != nil || len(random) != 32 {
+		t.Fatalf("GenerateRandom(32) = %d bytes, %v", len(random), err)
+	}
+	for _, n := range []int{0, protocol.MaxRandomBytes + 1} {
+		if _, err := c.GenerateRandom(context.Background(), n); err == nil {
+			t.Errorf("GenerateRandom(%d) succeeded", n)
+		}
+	}
+}
+
+func TestGenerateRandomSendsRemainingBudget(t *testing.T) {
+	var timeout int64
+	c := New(RoundTripFunc(func(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+		timeout = req.TimeoutMs
+		return protocol.OK(req, make([]byte, req.NumberOfBytes)), nil
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	c.GenerateRandom(ctx, 16)
+	if timeout <= 1000 || timeout > 2000 {
+		t.Fatalf("sent timeout_ms %d, want about 2000", timeout)
+	}
+}
+
+func TestGenerateRandomError(t *testing.T) {
+	c := New(&fakeProxy{fail: protocol.Errorf(protocol.CodeBusy, "rate limited")})
+	_, err := c.GenerateRandom(context.Background(), 16)
+	var perr *protocol.Error
+	if !errors.As(err, &perr) || perr.Code != protocol.CodeBusy || !perr.Retryable {
+		t.Fatalf("got %v, want a retryable busy error", err)
+	}
+
+	transport := New(RoundTripFunc(func(context.Context, *protocol.Request) (*protocol.Response, error) {
+		return nil, io.ErrUnexpectedEOF
+	}))
+	if _, err := transport.GenerateRandom(context.Background(), 16); !errors.As(err, &perr) || perr.Code != protocol.CodeUpstream {
+		t.Fatalf("got %v, want an upstream error", err)
+	}
+}
+
+func TestReaderSplitsLargeReads(t *testing.T) {
+	proxy := &fakeProxy{}
+	buf := make([]byte, 2*protocol.MaxRandomBytes+10)
+	if _, err := io.ReadFull(New(proxy).Reader(time.Second), buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []int{protocol.MaxRandomBytes, protocol.MaxRandomBytes, 10}
+	if len(proxy.sizes) != len(want) {
+		t.Fatalf("requested sizes %v, want %v", proxy.sizes, want)
+	}
+	for i := range want {
+		if proxy.sizes[i] != want[i] {
+			t.Fatalf("requested sizes %v, want %v", proxy.sizes, want)
+		}
+	}
+}
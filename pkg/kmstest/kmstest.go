@@ -0,0 +1,363 @@
+// Package kmstest is a fake AWS KMS for tests and cmd/allinone. It speaks
+// the KMS JSON protocol (POST with an X-Amz-Target header) for Encrypt,
+// Decrypt, GenerateDataKey, GenerateRandom, ListKeys and ListAliases,
+// which is enough to run the vsock-proxy against it without LocalStack.
+//
+// Keys are deterministic: each key's material is derived from its key ID,
+// so a CiphertextBlob made by one Server decrypts on any other with the
+// same keys. The encryption itself is real (AES-256-GCM), and a blob
+// names the key that made it, as with KMS. Requests are not
+// authenticated; signed and unsigned requests are treated alike.
+package kmstest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Region and Account appear in the key ARNs the Server reports.
+const (
+	Region  = "us-east-1"
+	Account = "000000000000"
+)
+
+// Server is a fake KMS endpoint; use its URL as the vsock-proxy's
+// --kms-target.
+type Server struct {
+	*httptest.Server
+
+	// aliases maps alias names to key IDs.
+	aliases map[string]string
+
+	mu    sync.Mutex
+	calls map[string]int
+	// stall delays every call, and calls fail until brownoutEnd (see
+	// Stall and Brownout)
+	stall       time.Duration
+	brownoutEnd time.Time
+}
+
+// NewServer starts a fake KMS with one key per alias, such as
+// "alias/dev-key". Close it when done.
+func NewServer(aliases ...string) *Server {
+	s := &Server{aliases: map[string]string{}, calls: map[string]int{}}
+	for _, alias := range aliases {
+		sum := sha256.Sum256([]byte(alias))
+		id := fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+		s.aliases[alias] = id
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// KeyARN returns the ARN of the key an alias points to.
+func (s *Server) KeyARN(alias string) string {
+	return arn(s.aliases[alias])
+}
+
+// Encrypt returns the CiphertextBlob of plaintext under the key an alias
+// points to, as KMS Encrypt would. Use it to make wrapped keys for flags
+// such as the enclave's --deterministic-key.
+func (s *Server) Encrypt(alias string, plaintext []byte) string {
+	return seal(s.aliases[alias], plaintext)
+}
+
+// Calls returns how many times action has been called.
+func (s *Server) Calls(action string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[action]
+}
+
+// Stall delays the answer to every call by d, as a slow KMS would, until
+// Stall(0). Use it to keep a request in flight.
+func (s *Server) Stall(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stall = d
+}
+
+// Brownout fails every call for d from now with HTTP 500
+// KMSInternalException, as KMS does during a brownout. Calls succeed
+// again once d has passed.
+func (s *Server) Brownout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.brownoutEnd = time.Now().Add(d)
+}
+
+func arn(keyID string) string {
+	return fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", Region, Account, keyID)
+}
+
+// kmsError is a KMS error response: HTTP 400 with the exception type.
+type kmsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *kmsError) Error() string { return e.Type + ": " + e.Message }
+
+func notFound(format string, args ...interface{}) *kmsError {
+	return &kmsError{Type: "NotFoundException", Message: fmt.Sprintf(format, args...)}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	action, ok := strings.CutPrefix(r.Header.Get("X-Amz-Target"), "TrentService.")
+	if r.Method != http.MethodPost || !ok {
+		writeJSON(w, http.StatusBadRequest, &kmsError{Type: "UnknownOperationException", Message: "expected a POST with X-Amz-Target: TrentService.<Action>"})
+		return
+	}
+	s.mu.Lock()
+	s.calls[action]++
+	stall, brownout := s.stall, time.Now().Before(s.brownoutEnd)
+	s.mu.Unlock()
+	if stall > 0 {
+		select {
+		case <-time.After(stall):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if brownout {
+		writeJSON(w, http.StatusInternalServerError, &kmsError{Type: "KMSInternalException", Message: "kmstest brownout"})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &kmsError{Type: "SerializationException", Message: err.Error()})
+		return
+	}
+	var out interface{}
+	switch action {
+	case "Encrypt":
+		out, err = s.encrypt(body)
+	case "Decrypt":
+		out, err = s.decrypt(body)
+	case "GenerateDataKey":
+		out, err = s.generateDataKey(body)
+	case "GenerateRandom":
+		out, err = generateRandom(body)
+	case "ListKeys":
+		out = s.listKeys()
+	case "ListAliases":
+		out = s.listAliases()
+	default:
+		err = &kmsError{Type: "UnsupportedOperationException", Message: action + " is not supported by kmstest"}
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func decode(body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return &kmsError{Type: "SerializationException", Message: err.Error()}
+	}
+	return nil
+}
+
+// resolve returns the key ID a KeyId parameter names: an alias name or
+// ARN, a key ID or a key ARN.
+func (s *Server) resolve(keyID string) (string, error) {
+	if i := strings.Index(keyID, ":alias/"); i >= 0 {
+		keyID = keyID[i+1:]
+	}
+	if id, ok := s.aliases[keyID]; ok {
+		return id, nil
+	}
+	if i := strings.LastIndex(keyID, ":key/"); i >= 0 {
+		keyID = keyID[i+len(":key/"):]
+	}
+	for _, id := range s.aliases {
+		if id == keyID {
+			return id, nil
+		}
+	}
+	return "", notFound("key %q does not exist", keyID)
+}
+
+// aead returns AES-256-GCM under the key with the given ID.
+func aead(id string) cipher.AEAD {
+	key := sha256.Sum256([]byte("kmstest key " + id))
+	block, _ := aes.NewCipher(key[:])
+	gcm, _ := cipher.NewGCM(block)
+	return gcm
+}
+
+// seal encrypts plaintext under key id. The blob is the key ID, a NUL,
+// the nonce and the GCM ciphertext; the key ID is also authenticated.
+func seal(id string, plaintext []byte) string {
+	gcm := aead(id)
+	blob := append([]byte(id), 0)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	blob = append(blob, nonce...)
+	blob = gcm.Seal(blob, nonce, plaintext, []byte(id))
+	return base64.StdEncoding.EncodeToString(blob)
+}
+
+func open(blob string) (id string, plaintext []byte, err error) {
+	invalid := &kmsError{Type: "InvalidCiphertextException", Message: "the ciphertext is invalid"}
+	raw, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return "", nil, invalid
+	}
+	i := strings.IndexByte(string(raw), 0)
+	if i < 0 {
+		return "", nil, invalid
+	}
+	id = string(raw[:i])
+	gcm := aead(id)
+	rest := raw[i+1:]
+	if len(rest) < gcm.NonceSize() {
+		return "", nil, invalid
+	}
+	plaintext, err = gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], []byte(id))
+	if err != nil {
+		return "", nil, invalid
+	}
+	return id, plaintext, nil
+}
+
+func (s *Server) encrypt(body []byte) (interface{}, error) {
+	var in struct {
+		KeyId     string
+		Plaintext []byte
+	}
+	if err := decode(body, &in); err != nil {
+		return nil, err
+	}
+	id, err := s.resolve(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if len(in.Plaintext) == 0 || len(in.Plaintext) > 4096 {
+		return nil, &kmsError{Type: "ValidationException", Message: "Plaintext must be 1 to 4096 bytes"}
+	}
+	return map[string]string{"CiphertextBlob": seal(id, in.Plaintext), "KeyId": arn(id)}, nil
+}
+
+func (s *Server) decrypt(body []byte) (interface{}, error) {
+	var in struct {
+		CiphertextBlob string
+		KeyId          string
+	}
+	if err := decode(body, &in); err != nil {
+		return nil, err
+	}
+	id, plaintext, err := open(in.CiphertextBlob)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.resolve(id); err != nil {
+		return nil, err
+	}
+	if in.KeyId != "" {
+		want, err := s.resolve(in.KeyId)
+		if err != nil {
+			return nil, err
+		}
+		if want != id {
+			return nil, &kmsError{Type: "IncorrectKeyException", Message: "the key ID in the request does not identify the key that encrypted the ciphertext"}
+		}
+	}
+	return map[string]interface{}{"Plaintext": plaintext, "KeyId": arn(id)}, nil
+}
+
+func (s *Server) generateDataKey(body []byte) (interface{}, error) {
+	var in struct {
+		KeyId         string
+		KeySpec       string
+		NumberOfBytes int
+	}
+	if err := decode(body, &in); err != nil {
+		return nil, err
+	}
+	id, err := s.resolve(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	n := in.NumberOfBytes
+	switch in.KeySpec {
+	case "AES_256":
+		n = 32
+	case "AES_128":
+		n = 16
+	case "":
+		if n < 1 || n > 1024 {
+			return nil, &kmsError{Type: "ValidationException", Message: "KeySpec or NumberOfBytes (1 to 1024) is required"}
+		}
+	default:
+		return nil, &kmsError{Type: "ValidationException", Message: "unsupported KeySpec " + in.KeySpec}
+	}
+	key := make([]byte, n)
+	rand.Read(key)
+	return map[string]interface{}{"CiphertextBlob": seal(id, key), "Plaintext": key, "KeyId": arn(id)}, nil
+}
+
+func generateRandom(body []byte) (interface{}, error) {
+	var in struct{ NumberOfBytes int }
+	if err := decode(body, &in); err != nil {
+		return nil, err
+	}
+	if in.NumberOfBytes < 1 || in.NumberOfBytes > 1024 {
+		return nil, &kmsError{Type: "ValidationException", Message: "NumberOfBytes must be 1 to 1024"}
+	}
+	random := make([]byte, in.NumberOfBytes)
+	rand.Read(random)
+	return map[string][]byte{"Plaintext": random}, nil
+}
+
+func (s *Server) listKeys() interface{} {
+	type key struct{ KeyId, KeyArn string }
+	var keys []key
+	for _, alias := range s.sortedAliases() {
+		id := s.aliases[alias]
+		keys = append(keys, key{KeyId: id, KeyArn: arn(id)})
+	}
+	return map[string]interface{}{"Keys": keys, "Truncated": false}
+}
+
+func (s *Server) listAliases() interface{} {
+	type alias struct{ AliasName, AliasArn, TargetKeyId string }
+	var aliases []alias
+	for _, name := range s.sortedAliases() {
+		aliases = append(aliases, alias{
+			AliasName:   name,
+			AliasArn:    fmt.Sprintf("arn:aws:kms:%s:%s:%s", Region, Account, name),
+			TargetKeyId: s.aliases[name],
+		})
+	}
+	return map[string]interface{}{"Aliases": aliases, "Truncated": false}
+}
+
+func (s *Server) sortedAliases() []string {
+	names := make([]string, 0, len(s.aliases))
+	for name := range s.aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,141 @@
+package kmstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func call(t *testing.T, s *Server, action string, in interface{}, out interface{}) (int, string) {
+	t.Helper()
+	body, _ := json.Marshal(in)
+	req, _ := http.NewRequest("POST", s.URL+"/", bytes.NewReader(body))
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var raw json.RawMessage
+	json.NewDecoder(resp.Body).Decode(&raw)
+	if resp.StatusCode != http.StatusOK {
+		var e kmsError
+		json.Unmarshal(raw, &e)
+		return resp.StatusCode, e.Type
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, ""
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	s := NewServer("alias/dev-key", "alias/other-key")
+	defer s.Close()
+
+	var enc struct{ CiphertextBlob, KeyId string }
+	if status, errType := call(t, s, "Encrypt", map[string]interface{}{"KeyId": "alias/dev-key", "Plaintext": []byte("hello")}, &enc); status != 200 {
+		t.Fatalf("Encrypt: %d %s", status, errType)
+	}
+	if enc.KeyId != s.KeyARN("alias/dev-key") {
+		t.Fatalf("Encrypt KeyId = %s", enc.KeyId)
+	}
+
+	var dec struct {
+		Plaintext []byte
+		KeyId     string
+	}
+	if status, errType := call(t, s, "Decrypt", map[string]string{"CiphertextBlob": enc.CiphertextBlob}, &dec); status != 200 {
+		t.Fatalf("Decrypt: %d %s", status, errType)
+	}
+	if string(dec.Plaintext) != "hello" || dec.KeyId != enc.KeyId {
+		t.Fatalf("Decrypt = %q under %s", dec.Plaintext, dec.KeyId)
+	}
+
+	// Keys come from their names, so another server decrypts the blob too
+	s2 := NewServer("alias/dev-key")
+	defer s2.Close()
+	if status, errType := call(t, s2, "Decrypt", map[string]string{"CiphertextBlob": enc.CiphertextBlob, "KeyId": s.KeyARN("alias/dev-key")}, &dec); status != 200 {
+		t.Fatalf("Decrypt on a second server: %d %s", status, errType)
+	}
+
+	tests := []struct {
+		action string
+		in     interface{}
+		want   string
+	}{
+		{"Decrypt", map[string]string{"CiphertextBlob": enc.CiphertextBlob, "KeyId": "alias/other-key"}, "IncorrectKeyException"},
+		{"Decrypt", map[string]string{"CiphertextBlob": "AAAA"}, "InvalidCiphertextException"},
+		{"Encrypt", map[string]interface{}{"KeyId": "alias/missing", "Plaintext": []byte("x")}, "NotFoundException"},
+		{"Sign", map[string]string{}, "UnsupportedOperationException"},
+	}
+	for _, tt := range tests {
+		if status, errType := call(t, s, tt.action, tt.in, nil); status != 400 || errType != tt.want {
+			t.Errorf("%s %v: %d %s, want 400 %s", tt.action, tt.in, status, errType, tt.want)
+		}
+	}
+	if s.Calls("Encrypt") != 2 || s.Calls("Decrypt") != 3 {
+		t.Errorf("calls: Encrypt %d, Decrypt %d", s.Calls("Encrypt"), s.Calls("Decrypt"))
+	}
+}
+
+func TestGenerateDataKey(t *testing.T) {
+	s := NewServer("alias/dev-key")
+	defer s.Close()
+
+	var dk struct {
+		CiphertextBlob string
+		Plaintext      []byte
+		KeyId          string
+	}
+	if status, errType := call(t, s, "GenerateDataKey", map[string]string{"KeyId": "alias/dev-key", "KeySpec": "AES_256"}, &dk); status != 200 {
+		t.Fatalf("GenerateDataKey: %d %s", status, errType)
+	}
+	if len(dk.Plaintext) != 32 {
+		t.Fatalf("data key is %d bytes", len(dk.Plaintext))
+	}
+	var dec struct{ Plaintext []byte }
+	call(t, s, "Decrypt", map[string]string{"CiphertextBlob": dk.CiphertextBlob}, &dec)
+	if !bytes.Equal(dec.Plaintext, dk.Plaintext) {
+		t.Fatal("wrapped data key doesn't decrypt to the plaintext key")
+	}
+}
+
+func TestListAliases(t *testing.T) {
+	s := NewServer("alias/b", "alias/a")
+	defer s.Close()
+	var out struct {
+		Aliases []struct{ AliasName, TargetKeyId string }
+	}
+	call(t, s, "ListAliases", struct{}{}, &out)
+	if len(out.Aliases) != 2 || out.Aliases[0].AliasName != "alias/a" || !strings.HasSuffix(s.KeyARN("alias/a"), out.Aliases[0].TargetKeyId) {
+		t.Fatalf("ListAliases = %+v", out)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	s := NewServer("alias/dev-key")
+	defer s.Close()
+	var out struct{ Keys []struct{ KeyId string } }
+
+	s.Stall(50 * time.Millisecond)
+	start := time.Now()
+	call(t, s, "ListKeys", struct{}{}, &out)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("stalled call answered after %v", time.Since(start))
+	}
+	s.Stall(0)
+
+	s.Brownout(100 * time.Millisecond)
+	if status, errType := call(t, s, "ListKeys", struct{}{}, &out); status != http.StatusInternalServerError || errType != "KMSInternalException" {
+		t.Fatalf("during brownout: %d %s", status, errType)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if status, _ := call(t, s, "ListKeys", struct{}{}, &out); status != http.StatusOK {
+		t.Fatalf("after brownout: %d", status)
+	}
+}
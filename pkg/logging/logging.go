@@ -0,0 +1,79 @@
+// Package logging sets up log/slog for the binaries: a --log-level and
+// --log-format flag, a default logger tagged with the component name, and
+// per-connection loggers carrying conn_id and peer_cid so every line can
+// be filtered and parsed by machines. Request data (plaintext, ciphertext,
+// KMS request bodies) is logged only as metadata and a SHA-256 digest,
+// unless --log-sensitive asks for the raw contents.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"nitro-dev-qemu/pkg/envflag"
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+var (
+	level     *string
+	format    *string
+	sensitive *bool
+)
+
+// RegisterFlags defines --log-level, --log-format and --log-sensitive on
+// fs. Call it before fs.Parse.
+func RegisterFlags(fs *flag.FlagSet) {
+	level = envflag.On(fs).String("log-level", "info", "Log level: debug, info, warn or error", "LOG_LEVEL")
+	format = envflag.On(fs).String("log-format", "text", "Log output format: text or json", "LOG_FORMAT")
+	sensitive = envflag.On(fs).Bool("log-sensitive", false, "Log raw plaintext and ciphertext alongside their length and SHA-256 (development only)", "LOG_SENSITIVE")
+}
+
+// Setup installs the default slog logger after fs.Parse. Every record
+// carries component=<component>; anything still written through the
+// standard log package goes through the same handler at info level.
+func Setup(component string) error {
+	lvl := slog.LevelInfo
+	if level != nil {
+		if err := lvl.UnmarshalText([]byte(*level)); err != nil {
+			return fmt.Errorf("invalid log level %q (want debug, info, warn or error)", *level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	f := "text"
+	if format != nil {
+		f = *format
+	}
+	var h slog.Handler
+	switch f {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (want text or json)", f)
+	}
+	slog.SetDefault(slog.New(h).With("component", component))
+	if sensitive != nil && *sensitive {
+		slog.Warn("Logging raw request data (--log-sensitive): never enable this with real data")
+	}
+	return nil
+}
+
+// Fatal logs msg at error level and exits, like log.Fatal.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// ForConn returns a logger for one accepted connection, carrying its
+// conn_id and the peer's vsock CID (or address, for other networks).
+func ForConn(conn net.Conn, connID int) *slog.Logger {
+	if addr, ok := conn.RemoteAddr().(*vsock.Addr); ok {
+		return slog.With("conn_id", connID, "peer_cid", addr.CID)
+	}
+	return slog.With("conn_id", connID, "peer", conn.RemoteAddr().String())
+}
@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"nitro-dev-qemu/pkg/sniff"
+)
+
+// Payload returns a log attribute describing request data: its length, an
+// estimate of its entropy, its sniffed content type and its SHA-256. That
+// is enough to tell whether the connector sent text or binary data,
+// whether a value is already encrypted (close to 8 bits of entropy per
+// byte) or whether it was truncated on the way, and the digest follows
+// the same value from the connector through the enclave to the proxy:
+//
+//	input.bytes=11 input.chars=11 input.entropy=3.28 input.content_type="text/plain; charset=utf-8" input.sha256=b94d27b9...
+//
+// chars is the number of characters, which differs from bytes for
+// non-ASCII text; it is left out for data that isn't valid UTF-8. With
+// --log-sensitive the raw contents are logged too, as value.
+func Payload(key string, data []byte) slog.Attr {
+	attrs := metadata(data)
+	if sensitive != nil && *sensitive {
+		attrs = append(attrs, "value", string(data))
+	}
+	return slog.Group(key, attrs...)
+}
+
+// Secret is Payload for data that must never be logged raw, such as a
+// GenerateDataKey response carrying a plaintext data key: it logs the
+// metadata and digest whatever --log-sensitive says.
+func Secret(key string, data []byte) slog.Attr {
+	return slog.Group(key, metadata(data)...)
+}
+
+func metadata(data []byte) []any {
+	ct := sniff.ContentType(data)
+	attrs := []any{"bytes", len(data)}
+	if strings.HasPrefix(ct, "text/") || ct == "application/json" {
+		if utf8.Valid(data) {
+			attrs = append(attrs, "chars", utf8.RuneCount(data))
+		}
+	}
+	sum := sha256.Sum256(data)
+	return append(attrs, "entropy", sniff.Entropy(data), "content_type", ct, "sha256", hex.EncodeToString(sum[:]))
+}
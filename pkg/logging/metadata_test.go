@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// withSensitive sets --log-sensitive for the test.
+func withSensitive(t *testing.T, on bool) {
+	old := sensitive
+	t.Cleanup(func() { sensitive = old })
+	sensitive = &on
+}
+
+func TestPayloadNeverLogsContents(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	logger.Info("request", Payload("input", []byte("hunter2 secret")))
+	out := buf.String()
+	if strings.Contains(out, "hunter2") || strings.Contains(out, "secret") {
+		t.Fatalf("payload contents leaked: %s", out)
+	}
+	for _, want := range []string{"input.bytes=14", "input.chars=14", `input.content_type="text/plain; charset=utf-8"`,
+		"input.sha256=" + hex.EncodeToString(sum("hunter2 secret"))} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in %s", want, out)
+		}
+	}
+}
+
+func TestPayloadCountsCharacters(t *testing.T) {
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("request", Payload("input", []byte("こんにちは")))
+	if out := buf.String(); !strings.Contains(out, "input.bytes=15") || !strings.Contains(out, "input.chars=5") {
+		t.Fatalf("got %s, want 15 bytes and 5 chars", out)
+	}
+}
+
+func sum(s string) []byte {
+	h := sha256.Sum256([]byte(s))
+	return h[:]
+}
+
+func TestPayloadLogSensitive(t *testing.T) {
+	withSensitive(t, true)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	logger.Info("request", Payload("input", []byte("hunter2")))
+	if out := buf.String(); !strings.Contains(out, "input.value=hunter2") || !strings.Contains(out, "input.sha256=") {
+		t.Fatalf("got %s, want the raw value and its digest", out)
+	}
+
+	// data keys are never logged raw
+	buf.Reset()
+	logger.Info("response", Secret("json", []byte(`{"Plaintext":"a2V5"}`)))
+	if out := buf.String(); strings.Contains(out, "a2V5") || !strings.Contains(out, "json.sha256=") {
+		t.Fatalf("secret logged as %s", out)
+	}
+}
+
+func TestLogSensitiveFlag(t *testing.T) {
+	t.Cleanup(func() { level, format, sensitive = nil, nil, nil })
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	t.Setenv("LOG_SENSITIVE", "")
+	RegisterFlags(fs)
+	if err := fs.Parse(nil); err != nil || *sensitive {
+		t.Fatalf("--log-sensitive defaults to %v (err %v)", *sensitive, err)
+	}
+
+	t.Setenv("LOG_SENSITIVE", "true")
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse(nil); err != nil || !*sensitive {
+		t.Fatalf("LOG_SENSITIVE=true gave %v (err %v)", *sensitive, err)
+	}
+}
@@ -0,0 +1,242 @@
+// Package metrics provides counters, gauges and histograms that stay cheap
+// under heavy concurrent use, and renders them in the Prometheus text
+// exposition format.
+//
+// Every metric is split into cache-line padded shards, one per CPU. Writers
+// pick a shard at random (math/rand/v2 draws from a per-thread generator,
+// so picking takes no lock), which means concurrent goroutines rarely touch
+// the same cache line. The shards are only summed when the metrics are
+// read, at scrape time.
+package metrics
+
+import (
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// cacheLine is the assumed CPU cache line size used for padding.
+const cacheLine = 64
+
+// numShards returns the shard count: GOMAXPROCS rounded up to a power of
+// two, so a shard can be picked with a mask.
+func numShards() int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) {
+		n <<= 1
+	}
+	return n
+}
+
+type paddedInt64 struct {
+	v int64
+	_ [cacheLine - 8]byte
+}
+
+// Counter is a monotonically increasing count.
+type Counter struct {
+	shards []paddedInt64
+}
+
+// NewCounter returns a zero Counter.
+func NewCounter() *Counter {
+	return &Counter{shards: make([]paddedInt64, numShards())}
+}
+
+// Inc adds one.
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add adds n, which should not be negative.
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.shards[rand.Uint32()&uint32(len(c.shards)-1)].v, n)
+}
+
+// Value sums the shards.
+func (c *Counter) Value() int64 {
+	var total int64
+	for i := range c.shards {
+		total += atomic.LoadInt64(&c.shards[i].v)
+	}
+	return total
+}
+
+// Gauge is a value that goes up and down, such as active connections.
+type Gauge struct {
+	Counter
+}
+
+// NewGauge returns a zero Gauge.
+func NewGauge() *Gauge {
+	return &Gauge{Counter: *NewCounter()}
+}
+
+// Dec subtracts one.
+func (g *Gauge) Dec() { g.Add(-1) }
+
+// Histogram counts observations into cumulative buckets, like a
+// Prometheus histogram.
+type Histogram struct {
+	bounds []float64
+	shards []histogramShard
+}
+
+type histogramShard struct {
+	counts []uint64 // len(bounds)+1; the last bucket is +Inf
+	sum    uint64   // float64 bits
+	_      [cacheLine - 24 - 8]byte
+}
+
+// DefaultLatencyBuckets are bucket bounds in seconds suited to request
+// latencies from sub-millisecond vsock hops to multi-second KMS calls.
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// NewHistogram returns a Histogram with the given upper bucket bounds.
+func NewHistogram(bounds []float64) *Histogram {
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+	h := &Histogram{bounds: b, shards: make([]histogramShard, numShards())}
+	for i := range h.shards {
+		// Spare capacity keeps neighbouring shards' buckets off this cache line
+		h.shards[i].counts = make([]uint64, len(b)+1, len(b)+1+cacheLine/8)
+	}
+	return h
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	s := &h.shards[rand.Uint32()&uint32(len(h.shards)-1)]
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&s.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&s.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&s.sum, old, sum) {
+			break
+		}
+	}
+}
+
+// HistogramSnapshot is the aggregated state of a Histogram.
+type HistogramSnapshot struct {
+	Bounds     []float64
+	Cumulative []uint64 // per bound, plus a final +Inf entry
+	Sum        float64
+	Count      uint64
+}
+
+// Snapshot sums the shards.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{Bounds: h.bounds, Cumulative: make([]uint64, len(h.bounds)+1)}
+	for i := range h.shards {
+		s := &h.shards[i]
+		for j := range s.counts {
+			snap.Cumulative[j] += atomic.LoadUint64(&s.counts[j])
+		}
+		snap.Sum += math.Float64frombits(atomic.LoadUint64(&s.sum))
+	}
+	for j := 1; j < len(snap.Cumulative); j++ {
+		snap.Cumulative[j] += snap.Cumulative[j-1]
+	}
+	snap.Count = snap.Cumulative[len(snap.Cumulative)-1]
+	return snap
+}
+
+// CounterVec is a family of counters distinguished by one label value,
+// e.g. KMS errors by status code.
+type CounterVec struct {
+	label    string
+	mu       sync.RWMutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec returns an empty CounterVec for the given label name.
+func NewCounterVec(label string) *CounterVec {
+	return &CounterVec{label: label, counters: make(map[string]*Counter)}
+}
+
+// With returns the counter for value, creating it on first use.
+func (v *CounterVec) With(value string) *Counter {
+	v.mu.RLock()
+	c, ok := v.counters[value]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.counters[value]; ok {
+		return c
+	}
+	c = NewCounter()
+	v.counters[value] = c
+	return c
+}
+
+// values returns the label values in sorted order with their totals.
+func (v *CounterVec) values() ([]string, []int64) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.counters))
+	for k := range v.counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	totals := make([]int64, len(keys))
+	for i, k := range keys {
+		totals[i] = v.counters[k].Value()
+	}
+	return keys, totals
+}
+
+// HistogramVec is a family of histograms with the same buckets,
+// distinguished by one label value, e.g. KMS latency by action.
+type HistogramVec struct {
+	label      string
+	bounds     []float64
+	mu         sync.RWMutex
+	histograms map[string]*Histogram
+}
+
+// NewHistogramVec returns an empty HistogramVec for the given label name.
+func NewHistogramVec(label string, bounds []float64) *HistogramVec {
+	return &HistogramVec{label: label, bounds: bounds, histograms: make(map[string]*Histogram)}
+}
+
+// With returns the histogram for value, creating it on first use.
+func (v *HistogramVec) With(value string) *Histogram {
+	v.mu.RLock()
+	h, ok := v.histograms[value]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok := v.histograms[value]; ok {
+		return h
+	}
+	h = NewHistogram(v.bounds)
+	v.histograms[value] = h
+	return h
+}
+
+// snapshots returns the label values in sorted order with their snapshots.
+func (v *HistogramVec) snapshots() ([]string, []HistogramSnapshot) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.histograms))
+	for k := range v.histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	snaps := make([]HistogramSnapshot, len(keys))
+	for i, k := range keys {
+		snaps[i] = v.histograms[k].Snapshot()
+	}
+	return keys, snaps
+}
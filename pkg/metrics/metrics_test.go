@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCounterConcurrentAdds(t *testing.T) {
+	c := NewCounter()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := c.Value(); got != 8000 {
+		t.Fatalf("counter = %d, want 8000", got)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.Observe(v)
+	}
+	snap := h.Snapshot()
+	want := []uint64{2, 3, 4} // le=1, le=5, +Inf
+	for i, w := range want {
+		if snap.Cumulative[i] != w {
+			t.Fatalf("bucket %d = %d, want %d", i, snap.Cumulative[i], w)
+		}
+	}
+	if snap.Count != 4 || snap.Sum != 14.5 {
+		t.Fatalf("count/sum = %d/%v, want 4/14.5", snap.Count, snap.Sum)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("requests_total", "Requests.").Add(3)
+	r.Gauge("active", "Active.").Inc()
+	r.CounterVec("errors_total", "Errors.", "status").With("500").Inc()
+	r.Histogram("latency_seconds", "Latency.", []float64{0.1}).Observe(0.05)
+	r.HistogramVec("kms_seconds", "KMS latency.", "action", []float64{0.1}).With("Encrypt").Observe(0.2)
+
+	var b strings.Builder
+	if err := r.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE requests_total counter",
+		"requests_total 3",
+		"active 1",
+		`errors_total{status="500"} 1`,
+		`latency_seconds_bucket{le="0.1"} 1`,
+		`latency_seconds_bucket{le="+Inf"} 1`,
+		"latency_seconds_count 1",
+		`kms_seconds_bucket{action="Encrypt",le="0.1"} 0`,
+		`kms_seconds_bucket{action="Encrypt",le="+Inf"} 1`,
+		`kms_seconds_sum{action="Encrypt"} 0.2`,
+		`kms_seconds_count{action="Encrypt"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("output missing %q:\n%s", line, b.String())
+		}
+	}
+}
+
+// The sharded counter should scale with parallelism where a single atomic
+// bounces one cache line between every CPU.
+func BenchmarkCounterSharded(b *testing.B) {
+	c := NewCounter()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Inc()
+		}
+	})
+}
+
+func BenchmarkCounterSingleAtomic(b *testing.B) {
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			atomic.AddInt64(&n, 1)
+		}
+	})
+}
+
+func BenchmarkHistogramObserve(b *testing.B) {
+	h := NewHistogram(DefaultLatencyBuckets)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h.Observe(0.003)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Registry holds named metrics and renders them for scraping.
+type Registry struct {
+	mu      sync.Mutex
+	entries []entry
+}
+
+type entry struct {
+	name, help, kind string
+	metric           interface{}
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(name, help, kind string, metric interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry{name: name, help: help, kind: kind, metric: metric})
+}
+
+// Counter registers and returns a new Counter.
+func (r *Registry) Counter(name, help string) *Counter {
+	c := NewCounter()
+	r.add(name, help, "counter", c)
+	return c
+}
+
+// Gauge registers and returns a new Gauge.
+func (r *Registry) Gauge(name, help string) *Gauge {
+	g := NewGauge()
+	r.add(name, help, "gauge", g)
+	return g
+}
+
+// Histogram registers and returns a new Histogram.
+func (r *Registry) Histogram(name, help string, bounds []float64) *Histogram {
+	h := NewHistogram(bounds)
+	r.add(name, help, "histogram", h)
+	return h
+}
+
+// CounterVec registers and returns a new CounterVec.
+func (r *Registry) CounterVec(name, help, label string) *CounterVec {
+	v := NewCounterVec(label)
+	r.add(name, help, "counter", v)
+	return v
+}
+
+// HistogramVec registers and returns a new HistogramVec.
+func (r *Registry) HistogramVec(name, help, label string, bounds []float64) *HistogramVec {
+	v := NewHistogramVec(label, bounds)
+	r.add(name, help, "histogram", v)
+	return v
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition
+// format (version 0.0.4), in registration order. Sharded values are summed
+// here, at scrape time.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	entries := append([]entry(nil), r.entries...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, e := range entries {
+		fmt.Fprintf(bw, "# HELP %s %s\n", e.name, e.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", e.name, e.kind)
+		switch m := e.metric.(type) {
+		case *Counter:
+			fmt.Fprintf(bw, "%s %d\n", e.name, m.Value())
+		case *Gauge:
+			fmt.Fprintf(bw, "%s %d\n", e.name, m.Value())
+		case *CounterVec:
+			keys, totals := m.values()
+			for i, k := range keys {
+				fmt.Fprintf(bw, "%s{%s=%q} %d\n", e.name, m.label, k, totals[i])
+			}
+		case *Histogram:
+			writeHistogram(bw, e.name, "", m.Snapshot())
+		case *HistogramVec:
+			keys, snaps := m.snapshots()
+			for i, k := range keys {
+				writeHistogram(bw, e.name, fmt.Sprintf("%s=%q", m.label, k), snaps[i])
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// writeHistogram writes the bucket, sum and count lines of one histogram.
+// labels is a rendered label pair added to every line, or "".
+func writeHistogram(w io.Writer, name, labels string, snap HistogramSnapshot) {
+	bucketLabels, labelSet := "{", ""
+	if labels != "" {
+		bucketLabels = "{" + labels + ","
+		labelSet = "{" + labels + "}"
+	}
+	for i, bound := range snap.Bounds {
+		fmt.Fprintf(w, "%s_bucket%sle=%q} %d\n", name, bucketLabels, strconv.FormatFloat(bound, 'g', -1, 64), snap.Cumulative[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", name, bucketLabels, snap.Count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labelSet, strconv.FormatFloat(snap.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labelSet, snap.Count)
+}
@@ -0,0 +1,94 @@
+// Package payload provides a handle for request payloads that redacts its
+// contents whenever it is formatted, so plaintext cannot leak into panics,
+// state dumps or careless log lines.
+package payload
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"runtime"
+)
+
+// Payload wraps request data. Formatting it with any fmt verb prints only
+// its length; use Bytes or Reveal to access the contents deliberately.
+type Payload struct {
+	data []byte
+}
+
+// New returns a Payload holding b. The slice is not copied.
+func New(b []byte) Payload {
+	return Payload{data: b}
+}
+
+// FromString returns a Payload holding the bytes of s.
+func FromString(s string) Payload {
+	return Payload{data: []byte(s)}
+}
+
+// Bytes returns the raw payload contents.
+func (p Payload) Bytes() []byte {
+	return p.data
+}
+
+// Reveal returns the payload contents as a string. Callers are responsible
+// for not logging the result.
+func (p Payload) Reveal() string {
+	return string(p.data)
+}
+
+// Len returns the payload length in bytes.
+func (p Payload) Len() int {
+	return len(p.data)
+}
+
+// String implements fmt.Stringer without exposing the contents.
+func (p Payload) String() string {
+	return fmt.Sprintf("[REDACTED %d bytes]", len(p.data))
+}
+
+// GoString implements fmt.GoStringer so %#v is redacted too.
+func (p Payload) GoString() string {
+	return p.String()
+}
+
+// Format implements fmt.Formatter so every verb (%v, %s, %q, %x, ...)
+// prints the redacted form.
+func (p Payload) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, p.String())
+}
+
+// MarshalJSON encodes the payload as a base64 string, the same encoding
+// encoding/json uses for []byte.
+func (p Payload) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.data)
+}
+
+// UnmarshalJSON decodes a base64 string produced by MarshalJSON.
+func (p *Payload) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	p.data = data
+	return nil
+}
+
+// DescribePanic returns a description of a recovered panic value that is
+// safe to log. Runtime errors (nil dereference, index out of range) are
+// reported verbatim; any other value may carry request data and is reported
+// by type only.
+func DescribePanic(r interface{}) string {
+	switch v := r.(type) {
+	case runtime.Error:
+		return v.Error()
+	case Payload:
+		return v.String()
+	default:
+		return fmt.Sprintf("panic value of type %T (contents withheld)", r)
+	}
+}
@@ -0,0 +1,121 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+const secret = "4111-1111-1111-1111"
+
+func TestFormattingRedacts(t *testing.T) {
+	p := FromString(secret)
+	const redacted = "[REDACTED 19 bytes]"
+	nested := struct {
+		Name string
+		Data Payload
+		Ptr  *Payload
+	}{"card", p, &p}
+
+	outputs := map[string]string{
+		"String":   p.String(),
+		"GoString": p.GoString(),
+		"Sprint":   fmt.Sprint(p),
+		"Sprintln": fmt.Sprintln(p),
+		"nested":   fmt.Sprintf("%v %+v", nested, nested),
+		"nested#":  fmt.Sprintf("%#v", nested),
+		"error":    fmt.Errorf("failed on %v", p).Error(),
+	}
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d", "%10s"} {
+		if s := fmt.Sprintf(verb, p); s != redacted {
+			t.Errorf("%s prints %q, want %q", verb, s, redacted)
+		}
+	}
+	for name, out := range outputs {
+		if strings.Contains(out, secret) || strings.Contains(out, fmt.Sprintf("%x", secret)) {
+			t.Errorf("%s leaks the plaintext: %q", name, out)
+		}
+		if name != "nested#" && !strings.Contains(out, redacted) {
+			t.Errorf("%s = %q, want the redacted form", name, out)
+		}
+	}
+}
+
+func TestLoggingRedacts(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	p := FromString(secret)
+	logger.Info("request", "payload", p, "group", slog.GroupValue(slog.Any("data", p)))
+	if strings.Contains(buf.String(), secret) {
+		t.Fatalf("log line leaks the plaintext: %s", buf.String())
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	p := FromString(secret)
+	b, err := json.Marshal(struct{ Payload Payload }{p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), secret) {
+		t.Fatalf("JSON leaks the plaintext: %s", b)
+	}
+	if want := `{"Payload":"` + base64.StdEncoding.EncodeToString([]byte(secret)) + `"}`; string(b) != want {
+		t.Fatalf("JSON = %s, want %s", b, want)
+	}
+
+	var back struct{ Payload Payload }
+	if err := json.Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Payload.Reveal() != secret {
+		t.Fatalf("round trip gave %q", back.Payload.Reveal())
+	}
+	if err := json.Unmarshal([]byte(`{"Payload":"not base64!"}`), &back); err == nil {
+		t.Fatal("decoded invalid base64")
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	p := FromString(secret)
+	if p.Reveal() != secret || string(p.Bytes()) != secret || p.Len() != len(secret) {
+		t.Fatalf("Reveal %q, Bytes %q, Len %d", p.Reveal(), p.Bytes(), p.Len())
+	}
+	b := []byte(secret)
+	if q := New(b); &q.Bytes()[0] != &b[0] {
+		t.Fatal("New copied the slice")
+	}
+	var zero Payload
+	if zero.Len() != 0 || zero.Reveal() != "" || zero.String() != "[REDACTED 0 bytes]" {
+		t.Fatalf("zero Payload: %q %v", zero.Reveal(), zero)
+	}
+}
+
+func TestDescribePanic(t *testing.T) {
+	var runtimeErr error
+	func() {
+		defer func() { runtimeErr = recover().(error) }()
+		var m map[string]int
+		m["x"] = 1
+	}()
+
+	tests := []struct {
+		value any
+		want  string
+	}{
+		{runtimeErr, "assignment to entry in nil map"},
+		{FromString(secret), "[REDACTED 19 bytes]"},
+		{secret, "panic value of type string (contents withheld)"},
+		{errors.New(secret), "panic value of type *errors.errorString (contents withheld)"},
+	}
+	for _, tt := range tests {
+		if got := DescribePanic(tt.value); got != tt.want || strings.Contains(got, secret) {
+			t.Errorf("DescribePanic(%T) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package pcr simulates the platform configuration registers (PCRs) a
+// Nitro enclave is measured into. A real enclave's PCR0 to PCR2 are
+// SHA-384 measurements of its enclave image file (EIF), its kernel and
+// boot ramdisk, and its application, taken by the Nitro hypervisor at
+// launch; KMS key policies and attestation documents refer to them.
+//
+// The simulated enclave is a plain binary, so here they measure:
+//
+//   - PCR0: the enclave binary
+//   - PCR1: the boot configuration (every flag value)
+//   - PCR2: the application (its module, dependencies and build settings)
+//
+// Each register starts as 48 zero bytes and is extended once with the
+// SHA-384 of what it measures, the way a TPM or NSM register is extended:
+// PCR = SHA-384(PCR || digest).
+package pcr
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// Size is the length of a register, that of a SHA-384 digest.
+const Size = sha512.Size384
+
+// HashAlgorithm names the register hash as nitro-cli prints it.
+const HashAlgorithm = "Sha384 { ... }"
+
+// Value is the contents of one register.
+type Value [Size]byte
+
+// String returns v in lowercase hex, as nitro-cli prints registers.
+func (v Value) String() string {
+	return hex.EncodeToString(v[:])
+}
+
+// Extend returns v extended with digest: SHA-384(v || digest).
+func (v Value) Extend(digest []byte) Value {
+	h := sha512.New384()
+	h.Write(v[:])
+	h.Write(digest)
+	var out Value
+	h.Sum(out[:0])
+	return out
+}
+
+// Measure returns a fresh register extended with the SHA-384 of r's
+// contents.
+func Measure(r io.Reader) (Value, error) {
+	h := sha512.New384()
+	if _, err := io.Copy(h, r); err != nil {
+		return Value{}, err
+	}
+	return Value{}.Extend(h.Sum(nil)), nil
+}
+
+// MeasureBytes is Measure for data already in memory.
+func MeasureBytes(data []byte) Value {
+	v, _ := Measure(bytes.NewReader(data))
+	return v
+}
+
+// Set holds the three registers an enclave is measured into.
+type Set struct {
+	PCR0 Value // the enclave binary
+	PCR1 Value // the boot configuration
+	PCR2 Value // the application
+}
+
+// Compute measures an enclave: image is its binary, config its boot
+// configuration and application the description of its application.
+func Compute(image io.Reader, config, application []byte) (Set, error) {
+	pcr0, err := Measure(image)
+	if err != nil {
+		return Set{}, fmt.Errorf("failed to measure the enclave image: %v", err)
+	}
+	return Set{PCR0: pcr0, PCR1: MeasureBytes(config), PCR2: MeasureBytes(application)}, nil
+}
+
+// Map returns the registers by index, as attestation documents carry
+// them.
+func (s Set) Map() map[int][]byte {
+	return map[int][]byte{0: s.PCR0[:], 1: s.PCR1[:], 2: s.PCR2[:]}
+}
+
+// Measurements is the "Measurements" object of nitro-cli describe-eif and
+// describe-enclaves.
+type Measurements struct {
+	HashAlgorithm string `json:"HashAlgorithm"`
+	PCR0          string `json:"PCR0"`
+	PCR1          string `json:"PCR1"`
+	PCR2          string `json:"PCR2"`
+}
+
+// Measurements returns s in the form nitro-cli prints.
+func (s Set) Measurements() Measurements {
+	return Measurements{HashAlgorithm: HashAlgorithm, PCR0: s.PCR0.String(), PCR1: s.PCR1.String(), PCR2: s.PCR2.String()}
+}
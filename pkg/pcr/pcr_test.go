@@ -0,0 +1,53 @@
+package pcr
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMeasure(t *testing.T) {
+	// SHA-384(48 zero bytes || SHA-384("hello"))
+	const want = "1d9b87caf048435fc39a4a0a8e4e864af9c9a584b3a3b436193bb8b60125698089f57479f370637f16fcce8a1852d1bc"
+	if got := MeasureBytes([]byte("hello")).String(); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	v, err := Measure(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != want {
+		t.Fatalf("Measure and MeasureBytes differ: %s", v)
+	}
+}
+
+func TestCompute(t *testing.T) {
+	base, err := Compute(strings.NewReader("binary"), []byte("config"), []byte("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each input changes its own register only
+	other, _ := Compute(strings.NewReader("binary"), []byte("other config"), []byte("app"))
+	if other.PCR0 != base.PCR0 || other.PCR1 == base.PCR1 || other.PCR2 != base.PCR2 {
+		t.Fatalf("changing the config: %+v, base %+v", other.Measurements(), base.Measurements())
+	}
+
+	m := base.Map()
+	if len(m) != 3 || !bytes.Equal(m[1], base.PCR1[:]) {
+		t.Fatalf("Map: %v", m)
+	}
+
+	out, err := json.Marshal(base.Measurements())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["HashAlgorithm"] != "Sha384 { ... }" || len(decoded["PCR2"]) != 2*Size {
+		t.Fatalf("Measurements JSON: %s", out)
+	}
+}
@@ -0,0 +1,373 @@
+// Package peer is an end-to-end encrypted channel between two enclaves,
+// carried over the parent's vsock-proxy relay. The parent only copies
+// bytes: each side proves what it runs with attestation evidence that
+// binds an ephemeral RSA key, the two sides agree on session keys sealed
+// to those keys, and everything after the handshake is AES-256-GCM. The
+// parent can refuse to relay, but it can't read or alter the traffic.
+//
+// Like crypto/tls, Client runs the handshake on the connection that
+// dialed, Server on the one that was accepted, and the resulting Channel
+// is a net.Conn:
+//
+//	conn, err := transport.DialContext(ctx, vsock.HostCID, 8002)
+//	err = peer.RequestRelay(conn, 16, 9003)
+//	ch, err := peer.Client(conn, &peer.Config{Format: f, Claims: claims, Key: key, VerifyPeer: check})
+//	protocol.WriteRequest(ch, req)
+//
+// The handshake, each message a frame (see pkg/framing):
+//
+//	client → server: hello {evidence, nonce}
+//	server → client: hello {evidence, nonce, secret sealed to the client's key}
+//	client → server: {secret sealed to the server's key}, then a sealed finished record
+//	server → client: a sealed finished record
+//
+// The session keys are HKDF-SHA-384 of the two secrets, salted with the
+// hash of both hellos; the finished records carry that hash, so both sides
+// know they saw the same handshake.
+package peer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"nitro-dev-qemu/pkg/attestation"
+	"nitro-dev-qemu/pkg/framing"
+)
+
+// Config is one side's identity and what it accepts of the other side.
+type Config struct {
+	// Format generates this side's evidence; the peer's evidence may be
+	// in any format attestation.Verify knows.
+	Format attestation.Format
+	// Claims is what this side attests to. Its PublicKey is replaced with
+	// Key's.
+	Claims attestation.Claims
+	// Key is this side's ephemeral key.
+	Key *rsa.PrivateKey
+	// VerifyPeer checks the peer's verified evidence, typically its PCRs.
+	// A nil VerifyPeer accepts any evidence that verifies.
+	VerifyPeer func(*attestation.Attested) error
+}
+
+const (
+	nonceSize  = 32
+	secretSize = 32
+	keySize    = 32
+)
+
+// hkdfInfo separates these session keys from anything else derived from
+// the same secrets.
+const hkdfInfo = "nitro-dev-qemu peer channel v1"
+
+type hello struct {
+	Evidence []byte `json:"evidence"`
+	Nonce    []byte `json:"nonce"`
+	Secret   []byte `json:"secret,omitempty"` // sealed; server hello only
+}
+
+type keyExchange struct {
+	Secret []byte `json:"secret"` // sealed
+}
+
+// Channel is an established channel. Each Write is sent as one sealed
+// record; Read returns the records' plaintext in order.
+type Channel struct {
+	net.Conn
+	peer *attestation.Attested
+
+	send, recv       cipher.AEAD
+	sendSeq, recvSeq uint64
+	pending          []byte
+}
+
+// Peer returns what the other side's evidence attests.
+func (c *Channel) Peer() *attestation.Attested {
+	return c.peer
+}
+
+// Client runs the handshake as the side that dialed conn. On failure the
+// caller still owns conn and should close it.
+func Client(conn net.Conn, cfg *Config) (*Channel, error) {
+	own, err := newHello(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ownBytes, err := writeJSON(conn, own)
+	if err != nil {
+		return nil, err
+	}
+
+	var theirs hello
+	theirBytes, err := readJSON(conn, &theirs)
+	if err != nil {
+		return nil, err
+	}
+	attested, err := checkHello(cfg, own, &theirs)
+	if err != nil {
+		return nil, err
+	}
+	theirSecret, err := attestation.OpenForRecipient(cfg.Key, theirs.Secret)
+	if err != nil || len(theirSecret) != secretSize {
+		return nil, fmt.Errorf("failed to open the server's secret: %v", err)
+	}
+	defer clear(theirSecret)
+
+	ownSecret, sealed, err := newSecret(attested.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(ownSecret)
+	if _, err := writeJSON(conn, keyExchange{Secret: sealed}); err != nil {
+		return nil, err
+	}
+
+	transcript := transcriptHash(ownBytes, theirBytes)
+	ch, err := newChannel(conn, attested, append(ownSecret, theirSecret...), transcript, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.finish(transcript, true); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Server runs the handshake as the side that accepted conn. On failure
+// the caller still owns conn and should close it.
+func Server(conn net.Conn, cfg *Config) (*Channel, error) {
+	var theirs hello
+	theirBytes, err := readJSON(conn, &theirs)
+	if err != nil {
+		return nil, err
+	}
+	own, err := newHello(cfg)
+	if err != nil {
+		return nil, err
+	}
+	attested, err := checkHello(cfg, own, &theirs)
+	if err != nil {
+		return nil, err
+	}
+	ownSecret, sealed, err := newSecret(attested.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(ownSecret)
+	own.Secret = sealed
+	ownBytes, err := writeJSON(conn, own)
+	if err != nil {
+		return nil, err
+	}
+
+	var kx keyExchange
+	if _, err := readJSON(conn, &kx); err != nil {
+		return nil, err
+	}
+	theirSecret, err := attestation.OpenForRecipient(cfg.Key, kx.Secret)
+	if err != nil || len(theirSecret) != secretSize {
+		return nil, fmt.Errorf("failed to open the client's secret: %v", err)
+	}
+	defer clear(theirSecret)
+
+	// Both sides order everything client first
+	transcript := transcriptHash(theirBytes, ownBytes)
+	ch, err := newChannel(conn, attested, append(theirSecret, ownSecret...), transcript, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.finish(transcript, false); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func newHello(cfg *Config) (*hello, error) {
+	claims := cfg.Claims
+	claims.PublicKey = &cfg.Key.PublicKey
+	evidence, err := cfg.Format.Generate(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s evidence: %v", cfg.Format.Name(), err)
+	}
+	h := &hello{Evidence: evidence, Nonce: make([]byte, nonceSize)}
+	if _, err := rand.Read(h.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return h, nil
+}
+
+// checkHello verifies the peer's evidence and hands it to VerifyPeer.
+func checkHello(cfg *Config, own, theirs *hello) (*attestation.Attested, error) {
+	if len(theirs.Nonce) != nonceSize {
+		return nil, fmt.Errorf("malformed peer hello")
+	}
+	// A relay reflecting our own hello back would otherwise pass: it
+	// carries evidence we would accept
+	if bytes.Equal(theirs.Nonce, own.Nonce) {
+		return nil, fmt.Errorf("peer hello is our own")
+	}
+	attested, err := attestation.Verify(theirs.Evidence)
+	if err != nil {
+		return nil, fmt.Errorf("peer attestation: %v", err)
+	}
+	if cfg.VerifyPeer != nil {
+		if err := cfg.VerifyPeer(attested); err != nil {
+			return nil, fmt.Errorf("peer rejected: %v", err)
+		}
+	}
+	return attested, nil
+}
+
+// newSecret returns a fresh secret and its sealing to pub.
+func newSecret(pub *rsa.PublicKey) ([]byte, []byte, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate secret: %v", err)
+	}
+	sealed, err := attestation.SealForRecipient(pub, secret)
+	if err != nil {
+		clear(secret)
+		return nil, nil, err
+	}
+	return secret, sealed, nil
+}
+
+func transcriptHash(clientHello, serverHello []byte) []byte {
+	h := sha512.New384()
+	binary.Write(h, binary.BigEndian, uint32(len(clientHello)))
+	h.Write(clientHello)
+	h.Write(serverHello)
+	return h.Sum(nil)
+}
+
+// newChannel derives the session keys from secrets (the client's then the
+// server's): the first key seals client-to-server records, the second
+// server-to-client ones.
+func newChannel(conn net.Conn, peer *attestation.Attested, secrets, transcript []byte, client bool) (*Channel, error) {
+	defer clear(secrets)
+	keys, err := hkdf.Key(sha512.New384, secrets, transcript, hkdfInfo, 2*keySize)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(keys)
+	toServer, err := newGCM(keys[:keySize])
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := newGCM(keys[keySize:])
+	if err != nil {
+		return nil, err
+	}
+	ch := &Channel{Conn: conn, peer: peer, send: toServer, recv: toClient}
+	if !client {
+		ch.send, ch.recv = toClient, toServer
+	}
+	return ch, nil
+}
+
+// finish exchanges the finished records, the client's first.
+func (c *Channel) finish(transcript []byte, client bool) error {
+	if client {
+		if _, err := c.Write(transcript); err != nil {
+			return err
+		}
+	}
+	theirs, err := c.readRecord()
+	if err != nil {
+		return fmt.Errorf("peer finished: %v", err)
+	}
+	if !hmac.Equal(theirs, transcript) {
+		return fmt.Errorf("peer saw a different handshake")
+	}
+	if !client {
+		if _, err := c.Write(transcript); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write seals p as one record.
+func (c *Channel) Write(p []byte) (int, error) {
+	if len(p) > framing.MaxFrameSize-c.send.Overhead() {
+		return 0, fmt.Errorf("record of %d bytes is too large", len(p))
+	}
+	record := c.send.Seal(nil, seqNonce(c.sendSeq), p, nil)
+	c.sendSeq++
+	if err := framing.WriteFrame(c.Conn, record); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns plaintext from the next records.
+func (c *Channel) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		record, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = record
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Channel) readRecord() ([]byte, error) {
+	record, err := framing.ReadFrame(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := c.recv.Open(nil, seqNonce(c.recvSeq), record, nil)
+	if err != nil {
+		return nil, fmt.Errorf("record %d failed authentication", c.recvSeq)
+	}
+	c.recvSeq++
+	return plaintext, nil
+}
+
+// seqNonce is the GCM nonce of record seq. Each direction has its own key,
+// so a counter never repeats a nonce under one key; it also makes dropped,
+// replayed or reordered records fail to open.
+func seqNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func writeJSON(conn net.Conn, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return data, framing.WriteFrame(conn, data)
+}
+
+func readJSON(conn net.Conn, v any) ([]byte, error) {
+	data, err := framing.ReadFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("malformed handshake message: %v", err)
+	}
+	return data, nil
+}
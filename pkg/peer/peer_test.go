@@ -0,0 +1,178 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"nitro-dev-qemu/pkg/attestation"
+	"nitro-dev-qemu/pkg/pcr"
+)
+
+func config(t *testing.T, format, image string) *Config {
+	t.Helper()
+	f, err := attestation.Lookup(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := attestation.GenerateRecipientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{
+		Format: f,
+		Claims: attestation.Claims{
+			ModuleID:         image,
+			ExecutableSHA384: pcr.MeasureBytes([]byte(image)).String(),
+			ConfigSHA384:     pcr.MeasureBytes(nil).String(),
+			PCRs:             pcr.Set{PCR0: pcr.MeasureBytes([]byte(image))},
+		},
+		Key: key,
+	}
+}
+
+// requirePCR0 accepts only peers running image.
+func requirePCR0(image string) func(*attestation.Attested) error {
+	want := pcr.MeasureBytes([]byte(image))
+	return func(a *attestation.Attested) error {
+		if !bytes.Equal(a.PCRs[0], want[:]) {
+			return errors.New("unexpected PCR0")
+		}
+		return nil
+	}
+}
+
+// recorder is a parent relay that copies bytes both ways and keeps a
+// copy of everything it saw.
+type recorder struct {
+	mu   sync.Mutex
+	seen bytes.Buffer
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seen.Write(p)
+}
+
+func relay(t *testing.T) (client, server net.Conn, rec *recorder) {
+	c, parentC := net.Pipe()
+	parentS, s := net.Pipe()
+	rec = &recorder{}
+	go func() { io.Copy(io.MultiWriter(parentS, rec), parentC); parentS.Close() }()
+	go func() { io.Copy(io.MultiWriter(parentC, rec), parentS); parentC.Close() }()
+	t.Cleanup(func() { c.Close(); s.Close() })
+	return c, s, rec
+}
+
+// handshake runs Client and Server at once and returns their results.
+func handshake(client, server net.Conn, cc, sc *Config) (*Channel, *Channel, error, error) {
+	var (
+		sch  *Channel
+		serr error
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		sch, serr = Server(server, sc)
+		if serr != nil {
+			server.Close()
+		}
+	}()
+	cch, cerr := Client(client, cc)
+	if cerr != nil {
+		client.Close()
+	}
+	<-done
+	return cch, sch, cerr, serr
+}
+
+func TestChannel(t *testing.T) {
+	cc, sc := config(t, "nitro", "frontend"), config(t, "tdx", "key-holder")
+	cc.VerifyPeer, sc.VerifyPeer = requirePCR0("key-holder"), requirePCR0("frontend")
+	client, server, rec := relay(t)
+
+	cch, sch, cerr, serr := handshake(client, server, cc, sc)
+	if cerr != nil || serr != nil {
+		t.Fatalf("handshake: client %v, server %v", cerr, serr)
+	}
+	if cch.Peer().Format != "tdx" || sch.Peer().Format != "nitro" {
+		t.Fatalf("peers %s, %s", cch.Peer().Format, sch.Peer().Format)
+	}
+
+	secret := []byte("cardholder 4111111111111111")
+	go cch.Write(secret)
+	got := make([]byte, len(secret))
+	if _, err := io.ReadFull(sch, got); err != nil || !bytes.Equal(got, secret) {
+		t.Fatalf("server read %q, %v", got, err)
+	}
+	go sch.Write([]byte("ok"))
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(cch, reply); err != nil || string(reply) != "ok" {
+		t.Fatalf("client read %q, %v", reply, err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if bytes.Contains(rec.seen.Bytes(), secret) {
+		t.Fatal("the relay saw the plaintext")
+	}
+}
+
+func TestChannelRejectsPeer(t *testing.T) {
+	cc, sc := config(t, "nitro", "frontend"), config(t, "nitro", "impostor")
+	cc.VerifyPeer = requirePCR0("key-holder")
+	client, server, _ := relay(t)
+
+	_, _, cerr, serr := handshake(client, server, cc, sc)
+	if cerr == nil || serr == nil {
+		t.Fatalf("handshake with the wrong image: client %v, server %v", cerr, serr)
+	}
+}
+
+func TestChannelRejectsTampering(t *testing.T) {
+	cc, sc := config(t, "nitro", "a"), config(t, "sev-snp", "b")
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	cch, sch, cerr, serr := handshake(client, server, cc, sc)
+	if cerr != nil || serr != nil {
+		t.Fatalf("handshake: client %v, server %v", cerr, serr)
+	}
+
+	// A record replayed out of order fails to open
+	go func() {
+		cch.Write([]byte("first"))
+		cch.sendSeq = 0
+		cch.Write([]byte("again"))
+	}()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sch, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sch.Read(buf); err == nil {
+		t.Fatal("a record under a reused sequence number opened")
+	}
+}
+
+func TestRelayRequest(t *testing.T) {
+	enclave, parent := net.Pipe()
+	defer enclave.Close()
+	go func() {
+		cid, port, err := ReadRelayRequest(parent)
+		if err == nil && (cid != 16 || port != 9003) {
+			err = errors.New("wrong address")
+		}
+		AnswerRelay(parent, err)
+		ReadRelayRequest(parent)
+		AnswerRelay(parent, errors.New("connection refused"))
+	}()
+	if err := RequestRelay(enclave, 16, 9003); err != nil {
+		t.Fatal(err)
+	}
+	if err := RequestRelay(enclave, 17, 9003); err == nil {
+		t.Fatal("refused relay reported as connected")
+	}
+}
@@ -0,0 +1,68 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	"nitro-dev-qemu/pkg/framing"
+)
+
+// relayRequest asks the vsock-proxy relay to connect the dialing enclave
+// to the enclave listening on CID:Port. It is sent in the clear, before
+// the handshake: the parent has to know where to relay to.
+type relayRequest struct {
+	CID  uint32 `json:"cid"`
+	Port uint32 `json:"port"`
+}
+
+// relayReply answers a relayRequest. An empty Error means the relay is
+// connected and every byte from here on goes to the other enclave.
+type relayReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// RequestRelay asks the relay at the other end of conn for a connection to
+// the enclave at cid:port, and waits until it has one.
+func RequestRelay(conn net.Conn, cid, port uint32) error {
+	if _, err := writeJSON(conn, relayRequest{CID: cid, Port: port}); err != nil {
+		return fmt.Errorf("failed to send relay request: %v", err)
+	}
+	var reply relayReply
+	if _, err := readJSON(conn, &reply); err != nil {
+		return fmt.Errorf("no relay reply: %v", err)
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("relay to %d:%d refused: %s", cid, port, reply.Error)
+	}
+	return nil
+}
+
+// ReadRelayRequest reads the request a relay gets from the dialing
+// enclave, returning the CID and port to connect it to.
+func ReadRelayRequest(r io.Reader) (cid, port uint32, err error) {
+	data, err := framing.ReadFrame(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	var req relayRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return 0, 0, fmt.Errorf("malformed relay request: %v", err)
+	}
+	return req.CID, req.Port, nil
+}
+
+// AnswerRelay tells the dialing enclave whether its relay is connected:
+// it is when relayErr is nil.
+func AnswerRelay(w io.Writer, relayErr error) error {
+	var reply relayReply
+	if relayErr != nil {
+		reply.Error = relayErr.Error()
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return framing.WriteFrame(w, data)
+}
@@ -0,0 +1,119 @@
+// Package profile implements the runtime policy profiles of the binaries.
+// The dev profile, the default, allows everything this simulation offers
+// for convenience. The prod profile hard-disables what must never reach a
+// production deployment: logging or recording request data, transports
+// without isolation or TLS, and fallbacks to mock or unauthenticated
+// crypto. A binary started with --profile prod and any of those settings
+// refuses to start, listing every setting at fault, rather than quietly
+// overriding them, so a misconfigured deployment fails its first start
+// instead of running with a false sense of safety.
+package profile
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"nitro-dev-qemu/pkg/envflag"
+)
+
+const (
+	Dev  = "dev"
+	Prod = "prod"
+)
+
+// Profile is the --profile of one component. Components running in one
+// process (cmd/allinone) each have their own.
+type Profile struct {
+	name *string
+}
+
+// Register defines --profile on fs and returns the profile it selects.
+// Call it before fs.Parse.
+func Register(fs *flag.FlagSet) *Profile {
+	return &Profile{name: envflag.On(fs).String("profile", Dev, "Runtime policy profile: dev, or prod to refuse debug or sensitive logging, request traces, insecure transports and mock crypto fallbacks", "PROFILE")}
+}
+
+// Name returns the profile's name, after fs.Parse.
+func (p *Profile) Name() string {
+	return *p.name
+}
+
+// IsProd reports whether p is the prod profile.
+func (p *Profile) IsProd() bool {
+	return p.Name() == Prod
+}
+
+// Rule is a setting the prod profile forbids. Setting names it as the
+// operator would look for it, such as "--log-level=debug", and Violated
+// reports whether it is in effect.
+type Rule struct {
+	Setting  string
+	Reason   string
+	Violated func() bool
+}
+
+// Flag returns a rule forbidding the values of flag name on fs that allowed
+// rejects. Call it after fs.Parse. A flag fs doesn't define never violates
+// it, so components can share rules.
+func Flag(fs *flag.FlagSet, name string, allowed func(value string) bool, reason string) Rule {
+	r := Rule{Setting: "--" + name, Reason: reason, Violated: func() bool { return false }}
+	f := fs.Lookup(name)
+	if f == nil {
+		return r
+	}
+	r.Setting = "--" + name + "=" + f.Value.String()
+	r.Violated = func() bool { return !allowed(f.Value.String()) }
+	return r
+}
+
+// Enforce checks the rules after fs.Parse. It returns nil under dev, and
+// under prod an error listing every violated rule, or an error for an
+// unknown profile.
+func (p *Profile) Enforce(rules ...Rule) error {
+	switch p.Name() {
+	case Dev:
+		return nil
+	case Prod:
+	default:
+		return fmt.Errorf("unknown profile %q (expected dev or prod)", p.Name())
+	}
+	var violations []string
+	for _, r := range rules {
+		if r.Violated() {
+			violations = append(violations, fmt.Sprintf("%s: %s", r.Setting, r.Reason))
+		}
+	}
+	if len(violations) > 0 {
+		return errors.New("the prod profile forbids " + strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// Common returns the rules for the flags every standalone component has.
+func Common(fs *flag.FlagSet) []Rule {
+	return []Rule{
+		Flag(fs, "log-level", func(v string) bool { return !strings.HasPrefix(strings.ToLower(v), "debug") },
+			"debug records describe every payload (size, entropy, content type, digest) and each call made for it"),
+		Flag(fs, "log-sensitive", Equals("false"),
+			"it logs raw plaintext and ciphertext"),
+		Flag(fs, "vsock-transport", Equals("vsock"),
+			"TCP has neither the isolation of vsock nor TLS"),
+	}
+}
+
+// Equals returns an allowed func for Flag accepting only want.
+func Equals(want string) func(string) bool {
+	return func(v string) bool { return v == want }
+}
+
+// Empty is an allowed func for Flag accepting only an unset value.
+func Empty(v string) bool {
+	return v == ""
+}
+
+// HTTPS is an allowed func for Flag accepting only https:// URLs.
+func HTTPS(v string) bool {
+	return strings.HasPrefix(v, "https://")
+}
@@ -0,0 +1,76 @@
+package profile
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// parse registers --profile and the common flags on a fresh flag set and
+// parses args.
+func parse(t *testing.T, args ...string) (*Profile, *flag.FlagSet) {
+	t.Helper()
+	t.Setenv("PROFILE", "")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	p := Register(fs)
+	fs.String("log-level", "info", "")
+	fs.Bool("log-sensitive", false, "")
+	fs.String("vsock-transport", "vsock", "")
+	fs.String("trace-file", "", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return p, fs
+}
+
+func rules(fs *flag.FlagSet) []Rule {
+	return append(Common(fs), Flag(fs, "trace-file", Empty, "traces"), Flag(fs, "not-defined", Empty, "never violated"))
+}
+
+func TestDevAllowsEverything(t *testing.T) {
+	p, fs := parse(t, "--log-level", "debug", "--vsock-transport", "tcp")
+	if p.Name() != Dev || p.IsProd() {
+		t.Fatalf("default profile %q", p.Name())
+	}
+	if err := p.Enforce(rules(fs)...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProdRefuses(t *testing.T) {
+	p, fs := parse(t, "--profile", "prod")
+	if err := p.Enforce(rules(fs)...); err != nil {
+		t.Fatalf("prod with safe settings: %v", err)
+	}
+
+	p, fs = parse(t, "--profile", "prod", "--log-level", "DEBUG", "--log-sensitive", "--vsock-transport", "tcp:127.0.0.1", "--trace-file", "t.jsonl")
+	err := p.Enforce(rules(fs)...)
+	if err == nil {
+		t.Fatal("prod started with debug and sensitive logging, TCP and traces")
+	}
+	// Every violation is reported at once
+	for _, want := range []string{"--log-level=DEBUG", "--log-sensitive=true", "--vsock-transport=tcp:127.0.0.1", "--trace-file=t.jsonl"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %s", err, want)
+		}
+	}
+
+	p, _ = parse(t, "--profile", "prod")
+	custom := Rule{Setting: "unsigned requests", Reason: "no credentials", Violated: func() bool { return true }}
+	if err := p.Enforce(custom); err == nil || !strings.Contains(err.Error(), "unsigned requests: no credentials") {
+		t.Fatalf("custom rule: %v", err)
+	}
+}
+
+func TestUnknownProfile(t *testing.T) {
+	p, _ := parse(t, "--profile", "staging")
+	if err := p.Enforce(); err == nil {
+		t.Fatal("unknown profile accepted")
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	if !HTTPS("https://kms.us-east-1.amazonaws.com") || HTTPS("http://localhost:4566") {
+		t.Fatal("HTTPS")
+	}
+}
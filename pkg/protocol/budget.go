@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Budgets holds per-operation timeout budgets, as set by a flag such as
+//
+//	--operation-timeouts Encrypt=2s,EnvelopeEncrypt=5s
+//
+// Operations that aren't listed use the default passed to For.
+type Budgets map[string]time.Duration
+
+// Set parses a comma-separated list of Operation=duration pairs. It
+// implements flag.Value.
+func (b *Budgets) Set(s string) error {
+	m := Budgets{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		op, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("%q is not Operation=duration", pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q for %s", value, op)
+		}
+		m[strings.TrimSpace(op)] = d
+	}
+	*b = m
+	return nil
+}
+
+func (b *Budgets) String() string {
+	if b == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*b))
+	for op, d := range *b {
+		pairs = append(pairs, op+"="+d.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// For returns the budget for op, or def if none is configured.
+func (b Budgets) For(op string, def time.Duration) time.Duration {
+	if d, ok := b[op]; ok {
+		return d
+	}
+	return def
+}
+
+// Budget returns the budget that applies to req: the receiver's budget
+// for the operation, shortened to the sender's TimeoutMs if that is sooner.
+func (b Budgets) Budget(req *Request, def time.Duration) time.Duration {
+	budget := b.For(req.Operation, def)
+	if t := req.Timeout(); t > 0 && t < budget {
+		return t
+	}
+	return budget
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The error model is the same whichever transport carries it: a Code from
+// the list in protocol.go, a message, whether retrying may help, and
+// details. The raw vsock protocol sends the Error as is; an HTTP gateway
+// or gRPC service must answer with the status HTTPStatus or GRPCCode
+// returns and put the Error in the body or status details, so clients see
+// the same semantics on every transport.
+
+// retryableCodes are retryable unless the error says otherwise. A
+// kms_error is retryable only when KMS says so (throttling, 5xx); see the
+// vsock-proxy.
+var retryableCodes = map[string]bool{
+	CodeUpstream: true,
+	CodeBusy:     true,
+	CodeTimeout:  true,
+}
+
+// GRPCCode is a gRPC status code, numbered as in google.golang.org/grpc/codes.
+type GRPCCode uint32
+
+const (
+	GRPCOK                 GRPCCode = 0
+	GRPCUnknown            GRPCCode = 2
+	GRPCInvalidArgument    GRPCCode = 3
+	GRPCDeadlineExceeded   GRPCCode = 4
+	GRPCNotFound           GRPCCode = 5
+	GRPCAlreadyExists      GRPCCode = 6
+	GRPCPermissionDenied   GRPCCode = 7
+	GRPCResourceExhausted  GRPCCode = 8
+	GRPCFailedPrecondition GRPCCode = 9
+	GRPCOutOfRange         GRPCCode = 11
+	GRPCUnimplemented      GRPCCode = 12
+	GRPCInternal           GRPCCode = 13
+	GRPCUnavailable        GRPCCode = 14
+	GRPCUnauthenticated    GRPCCode = 16
+)
+
+// statusCodes maps each error code to its HTTP and gRPC status.
+var statusCodes = map[string]struct {
+	http int
+	grpc GRPCCode
+}{
+	CodeBadRequest:           {http.StatusBadRequest, GRPCInvalidArgument},
+	CodeUnsupportedOperation: {http.StatusNotImplemented, GRPCUnimplemented},
+	CodeKMS:                  {http.StatusBadGateway, GRPCFailedPrecondition},
+	CodeUpstream:             {http.StatusBadGateway, GRPCUnavailable},
+	CodeBusy:                 {http.StatusServiceUnavailable, GRPCResourceExhausted},
+	CodeTimeout:              {http.StatusGatewayTimeout, GRPCDeadlineExceeded},
+	CodeInvalidSignature:     {http.StatusUnprocessableEntity, GRPCInvalidArgument},
+	CodePolicyDenied:         {http.StatusForbidden, GRPCPermissionDenied},
+	CodeInternal:             {http.StatusInternalServerError, GRPCInternal},
+}
+
+// HTTPStatus returns the HTTP status code for e.
+func (e *Error) HTTPStatus() int {
+	if s, ok := statusCodes[e.Code]; ok {
+		return s.http
+	}
+	return http.StatusInternalServerError
+}
+
+// GRPCCode returns the gRPC status code for e. A retryable kms_error is
+// Unavailable, which gRPC clients retry, rather than FailedPrecondition,
+// which they don't.
+func (e *Error) GRPCCode() GRPCCode {
+	if e.Code == CodeKMS && e.Retryable {
+		return GRPCUnavailable
+	}
+	if s, ok := statusCodes[e.Code]; ok {
+		return s.grpc
+	}
+	return GRPCUnknown
+}
+
+// FromGRPC returns the Error for a gRPC status from a service the enclave
+// calls, such as a workload's callout service, so the connector sees it
+// with the usual semantics: a rejected request is bad_request, a refusal
+// policy_denied, an overloaded or unreachable service busy or
+// upstream_error (both retryable), and anything else internal_error. The
+// gRPC code is kept in the "grpc_code" detail.
+func FromGRPC(code GRPCCode, message string) *Error {
+	var e *Error
+	switch code {
+	case GRPCInvalidArgument, GRPCFailedPrecondition, GRPCOutOfRange, GRPCNotFound, GRPCAlreadyExists:
+		e = Errorf(CodeBadRequest, "%s", message)
+	case GRPCPermissionDenied, GRPCUnauthenticated:
+		e = Errorf(CodePolicyDenied, "%s", message)
+	case GRPCDeadlineExceeded:
+		e = Errorf(CodeTimeout, "%s", message)
+	case GRPCResourceExhausted:
+		e = Errorf(CodeBusy, "%s", message)
+	case GRPCUnavailable:
+		e = Errorf(CodeUpstream, "%s", message)
+	case GRPCUnimplemented:
+		e = Errorf(CodeUnsupportedOperation, "%s", message)
+	default:
+		e = Errorf(CodeInternal, "%s", message)
+	}
+	return e.WithDetail("grpc_code", fmt.Sprint(uint32(code)))
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestFailedKeepsRetryableAndDetails(t *testing.T) {
+	cause := Errorf(CodeKMS, "KMS Encrypt failed").WithRetryable(true).WithDetail("kms_status", "429")
+	resp := Failed(&Request{RequestId: "r1"}, fmt.Errorf("while encrypting: %w", cause))
+
+	var buf bytes.Buffer
+	if err := WriteResponse(&buf, resp); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadResponse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := got.Error
+	if e.Code != CodeKMS || e.Message != "while encrypting: KMS Encrypt failed" || !e.Retryable || e.Details["kms_status"] != "429" {
+		t.Fatalf("got %+v", e)
+	}
+}
+
+func TestStatusMapping(t *testing.T) {
+	tests := []struct {
+		err  *Error
+		http int
+		grpc GRPCCode
+	}{
+		{Errorf(CodeBadRequest, ""), http.StatusBadRequest, GRPCInvalidArgument},
+		{Errorf(CodeBusy, ""), http.StatusServiceUnavailable, GRPCResourceExhausted},
+		{Errorf(CodeTimeout, ""), http.StatusGatewayTimeout, GRPCDeadlineExceeded},
+		{Errorf(CodeKMS, ""), http.StatusBadGateway, GRPCFailedPrecondition},
+		{Errorf(CodeKMS, "").WithRetryable(true), http.StatusBadGateway, GRPCUnavailable},
+		{Errorf(CodePolicyDenied, ""), http.StatusForbidden, GRPCPermissionDenied},
+		{Errorf("something_new", ""), http.StatusInternalServerError, GRPCUnknown},
+	}
+	for _, tt := range tests {
+		if got := tt.err.HTTPStatus(); got != tt.http {
+			t.Errorf("%s (retryable %v): HTTP %d, want %d", tt.err.Code, tt.err.Retryable, got, tt.http)
+		}
+		if got := tt.err.GRPCCode(); got != tt.grpc {
+			t.Errorf("%s (retryable %v): gRPC %d, want %d", tt.err.Code, tt.err.Retryable, got, tt.grpc)
+		}
+	}
+}
+
+func TestFromGRPC(t *testing.T) {
+	tests := []struct {
+		grpc      GRPCCode
+		code      string
+		retryable bool
+	}{
+		{GRPCInvalidArgument, CodeBadRequest, false},
+		{GRPCNotFound, CodeBadRequest, false},
+		{GRPCUnauthenticated, CodePolicyDenied, false},
+		{GRPCDeadlineExceeded, CodeTimeout, true},
+		{GRPCResourceExhausted, CodeBusy, true},
+		{GRPCUnavailable, CodeUpstream, true},
+		{GRPCUnimplemented, CodeUnsupportedOperation, false},
+		{GRPCUnknown, CodeInternal, false},
+	}
+	for _, tt := range tests {
+		e := FromGRPC(tt.grpc, "from the service")
+		if e.Code != tt.code || e.Retryable != tt.retryable || e.Message != "from the service" || e.Details["grpc_code"] != fmt.Sprint(uint32(tt.grpc)) {
+			t.Errorf("gRPC %d: got %+v", tt.grpc, e)
+		}
+	}
+}
+
+func TestRetryableByDefault(t *testing.T) {
+	for code, want := range map[string]bool{CodeBusy: true, CodeTimeout: true, CodeUpstream: true, CodeBadRequest: false, CodeKMS: false} {
+		if got := Errorf(code, "").Retryable; got != want {
+			t.Errorf("%s: retryable %v, want %v", code, got, want)
+		}
+	}
+}
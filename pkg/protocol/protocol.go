@@ -0,0 +1,425 @@
+// Package protocol defines the request and response messages exchanged
+// between the connector, the enclave and the vsock-proxy. Each message is
+// JSON encoded and sent as a single pkg/framing frame; every request is
+// answered with exactly one Response, which carries either a result or an
+// error.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/framing"
+	"nitro-dev-qemu/pkg/payload"
+)
+
+// Version is the protocol version sent in every request and response.
+const Version = 1
+
+// Supported operations.
+const (
+	OpEncrypt = "Encrypt"
+	OpDecrypt = "Decrypt"
+
+	// OpGenerateDataKey is sent by the enclave to the vsock-proxy; the
+	// response is a JSON encoded DataKey. The payload is unused.
+	OpGenerateDataKey = "GenerateDataKey"
+
+	// OpEnvelopeEncrypt and OpEnvelopeDecrypt are handled inside the
+	// enclave with a KMS data key; the result of EnvelopeEncrypt (and the
+	// payload of EnvelopeDecrypt) is a JSON envelope from pkg/envelope.
+	OpEnvelopeEncrypt = "EnvelopeEncrypt"
+	OpEnvelopeDecrypt = "EnvelopeDecrypt"
+
+	// OpSign signs the payload with an asymmetric KMS key; the result is
+	// the base64 signature. OpVerify checks Signing.Signature against the
+	// payload; the result is a JSON encoded Verification, and an invalid
+	// signature is reported as CodeInvalidSignature.
+	OpSign   = "Sign"
+	OpVerify = "Verify"
+
+	// OpGenerateRandom asks for NumberOfBytes random bytes from KMS; the
+	// result is the bytes themselves.
+	OpGenerateRandom = "GenerateRandom"
+
+	// OpTransform runs the payload through an enclave pipeline of stages
+	// such as gzip,envelope,base64 (see pkg/transform), named in Pipeline
+	// or configured on the enclave. OpReverseTransform undoes the same
+	// pipeline.
+	OpTransform        = "Transform"
+	OpReverseTransform = "ReverseTransform"
+
+	// OpEncryptFields encrypts only the fields of a JSON document that
+	// Fields selects (JSONPaths, see pkg/jsonpath), each through the
+	// Transform pipeline, and returns the document with those values
+	// replaced by ciphertext strings. OpDecryptFields restores them.
+	OpEncryptFields = "EncryptFields"
+	OpDecryptFields = "DecryptFields"
+
+	// OpEncryptColumns encrypts the cells of the CSV columns named in
+	// Columns, each through the Transform pipeline; the payload and result
+	// are CSV with a header row. OpDecryptColumns restores them.
+	OpEncryptColumns = "EncryptColumns"
+	OpDecryptColumns = "DecryptColumns"
+
+	// OpFPEEncrypt encrypts the numerals in the payload, such as the
+	// digits of a card number or SSN, with FF3-1 format-preserving
+	// encryption (see pkg/ff3) under a deterministic key, leaving any
+	// other characters in place. OpFPEDecrypt restores them. FPE sets the
+	// radix and tweak.
+	OpFPEEncrypt = "FPEEncrypt"
+	OpFPEDecrypt = "FPEDecrypt"
+
+	// OpRecordEncrypt encrypts the payload under a key of its own for
+	// RecordId, derived inside the enclave from a KMS data key (see
+	// pkg/shred); the result is base64. OpRecordDecrypt restores it.
+	// OpShred destroys RecordId's key, making all of its ciphertexts
+	// unreadable; the result is a JSON encoded ShredResult.
+	OpRecordEncrypt = "RecordEncrypt"
+	OpRecordDecrypt = "RecordDecrypt"
+	OpShred         = "Shred"
+
+	// OpStreamEncrypt and OpStreamDecrypt take a whole connection, for
+	// payloads of any size (see pkg/envelope's Stream). The first request
+	// opens the stream: for StreamEncrypt it has an empty payload and
+	// Stream.ChunkSize, and the result is the JSON StreamHeader; for
+	// StreamDecrypt the payload is that header and the result is empty.
+	// Each following request on the connection carries one chunk, in
+	// order, and its result is the chunk encrypted or decrypted. The
+	// stream, and the connection, end with the request marked
+	// Stream.Final.
+	OpStreamEncrypt = "StreamEncrypt"
+	OpStreamDecrypt = "StreamDecrypt"
+)
+
+// builtinOperations are the operations above. Any other name is free for a
+// workload's own operations, which an enclave may hand to a callout
+// service (see pkg/callout).
+var builtinOperations = map[string]bool{
+	OpEncrypt: true, OpDecrypt: true, OpGenerateDataKey: true,
+	OpEnvelopeEncrypt: true, OpEnvelopeDecrypt: true,
+	OpSign: true, OpVerify: true, OpGenerateRandom: true,
+	OpTransform: true, OpReverseTransform: true,
+	OpEncryptFields: true, OpDecryptFields: true,
+	OpEncryptColumns: true, OpDecryptColumns: true,
+	OpFPEEncrypt: true, OpFPEDecrypt: true,
+	OpRecordEncrypt: true, OpRecordDecrypt: true, OpShred: true,
+	OpStreamEncrypt: true, OpStreamDecrypt: true,
+}
+
+// IsBuiltin reports whether op is one of the operations above.
+func IsBuiltin(op string) bool {
+	return builtinOperations[op]
+}
+
+// MaxRandomBytes is the most a GenerateRandom request may ask for, the KMS
+// limit per call.
+const MaxRandomBytes = 1024
+
+// Request asks the receiver to perform Operation on Payload. For Encrypt
+// the payload is plaintext; for Decrypt it is a base64 CiphertextBlob as
+// returned by Encrypt. KeyId selects the KMS key (empty means the
+// vsock-proxy's default) and RequestId is echoed in the response and
+// propagated to upstream requests. Seq is also echoed: it tells apart
+// requests multiplexed on one persistent connection. TimeoutMs, when set,
+// is how long the sender will wait for the response; the receiver gives up
+// at that point or at its own budget for the operation, whichever is
+// sooner.
+type Request struct {
+	Version   int    `json:"version"`
+	Seq       uint64 `json:"seq,omitempty"`
+	Operation string `json:"operation"`
+	KeyId     string `json:"key_id,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
+	TimeoutMs int64  `json:"timeout_ms,omitempty"`
+	// NumberOfBytes is the size of a GenerateRandom result.
+	NumberOfBytes int `json:"number_of_bytes,omitempty"`
+	// Pipeline is the comma-separated stage list for Transform,
+	// ReverseTransform and the field and column operations.
+	Pipeline string `json:"pipeline,omitempty"`
+	// Fields are the JSONPaths EncryptFields and DecryptFields apply to.
+	// Fields and Columns may name their own key with an "@" suffix, such
+	// as "$.email@alias/dev-token-key" (see SplitFieldKey).
+	Fields []string `json:"fields,omitempty"`
+	// Columns are the CSV column names EncryptColumns and DecryptColumns
+	// apply to.
+	Columns []string `json:"columns,omitempty"`
+	// RecordId names the record for RecordEncrypt, RecordDecrypt and
+	// Shred, such as a customer ID.
+	RecordId  string          `json:"record_id,omitempty"`
+	Payload   payload.Payload `json:"payload"`
+	Recipient *Recipient      `json:"recipient,omitempty"`
+	Signing   *Signing        `json:"signing,omitempty"`
+	FPE       *FPE            `json:"fpe,omitempty"`
+	Stream    *Stream         `json:"stream,omitempty"`
+}
+
+// Stream carries the parameters of StreamEncrypt and StreamDecrypt.
+// ChunkSize is the plaintext size of the chunks, set when a StreamEncrypt
+// is opened. Final marks the last chunk, which may be shorter or empty.
+type Stream struct {
+	ChunkSize int  `json:"chunk_size,omitempty"`
+	Final     bool `json:"final,omitempty"`
+}
+
+// FPE carries the parameters of FPEEncrypt, FPEDecrypt and the fpe
+// pipeline stage. Radix is the number base of the numerals, 2 to 36 (0
+// means 10): digits first, then lowercase letters. Tweak is 7 bytes, hex
+// encoded, mixed into the encryption so the same value encrypts
+// differently in different domains, such as two fields; it defaults to
+// zeros.
+type FPE struct {
+	Radix int    `json:"radix,omitempty"`
+	Tweak string `json:"tweak,omitempty"`
+}
+
+// Signing carries the parameters of Sign and Verify, named as in the KMS
+// API. SigningAlgorithm defaults to RSASSA_PSS_SHA_256 and MessageType to
+// RAW (the payload is the message itself rather than its digest).
+// Signature, base64 encoded as returned by Sign, is used by Verify only.
+type Signing struct {
+	SigningAlgorithm string `json:"signing_algorithm,omitempty"`
+	MessageType      string `json:"message_type,omitempty"`
+	Signature        string `json:"signature,omitempty"`
+}
+
+// Verification is the result of a successful Verify.
+type Verification struct {
+	KeyId            string `json:"key_id"`
+	SigningAlgorithm string `json:"signing_algorithm"`
+	SignatureValid   bool   `json:"signature_valid"`
+}
+
+// ShredResult is the result of Shred. HadKey is false when the record's
+// key had already been destroyed or never existed; shredding is
+// idempotent either way. ShreddedAt is when the key was destroyed.
+type ShredResult struct {
+	RecordId   string    `json:"record_id"`
+	HadKey     bool      `json:"had_key"`
+	ShreddedAt time.Time `json:"shredded_at"`
+}
+
+// Recipient mirrors the KMS RecipientInfo parameter. When a Decrypt
+// request carries one, the result is not the plaintext but a
+// CiphertextForRecipient (see pkg/attestation) that only the enclave whose
+// key is in the attestation document can open.
+type Recipient struct {
+	KeyEncryptionAlgorithm string `json:"key_encryption_algorithm"`
+	AttestationDocument    []byte `json:"attestation_document"`
+}
+
+// Response statuses.
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// Response answers a Request. Result is set when Status is StatusOK, Error
+// when it is StatusError. Timing is set by receivers that report it, on
+// success and failure alike.
+type Response struct {
+	Version   int             `json:"version"`
+	Seq       uint64          `json:"seq,omitempty"`
+	RequestId string          `json:"request_id,omitempty"`
+	Status    string          `json:"status"`
+	Error     *Error          `json:"error,omitempty"`
+	Result    payload.Payload `json:"result"`
+	Timing    *Timing         `json:"timing,omitempty"`
+}
+
+// Timing reports where the receiver spent its time on a request and the
+// timeout budget it applied, so clients can set their own deadlines from
+// observed behaviour instead of guessing. StagesMs names are specific to
+// the receiver (e.g. "read", "kms"); stages the receiver's own upstream
+// reported are included with a prefix such as "proxy_".
+type Timing struct {
+	BudgetMs float64            `json:"budget_ms"`
+	TotalMs  float64            `json:"total_ms"`
+	StagesMs map[string]float64 `json:"stages_ms,omitempty"`
+}
+
+// Ms converts d to fractional milliseconds for Timing.
+func Ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Error codes reported in a Response. errors.go maps them to HTTP and gRPC
+// status codes.
+const (
+	CodeBadRequest           = "bad_request"
+	CodeUnsupportedOperation = "unsupported_operation"
+	CodeKMS                  = "kms_error"
+	CodeUpstream             = "upstream_error"
+	CodeBusy                 = "busy"
+	CodeTimeout              = "timeout"
+	CodeInvalidSignature     = "invalid_signature"
+	CodePolicyDenied         = "policy_denied"
+	CodeInternal             = "internal_error"
+)
+
+// Error is a failure reported by the peer. It implements error so it can be
+// returned (and wrapped) like any other error; Error() returns only the
+// message, the code is for callers that inspect it with errors.As.
+//
+// Retryable tells the client whether sending the same request again may
+// succeed. Details carries machine-readable context, such as the KMS
+// status and error type behind a kms_error.
+type Error struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Retryable bool              `json:"retryable,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf returns an *Error with the given code, retryable if the code
+// usually is (see retryableCodes).
+func Errorf(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), Retryable: retryableCodes[code]}
+}
+
+// WithRetryable overrides whether the error is retryable and returns e.
+func (e *Error) WithRetryable(retryable bool) *Error {
+	e.Retryable = retryable
+	return e
+}
+
+// WithDetail adds a detail and returns e.
+func (e *Error) WithDetail(key, value string) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details[key] = value
+	return e
+}
+
+// Timeout returns the sender's TimeoutMs as a duration (0 if unset).
+func (r *Request) Timeout() time.Duration {
+	return time.Duration(r.TimeoutMs) * time.Millisecond
+}
+
+// SplitFieldKey splits a Fields or Columns entry such as
+// "$.email@alias/dev-token-key" into the field and its own key ID. The
+// key ID is empty when the entry has none, and the request's KeyId
+// applies.
+func SplitFieldKey(entry string) (field, keyID string) {
+	i := strings.LastIndex(entry, "@")
+	if i <= 0 || strings.ContainsAny(entry[i+1:], "]'\"") {
+		return strings.TrimSpace(entry), ""
+	}
+	return strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+}
+
+// OK returns a successful response to req.
+func OK(req *Request, result []byte) *Response {
+	resp := reply(req)
+	resp.Status = StatusOK
+	resp.Result = payload.New(result)
+	return resp
+}
+
+// Failed returns an error response to req (which may be nil if the request
+// could not be read). An *Error anywhere in err's chain supplies the code;
+// otherwise the failure is reported as an internal error. The message is
+// that of err as a whole, so context added by wrapping is kept.
+func Failed(req *Request, err error) *Response {
+	var perr *Error
+	if errors.As(err, &perr) {
+		perr = &Error{Code: perr.Code, Message: err.Error(), Retryable: perr.Retryable, Details: perr.Details}
+	} else {
+		perr = &Error{Code: CodeInternal, Message: err.Error()}
+	}
+	resp := reply(req)
+	resp.Status = StatusError
+	resp.Error = perr
+	return resp
+}
+
+// reply returns a response echoing req's identifiers.
+func reply(req *Request) *Response {
+	resp := &Response{Version: Version}
+	if req != nil {
+		resp.Seq = req.Seq
+		resp.RequestId = req.RequestId
+	}
+	return resp
+}
+
+// Err returns the response's error (always an *Error), or nil if it
+// succeeded.
+func (r *Response) Err() error {
+	if r.Status == StatusOK {
+		return nil
+	}
+	if r.Error == nil {
+		return Errorf(CodeInternal, "response has status %q but no error", r.Status)
+	}
+	return r.Error
+}
+
+// DataKey is the vsock-proxy's response to GenerateDataKey.
+type DataKey struct {
+	KeyId          string          `json:"key_id"`
+	Plaintext      payload.Payload `json:"plaintext"`
+	CiphertextBlob string          `json:"ciphertext_blob"`
+}
+
+// WriteRequest sends req as one frame, filling in the protocol version.
+func WriteRequest(w io.Writer, req *Request) error {
+	req.Version = Version
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+	return framing.WriteFrame(w, data)
+}
+
+// ReadRequest reads one frame and decodes it as a Request. Malformed or
+// unsupported requests yield an *Error with CodeBadRequest; the request is
+// still returned when it could be parsed, so its RequestId can be echoed.
+func ReadRequest(r io.Reader) (*Request, error) {
+	data, err := framing.ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, Errorf(CodeBadRequest, "failed to parse request: %v", err)
+	}
+	if req.Version != Version {
+		return &req, Errorf(CodeBadRequest, "unsupported protocol version %d", req.Version)
+	}
+	return &req, nil
+}
+
+// WriteResponse sends resp as one frame.
+func WriteResponse(w io.Writer, resp *Response) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %v", err)
+	}
+	return framing.WriteFrame(w, data)
+}
+
+// ReadResponse reads one frame and decodes it as a Response.
+func ReadResponse(r io.Reader) (*Response, error) {
+	data, err := framing.ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	if resp.Version != Version {
+		return nil, fmt.Errorf("unsupported protocol version %d in response", resp.Version)
+	}
+	return &resp, nil
+}
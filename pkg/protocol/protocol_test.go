@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"nitro-dev-qemu/pkg/framing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	req := &Request{Seq: 7, RequestId: "r1", Operation: OpEncrypt, KeyId: "alias/k"}
+	if err := WriteRequest(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadRequest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != Version || got.Seq != 7 || got.RequestId != "r1" || got.Operation != OpEncrypt || got.KeyId != "alias/k" {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestReadRequestErrors(t *testing.T) {
+	// A request from another protocol version is still returned, so the
+	// caller can echo its RequestId in the error response.
+	var buf bytes.Buffer
+	framing.WriteFrame(&buf, []byte(`{"version":99,"request_id":"r1","operation":"Encrypt"}`))
+	req, err := ReadRequest(&buf)
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Code != CodeBadRequest {
+		t.Fatalf("bad version: err = %v", err)
+	}
+	if req == nil || req.RequestId != "r1" {
+		t.Fatalf("bad version: req = %+v", req)
+	}
+
+	buf.Reset()
+	framing.WriteFrame(&buf, []byte(`{not json`))
+	req, err = ReadRequest(&buf)
+	if !errors.As(err, &perr) || perr.Code != CodeBadRequest || req != nil {
+		t.Fatalf("malformed: req = %+v, err = %v", req, err)
+	}
+
+	// Framing errors pass through unchanged, so callers can tell a clean
+	// disconnect from a bad request.
+	if _, err := ReadRequest(&bytes.Buffer{}); err != io.EOF {
+		t.Fatalf("empty: err = %v, want io.EOF", err)
+	}
+}
+
+func TestReadResponseErrors(t *testing.T) {
+	var buf bytes.Buffer
+	framing.WriteFrame(&buf, []byte(`{"version":99,"status":"ok"}`))
+	if resp, err := ReadResponse(&buf); err == nil {
+		t.Fatalf("bad version: got %+v", resp)
+	}
+	buf.Reset()
+	framing.WriteFrame(&buf, []byte(`[]`))
+	if resp, err := ReadResponse(&buf); err == nil {
+		t.Fatalf("malformed: got %+v", resp)
+	}
+}
+
+func TestOKAndFailed(t *testing.T) {
+	req := &Request{Seq: 3, RequestId: "r1"}
+	resp := OK(req, []byte("out"))
+	if resp.Seq != 3 || resp.RequestId != "r1" || resp.Status != StatusOK || resp.Err() != nil {
+		t.Fatalf("OK: got %+v", resp)
+	}
+	if string(resp.Result.Bytes()) != "out" {
+		t.Fatalf("OK: result %q", resp.Result.Bytes())
+	}
+
+	// Errors without an *Error in their chain are reported as internal.
+	resp = Failed(nil, errors.New("boom"))
+	var perr *Error
+	if !errors.As(resp.Err(), &perr) || perr.Code != CodeInternal || perr.Message != "boom" {
+		t.Fatalf("Failed: got %+v", resp.Error)
+	}
+	if resp.RequestId != "" || resp.Seq != 0 {
+		t.Fatalf("Failed(nil): got %+v", resp)
+	}
+
+	// A response claiming failure without saying why is still an error.
+	resp = &Response{Status: StatusError}
+	if !errors.As(resp.Err(), &perr) || perr.Code != CodeInternal {
+		t.Fatalf("Err: got %v", resp.Err())
+	}
+}
+
+func TestSplitFieldKey(t *testing.T) {
+	tests := []struct {
+		entry, field, keyID string
+	}{
+		{"$.email", "$.email", ""},
+		{"$.email@alias/dev-token-key", "$.email", "alias/dev-token-key"},
+		{"email @ alias/k ", "email", "alias/k"},
+		{"@alias/k", "@alias/k", ""},
+		{"$['a@b']", "$['a@b']", ""},
+		{"$['a@b']@alias/k", "$['a@b']", "alias/k"},
+	}
+	for _, tt := range tests {
+		field, keyID := SplitFieldKey(tt.entry)
+		if field != tt.field || keyID != tt.keyID {
+			t.Errorf("SplitFieldKey(%q) = %q, %q; want %q, %q", tt.entry, field, keyID, tt.field, tt.keyID)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+)
+
+// NewRequestID returns a random identifier for a new request, a version 4
+// UUID. The connector sets one on every request; the enclave and the
+// vsock-proxy log it on each line about the request, copy it to the
+// requests they make for it, and the vsock-proxy sends it to KMS, so one
+// ID finds a request in every log.
+func NewRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the ID of the request it
+// serves, so code further down, such as a KMS call, can be tagged with it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"context"
+	"regexp"
+	"testing"
+)
+
+func TestNewRequestID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for range 100 {
+		id := NewRequestID()
+		if !uuid.MatchString(id) {
+			t.Fatalf("%q is not a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("%q generated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestRequestIDContext(t *testing.T) {
+	if id := RequestID(context.Background()); id != "" {
+		t.Fatalf("RequestID without one = %q", id)
+	}
+	ctx := WithRequestID(context.Background(), "r1")
+	if id := RequestID(ctx); id != "r1" {
+		t.Fatalf("RequestID = %q, want r1", id)
+	}
+}
@@ -0,0 +1,252 @@
+// Package shred implements crypto-shredding: every record is encrypted
+// under its own key, so a record can be erased by destroying its key
+// instead of hunting down every copy of its ciphertext in databases, logs
+// and backups.
+//
+// A record key is derived with HKDF-SHA256 from a root key (a KMS data
+// key), a random salt kept for that record, and the record ID. The salt is
+// the record's derivation material: Shred deletes it, after which the key
+// can't be derived again, even with the root key, and every ciphertext of
+// the record is unreadable. Other records are untouched. A shredded record
+// leaves a tombstone with no key material, so that encrypting under its ID
+// again is refused rather than quietly starting a new record.
+//
+// The salts and tombstones are a Keyring's state. Save seals it under a
+// key derived from the root key for storage outside the enclave, and New
+// loads it back. Shredding is only as final as the deletion of the older
+// saved states that still hold the salt.
+package shred
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RootKeySize is the size of the root key, a KMS AES_256 data key.
+const RootKeySize = 32
+
+// SaltSize is the size of each record's salt.
+const SaltSize = 32
+
+// version is the first byte of record ciphertexts and sealed states.
+const version = 1
+
+var (
+	// ErrShredded is returned for records whose key has been destroyed.
+	ErrShredded = errors.New("shred: record has been shredded")
+	// ErrUnknownRecord is returned when decrypting a record the keyring
+	// has no key for.
+	ErrUnknownRecord = errors.New("shred: unknown record")
+	// ErrOpen is returned when a ciphertext or state fails
+	// authentication: it is damaged, or belongs to another record or
+	// another root key.
+	ErrOpen = errors.New("shred: message authentication failed")
+)
+
+// record is a record's derivation material, or its tombstone once
+// shredded.
+type record struct {
+	Salt     []byte    `json:"salt,omitempty"`
+	Shredded time.Time `json:"shredded,omitempty"`
+}
+
+// Keyring derives per-record keys from a root key. It is safe for
+// concurrent use.
+type Keyring struct {
+	stateKey []byte
+
+	mu      sync.Mutex
+	root    []byte
+	records map[string]*record
+	changes uint64
+}
+
+// New returns a keyring for the 32-byte root key. state is a sealed state
+// from Save, or nil to start empty.
+func New(root, state []byte) (*Keyring, error) {
+	if len(root) != RootKeySize {
+		return nil, fmt.Errorf("shred: root key must be %d bytes, got %d", RootKeySize, len(root))
+	}
+	k := &Keyring{root: append([]byte(nil), root...), records: map[string]*record{}}
+	var err error
+	if k.stateKey, err = hkdf.Key(sha256.New, root, nil, "nitro-dev-qemu shred state", 32); err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return k, nil
+	}
+	plain, err := open(k.stateKey, state, []byte("state"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(plain, &k.records); err != nil {
+		return nil, fmt.Errorf("shred: bad state: %v", err)
+	}
+	return k, nil
+}
+
+// recordKey derives the key of recordID from its salt.
+func (k *Keyring) recordKey(recordID string, r *record) ([]byte, error) {
+	return hkdf.Key(sha256.New, k.root, r.Salt, "nitro-dev-qemu shred record "+recordID, 32)
+}
+
+// Encrypt encrypts plaintext under recordID's key, creating the record
+// with a salt read from random on first use. The ciphertext is a version
+// byte, the nonce and the AES-256-GCM output; the record ID is
+// authenticated, so ciphertexts can't be moved between records.
+func (k *Keyring) Encrypt(random io.Reader, recordID string, plaintext []byte) ([]byte, error) {
+	if recordID == "" {
+		return nil, errors.New("shred: empty record ID")
+	}
+	k.mu.Lock()
+	r, ok := k.records[recordID]
+	if !ok {
+		r = &record{Salt: make([]byte, SaltSize)}
+		if _, err := io.ReadFull(random, r.Salt); err != nil {
+			k.mu.Unlock()
+			return nil, fmt.Errorf("shred: failed to generate salt: %v", err)
+		}
+		k.records[recordID] = r
+		k.changes++
+	}
+	if r.Salt == nil {
+		k.mu.Unlock()
+		return nil, ErrShredded
+	}
+	key, err := k.recordKey(recordID, r)
+	k.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return seal(random, key, plaintext, []byte("record "+recordID))
+}
+
+// Decrypt decrypts a ciphertext from Encrypt for recordID.
+func (k *Keyring) Decrypt(recordID string, ciphertext []byte) ([]byte, error) {
+	k.mu.Lock()
+	r, ok := k.records[recordID]
+	switch {
+	case !ok:
+		k.mu.Unlock()
+		return nil, ErrUnknownRecord
+	case r.Salt == nil:
+		k.mu.Unlock()
+		return nil, ErrShredded
+	}
+	key, err := k.recordKey(recordID, r)
+	k.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return open(key, ciphertext, []byte("record "+recordID))
+}
+
+// Shred destroys recordID's salt, leaving a tombstone dated now. It
+// reports whether the record had a key; shredding an unknown or already
+// shredded record only makes sure the tombstone is there.
+func (k *Keyring) Shred(recordID string, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	r, ok := k.records[recordID]
+	if ok && r.Salt == nil {
+		return false
+	}
+	if ok {
+		clear(r.Salt)
+	}
+	k.records[recordID] = &record{Shredded: now.UTC()}
+	k.changes++
+	return ok
+}
+
+// Changes counts the changes to the keyring's state: records created and
+// shredded. Compare it before and after an operation to tell whether the
+// state needs saving.
+func (k *Keyring) Changes() uint64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.changes
+}
+
+// Shredded returns when recordID was shredded, or false if it wasn't.
+func (k *Keyring) Shredded(recordID string) (time.Time, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	r, ok := k.records[recordID]
+	if !ok || r.Salt != nil {
+		return time.Time{}, false
+	}
+	return r.Shredded, true
+}
+
+// Records returns the IDs of the live (not shredded) records, sorted.
+func (k *Keyring) Records() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var ids []string
+	for id, r := range k.records {
+		if r.Salt != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Save returns the keyring's state sealed under a key derived from the
+// root key, with a nonce read from random.
+func (k *Keyring) Save(random io.Reader) ([]byte, error) {
+	k.mu.Lock()
+	plain, err := json.Marshal(k.records)
+	k.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return seal(random, k.stateKey, plain, []byte("state"))
+}
+
+func seal(random io.Reader, key, plaintext, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1+gcm.NonceSize(), 1+gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	out[0] = version
+	if _, err := io.ReadFull(random, out[1:]); err != nil {
+		return nil, fmt.Errorf("shred: failed to generate nonce: %v", err)
+	}
+	return gcm.Seal(out, out[1:], plaintext, ad), nil
+}
+
+func open(key, ciphertext, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < 1+gcm.NonceSize()+gcm.Overhead() || ciphertext[0] != version {
+		return nil, ErrOpen
+	}
+	nonce := ciphertext[1 : 1+gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext[1+gcm.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrOpen
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
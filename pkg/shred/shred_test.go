@@ -0,0 +1,135 @@
+package shred
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newKeyring(t *testing.T) (*Keyring, []byte) {
+	t.Helper()
+	root := make([]byte, RootKeySize)
+	rand.Read(root)
+	k, err := New(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, root
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k, _ := newKeyring(t)
+
+	a, err := k.Encrypt(rand.Reader, "user-1", []byte("alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.Encrypt(rand.Reader, "user-2", []byte("bob@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := k.Decrypt("user-1", a); err != nil || string(got) != "alice@example.com" {
+		t.Fatalf("Decrypt = %q, %v", got, err)
+	}
+
+	// A ciphertext only opens under its own record
+	if _, err := k.Decrypt("user-2", a); !errors.Is(err, ErrOpen) {
+		t.Fatalf("Decrypt under another record: %v", err)
+	}
+	if _, err := k.Decrypt("user-3", a); !errors.Is(err, ErrUnknownRecord) {
+		t.Fatalf("Decrypt of an unknown record: %v", err)
+	}
+	a[len(a)-1] ^= 1
+	if _, err := k.Decrypt("user-1", a); !errors.Is(err, ErrOpen) {
+		t.Fatalf("Decrypt of a damaged ciphertext: %v", err)
+	}
+	if got, err := k.Decrypt("user-2", b); err != nil || string(got) != "bob@example.com" {
+		t.Fatalf("Decrypt = %q, %v", got, err)
+	}
+}
+
+func TestShred(t *testing.T) {
+	k, _ := newKeyring(t)
+	a, _ := k.Encrypt(rand.Reader, "user-1", []byte("alice"))
+	b, _ := k.Encrypt(rand.Reader, "user-2", []byte("bob"))
+
+	if k.Changes() != 2 {
+		t.Fatalf("Changes = %d after creating two records", k.Changes())
+	}
+	k.Encrypt(rand.Reader, "user-1", []byte("alice"))
+	if k.Changes() != 2 {
+		t.Fatal("encrypting under an existing record changed the state")
+	}
+
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	if !k.Shred("user-1", now) {
+		t.Fatal("Shred of a live record reported no key")
+	}
+	if _, err := k.Decrypt("user-1", a); !errors.Is(err, ErrShredded) {
+		t.Fatalf("Decrypt after Shred: %v", err)
+	}
+	if _, err := k.Encrypt(rand.Reader, "user-1", []byte("alice again")); !errors.Is(err, ErrShredded) {
+		t.Fatalf("Encrypt after Shred: %v", err)
+	}
+	if at, ok := k.Shredded("user-1"); !ok || !at.Equal(now) {
+		t.Fatalf("Shredded = %v, %v", at, ok)
+	}
+	if k.Shred("user-1", now.Add(time.Hour)) {
+		t.Fatal("second Shred reported a key")
+	}
+	if at, _ := k.Shredded("user-1"); !at.Equal(now) {
+		t.Fatalf("second Shred moved the tombstone to %v", at)
+	}
+
+	// Other records are untouched
+	if got, err := k.Decrypt("user-2", b); err != nil || string(got) != "bob" {
+		t.Fatalf("Decrypt of another record = %q, %v", got, err)
+	}
+	if ids := k.Records(); len(ids) != 1 || ids[0] != "user-2" {
+		t.Fatalf("Records = %v", ids)
+	}
+
+	// Shredding a record that never existed leaves a tombstone
+	if k.Shred("user-9", now) {
+		t.Fatal("Shred of an unknown record reported a key")
+	}
+	if _, err := k.Encrypt(rand.Reader, "user-9", []byte("x")); !errors.Is(err, ErrShredded) {
+		t.Fatalf("Encrypt after Shred of an unknown record: %v", err)
+	}
+}
+
+func TestSave(t *testing.T) {
+	k, root := newKeyring(t)
+	a, _ := k.Encrypt(rand.Reader, "user-1", []byte("alice"))
+	b, _ := k.Encrypt(rand.Reader, "user-2", []byte("bob"))
+	k.Shred("user-2", time.Now())
+
+	state, err := k.Save(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(state, []byte("user-1")) {
+		t.Fatal("saved state shows record IDs")
+	}
+
+	k2, err := New(root, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := k2.Decrypt("user-1", a); err != nil || string(got) != "alice" {
+		t.Fatalf("Decrypt after reload = %q, %v", got, err)
+	}
+	if _, err := k2.Decrypt("user-2", b); !errors.Is(err, ErrShredded) {
+		t.Fatalf("shredded record after reload: %v", err)
+	}
+
+	other := make([]byte, RootKeySize)
+	if _, err := New(other, state); !errors.Is(err, ErrOpen) {
+		t.Fatalf("state under another root key: %v", err)
+	}
+	if _, err := New(root[:16], nil); err == nil {
+		t.Fatal("16-byte root key accepted")
+	}
+}
@@ -0,0 +1,121 @@
+// Package shutdown helps the vsock servers stop cleanly: on SIGINT or
+// SIGTERM they stop accepting, let in-flight handlers finish for a bounded
+// time and then exit.
+//
+// Two contexts carry this to the network code. Listening ends at Stop, and
+// accept loops pass it to vsock.Accept, which closes their listeners.
+// Context ends when Wait gives up on the handlers; connections are bound
+// to contexts derived from it (see vsock.WithConn), so abandoned handlers
+// have their connections closed rather than left to the process exit.
+package shutdown
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Drainer tracks in-flight connection handlers.
+type Drainer struct {
+	wg       sync.WaitGroup
+	active   int64
+	stopping int32
+
+	once                       sync.Once
+	listening, serving         context.Context
+	stopListening, stopServing context.CancelFunc
+}
+
+// Go runs handler in a new goroutine and tracks it until it returns.
+func (d *Drainer) Go(handler func()) {
+	d.wg.Add(1)
+	atomic.AddInt64(&d.active, 1)
+	go func() {
+		defer func() {
+			atomic.AddInt64(&d.active, -1)
+			d.wg.Done()
+		}()
+		handler()
+	}()
+}
+
+// Active returns the number of handlers still running.
+func (d *Drainer) Active() int64 {
+	return atomic.LoadInt64(&d.active)
+}
+
+// Stop marks the server as shutting down, so accept loops can tell a
+// listener closed on purpose from an accept failure.
+func (d *Drainer) Stop() {
+	if atomic.CompareAndSwapInt32(&d.stopping, 0, 1) {
+		d.init()
+		d.stopListening()
+	}
+}
+
+// Done returns a channel that is closed by Stop, so handlers serving
+// long-lived connections can stop reading new requests.
+func (d *Drainer) Done() <-chan struct{} {
+	return d.Listening().Done()
+}
+
+// Listening returns a context that ends when Stop is called. Accept loops
+// pass it to vsock.Accept, so stopping closes their listeners.
+func (d *Drainer) Listening() context.Context {
+	d.init()
+	return d.listening
+}
+
+// Context returns the servers' root context, which ends when Wait gives
+// up on the handlers still running. Connection contexts derive from it.
+func (d *Drainer) Context() context.Context {
+	d.init()
+	return d.serving
+}
+
+func (d *Drainer) init() {
+	d.once.Do(func() {
+		d.serving, d.stopServing = context.WithCancel(context.Background())
+		d.listening, d.stopListening = context.WithCancel(d.serving)
+	})
+}
+
+// Stopping reports whether Stop has been called.
+func (d *Drainer) Stopping() bool {
+	return atomic.LoadInt32(&d.stopping) == 1
+}
+
+// Wait blocks until every handler has returned or timeout elapses, and
+// reports whether all handlers finished. When they haven't, it cancels
+// Context, closing the connections of the handlers it abandons.
+func (d *Drainer) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		d.init()
+		d.stopServing()
+		return false
+	}
+}
+
+// OnSignal calls f once, in its own goroutine, when the process receives
+// SIGINT or SIGTERM.
+func OnSignal(f func(os.Signal)) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		f(sig)
+	}()
+}
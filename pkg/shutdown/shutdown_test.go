@@ -0,0 +1,120 @@
+package shutdown
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDrainOrder(t *testing.T) {
+	var d Drainer
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	d.Go(func() {
+		<-release
+		close(finished)
+	})
+	if n := d.Active(); n != 1 {
+		t.Fatalf("Active() = %d, want 1", n)
+	}
+	if d.Stopping() || d.Listening().Err() != nil || d.Context().Err() != nil {
+		t.Fatal("stopping before Stop")
+	}
+
+	// Stop ends Listening first; handlers keep their connections
+	d.Stop()
+	if !d.Stopping() {
+		t.Fatal("Stopping() is false after Stop")
+	}
+	select {
+	case <-d.Done():
+	default:
+		t.Fatal("Done isn't closed after Stop")
+	}
+	if d.Listening().Err() == nil {
+		t.Fatal("Listening didn't end at Stop")
+	}
+	if d.Context().Err() != nil {
+		t.Fatal("Context ended at Stop, before the handlers were given time")
+	}
+	d.Stop() // idempotent
+
+	waited := make(chan bool)
+	go func() { waited <- d.Wait(time.Second) }()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned with a handler running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if !<-waited {
+		t.Fatal("Wait reported unfinished handlers")
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Wait returned before the handler did")
+	}
+	if n := d.Active(); n != 0 {
+		t.Fatalf("Active() = %d after Wait", n)
+	}
+	// handlers that finished in time don't have Context cancelled
+	if d.Context().Err() != nil {
+		t.Fatal("Context ended although every handler finished")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	var d Drainer
+	abandoned := make(chan struct{})
+	d.Go(func() {
+		// a handler stuck on its connection until Context ends
+		<-d.Context().Done()
+		close(abandoned)
+	})
+	d.Go(func() {})
+
+	d.Stop()
+	start := time.Now()
+	if d.Wait(50 * time.Millisecond) {
+		t.Fatal("Wait reported every handler finished")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Wait gave up after %v, want the 50ms timeout", elapsed)
+	}
+	if d.Context().Err() == nil {
+		t.Fatal("Context wasn't cancelled when Wait gave up")
+	}
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Fatal("the abandoned handler didn't see Context end")
+	}
+}
+
+func TestWaitWithoutHandlers(t *testing.T) {
+	var d Drainer
+	if !d.Wait(time.Second) {
+		t.Fatal("Wait timed out with nothing to wait for")
+	}
+	if d.Listening().Err() != nil {
+		t.Fatal("Wait ended Listening")
+	}
+}
+
+func TestOnSignal(t *testing.T) {
+	got := make(chan os.Signal, 1)
+	OnSignal(func(sig os.Signal) { got <- sig })
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sig := <-got:
+		if sig != syscall.SIGTERM {
+			t.Fatalf("got %v", sig)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("f wasn't called")
+	}
+}
@@ -0,0 +1,160 @@
+// Package siv implements AES-SIV (RFC 5297), deterministic authenticated
+// encryption: the same key, plaintext and associated data always produce
+// the same ciphertext. That makes encrypted values comparable for
+// equality (joinable tokens), and it also tells anyone holding two
+// ciphertexts whether their plaintexts are equal. Use it only where that
+// is the point.
+//
+// The ciphertext is the 16-byte synthetic IV followed by the encrypted
+// plaintext, as in the RFC.
+package siv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// Overhead is how much longer a ciphertext is than its plaintext.
+const Overhead = aes.BlockSize
+
+// ErrOpen is returned when a ciphertext fails authentication.
+var ErrOpen = errors.New("siv: message authentication failed")
+
+// SIV is an AES-SIV key.
+type SIV struct {
+	mac *cmac
+	ctr cipher.Block
+}
+
+// New returns AES-SIV for key, which is 32, 48 or 64 bytes: a CMAC key
+// followed by a CTR key of equal size (AES-128, AES-192 or AES-256).
+func New(key []byte) (*SIV, error) {
+	switch len(key) {
+	case 32, 48, 64:
+	default:
+		return nil, fmt.Errorf("siv: invalid key size %d (want 32, 48 or 64 bytes)", len(key))
+	}
+	half := len(key) / 2
+	macBlock, err := aes.NewCipher(key[:half])
+	if err != nil {
+		return nil, err
+	}
+	ctrBlock, err := aes.NewCipher(key[half:])
+	if err != nil {
+		return nil, err
+	}
+	return &SIV{mac: newCMAC(macBlock), ctr: ctrBlock}, nil
+}
+
+// Seal encrypts plaintext, authenticating it together with each piece of
+// associated data, and returns the ciphertext.
+func (s *SIV) Seal(plaintext []byte, ad ...[]byte) []byte {
+	v := s.s2v(plaintext, ad)
+	out := make([]byte, Overhead+len(plaintext))
+	copy(out, v)
+	s.xorCTR(out[Overhead:], plaintext, v)
+	return out
+}
+
+// Open decrypts and authenticates a ciphertext from Seal with the same
+// associated data.
+func (s *SIV) Open(ciphertext []byte, ad ...[]byte) ([]byte, error) {
+	if len(ciphertext) < Overhead {
+		return nil, ErrOpen
+	}
+	v := ciphertext[:Overhead]
+	plaintext := make([]byte, len(ciphertext)-Overhead)
+	s.xorCTR(plaintext, ciphertext[Overhead:], v)
+	if subtle.ConstantTimeCompare(s.s2v(plaintext, ad), v) != 1 {
+		clear(plaintext)
+		return nil, ErrOpen
+	}
+	return plaintext, nil
+}
+
+// xorCTR runs AES-CTR from the synthetic IV with the two bits the RFC
+// reserves cleared, so implementations can use 64-bit counters.
+func (s *SIV) xorCTR(dst, src, v []byte) {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, v)
+	iv[8] &= 0x7f
+	iv[12] &= 0x7f
+	cipher.NewCTR(s.ctr, iv).XORKeyStream(dst, src)
+}
+
+// s2v is the RFC's S2V: a CMAC-based PRF over a vector of strings.
+func (s *SIV) s2v(plaintext []byte, ad [][]byte) []byte {
+	d := s.mac.sum(make([]byte, aes.BlockSize))
+	for _, a := range ad {
+		dbl(d)
+		xorInto(d, s.mac.sum(a))
+	}
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = append([]byte(nil), plaintext...)
+		xorInto(t[len(t)-aes.BlockSize:], d)
+	} else {
+		dbl(d)
+		t = make([]byte, aes.BlockSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		xorInto(t, d)
+	}
+	return s.mac.sum(t)
+}
+
+// cmac is AES-CMAC (RFC 4493).
+type cmac struct {
+	block  cipher.Block
+	k1, k2 []byte
+}
+
+func newCMAC(block cipher.Block) *cmac {
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	dbl(k1)
+	k2 := append([]byte(nil), k1...)
+	dbl(k2)
+	return &cmac{block: block, k1: k1, k2: k2}
+}
+
+func (c *cmac) sum(msg []byte) []byte {
+	x := make([]byte, aes.BlockSize)
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	if n == 0 {
+		n = 1
+	}
+	for i := 0; i < n-1; i++ {
+		xorInto(x, msg[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		c.block.Encrypt(x, x)
+	}
+	last := make([]byte, aes.BlockSize)
+	rest := msg[(n-1)*aes.BlockSize:]
+	copy(last, rest)
+	if len(rest) == aes.BlockSize {
+		xorInto(last, c.k1)
+	} else {
+		last[len(rest)] = 0x80
+		xorInto(last, c.k2)
+	}
+	xorInto(x, last)
+	c.block.Encrypt(x, x)
+	return x
+}
+
+// dbl multiplies b by x in GF(2^128), in place.
+func dbl(b []byte) {
+	carry := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] <<= 1
+	b[len(b)-1] ^= 0x87 * carry
+}
+
+func xorInto(dst, src []byte) {
+	subtle.XORBytes(dst, dst, src)
+}
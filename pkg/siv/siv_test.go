@@ -0,0 +1,78 @@
+package siv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RFC 4493, section 4.
+func TestCMAC(t *testing.T) {
+	block, _ := aes.NewCipher(unhex("2b7e1516 28aed2a6 abf71588 09cf4f3c"))
+	c := newCMAC(block)
+	tests := []struct{ msg, mac string }{
+		{"", "bb1d6929 e9593728 7fa37d12 9b756746"},
+		{"6bc1bee2 2e409f96 e93d7e11 7393172a", "070a16b4 6b4d4144 f79bdd9d d04a287c"},
+		{"6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51 30c81c46 a35ce411", "dfa66747 de9ae630 30ca3261 1497c827"},
+	}
+	for _, tt := range tests {
+		if got := c.sum(unhex(tt.msg)); !bytes.Equal(got, unhex(tt.mac)) {
+			t.Errorf("CMAC(%s) = %x, want %s", tt.msg, got, tt.mac)
+		}
+	}
+}
+
+// RFC 5297, appendix A.1.
+func TestDeterministicVector(t *testing.T) {
+	s, err := New(unhex("fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0 f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := unhex("10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627")
+	plaintext := unhex("11223344 55667788 99aabbcc ddee")
+	want := unhex("85632d07 c6e8f37f 950acd32 0a2ecc93 40c02b96 90c4dc04 daef7f6a fe5c")
+
+	got := s.Seal(plaintext, ad)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Seal = %x\nwant   %x", got, want)
+	}
+	opened, err := s.Open(got, ad)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("Open = %x, %v", opened, err)
+	}
+}
+
+func TestRoundTripAndTamper(t *testing.T) {
+	s, _ := New(bytes.Repeat([]byte{7}, 64))
+	for _, n := range []int{0, 1, 15, 16, 17, 100} {
+		plaintext := bytes.Repeat([]byte{'x'}, n)
+		ct := s.Seal(plaintext)
+		if !bytes.Equal(ct, s.Seal(plaintext)) {
+			t.Fatalf("%d bytes: Seal is not deterministic", n)
+		}
+		opened, err := s.Open(ct)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Fatalf("%d bytes: Open = %q, %v", n, opened, err)
+		}
+		ct[len(ct)-1] ^= 1
+		if _, err := s.Open(ct); err != ErrOpen {
+			t.Fatalf("%d bytes: tampered ciphertext opened: %v", n, err)
+		}
+	}
+	if _, err := s.Open(s.Seal([]byte("a"), []byte("ad")), []byte("other")); err != ErrOpen {
+		t.Fatalf("wrong associated data opened: %v", err)
+	}
+	if _, err := New(make([]byte, 16)); err == nil {
+		t.Fatal("16-byte key accepted")
+	}
+}
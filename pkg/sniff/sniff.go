@@ -0,0 +1,191 @@
+// Package sniff looks at request data without interpreting it: how much
+// entropy it has, what content type it looks like, and whether it appears
+// to be compressed or already encrypted. Logging uses it to describe
+// payloads without printing them; the enclave uses it to enforce content
+// policies. Everything here is a heuristic and can be fooled by data
+// crafted to look like something else.
+package sniff
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Kind is the broad class of a payload.
+type Kind string
+
+const (
+	Empty      Kind = "empty"
+	Text       Kind = "text"
+	Binary     Kind = "binary"
+	Compressed Kind = "compressed"
+	Encrypted  Kind = "encrypted"
+)
+
+// Result is what Classify found out about a payload.
+type Result struct {
+	Kind Kind
+	// Format names what was recognised, e.g. "gzip", "KMS ciphertext
+	// blob" or "high entropy"; empty for plain text and binary data.
+	Format string
+	// Entropy is the Shannon entropy in bits per byte (see Entropy).
+	Entropy float64
+}
+
+// Compressible reports whether compressing the data first would likely
+// save a good share of its size: text, or binary data with less than 6
+// bits of entropy per byte.
+func (r Result) Compressible() bool {
+	return r.Kind == Text || (r.Kind == Binary && r.Entropy < 6)
+}
+
+// compressedMagic are the leading bytes of the common compression formats.
+var compressedMagic = []struct {
+	format string
+	magic  []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zip", []byte("PK\x03\x04")},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"bzip2", []byte("BZh")},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"7z", []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}},
+}
+
+// encryptedPrefixes are the leading bytes of encrypted formats that are
+// recognisable as such. KMS CiphertextBlobs start with the bytes 01 02 02
+// 00 78 or 01 02 03 00 78, which are "AQICAH" and "AQIDAH" in base64.
+var encryptedPrefixes = []struct {
+	format string
+	prefix string
+}{
+	{"KMS ciphertext blob", "AQICAH"},
+	{"KMS ciphertext blob", "AQIDAH"},
+	{"KMS ciphertext blob", "\x01\x02\x02\x00\x78"},
+	{"KMS ciphertext blob", "\x01\x02\x03\x00\x78"},
+	{"PGP message", "-----BEGIN PGP MESSAGE-----"},
+	{"age file", "age-encryption.org/v1"},
+	{"age file", "-----BEGIN AGE ENCRYPTED FILE-----"},
+}
+
+const (
+	// minRandomBytes is the shortest data the entropy test judges; below
+	// it, random and structured data can't be told apart reliably.
+	minRandomBytes = 32
+	// randomFraction of the highest entropy data of its length can have
+	// marks it as random: ciphertext, or compressed data without a
+	// recognisable header.
+	randomFraction = 0.85
+)
+
+// Classify sniffs data. It recognises compressed data by its magic number
+// and encrypted data by the format's prefix (KMS CiphertextBlobs, the
+// enclave's envelopes, PGP and age), and otherwise treats binary data, or
+// base64 text that decodes to binary data, whose entropy is close to the
+// maximum for its length as encrypted.
+func Classify(data []byte) Result {
+	r := Result{Entropy: Entropy(data)}
+	if len(data) == 0 {
+		r.Kind = Empty
+		return r
+	}
+	for _, c := range compressedMagic {
+		if bytes.HasPrefix(data, c.magic) {
+			r.Kind, r.Format = Compressed, c.format
+			return r
+		}
+	}
+	trimmed := bytes.TrimSpace(data)
+	for _, e := range encryptedPrefixes {
+		if bytes.HasPrefix(trimmed, []byte(e.prefix)) {
+			r.Kind, r.Format = Encrypted, e.format
+			return r
+		}
+	}
+	if isEnvelope(trimmed) {
+		r.Kind, r.Format = Encrypted, "enclave envelope"
+		return r
+	}
+
+	if ct := ContentType(data); strings.HasPrefix(ct, "text/") || ct == "application/json" {
+		r.Kind = Text
+		if decoded, err := base64.StdEncoding.DecodeString(string(trimmed)); err == nil && looksRandom(decoded) {
+			r.Kind, r.Format = Encrypted, "base64 high entropy"
+		}
+		return r
+	}
+	r.Kind = Binary
+	if looksRandom(data) {
+		r.Kind, r.Format = Encrypted, "high entropy"
+	}
+	return r
+}
+
+// looksRandom reports whether data is long enough to judge and has nearly
+// the most entropy data of its length can have: log2(len) bits per byte,
+// up to 8.
+func looksRandom(data []byte) bool {
+	if len(data) < minRandomBytes {
+		return false
+	}
+	maxEntropy := math.Min(8, math.Log2(float64(len(data))))
+	return Entropy(data) >= randomFraction*maxEntropy
+}
+
+// isEnvelope reports whether data is an envelope produced by
+// EnvelopeEncrypt. It checks the JSON field names rather than importing
+// pkg/envelope, so it also catches envelopes of other versions.
+func isEnvelope(data []byte) bool {
+	if len(data) == 0 || data[0] != '{' {
+		return false
+	}
+	var env struct {
+		Algorithm        string `json:"algorithm"`
+		EncryptedDataKey string `json:"encrypted_data_key"`
+		Ciphertext       []byte `json:"ciphertext"`
+	}
+	return json.Unmarshal(data, &env) == nil && env.Algorithm != "" && env.EncryptedDataKey != "" && len(env.Ciphertext) > 0
+}
+
+// Entropy estimates the Shannon entropy of data in bits per byte, from 0
+// (one repeated byte) to 8 (uniformly random), rounded to two decimals.
+// Short inputs can't reach 8: n bytes carry at most log2(n) bits each.
+func Entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	h := 0.0
+	n := float64(len(data))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return math.Round(h*100) / 100
+}
+
+// ContentType sniffs data with the WHATWG algorithm behind
+// http.DetectContentType, which recognises UTF-8 and UTF-16 text by their
+// byte order marks and the common binary formats by their magic numbers.
+// JSON, which it reports as plain text, is recognised separately.
+func ContentType(data []byte) string {
+	if len(data) == 0 {
+		return "empty"
+	}
+	ct := http.DetectContentType(data)
+	if strings.HasPrefix(ct, "text/plain") {
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+			return "application/json"
+		}
+	}
+	return ct
+}
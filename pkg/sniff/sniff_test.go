@@ -0,0 +1,91 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestEntropy(t *testing.T) {
+	random := make([]byte, 1<<16)
+	rand.Read(random)
+	for _, tc := range []struct {
+		data     []byte
+		min, max float64
+	}{
+		{nil, 0, 0},
+		{bytes.Repeat([]byte{'a'}, 100), 0, 0},
+		{[]byte("abab"), 1, 1},
+		{random, 7.99, 8},
+	} {
+		if got := Entropy(tc.data); got < tc.min || got > tc.max {
+			t.Errorf("entropy of %d bytes = %v, want %v to %v", len(tc.data), got, tc.min, tc.max)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	for data, want := range map[string]string{
+		"":                        "empty",
+		"hello":                   "text/plain; charset=utf-8",
+		` {"KeyId":"alias/x"} `:   "application/json",
+		"{not json":               "text/plain; charset=utf-8",
+		"\x89PNG\r\n\x1a\n\x00":   "image/png",
+		"\x00\x01\x02\x03\xff":    "application/octet-stream",
+		"\xfe\xffU\x00T\x00F\x00": "text/plain; charset=utf-16be",
+	} {
+		if got := ContentType([]byte(data)); got != want {
+			t.Errorf("ContentType(%q) = %q, want %q", data, got, want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	random := make([]byte, 200)
+	rand.Read(random)
+	kmsBlob := append([]byte{0x01, 0x02, 0x02, 0x00, 0x78}, random[:150]...)
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		kind   Kind
+		format string
+	}{
+		{"empty", nil, Empty, ""},
+		{"text", []byte("The quick brown fox jumps over the lazy dog, again and again."), Text, ""},
+		{"short token", []byte("c2VjcmV0LXRva2Vu"), Text, ""},
+		{"json", []byte(`{"name":"Ada","card":"4111 1111 1111 1111"}`), Text, ""},
+		{"gzip", append([]byte{0x1f, 0x8b, 0x08}, random...), Compressed, "gzip"},
+		{"zstd", append([]byte{0x28, 0xb5, 0x2f, 0xfd}, random...), Compressed, "zstd"},
+		{"raw KMS blob", kmsBlob, Encrypted, "KMS ciphertext blob"},
+		{"base64 KMS blob", []byte(base64.StdEncoding.EncodeToString(kmsBlob)), Encrypted, "KMS ciphertext blob"},
+		{"envelope", []byte(`{"version":1,"algorithm":"AES-256-GCM","encrypted_data_key":"AQICAHg=","nonce":"AAAA","ciphertext":"AAECAw=="}`), Encrypted, "enclave envelope"},
+		{"pgp", []byte("-----BEGIN PGP MESSAGE-----\n\nhQEMA..."), Encrypted, "PGP message"},
+		{"random", random, Encrypted, "high entropy"},
+		{"base64 random", []byte(base64.StdEncoding.EncodeToString(random)), Encrypted, "base64 high entropy"},
+		// too short to measure entropy; fixed, since 16 random bytes are
+		// now and then valid text
+		{"short random", []byte{0x9c, 0x03, 0xf1, 0x5e, 0x00, 0xc8, 0x77, 0xa2, 0x1b, 0xfe, 0x40, 0x8d, 0xe5, 0x06, 0xb9, 0x31}, Binary, ""},
+		{"structured binary", bytes.Repeat([]byte{0, 0, 0, 1, 0, 0, 0, 2}, 64), Binary, ""},
+	} {
+		got := Classify(tc.data)
+		if got.Kind != tc.kind || got.Format != tc.format {
+			t.Errorf("%s: got %s (%q), want %s (%q)", tc.name, got.Kind, got.Format, tc.kind, tc.format)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+	if !Classify(bytes.Repeat([]byte("log line\n"), 100)).Compressible() {
+		t.Error("text is not compressible")
+	}
+	if !Classify(make([]byte, 4096)).Compressible() {
+		t.Error("zeros are not compressible")
+	}
+	if Classify(random).Compressible() {
+		t.Error("random data is compressible")
+	}
+}
@@ -0,0 +1,226 @@
+// Package transform chains payload transformations into pipelines such as
+//
+//	gzip,envelope,base64
+//
+// which compresses, encrypts and then encodes a payload, and undoes the
+// steps in reverse order on the way back. Stages are looked up by name in
+// a Registry. The built-in stages are gzip, base64 and hex; the enclave
+// registers its encryption stages, and other code can register its own to
+// model whatever processing a real enclave application does.
+package transform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxOutput bounds what a stage may produce when reversing, so a small
+// compressed payload can't expand into gigabytes inside the enclave. It
+// matches the largest frame the vsock protocol carries.
+var MaxOutput = 64 << 20
+
+// Stage is one reversible step of a pipeline. Reverse must undo Forward.
+type Stage interface {
+	Name() string
+	Forward(ctx context.Context, data []byte) ([]byte, error)
+	Reverse(ctx context.Context, data []byte) ([]byte, error)
+}
+
+// Func is a Stage made of two functions.
+type Func struct {
+	StageName string
+	Fwd, Rev  func(ctx context.Context, data []byte) ([]byte, error)
+}
+
+func (f Func) Name() string { return f.StageName }
+
+func (f Func) Forward(ctx context.Context, data []byte) ([]byte, error) { return f.Fwd(ctx, data) }
+
+func (f Func) Reverse(ctx context.Context, data []byte) ([]byte, error) { return f.Rev(ctx, data) }
+
+// Registry maps stage names to stages. It is safe for concurrent use.
+type Registry struct {
+	mu     sync.RWMutex
+	stages map[string]Stage
+}
+
+// NewRegistry returns a Registry holding the built-in stages.
+func NewRegistry() *Registry {
+	r := &Registry{stages: map[string]Stage{}}
+	for _, s := range builtins {
+		r.stages[s.Name()] = s
+	}
+	return r
+}
+
+// Register adds a stage. Names are unique and may not contain commas.
+func (r *Registry) Register(s Stage) error {
+	name := s.Name()
+	if name == "" || strings.ContainsAny(name, ", ") {
+		return fmt.Errorf("invalid stage name %q", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.stages[name]; ok {
+		return fmt.Errorf("stage %q is already registered", name)
+	}
+	r.stages[name] = s
+	return nil
+}
+
+// Names returns the registered stage names, sorted.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.stages))
+	for name := range r.stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse builds a pipeline from a comma-separated list of stage names,
+// applied left to right.
+func (r *Registry) Parse(spec string) (Pipeline, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var p Pipeline
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		s, ok := r.stages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q", name)
+		}
+		p = append(p, s)
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("empty pipeline")
+	}
+	return p, nil
+}
+
+// Pipeline is a sequence of stages.
+type Pipeline []Stage
+
+// Observer is told about every stage a pipeline runs, for logging and
+// timing. It may be nil.
+type Observer func(stage string, inBytes, outBytes int, d time.Duration)
+
+// String returns the pipeline in the form Parse accepts.
+func (p Pipeline) String() string {
+	names := make([]string, len(p))
+	for i, s := range p {
+		names[i] = s.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Forward runs every stage's Forward, first to last.
+func (p Pipeline) Forward(ctx context.Context, data []byte, observe Observer) ([]byte, error) {
+	for _, s := range p {
+		var err error
+		if data, err = run(ctx, s.Name(), s.Forward, data, observe); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Reverse runs every stage's Reverse, last to first, undoing Forward.
+func (p Pipeline) Reverse(ctx context.Context, data []byte, observe Observer) ([]byte, error) {
+	for i := len(p) - 1; i >= 0; i-- {
+		var err error
+		if data, err = run(ctx, p[i].Name(), p[i].Reverse, data, observe); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// run applies one stage. The error keeps its cause, so a protocol error
+// from an encryption stage still reaches the client with its code.
+func run(ctx context.Context, name string, f func(context.Context, []byte) ([]byte, error), data []byte, observe Observer) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := f(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("stage %s: %w", name, err)
+	}
+	if observe != nil {
+		observe(name, len(data), len(out), time.Since(start))
+	}
+	return out, nil
+}
+
+// builtins are the stages every Registry starts with.
+var builtins = []Stage{
+	Func{"gzip", gzipCompress, gzipDecompress},
+	Func{"base64", base64Encode, base64Decode},
+	Func{"hex", hexEncode, hexDecode},
+}
+
+func gzipCompress(_ context.Context, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(_ context.Context, data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not gzip data: %v", err)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, int64(MaxOutput)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %v", err)
+	}
+	if len(out) > MaxOutput {
+		return nil, fmt.Errorf("decompressed data exceeds %d bytes", MaxOutput)
+	}
+	return out, nil
+}
+
+func base64Encode(_ context.Context, data []byte) ([]byte, error) {
+	return base64.StdEncoding.AppendEncode(nil, data), nil
+}
+
+func base64Decode(_ context.Context, data []byte) ([]byte, error) {
+	out, err := base64.StdEncoding.AppendDecode(nil, bytes.TrimSpace(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %v", err)
+	}
+	return out, nil
+}
+
+func hexEncode(_ context.Context, data []byte) ([]byte, error) {
+	return hex.AppendEncode(nil, data), nil
+}
+
+func hexDecode(_ context.Context, data []byte) ([]byte, error) {
+	out, err := hex.AppendDecode(nil, bytes.TrimSpace(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %v", err)
+	}
+	return out, nil
+}
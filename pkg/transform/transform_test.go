@@ -0,0 +1,109 @@
+package transform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// xor is a toy stand-in for an encryption stage.
+var xor = Func{"xor", flip, flip}
+
+func flip(_ context.Context, data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ 0x5a
+	}
+	return out, nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(xor); err != nil {
+		t.Fatal(err)
+	}
+	p, err := r.Parse("gzip, xor ,base64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != "gzip,xor,base64" {
+		t.Fatalf("String() = %q", p.String())
+	}
+
+	var forward []string
+	input := []byte(strings.Repeat("compressible ", 100))
+	out, err := p.Forward(context.Background(), input, func(stage string, in, out int, d time.Duration) {
+		forward = append(forward, stage)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(forward, ",") != "gzip,xor,base64" {
+		t.Fatalf("stages ran in order %v", forward)
+	}
+	if len(out) >= len(input) {
+		t.Fatalf("output of %d bytes is not compressed", len(out))
+	}
+
+	var reverse []string
+	back, err := p.Reverse(context.Background(), out, func(stage string, in, out int, d time.Duration) {
+		reverse = append(reverse, stage)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back, input) {
+		t.Fatal("round trip changed the data")
+	}
+	if strings.Join(reverse, ",") != "base64,xor,gzip" {
+		t.Fatalf("reverse ran in order %v", reverse)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(Func{StageName: "gzip"}); err == nil {
+		t.Error("registered a duplicate name")
+	}
+	if err := r.Register(Func{StageName: "a,b"}); err == nil {
+		t.Error("registered a name with a comma")
+	}
+	if _, err := r.Parse("gzip,rot13"); err == nil || !strings.Contains(err.Error(), "rot13") {
+		t.Errorf("unknown stage: got %v", err)
+	}
+	if _, err := r.Parse(" , "); err == nil {
+		t.Error("parsed an empty pipeline")
+	}
+	if got := strings.Join(r.Names(), ","); got != "base64,gzip,hex" {
+		t.Errorf("Names() = %s", got)
+	}
+}
+
+func TestStageErrorKeepsCause(t *testing.T) {
+	cause := errors.New("KMS said no")
+	r := NewRegistry()
+	r.Register(Func{"fail", func(context.Context, []byte) ([]byte, error) { return nil, cause }, flip})
+	p, _ := r.Parse("gzip,fail")
+	_, err := p.Forward(context.Background(), []byte("x"), nil)
+	if !errors.Is(err, cause) || !strings.Contains(err.Error(), "stage fail") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	defer func(n int) { MaxOutput = n }(MaxOutput)
+	MaxOutput = 1000
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(make([]byte, 1001))
+	w.Close()
+	p, _ := NewRegistry().Parse("gzip")
+	if _, err := p.Reverse(context.Background(), buf.Bytes(), nil); err == nil {
+		t.Fatal("decompressed past MaxOutput")
+	}
+}
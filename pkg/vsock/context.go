@@ -0,0 +1,32 @@
+package vsock
+
+import (
+	"context"
+	"net"
+)
+
+// Accept waits for the next connection on l until ctx ends. Ending ctx
+// closes l, which is what unblocks a pending accept, so it is meant for a
+// server's listening context: once it is done the listener is gone and
+// Accept returns ctx's error, which accept loops can tell from a failure.
+func Accept(ctx context.Context, l net.Listener) (net.Conn, error) {
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	conn, err := l.Accept()
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return conn, err
+}
+
+// WithConn returns a context for serving conn, derived from parent, that
+// closes conn when it ends: when parent does, or when cancel is called.
+// Reads and writes blocked on conn then fail, so cancelling a server's
+// root context ends every connection served under it, and a handler that
+// defers cancel needs no conn.Close of its own. Request contexts derive
+// from the returned one.
+func WithConn(parent context.Context, conn net.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	context.AfterFunc(ctx, func() { conn.Close() })
+	return ctx, cancel
+}
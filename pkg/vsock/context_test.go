@@ -0,0 +1,90 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptContext(t *testing.T) {
+	var m Memory
+	l, err := m.Listen(AnyCID, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := Accept(ctx, l)
+		accepted <- err
+	}()
+	cancel()
+	if err := <-accepted; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Accept after cancel: err = %v, want context.Canceled", err)
+	}
+	// Ending the context closed the listener
+	if m.Listening(AnyCID, 5000) {
+		t.Fatal("listener still open")
+	}
+}
+
+func TestWithConn(t *testing.T) {
+	var m Memory
+	l, err := m.Listen(AnyCID, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Read(make([]byte, 1))
+	}()
+
+	parent, cancelParent := context.WithCancel(context.Background())
+	c, err := m.DialContext(parent, HostCID, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := WithConn(parent, c)
+	defer cancel()
+
+	// A blocked read ends when the parent context does
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+	cancelParent()
+	select {
+	case err := <-read:
+		if !errors.Is(err, net.ErrClosed) && ctx.Err() == nil {
+			t.Fatalf("Read after cancel: err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read still blocked after cancel")
+	}
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var m Memory
+	l, _ := m.Listen(AnyCID, 5000)
+	defer l.Close()
+	if _, err := m.DialContext(ctx, HostCID, 5000); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Memory dial: err = %v, want context.Canceled", err)
+	}
+	// The system dial checks ctx before making a socket, so this works
+	// without the vsock module
+	if _, err := DialContext(ctx, HostCID, 5000); !errors.Is(err, context.Canceled) {
+		t.Fatalf("vsock dial: err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,180 @@
+package vsock
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Transport dials and listens on vsock addresses. System uses the kernel's
+// AF_VSOCK; Memory connects Dial and Listen calls within one process, so
+// the enclave, vsock-proxy and connector handlers can be tested without a
+// VM or the vsock kernel modules. DialContext gives up when ctx ends, like
+// net.Dialer.DialContext; to cancel a connection's reads and writes too,
+// bind it to a context with WithConn.
+type Transport interface {
+	DialContext(ctx context.Context, cid, port uint32) (net.Conn, error)
+	Listen(cid, port uint32) (net.Listener, error)
+}
+
+// System is the Transport backed by real AF_VSOCK sockets.
+type System struct{}
+
+func (System) DialContext(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	return DialContext(ctx, cid, port)
+}
+
+func (System) Listen(cid, port uint32) (net.Listener, error) {
+	return Listen(cid, port)
+}
+
+// TCP is a Transport that carries vsock connections over TCP to Host
+// (127.0.0.1 if empty), so the enclave, vsock-proxy and connector can run
+// as ordinary processes on one machine, without a VM. The CID is ignored
+// and cid:port maps to Host:port, so each listener needs its own port.
+type TCP struct {
+	Host string
+}
+
+func (t TCP) DialContext(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", t.addr(port))
+}
+
+func (t TCP) Listen(cid, port uint32) (net.Listener, error) {
+	return net.Listen("tcp", t.addr(port))
+}
+
+func (t TCP) addr(port uint32) string {
+	host := t.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+}
+
+// ParseTransport returns the Transport a --vsock-transport flag names:
+// "vsock" for real AF_VSOCK sockets, or "tcp" or "tcp:HOST" for TCP.
+func ParseTransport(name string) (Transport, error) {
+	switch {
+	case name == "vsock":
+		return System{}, nil
+	case name == "tcp":
+		return TCP{}, nil
+	case strings.HasPrefix(name, "tcp:"):
+		return TCP{Host: strings.TrimPrefix(name, "tcp:")}, nil
+	}
+	return nil, fmt.Errorf("unknown vsock transport %q (expected vsock, tcp or tcp:HOST)", name)
+}
+
+// Memory is an in-process Transport built on net.Pipe. A Dial to cid:port
+// reaches the Memory listener on that address, or on AnyCID:port, and
+// fails with ECONNREFUSED when there is none, like a real socket.
+// Connections support deadlines but are unbuffered: a Write blocks until
+// the peer reads it. The zero value is ready to use; share one Memory
+// between the two sides of a test.
+type Memory struct {
+	mu        sync.Mutex
+	listeners map[Addr]*memListener
+	// nextPort numbers the local ends of dialed connections, like
+	// ephemeral ports.
+	nextPort uint32
+}
+
+// LocalCID is the CID dialers appear to come from on a Memory transport.
+const LocalCID = 3
+
+func (m *Memory) Listen(cid, port uint32) (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addr := Addr{CID: cid, Port: port}
+	if _, ok := m.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "vsock", Addr: &addr, Err: syscall.EADDRINUSE}
+	}
+	if m.listeners == nil {
+		m.listeners = map[Addr]*memListener{}
+	}
+	l := &memListener{m: m, addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+	m.listeners[addr] = l
+	return l, nil
+}
+
+func (m *Memory) DialContext(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	remote := &Addr{CID: cid, Port: port}
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: remote, Err: err}
+	}
+	m.mu.Lock()
+	l, ok := m.listeners[*remote]
+	if !ok {
+		l, ok = m.listeners[Addr{CID: AnyCID, Port: port}]
+	}
+	m.nextPort++
+	local := &Addr{CID: LocalCID, Port: 1<<30 + m.nextPort}
+	m.mu.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: remote, Err: syscall.ECONNREFUSED}
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &memConn{Conn: server, local: remote, remote: local}:
+		return &memConn{Conn: client, local: local, remote: remote}, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: remote, Err: syscall.ECONNREFUSED}
+	case <-ctx.Done():
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: remote, Err: ctx.Err()}
+	}
+}
+
+// Listening reports whether a listener is open on cid:port, so a program
+// running servers in goroutines can wait for them without dialing.
+func (m *Memory) Listening(cid, port uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.listeners[Addr{CID: cid, Port: port}]
+	return ok
+}
+
+type memListener struct {
+	m     *Memory
+	addr  Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: &l.addr, Err: net.ErrClosed}
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.m.mu.Lock()
+		delete(l.m.listeners, l.addr)
+		l.m.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return &l.addr }
+
+// memConn gives a net.Pipe end vsock addresses, so code that logs the
+// peer CID works unchanged.
+type memConn struct {
+	net.Conn
+	local, remote *Addr
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
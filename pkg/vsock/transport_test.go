@@ -0,0 +1,155 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMemoryDialListen(t *testing.T) {
+	var m Memory
+	l, err := m.Listen(AnyCID, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := m.Listen(AnyCID, 5000); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("second Listen: err = %v, want EADDRINUSE", err)
+	}
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	c, err := m.DialContext(context.Background(), HostCID, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if addr, ok := c.RemoteAddr().(*Addr); !ok || addr.CID != HostCID || addr.Port != 5000 {
+		t.Fatalf("RemoteAddr = %v", c.RemoteAddr())
+	}
+	if addr, ok := c.LocalAddr().(*Addr); !ok || addr.CID != LocalCID {
+		t.Fatalf("LocalAddr = %v", c.LocalAddr())
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+
+	// Deadlines work as on a real socket
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	var nerr net.Error
+	if _, err := c.Read(buf); !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("Read past deadline: err = %v, want a timeout", err)
+	}
+}
+
+func TestMemoryRefused(t *testing.T) {
+	var m Memory
+	if _, err := m.DialContext(context.Background(), HostCID, 5000); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Dial without listener: err = %v, want ECONNREFUSED", err)
+	}
+
+	l, _ := m.Listen(HostCID, 5000)
+	if !m.Listening(HostCID, 5000) || m.Listening(HostCID, 5001) {
+		t.Fatal("Listening doesn't match the open listeners")
+	}
+	// Nobody accepts: the dial gives up at the context's deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.DialContext(ctx, HostCID, 5000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dial without Accept: err = %v, want context.DeadlineExceeded", err)
+	}
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	l.Close()
+	if err := <-accepted; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after Close: err = %v, want net.ErrClosed", err)
+	}
+	if _, err := m.DialContext(context.Background(), HostCID, 5000); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Dial after Close: err = %v, want ECONNREFUSED", err)
+	}
+	if m.Listening(HostCID, 5000) {
+		t.Fatal("Listening after Close")
+	}
+	// The address is free again
+	if l, err := m.Listen(HostCID, 5000); err != nil {
+		t.Fatal(err)
+	} else {
+		l.Close()
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	tests := []struct {
+		name string
+		want Transport
+	}{
+		{"vsock", System{}},
+		{"tcp", TCP{}},
+		{"tcp:10.0.0.5", TCP{Host: "10.0.0.5"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseTransport(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseTransport(%q) = %#v, %v", tt.name, got, err)
+		}
+	}
+	if _, err := ParseTransport("udp"); err == nil {
+		t.Error("ParseTransport accepted udp")
+	}
+}
+
+func TestTCP(t *testing.T) {
+	// Find a free port, then listen on it through the transport
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint32(probe.Addr().(*net.TCPAddr).Port)
+	probe.Close()
+
+	var tr TCP
+	l, err := tr.Listen(LocalCID, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	// Any CID reaches the listener: only the port counts
+	c, err := tr.DialContext(context.Background(), HostCID, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
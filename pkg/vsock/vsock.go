@@ -0,0 +1,306 @@
+// Package vsock provides net.Conn and net.Listener implementations for
+// AF_VSOCK stream sockets.
+//
+// Sockets are created non-blocking and handed to the Go runtime poller via
+// os.File, so connections support deadlines, can be used with io.Copy and
+// friends, and closing a Listener unblocks a pending Accept.
+package vsock
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// HostCID is the CID of the parent instance (the host side of vsock).
+	HostCID = unix.VMADDR_CID_HOST
+	// AnyCID binds a listener to every local CID.
+	AnyCID = unix.VMADDR_CID_ANY
+
+	listenBacklog = 128
+)
+
+// Addr is a vsock address.
+type Addr struct {
+	CID  uint32
+	Port uint32
+}
+
+func (a *Addr) Network() string { return "vsock" }
+func (a *Addr) String() string  { return fmt.Sprintf("%d:%d", a.CID, a.Port) }
+
+func addrFromSockaddr(sa unix.Sockaddr) *Addr {
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		return &Addr{CID: vm.CID, Port: vm.Port}
+	}
+	return &Addr{}
+}
+
+func newSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	return fd, nil
+}
+
+// Dial connects to the vsock address cid:port.
+func Dial(cid, port uint32) (net.Conn, error) {
+	return DialContext(context.Background(), cid, port)
+}
+
+// DialTimeout is like Dial but gives up after timeout. A zero timeout
+// means no limit beyond the kernel's own connect timeout.
+func DialTimeout(cid, port uint32, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return DialContext(ctx, cid, port)
+}
+
+// DialContext connects to cid:port, giving up at ctx's deadline. Cancelling
+// ctx while the connect is in progress closes the socket, which wakes the
+// wait for it. Once connected, ctx no longer affects the connection; use
+// WithConn to tie a connection to a context.
+func DialContext(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	remote := &Addr{CID: cid, Port: port}
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "vsock", Addr: remote, Err: err}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, opErr(err)
+	}
+
+	fd, err := newSocket()
+	if err != nil {
+		return nil, opErr(err)
+	}
+
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port})
+	if err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return nil, opErr(os.NewSyscallError("connect", err))
+	}
+
+	file := os.NewFile(uintptr(fd), "vsock:"+remote.String())
+	if err == unix.EINPROGRESS {
+		// Non-blocking connect: wait until the socket is writable, then
+		// collect the real result from SO_ERROR.
+		if deadline, ok := ctx.Deadline(); ok {
+			file.SetWriteDeadline(deadline)
+		}
+		stop := context.AfterFunc(ctx, func() { file.Close() })
+		err := waitConnected(file)
+		if !stop() {
+			// ctx ended first and closed the socket, whatever err says
+			return nil, opErr(ctx.Err())
+		}
+		if err != nil {
+			file.Close()
+			return nil, opErr(err)
+		}
+		file.SetWriteDeadline(time.Time{})
+	}
+
+	return newConn(file, remote)
+}
+
+func waitConnected(file *os.File) error {
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var connectErr error
+	err = rc.Write(func(fd uintptr) bool {
+		soErr, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			connectErr = os.NewSyscallError("getsockopt", err)
+			return true
+		}
+		switch syscall.Errno(soErr) {
+		case unix.EINPROGRESS, unix.EALREADY, unix.EINTR:
+			return false
+		case 0:
+			return true
+		default:
+			connectErr = os.NewSyscallError("connect", syscall.Errno(soErr))
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return connectErr
+}
+
+// Conn is a vsock stream connection.
+type Conn struct {
+	file   *os.File
+	local  *Addr
+	remote *Addr
+}
+
+func newConn(file *os.File, remote *Addr) (*Conn, error) {
+	c := &Conn{file: file, local: &Addr{}, remote: remote}
+	rc, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	rc.Control(func(fd uintptr) {
+		if sa, err := unix.Getsockname(int(fd)); err == nil {
+			c.local = addrFromSockaddr(sa)
+		}
+	})
+	return c, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error)         { return c.file.Read(b) }
+func (c *Conn) Write(b []byte) (int, error)        { return c.file.Write(b) }
+func (c *Conn) Close() error                       { return c.file.Close() }
+func (c *Conn) LocalAddr() net.Addr                { return c.local }
+func (c *Conn) RemoteAddr() net.Addr               { return c.remote }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.file.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.file.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.file.SetWriteDeadline(t) }
+
+// WriteBuffers writes the contents of bufs with writev(2), so several
+// buffers (e.g. a frame header and its payload) leave in one syscall. It
+// honours the write deadline and handles short writes, reslicing bufs as
+// it goes.
+func (c *Conn) WriteBuffers(bufs [][]byte) (int64, error) {
+	rc, err := c.file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for len(bufs) > 0 {
+		var (
+			n        int
+			writeErr error
+		)
+		err = rc.Write(func(fd uintptr) bool {
+			for {
+				n, writeErr = unix.Writev(int(fd), bufs)
+				if writeErr != unix.EINTR {
+					break
+				}
+			}
+			return writeErr != unix.EAGAIN
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return total, &net.OpError{Op: "writev", Net: "vsock", Source: c.local, Addr: c.remote, Err: err}
+		}
+		total += int64(n)
+
+		// Drop what was written and retry the rest
+		for len(bufs) > 0 && n >= len(bufs[0]) {
+			n -= len(bufs[0])
+			bufs = bufs[1:]
+		}
+		if len(bufs) > 0 {
+			bufs[0] = bufs[0][n:]
+		}
+	}
+	return total, nil
+}
+
+// CloseWrite shuts down the sending side of the connection, so the peer
+// reads EOF while this side can still read, like (*net.TCPConn).CloseWrite.
+func (c *Conn) CloseWrite() error {
+	rc, err := c.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var shutdownErr error
+	if err := rc.Control(func(fd uintptr) {
+		shutdownErr = unix.Shutdown(int(fd), unix.SHUT_WR)
+	}); err != nil {
+		return err
+	}
+	if shutdownErr != nil {
+		return &net.OpError{Op: "shutdown", Net: "vsock", Source: c.local, Addr: c.remote, Err: shutdownErr}
+	}
+	return nil
+}
+
+// SyscallConn gives access to the underlying socket for socket options.
+func (c *Conn) SyscallConn() (syscall.RawConn, error) { return c.file.SyscallConn() }
+
+// Listener accepts vsock stream connections.
+type Listener struct {
+	file *os.File
+	addr *Addr
+}
+
+// Listen binds to cid:port and starts listening for connections.
+func Listen(cid, port uint32) (net.Listener, error) {
+	local := &Addr{CID: cid, Port: port}
+	opErr := func(err error) error {
+		return &net.OpError{Op: "listen", Net: "vsock", Addr: local, Err: err}
+	}
+
+	fd, err := newSocket()
+	if err != nil {
+		return nil, opErr(err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, opErr(os.NewSyscallError("bind", err))
+	}
+	if err := unix.Listen(fd, listenBacklog); err != nil {
+		unix.Close(fd)
+		return nil, opErr(os.NewSyscallError("listen", err))
+	}
+
+	return &Listener{
+		file: os.NewFile(uintptr(fd), "vsock-listener:"+local.String()),
+		addr: local,
+	}, nil
+}
+
+// Accept waits for and returns the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	rc, err := l.file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		nfd       int
+		sa        unix.Sockaddr
+		acceptErr error
+	)
+	err = rc.Read(func(fd uintptr) bool {
+		nfd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return acceptErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = acceptErr
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: l.addr, Err: err}
+	}
+
+	remote := addrFromSockaddr(sa)
+	return newConn(os.NewFile(uintptr(nfd), "vsock:"+remote.String()), remote)
+}
+
+// Close stops listening. A blocked Accept returns with an error.
+func (l *Listener) Close() error { return l.file.Close() }
+
+// Addr returns the listener's bound address.
+func (l *Listener) Addr() net.Addr { return l.addr }
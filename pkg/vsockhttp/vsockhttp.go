@@ -0,0 +1,160 @@
+// Package vsockhttp is an HTTPS client for code running inside the
+// enclave. The enclave has no network of its own: it reaches services such
+// as Secrets Manager or STS through vsock-proxy --forward ports, which copy
+// raw bytes to the service. This client dials those ports and runs TLS
+// itself, end to end with the service, so the host only ever sees
+// ciphertext. Certificates are verified against a root CA pool bundled in
+// the enclave binary rather than the host's, since the host is not
+// trusted.
+//
+//	client, err := vsockhttp.NewClient(vsockhttp.Config{
+//		Routes: []vsockhttp.Route{{Addr: "secretsmanager.us-east-1.amazonaws.com:443", CID: 3, Port: 8001}},
+//	})
+//	resp, err := client.Post("https://secretsmanager.us-east-1.amazonaws.com/", ...)
+package vsockhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"nitro-dev-qemu/pkg/vsock"
+)
+
+//go:embed roots.pem
+var rootsPEM []byte
+
+// RootCAs returns the bundled root CA pool: the Amazon Trust Services
+// roots that AWS service endpoints chain to.
+func RootCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootsPEM) {
+		panic("vsockhttp: no certificates in the bundled roots.pem")
+	}
+	return pool
+}
+
+// Route sends connections for Addr (host:port, as in the request URL)
+// to a vsock address, normally a vsock-proxy --forward port for that
+// endpoint.
+type Route struct {
+	Addr string
+	CID  uint32
+	Port uint32
+}
+
+// ParseRoutes parses a comma-separated list of routes such as
+//
+//	secretsmanager.us-east-1.amazonaws.com:443=3:8001,sts.amazonaws.com:443=3:8002
+//
+// mapping each host:port to a vsock CID:port. It suits a command-line flag.
+func ParseRoutes(s string) ([]Route, error) {
+	var routes []Route
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		addr, target, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("route %q is not HOST:PORT=CID:PORT", item)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("route %q: %v", item, err)
+		}
+		cid, port, ok := strings.Cut(target, ":")
+		c, cerr := strconv.ParseUint(cid, 10, 32)
+		p, perr := strconv.ParseUint(port, 10, 32)
+		if !ok || cerr != nil || perr != nil {
+			return nil, fmt.Errorf("route %q: invalid vsock address %q", item, target)
+		}
+		routes = append(routes, Route{Addr: addr, CID: uint32(c), Port: uint32(p)})
+	}
+	return routes, nil
+}
+
+// Config configures NewClient.
+type Config struct {
+	// Routes say which vsock address to dial for each host:port. Requests
+	// to anything else fail: there is no other way out of the enclave.
+	Routes []Route
+	// RootCAs verifies server certificates. Nil means RootCAs().
+	RootCAs *x509.CertPool
+	// Timeout bounds each request, including reading the body. Zero
+	// means no limit.
+	Timeout time.Duration
+	// Dial connects to a vsock address. Nil means vsock.DialContext; tests
+	// substitute their own.
+	Dial func(ctx context.Context, cid, port uint32) (net.Conn, error)
+}
+
+// NewClient returns an http.Client that sends https requests over
+// cfg.Routes; plain http requests are refused.
+// Connections are kept alive and reused like any http.Client's, and HTTP/2
+// is negotiated where the service supports it.
+func NewClient(cfg Config) (*http.Client, error) {
+	routes := make(map[string]Route, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		host, port, err := net.SplitHostPort(r.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %v", r.Addr, err)
+		}
+		routes[net.JoinHostPort(strings.ToLower(host), port)] = r
+	}
+	roots := cfg.RootCAs
+	if roots == nil {
+		roots = RootCAs()
+	}
+	dial := cfg.Dial
+	if dial == nil {
+		dial = vsock.DialContext
+	}
+
+	transport := &http.Transport{
+		// Never use HTTP_PROXY and friends: the only way out is a route
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			r, ok := routes[net.JoinHostPort(strings.ToLower(host), port)]
+			if !ok {
+				return nil, fmt.Errorf("no vsock route for %s", addr)
+			}
+			return dial(ctx, r.CID, r.Port)
+		},
+		TLSClientConfig: &tls.Config{
+			RootCAs:    roots,
+			MinVersion: tls.VersionTLS12,
+		},
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{Transport: httpsOnly{transport}, Timeout: cfg.Timeout}, nil
+}
+
+// httpsOnly refuses plain HTTP requests, which would show the host
+// everything the enclave sends.
+type httpsOnly struct {
+	next http.RoundTripper
+}
+
+func (t httpsOnly) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("refusing %s request to %s: only https keeps the host from seeing the traffic", req.URL.Scheme, req.URL.Host)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,104 @@
+package vsockhttp
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newClient starts a TLS server and returns a client whose routes dial it
+// over TCP in place of vsock, and the vsock ports it dialed. The server's
+// test certificate is valid for example.com. With trustServer the client
+// trusts it; otherwise it uses the bundled roots.
+func newClient(t *testing.T, trustServer bool) (*http.Client, *[]uint32) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.Host)
+	}))
+	t.Cleanup(srv.Close)
+
+	dialed := new([]uint32)
+	cfg := Config{
+		Routes: []Route{{Addr: "EXAMPLE.com:443", CID: 3, Port: 8001}},
+		Dial: func(ctx context.Context, cid, port uint32) (net.Conn, error) {
+			*dialed = append(*dialed, port)
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", srv.Listener.Addr().String())
+		},
+	}
+	if trustServer {
+		cfg.RootCAs = x509.NewCertPool()
+		cfg.RootCAs.AddCert(srv.Certificate())
+	}
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, dialed
+}
+
+func TestRoutedRequest(t *testing.T) {
+	client, dialed := newClient(t, true)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("https://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello from example.com" {
+			t.Fatalf("body = %q", body)
+		}
+	}
+	// The second request reuses the kept-alive connection
+	if len(*dialed) != 1 || (*dialed)[0] != 8001 {
+		t.Fatalf("dialed vsock ports %v, want [8001]", *dialed)
+	}
+}
+
+func TestUntrustedCertificate(t *testing.T) {
+	client, _ := newClient(t, false)
+	_, err := client.Get("https://example.com/")
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("err = %v, want a certificate error", err)
+	}
+}
+
+func TestRefusals(t *testing.T) {
+	client, dialed := newClient(t, true)
+	if _, err := client.Get("http://example.com/"); err == nil || !strings.Contains(err.Error(), "refusing http") {
+		t.Errorf("plain http: err = %v", err)
+	}
+	if _, err := client.Get("https://example.org/"); err == nil || !strings.Contains(err.Error(), "no vsock route") {
+		t.Errorf("unrouted host: err = %v", err)
+	}
+	if len(*dialed) != 0 {
+		t.Errorf("dialed %v", *dialed)
+	}
+}
+
+func TestRootCAs(t *testing.T) {
+	if n := len(RootCAs().Subjects()); n != 5 {
+		t.Fatalf("%d bundled roots, want 5", n)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes("secretsmanager.us-east-1.amazonaws.com:443=3:8001, sts.amazonaws.com:443=3:8002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[1] != (Route{Addr: "sts.amazonaws.com:443", CID: 3, Port: 8002}) {
+		t.Fatalf("routes = %+v", routes)
+	}
+	for _, bad := range []string{"sts.amazonaws.com=3:8002", "sts.amazonaws.com:443", "sts.amazonaws.com:443=3", "sts.amazonaws.com:443=x:1"} {
+		if _, err := ParseRoutes(bad); err == nil {
+			t.Errorf("ParseRoutes(%q) succeeded", bad)
+		}
+	}
+}
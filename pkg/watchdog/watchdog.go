@@ -0,0 +1,97 @@
+// Package watchdog bounds how long a request handler can hold a
+// connection. Handlers are expected to honour their context, but one that
+// doesn't (a blocked syscall, a missed select) would otherwise keep its
+// client waiting forever. Run stops waiting for such a handler shortly
+// after its deadline, so the caller can answer with a timeout and free the
+// connection; the handler's goroutine is abandoned and finishes, or not,
+// on its own.
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// ErrAbandoned is returned by Run when the handler was still running a
+// grace period after its context was done.
+var ErrAbandoned = errors.New("handler did not stop at its deadline and was abandoned")
+
+// PanicError is returned by Run when the handler panicked. The panic is
+// recovered in the handler's goroutine, where the caller's own recover
+// can't reach it.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return "handler panicked"
+}
+
+// stuck counts abandoned handlers that haven't returned yet.
+var stuck atomic.Int64
+
+// Stuck returns the number of abandoned handlers still running.
+func Stuck() int64 {
+	return stuck.Load()
+}
+
+// Run calls fn in a new goroutine and returns its result. If ctx is done
+// and fn hasn't returned within grace, Run returns ErrAbandoned instead.
+func Run[T any](ctx context.Context, grace time.Duration, fn func() (T, error)) (T, error) {
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	// state moves from running to either finished or abandoned, once, so
+	// exactly one side decides whether the handler counts as stuck
+	const (
+		running = iota
+		finished
+		abandoned
+	)
+	var state atomic.Int32
+	go func() {
+		var r result
+		defer func() {
+			if p := recover(); p != nil {
+				r.err = &PanicError{Value: p, Stack: debug.Stack()}
+			}
+			if !state.CompareAndSwap(running, finished) {
+				stuck.Add(-1)
+			}
+			done <- r
+		}()
+		r.v, r.err = fn()
+	}()
+
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-timer.C:
+	}
+
+	// Count it as stuck before handing over, so the handler's own
+	// decrement can't come first
+	stuck.Add(1)
+	if !state.CompareAndSwap(running, abandoned) {
+		// It finished just now after all
+		stuck.Add(-1)
+		r := <-done
+		return r.v, r.err
+	}
+	var zero T
+	return zero, fmt.Errorf("%w after %v", ErrAbandoned, grace)
+}
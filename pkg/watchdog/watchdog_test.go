@@ -0,0 +1,63 @@
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunReturnsResult(t *testing.T) {
+	v, err := Run(context.Background(), time.Second, func() (int, error) { return 42, nil })
+	if v != 42 || err != nil {
+		t.Fatalf("got %d, %v", v, err)
+	}
+}
+
+func TestRunAbandonsStuckHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	release := make(chan struct{})
+	start := time.Now()
+	_, err := Run(ctx, 20*time.Millisecond, func() (int, error) {
+		<-release // ignores ctx
+		return 1, nil
+	})
+	if !errors.Is(err, ErrAbandoned) {
+		t.Fatalf("got %v, want ErrAbandoned", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Run took %v", d)
+	}
+	if n := Stuck(); n != 1 {
+		t.Fatalf("Stuck() = %d, want 1", n)
+	}
+
+	close(release)
+	for deadline := time.Now().Add(time.Second); Stuck() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Stuck() = %d after the handler returned", Stuck())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunWaitsOutGracePeriod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	v, err := Run(ctx, time.Second, func() (string, error) {
+		time.Sleep(10 * time.Millisecond)
+		return "late but in time", nil
+	})
+	if err != nil || v != "late but in time" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+}
+
+func TestRunRecoversPanic(t *testing.T) {
+	_, err := Run(context.Background(), time.Second, func() (int, error) { panic("boom") })
+	var perr *PanicError
+	if !errors.As(err, &perr) || perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Fatalf("got %v, want a PanicError with the value and stack", err)
+	}
+}